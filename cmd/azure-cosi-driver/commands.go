@@ -0,0 +1,112 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"project/azure-cosi-driver/pkg/audit"
+	"project/azure-cosi-driver/pkg/azureutils"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+)
+
+const (
+	// rotateStorageAccountKeyCommand switches a storage account to signing with its other key and regenerates the key grants were signed with
+	// once they were all granted again, running it again resumes a rotation waiting for grants
+	rotateStorageAccountKeyCommand = "rotate-storage-account-key"
+	// revokeStorageAccountSASCommand regenerates both keys of a storage account, revoking every SAS signed with them
+	revokeStorageAccountSASCommand = "revoke-storage-account-sas"
+
+	// commandActor is the actor commands are audited as
+	commandActor = "command-line"
+	// commandEventComponent is the source of the events commands record
+	commandEventComponent = "azure-cosi-driver-command"
+)
+
+// runCommand runs the command given as arguments instead of the driver, and returns the exit code of the process
+func runCommand(args []string, auditLog *audit.Logger) int {
+	if len(args) != 2 || (args[0] != rotateStorageAccountKeyCommand && args[0] != revokeStorageAccountSASCommand) {
+		klog.Errorf("Usage: azure-cosi-driver [flags] %s|%s <storage account name or resource ID>", rotateStorageAccountKeyCommand, revokeStorageAccountSASCommand)
+		return 2
+	}
+
+	kubeClient, err := azureutils.GetKubeClient(*kubeconfig)
+	if err != nil {
+		klog.Errorf("Error creating kube client: %v", err)
+		return 1
+	}
+	cloud, err := azureutils.GetAzureCloudProvider(kubeClient, *cloudConfigSecretName, *cloudConfigSecretNamespace)
+	if err != nil {
+		klog.Errorf("Error getting Azure cloud provider: %v", err)
+		return 1
+	}
+	account, err := azureutils.ParseStorageAccount(args[1], cloud)
+	if err != nil {
+		klog.Errorf("Invalid storage account: %v", err)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	defer broadcaster.Shutdown()
+	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: commandEventComponent})
+
+	record := audit.Record{Actor: commandActor, StorageAccount: account.Name, Outcome: audit.OutcomeSuccess}
+	switch args[0] {
+	case rotateStorageAccountKeyCommand:
+		record.Action = audit.ActionRotateStorageAccountKey
+		var rotation *azureutils.KeyRotation
+		rotation, err = azureutils.RotateStorageAccountKey(ctx, cloud, kubeClient, recorder, account, *keyRotationGracePeriod, *accountKeyCacheTTL)
+		if err == nil {
+			klog.Infof("Storage account %s now signs with %s and regenerated %s", account.Name, rotation.SigningKey, rotation.PreviousKey)
+		} else if rotation != nil && rotation.PendingGrants > 0 {
+			klog.Infof("Storage account %s now signs with %s, %s is regenerated once %d grants were granted again and %s is run again",
+				account.Name, rotation.SigningKey, rotation.PreviousKey, rotation.PendingGrants, rotateStorageAccountKeyCommand)
+		}
+	case revokeStorageAccountSASCommand:
+		record.Action = audit.ActionRevokeStorageAccountSAS
+		err = azureutils.RevokeAccountKeySAS(ctx, cloud, account)
+		if err == nil {
+			klog.Infof("Regenerated both keys of storage account %s, every SAS signed with them is revoked", account.Name)
+		}
+	}
+	if err == nil && *journalConfigMapName != "" {
+		// Running drivers drop the keys they cached once the regeneration is recorded in the journal ConfigMap they watch
+		if err = azureutils.RecordKeyRegeneration(ctx, kubeClient, *journalConfigMapNamespace, *journalConfigMapName, account.Name); err != nil {
+			klog.Warningf("Could not record the regeneration of the keys of storage account %s, drivers keep their cached keys until they expire: %v", account.Name, err)
+			err = nil
+		}
+	}
+	if err != nil {
+		record.Outcome = audit.OutcomeFailure
+		record.Error = err.Error()
+	}
+	auditLog.Log(record)
+	if err != nil {
+		klog.Errorf("Error running %s: %v", args[0], err)
+		return 1
+	}
+	return 0
+}
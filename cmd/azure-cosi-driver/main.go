@@ -14,19 +14,56 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"os"
+	"project/azure-cosi-driver/pkg/audit"
+	"project/azure-cosi-driver/pkg/azureutils"
 	"project/azure-cosi-driver/pkg/driver"
+	"project/azure-cosi-driver/pkg/health"
+	"project/azure-cosi-driver/pkg/metrics"
 	identityserver "project/azure-cosi-driver/pkg/server/identity"
 	provisionerserver "project/azure-cosi-driver/pkg/server/provisioner"
+	"project/azure-cosi-driver/pkg/tracing"
+	"strings"
+	"time"
 
 	"k8s.io/klog"
 )
 
 var (
 	endpoint                   = flag.String("endpoint", driver.DefaultEndpoint, "endpoint for the GRPC server")
+	driverName                 = flag.String("driver-name", driver.DefaultDriverName, "name of the driver, matched by the driverName of BucketClasses and BucketAccessClasses. Instances with different names never touch each other's storage accounts and containers.")
+	configFile                 = flag.String("config", "", "YAML file with cluster-wide defaults merged under BucketClass and BucketAccessClass parameters, and the policy they must satisfy")
+	maxSASLifetime             = flag.Duration("max-sas-lifetime", 0, "maximum lifetime of SAS tokens, overriding policy.maxSASLifetime of --config. BucketAccessClasses asking for longer tokens are denied.")
+	forbiddenSASPermissions    = flag.String("forbidden-sas-permissions", "", "comma separated SAS permissions no BucketAccessClass may grant, e.g. deleteversion,permanentdelete, added to policy.forbiddenSASPermissions of --config")
+	forbidAccountSAS           = flag.Bool("forbid-account-sas", false, "deny SAS tokens scoped to a whole storage account")
+	requireHTTPSSAS            = flag.Bool("require-https-sas", false, "deny SAS tokens that can be used over HTTP")
+	allowAccountKeys           = flag.Bool("allow-account-key-credentials", false, "allow BucketAccessClasses with credentialmode accountkey, which grant the storage account key instead of a SAS. They stay denied with --forbid-account-sas.")
 	kubeconfig                 = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. Required only when running out of cluster.")
 	cloudConfigSecretName      = flag.String("cloud-config-secret-name", "azure-cloud-provider", "cloud config secret name")
 	cloudConfigSecretNamespace = flag.String("cloud-config-secret-namespace", "kube-system", "cloud config secret namespace")
+	cloudConfigReloadInterval  = flag.Duration("cloud-config-reload-interval", provisionerserver.DefaultCloudConfigReloadInterval, "how often the credential file is checked for changes and failed cloud config reloads are retried. Changes to the cloud config secret are picked up as they happen. Reloading is disabled when 0.")
+	clusterName                = flag.String("cluster-name", "", "name of the cluster, substituted for ${cluster.name} in BucketClass parameters")
+	metricsAddress             = flag.String("metrics-address", "", "address to serve Prometheus metrics on, e.g. :8080. Metrics are disabled when empty.")
+	healthAddress              = flag.String("health-address", "", "address to serve the /healthz and /readyz endpoints on, e.g. :9808. The endpoints are disabled when empty.")
+	otlpEndpoint               = flag.String("otlp-endpoint", "", "OTLP/gRPC collector endpoint to export traces to, e.g. otel-collector:4317. Tracing is disabled when empty.")
+	otlpInsecure               = flag.Bool("otlp-insecure", false, "connect to the OTLP collector without TLS")
+	tlsCertFile                = flag.String("tls-cert-file", "", "PEM encoded server certificate for tcp:// endpoints, reloaded when the file changes")
+	tlsKeyFile                 = flag.String("tls-key-file", "", "PEM encoded server private key for tcp:// endpoints, reloaded when the file changes")
+	tlsClientCAFile            = flag.String("tls-client-ca-file", "", "PEM encoded CA bundle to verify client certificates against. Client certificates are required when set.")
+	insecure                   = flag.Bool("insecure", false, "allow serving a tcp:// endpoint without TLS")
+	rpcTimeout                 = flag.Duration("rpc-timeout", 2*time.Minute, "timeout of GRPC calls whose method has no timeout in --method-timeouts. Calls are unbounded when 0.")
+	methodTimeouts             = flag.String("method-timeouts", "", "comma separated per-method GRPC call timeouts, e.g. DriverCreateBucket=5m,DriverGrantBucketAccess=30s")
+	drainTimeout               = flag.Duration("drain-timeout", driver.DefaultDrainTimeout, "how long in-flight GRPC calls get to finish on SIGINT or SIGTERM before they are cancelled")
+	maxRequestsPerAccount      = flag.Int("max-concurrent-requests-per-account", 4, "maximum number of requests working on the same storage account at once, including storage accounts picked from a pool or named by the driver. Requests are unbounded when 0.")
+	armRequestsPerSecond       = flag.Float64("arm-requests-per-second", azureutils.DefaultARMRequestsPerSecond, "client-side limit of ARM requests per subscription. The limit is lowered while ARM throttles the subscription and grows back as requests succeed. Limiting is disabled when 0.")
+	armBurst                   = flag.Int("arm-burst", azureutils.DefaultARMBurst, "number of ARM requests per subscription that may exceed --arm-requests-per-second at once")
+	accountKeyCacheTTL         = flag.Duration("account-key-cache-ttl", azureutils.DefaultAccountKeyCacheTTL, "how long storage account keys are cached for, rather than listed from ARM on every grant and deletion. Keys rejected by a storage account are fetched again. Caching is disabled when 0.")
+	journalConfigMapName       = flag.String("journal-configmap-name", azureutils.DefaultJournalConfigMapName, "name of the ConfigMap recording bucket creations in progress, so that interrupted ones are rolled back, and key regenerations run from the command line, so that drivers drop the keys they cached. The journal is disabled when empty.")
+	journalConfigMapNamespace  = flag.String("journal-configmap-namespace", "kube-system", "namespace of the journal ConfigMap")
+	keyRotationGracePeriod     = flag.Duration("key-rotation-grace-period", time.Minute, "how long "+rotateStorageAccountKeyCommand+" waits after switching a storage account to its other key for grants being signed with the previous key to complete, before regenerating it. It waits at least --account-key-cache-ttl, for running drivers to sign with the other key.")
+	auditLogPath               = flag.String("audit-log-path", "", "file to append the JSON audit log of provisioning actions to, or - for stdout. Audit logging is disabled when empty.")
 )
 
 func init() {
@@ -34,20 +71,130 @@ func init() {
 }
 
 func main() {
+	os.Exit(run())
+}
+
+// run runs the driver until it is stopped and returns the exit code of the process.
+// Returning rather than exiting lets the audit log and the trace exporter flush on shutdown.
+func run() int {
 	flag.Parse()
 	defer klog.Flush()
 
-	provServer, err := provisionerserver.NewProvisionerServer(*kubeconfig, *cloudConfigSecretName, *cloudConfigSecretNamespace)
+	if err := driver.ValidateDriverName(*driverName); err != nil {
+		klog.Errorf("Invalid --driver-name: %v", err)
+		return 1
+	}
+	azureutils.SetDriverName(*driverName)
+	metrics.SetDriverName(*driverName)
+
+	config := &azureutils.DriverConfig{}
+	if *configFile != "" {
+		var err error
+		config, err = azureutils.LoadDriverConfig(*configFile)
+		if err != nil {
+			klog.Errorf("Error loading --config: %v", err)
+			return 1
+		}
+	}
+	applySASPolicyFlags(&config.Policy)
+	if err := config.Validate(); err != nil {
+		klog.Errorf("Invalid SAS policy: %v", err)
+		return 1
+	}
+	azureutils.SetDriverConfig(config)
+	azureutils.SetAccountKeyCacheTTL(*accountKeyCacheTTL)
+	azureutils.SetARMRateLimit(*armRequestsPerSecond, *armBurst)
+	azureutils.SetMaxConcurrentRequestsPerAccount(*maxRequestsPerAccount)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), *otlpEndpoint, *otlpInsecure)
+	if err != nil {
+		klog.Errorf("Error setting up tracing: %v", err)
+		return 1
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			klog.Errorf("Error shutting down tracing: %v", err)
+		}
+	}()
+
+	auditLog, err := audit.Open(*auditLogPath)
+	if err != nil {
+		klog.Errorf("Error opening audit log: %v", err)
+		return 1
+	}
+	defer auditLog.Close()
+
+	// Storage account key commands run instead of the driver, e.g. azure-cosi-driver rotate-storage-account-key <account>.
+	// Rotations of an account are refused within --account-key-cache-ttl of the last one, as drivers may have the regenerated key cached.
+	if flag.NArg() > 0 {
+		return runCommand(flag.Args(), auditLog)
+	}
+
+	if *metricsAddress != "" {
+		if err := metrics.StartServer(*metricsAddress); err != nil {
+			klog.Errorf("Error starting metrics server: %v", err)
+			return 1
+		}
+	}
+
+	provServer, err := provisionerserver.NewProvisionerServer(*kubeconfig, *cloudConfigSecretName, *cloudConfigSecretNamespace, *clusterName, auditLog, *journalConfigMapNamespace, *journalConfigMapName, *cloudConfigReloadInterval)
 	if err != nil {
-		klog.Exitf("Error creating ProvisionerServer: %v", err)
+		klog.Errorf("Error creating ProvisionerServer: %v", err)
+		return 1
 	}
-	identityServer, err := identityserver.NewIdentityServer(driver.DriverName)
+	defer provServer.Stop()
+	identityServer, err := identityserver.NewIdentityServer(*driverName)
 	if err != nil {
-		klog.Exitf("Error creating IdentityServer: %v", err)
+		klog.Errorf("Error creating IdentityServer: %v", err)
+		return 1
 	}
 
-	err = driver.RunServerWithSignalHandler(*endpoint, identityServer, provServer)
+	readiness := health.NewChecker(provServer)
+	go readiness.Run(provServer.Stopped())
+	if *healthAddress != "" {
+		if err := health.StartServer(*healthAddress, readiness); err != nil {
+			klog.Errorf("Error starting health server: %v", err)
+			return 1
+		}
+	}
+
+	timeouts, err := driver.ParseMethodTimeouts(*methodTimeouts)
 	if err != nil {
-		klog.Exitf("Error when running driver: %v", err)
+		klog.Errorf("Error parsing --method-timeouts: %v", err)
+		return 1
+	}
+
+	serverOptions := driver.ServerOptions{
+		Checker: readiness,
+		TLS: driver.TLSOptions{
+			CertFile:     *tlsCertFile,
+			KeyFile:      *tlsKeyFile,
+			ClientCAFile: *tlsClientCAFile,
+			Insecure:     *insecure,
+		},
+		DefaultTimeout: *rpcTimeout,
+		MethodTimeouts: timeouts,
+		DrainTimeout:   *drainTimeout,
+	}
+	if err := driver.RunServerWithSignalHandler(*endpoint, identityServer, provServer, serverOptions); err != nil {
+		klog.Errorf("Error when running driver: %v", err)
+		return 1
+	}
+	klog.Info("Driver stopped")
+	return 0
+}
+
+// applySASPolicyFlags applies the SAS policy flags on top of the policy of the --config file
+func applySASPolicyFlags(policy *azureutils.DriverPolicy) {
+	if *maxSASLifetime > 0 {
+		policy.MaxSASLifetime.Duration = *maxSASLifetime
+	}
+	for _, permission := range strings.Split(*forbiddenSASPermissions, ",") {
+		if permission = strings.TrimSpace(permission); permission != "" {
+			policy.ForbiddenSASPermissions = append(policy.ForbiddenSASPermissions, permission)
+		}
 	}
+	policy.ForbidAccountSAS = policy.ForbidAccountSAS || *forbidAccountSAS
+	policy.RequireHTTPS = policy.RequireHTTPS || *requireHTTPSSAS
+	policy.AllowAccountKeyCredentials = policy.AllowAccountKeyCredentials || *allowAccountKeys
 }
@@ -0,0 +1,164 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"project/azure-cosi-driver/pkg/redact"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// StdoutPath writes the audit log to stdout instead of a file
+	StdoutPath = "-"
+
+	ActionCreateBucket       = "CreateBucket"
+	ActionDeleteBucket       = "DeleteBucket"
+	ActionGrantBucketAccess  = "GrantBucketAccess"
+	ActionRevokeBucketAccess = "RevokeBucketAccess"
+	// ActionRotateStorageAccountKey and ActionRevokeStorageAccountSAS are run from the command line
+	ActionRotateStorageAccountKey = "RotateStorageAccountKey"
+	ActionRevokeStorageAccountSAS = "RevokeStorageAccountSAS"
+
+	OutcomeSuccess = "Success"
+	OutcomeFailure = "Failure"
+
+	// unknownActor is recorded when the caller cannot be identified, e.g. on unix sockets
+	unknownActor = "unknown"
+)
+
+// Record is a single audit log entry. It never holds credentials.
+type Record struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	Outcome string    `json:"outcome"`
+	// Actor identifies the caller, by client certificate subject on mTLS endpoints and by address otherwise
+	Actor        string `json:"actor"`
+	BucketClaim  string `json:"bucketClaim,omitempty"`
+	Bucket       string `json:"bucket,omitempty"`
+	BucketID     string `json:"bucketID,omitempty"`
+	BucketAccess string `json:"bucketAccess,omitempty"`
+	// StorageAccount is the storage account whose keys were rotated or regenerated
+	StorageAccount string     `json:"storageAccount,omitempty"`
+	Permissions    string     `json:"permissions,omitempty"`
+	Expiry         *time.Time `json:"expiry,omitempty"`
+	Error          string     `json:"error,omitempty"`
+}
+
+// Logger writes audit records as JSON lines. A nil Logger discards records.
+type Logger struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+	closer  io.Closer
+	now     func() time.Time
+}
+
+// NewLogger returns a Logger writing to w
+func NewLogger(w io.Writer) *Logger {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return &Logger{encoder: encoder, now: time.Now}
+}
+
+// Open returns a Logger appending to the file at path, or writing to stdout for StdoutPath.
+// An empty path disables audit logging and returns a nil Logger.
+func Open(path string) (*Logger, error) {
+	switch path {
+	case "":
+		return nil, nil
+	case StdoutPath:
+		return NewLogger(os.Stdout), nil
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	logger := NewLogger(file)
+	logger.closer = file
+	return logger, nil
+}
+
+// Log writes the record, filling in its time. Errors are redacted as they may quote request URLs.
+func (l *Logger) Log(record Record) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	record.Time = l.now().UTC()
+	record.Error = redact.String(record.Error)
+	if err := l.encoder.Encode(record); err != nil {
+		klog.Errorf("Could not write audit record: %v", err)
+	}
+}
+
+// Close closes the file the Logger writes to
+func (l *Logger) Close() error {
+	if l == nil || l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+// Actor identifies the caller of the RPC in ctx
+func Actor(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return unknownActor
+	}
+	if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+		if subject := clientSubject(tlsInfo.State); subject != "" {
+			return subject
+		}
+	}
+	if p.Addr == nil || p.Addr.String() == "" || p.Addr.String() == "@" {
+		return unknownActor
+	}
+	return p.Addr.String()
+}
+
+func clientSubject(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.String()
+}
+
+// SASGrant returns the permissions and expiry of a SAS URL, read from its sp and se query parameters
+func SASGrant(sasURL string) (string, *time.Time) {
+	u, err := url.Parse(sasURL)
+	if err != nil {
+		return "", nil
+	}
+	query := u.Query()
+	expiry, err := time.Parse(time.RFC3339, query.Get("se"))
+	if err != nil {
+		return query.Get("sp"), nil
+	}
+	return query.Get("sp"), &expiry
+}
@@ -0,0 +1,181 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+func TestLog(t *testing.T) {
+	now := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	expiry := now.Add(time.Hour)
+	tests := []struct {
+		testName     string
+		record       Record
+		expectedLine string
+	}{
+		{
+			testName: "Successful grant",
+			record: Record{
+				Action:       ActionGrantBucketAccess,
+				Outcome:      OutcomeSuccess,
+				Actor:        "CN=sidecar",
+				BucketID:     "id",
+				BucketAccess: "ba-uid",
+				Permissions:  "rl",
+				Expiry:       &expiry,
+			},
+			expectedLine: `{"time":"2022-09-01T12:00:00Z","action":"GrantBucketAccess","outcome":"Success","actor":"CN=sidecar","bucketID":"id","bucketAccess":"ba-uid","permissions":"rl","expiry":"2022-09-01T13:00:00Z"}`,
+		},
+		{
+			testName: "Failure with secret in error",
+			record: Record{
+				Action:  ActionCreateBucket,
+				Outcome: OutcomeFailure,
+				Actor:   unknownActor,
+				Bucket:  "bucket",
+				Error:   "GET https://account.blob.core.windows.net/?sv=2020&sig=secret failed",
+			},
+			expectedLine: `{"time":"2022-09-01T12:00:00Z","action":"CreateBucket","outcome":"Failure","actor":"unknown","bucket":"bucket","error":"GET https://account.blob.core.windows.net/?sv=2020&sig=REDACTED failed"}`,
+		},
+	}
+	for _, test := range tests {
+		buf := &bytes.Buffer{}
+		logger := NewLogger(buf)
+		logger.now = func() time.Time { return now }
+		logger.Log(test.record)
+		if line := strings.TrimSpace(buf.String()); line != test.expectedLine {
+			t.Errorf("\nTestCase: %s\nExpected Line: %s\nActual Line: %s", test.testName, test.expectedLine, line)
+		}
+	}
+
+	// A nil logger discards records
+	var logger *Logger
+	logger.Log(Record{Action: ActionDeleteBucket})
+	if err := logger.Close(); err != nil {
+		t.Errorf("unexpected error closing nil logger: %v", err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	logger, err := Open("")
+	if err != nil || logger != nil {
+		t.Errorf("expected audit logging to be disabled for an empty path, got %v, %v", logger, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 2; i++ {
+		logger, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger.Log(Record{Action: ActionDeleteBucket, Outcome: OutcomeSuccess})
+		if err := logger.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Errorf("expected the audit log to be appended to, found %d lines", lines)
+	}
+}
+
+func TestActor(t *testing.T) {
+	clientCert := &x509.Certificate{Subject: pkix.Name{CommonName: "sidecar", Organization: []string{"cosi"}}}
+	tests := []struct {
+		testName      string
+		ctx           context.Context
+		expectedActor string
+	}{
+		{
+			testName:      "No peer",
+			ctx:           context.Background(),
+			expectedActor: unknownActor,
+		},
+		{
+			testName:      "Unix socket",
+			ctx:           peer.NewContext(context.Background(), &peer.Peer{Addr: &net.UnixAddr{Name: "@", Net: "unix"}}),
+			expectedActor: unknownActor,
+		},
+		{
+			testName:      "TCP without client certificate",
+			ctx:           peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}}),
+			expectedActor: "10.0.0.1:1234",
+		},
+		{
+			testName: "Verified client certificate",
+			ctx: peer.NewContext(context.Background(), &peer.Peer{
+				Addr:     &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234},
+				AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{clientCert}}}},
+			}),
+			expectedActor: "CN=sidecar,O=cosi",
+		},
+	}
+	for _, test := range tests {
+		if actor := Actor(test.ctx); actor != test.expectedActor {
+			t.Errorf("\nTestCase: %s\nExpected Actor: %s\nActual Actor: %s", test.testName, test.expectedActor, actor)
+		}
+	}
+}
+
+func TestSASGrant(t *testing.T) {
+	expiry := time.Date(2022, 9, 8, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		testName            string
+		sasURL              string
+		expectedPermissions string
+		expectedExpiry      *time.Time
+	}{
+		{
+			testName:            "Container SAS",
+			sasURL:              "https://account.blob.core.windows.net/container?se=2022-09-08T12%3A00%3A00Z&sig=secret&sp=rl&sr=c&sv=2020-02-10",
+			expectedPermissions: "rl",
+			expectedExpiry:      &expiry,
+		},
+		{
+			testName:            "Without expiry",
+			sasURL:              "https://account.blob.core.windows.net/?sp=rwdl",
+			expectedPermissions: "rwdl",
+		},
+		{
+			testName: "Invalid URL",
+			sasURL:   "://",
+		},
+	}
+	for _, test := range tests {
+		permissions, expiry := SASGrant(test.sasURL)
+		if permissions != test.expectedPermissions {
+			t.Errorf("\nTestCase: %s\nExpected Permissions: %s\nActual Permissions: %s", test.testName, test.expectedPermissions, permissions)
+		}
+		if (expiry == nil) != (test.expectedExpiry == nil) || (expiry != nil && !expiry.Equal(*test.expectedExpiry)) {
+			t.Errorf("\nTestCase: %s\nExpected Expiry: %v\nActual Expiry: %v", test.testName, test.expectedExpiry, expiry)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"project/azure-cosi-driver/pkg/constant"
+	"project/azure-cosi-driver/pkg/types"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+const (
+	// AccountKeyGrantsTag is the storage account tag recording the account key grants of the account, as a comma
+	// separated list of <grant ID>:<key granted>, followed by :r for grants whose key is regenerated on revocation.
+	// A single tag keeps the grants within the tag limit of the account, see maxAccountKeyGrantsLength.
+	AccountKeyGrantsTag = "cosi-account-key-grants"
+	// regenerateOnRevoke marks account key grants whose key is regenerated when they are revoked
+	regenerateOnRevoke = "r"
+	// accountKeyGrantIDLength is the length of the hash of the account name identifying a grant in AccountKeyGrantsTag
+	accountKeyGrantIDLength = 8
+	// maxAccountKeyGrantsLength is the longest value Azure allows for a tag
+	maxAccountKeyGrantsLength = 256
+)
+
+// accountKeyGrant is an account key grant recorded in the AccountKeyGrantsTag of a storage account
+type accountKeyGrant struct {
+	id                 string
+	keyName            string
+	regenerateOnRevoke bool
+}
+
+// getAccountKeyGrantID returns the ID of the account key grant of the account name of a grant
+func getAccountKeyGrantID(accountName string) string {
+	return nameHash(accountKeyGrantIDLength, accountName)
+}
+
+// parseAccountKeyGrants returns the account key grants recorded in the tags of a storage account, skipping malformed ones
+func parseAccountKeyGrants(tags map[string]*string) []accountKeyGrant {
+	value, ok := tags[AccountKeyGrantsTag]
+	if !ok || value == nil || *value == "" {
+		return nil
+	}
+	var grants []accountKeyGrant
+	for _, entry := range strings.Split(*value, ",") {
+		fields := strings.Split(entry, ":")
+		if len(fields) < 2 || len(fields) > 3 || (len(fields) == 3 && fields[2] != regenerateOnRevoke) {
+			klog.Warningf("Ignoring malformed account key grant %q in tag %s", entry, AccountKeyGrantsTag)
+			continue
+		}
+		grants = append(grants, accountKeyGrant{id: fields[0], keyName: fields[1], regenerateOnRevoke: len(fields) == 3})
+	}
+	return grants
+}
+
+// formatAccountKeyGrants returns the value of the AccountKeyGrantsTag recording grants
+func formatAccountKeyGrants(grants []accountKeyGrant) string {
+	entries := make([]string, 0, len(grants))
+	for _, grant := range grants {
+		entry := grant.id + ":" + grant.keyName
+		if grant.regenerateOnRevoke {
+			entry += ":" + regenerateOnRevoke
+		}
+		entries = append(entries, entry)
+	}
+	return strings.Join(entries, ",")
+}
+
+// findAccountKeyGrant returns the index of the grant with the ID in grants, -1 if there is none
+func findAccountKeyGrant(grants []accountKeyGrant, id string) int {
+	for i, grant := range grants {
+		if grant.id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// grantAccountKey grants the storage account key of a storage account bucket, for clients that cannot use a SAS,
+// and records the grant in the tags of the account so that revoking it can regenerate the key
+func grantAccountKey(ctx context.Context, bucketID, accountName string, params *BucketAccessClassParameters, cloud *azure.Cloud) (map[string]string, error) {
+	id, err := types.DecodeToBucketID(bucketID)
+	if err != nil {
+		return nil, err
+	}
+	accountURL, err := url.Parse(id.URL)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid bucket URL %s: %v", id.URL, err))
+	}
+	if getContainerNameFromContainerURL(id.URL) != "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%s %s is only granted on buckets of %s %s", constant.CredentialModeField, constant.AccountKeyCredentialMode, constant.BucketUnitTypeField, constant.StorageAccount))
+	}
+	account := bucketStorageAccount(id, cloud)
+
+	key, err := getSigningAccountKey(ctx, cloud, account.SubscriptionID, account.ResourceGroup, account.Name, params.signingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := getStorageAccountTags(ctx, cloud, account)
+	if err != nil {
+		return nil, err
+	}
+	// A retried grant replaces the record of the grant it retries
+	grant := accountKeyGrant{id: getAccountKeyGrantID(accountName), keyName: key.name, regenerateOnRevoke: params.regenerateKeyOnRevoke}
+	grants := parseAccountKeyGrants(tags)
+	if i := findAccountKeyGrant(grants, grant.id); i >= 0 {
+		grants = append(grants[:i], grants[i+1:]...)
+	}
+	grants = append(grants, grant)
+	value := formatAccountKeyGrants(grants)
+	if len(value) > maxAccountKeyGrantsLength {
+		return nil, status.Error(codes.ResourceExhausted, fmt.Sprintf("Storage account %s has too many account key grants, revoke some of them or grant a SAS", account.Name))
+	}
+	klog.Infof("Recording the grant of %s of storage account %s as %s in tag %s", key.name, account.Name, grant.id, AccountKeyGrantsTag)
+	if err := setStorageAccountTags(ctx, cloud, account, tags, map[string]string{AccountKeyGrantsTag: value}); err != nil {
+		return nil, err
+	}
+
+	blobEndpoint := accountURL.Scheme + "://" + accountURL.Host
+	return map[string]string{
+		constant.AccountName: account.Name,
+		constant.AccountKey:  key.value,
+		constant.ConnectionString: fmt.Sprintf("DefaultEndpointsProtocol=%s;AccountName=%s;AccountKey=%s;BlobEndpoint=%s",
+			accountURL.Scheme, account.Name, key.value, blobEndpoint),
+	}, nil
+}
+
+// revokeAccountKey removes the record of the account key grant from the tags of the storage account of the bucket,
+// and regenerates the key granted if the grant asked for it. The key is not regenerated while other grants hold it:
+// they are marked to regenerate it instead, so that it is regenerated once the last of them is revoked.
+// Storage accounts without the grant have nothing to revoke.
+func revokeAccountKey(ctx context.Context, id *types.BucketID, accountName string, cloud *azure.Cloud) error {
+	account := bucketStorageAccount(id, cloud)
+	tags, err := getStorageAccountTags(ctx, cloud, account)
+	if status.Code(err) == codes.NotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	grants := parseAccountKeyGrants(tags)
+	i := findAccountKeyGrant(grants, getAccountKeyGrantID(accountName))
+	if i < 0 {
+		return nil
+	}
+	grant := grants[i]
+	grants = append(grants[:i], grants[i+1:]...)
+
+	holders := 0
+	for i := range grants {
+		if strings.EqualFold(grants[i].keyName, grant.keyName) {
+			grants[i].regenerateOnRevoke = grants[i].regenerateOnRevoke || grant.regenerateOnRevoke
+			holders++
+		}
+	}
+	value := formatAccountKeyGrants(grants)
+	if !grant.regenerateOnRevoke {
+		klog.Infof("Removing the grant of %s of storage account %s, the key is not regenerated", grant.keyName, account.Name)
+		return setStorageAccountTags(ctx, cloud, account, tags, map[string]string{AccountKeyGrantsTag: value})
+	}
+	if holders > 0 {
+		klog.Infof("Removing the grant of %s of storage account %s, the key is regenerated once the %d other grants holding it are revoked", grant.keyName, account.Name, holders)
+		return setStorageAccountTags(ctx, cloud, account, tags, map[string]string{AccountKeyGrantsTag: value})
+	}
+
+	regenerator, err := newKeyRegenerator(cloud, account.SubscriptionID)
+	if err != nil {
+		return err
+	}
+	tags[AccountKeyGrantsTag] = to.StringPtr(value)
+	klog.Infof("Regenerating %s of storage account %s on revocation of its grant", grant.keyName, account.Name)
+	return regenerateStorageAccountKeys(ctx, cloud, regenerator, account, tags, grant.keyName)
+}
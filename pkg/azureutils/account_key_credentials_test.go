@@ -0,0 +1,168 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"project/azure-cosi-driver/pkg/constant"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+func TestGrantAccountKey(t *testing.T) {
+	defer SetDriverConfig(nil)
+	SetDriverConfig(&DriverConfig{Policy: DriverPolicy{AllowAccountKeyCredentials: true}})
+
+	accountBucket := encodeBucketID(t, "https://"+constant.ValidAccount+".blob.core.windows.net/")
+	grantID := getAccountKeyGrantID(sftpGrantName)
+	secrets := map[string]string{
+		constant.AccountName:      constant.ValidAccount,
+		constant.AccountKey:       "a2V5",
+		constant.ConnectionString: "DefaultEndpointsProtocol=https;AccountName=" + constant.ValidAccount + ";AccountKey=a2V5;BlobEndpoint=https://" + constant.ValidAccount + ".blob.core.windows.net",
+	}
+	tooManyGrants := make([]string, 18)
+	for i := range tooManyGrants {
+		tooManyGrants[i] = fmt.Sprintf("%08d:%s", i, Key1Name)
+	}
+	tests := []struct {
+		testName        string
+		bucketID        string
+		parameters      map[string]string
+		tags            map[string]*string
+		expectedSecrets map[string]string
+		expectedGrants  string
+		expectedCode    codes.Code
+	}{
+		{
+			testName:        "Signing key of the storage account",
+			bucketID:        accountBucket,
+			tags:            map[string]*string{SigningKeyTag: to.StringPtr(Key2Name)},
+			expectedSecrets: secrets,
+			expectedGrants:  grantID + ":" + Key2Name,
+		},
+		{
+			testName:        "Key regenerated on revocation",
+			bucketID:        accountBucket,
+			parameters:      map[string]string{constant.SigningKeyField: Key2Name, constant.RegenerateKeyOnRevokeField: TrueValue},
+			tags:            map[string]*string{AccountKeyGrantsTag: to.StringPtr("00000000:" + Key1Name)},
+			expectedSecrets: secrets,
+			expectedGrants:  "00000000:" + Key1Name + "," + grantID + ":" + Key2Name + ":" + regenerateOnRevoke,
+		},
+		{
+			testName:        "Retried grant",
+			bucketID:        accountBucket,
+			tags:            map[string]*string{AccountKeyGrantsTag: to.StringPtr(grantID + ":" + Key2Name + ":" + regenerateOnRevoke)},
+			expectedSecrets: secrets,
+			expectedGrants:  grantID + ":" + Key1Name,
+		},
+		{
+			testName:       "Too many grants",
+			bucketID:       accountBucket,
+			tags:           map[string]*string{AccountKeyGrantsTag: to.StringPtr(strings.Join(tooManyGrants, ","))},
+			expectedGrants: strings.Join(tooManyGrants, ","),
+			expectedCode:   codes.ResourceExhausted,
+		},
+		{
+			testName:     "Container bucket",
+			bucketID:     encodeBucketID(t, constant.ValidContainerURL),
+			tags:         map[string]*string{},
+			expectedCode: codes.InvalidArgument,
+		},
+	}
+	for _, test := range tests {
+		parameters := map[string]string{constant.CredentialModeField: constant.AccountKeyCredentialMode, constant.BucketUnitTypeField: constant.StorageAccount.String()}
+		for k, v := range test.parameters {
+			parameters[k] = v
+		}
+		InvalidateStorageAccountKey("subscription", "rg", constant.ValidAccount)
+
+		secrets, err := GrantBucketAccess(context.Background(), test.bucketID, sftpGrantName, parameters, newKeyRotationCloud(t, test.tags, Key1Name, Key2Name))
+		if status.Code(err) != test.expectedCode {
+			t.Errorf("\nTestCase: %s\nExpected Code: %v\nActual Error: %v", test.testName, test.expectedCode, err)
+		}
+		if !reflect.DeepEqual(secrets, test.expectedSecrets) {
+			t.Errorf("\nTestCase: %s\nExpected Secrets: %v\nActual Secrets: %v", test.testName, test.expectedSecrets, secrets)
+		}
+		if grants := to.String(test.tags[AccountKeyGrantsTag]); grants != test.expectedGrants {
+			t.Errorf("\nTestCase: %s\nExpected Grants: %s\nActual Grants: %s", test.testName, test.expectedGrants, grants)
+		}
+	}
+}
+
+func TestRevokeAccountKey(t *testing.T) {
+	defer func(f func(*azure.Cloud, string) (storageAccountKeyRegenerator, error)) { newKeyRegenerator = f }(newKeyRegenerator)
+
+	accountBucket := encodeBucketID(t, "https://"+constant.ValidAccount+".blob.core.windows.net/")
+	grantID := getAccountKeyGrantID(sftpGrantName)
+	tests := []struct {
+		testName            string
+		bucketID            string
+		grants              string
+		expectedRegenerated []string
+		expectedGrants      string
+	}{
+		{
+			testName:            "Key regenerated on revocation",
+			bucketID:            accountBucket,
+			grants:              grantID + ":" + Key2Name + ":" + regenerateOnRevoke + ",00000000:" + Key1Name,
+			expectedRegenerated: []string{Key2Name},
+			expectedGrants:      "00000000:" + Key1Name,
+		},
+		{
+			testName:       "Key held by other grants",
+			bucketID:       accountBucket,
+			grants:         "00000000:" + Key2Name + "," + grantID + ":" + Key2Name + ":" + regenerateOnRevoke,
+			expectedGrants: "00000000:" + Key2Name + ":" + regenerateOnRevoke,
+		},
+		{
+			testName: "Key kept on revocation",
+			bucketID: accountBucket,
+			grants:   grantID + ":" + Key1Name,
+		},
+		{
+			testName: "SAS grant",
+			bucketID: accountBucket,
+			grants:   "00000000:" + Key1Name,
+			// Nothing is written
+			expectedGrants: "00000000:" + Key1Name,
+		},
+	}
+	for _, test := range tests {
+		regenerator := &fakeRegenerator{}
+		newKeyRegenerator = func(*azure.Cloud, string) (storageAccountKeyRegenerator, error) { return regenerator, nil }
+		tags := map[string]*string{AccountKeyGrantsTag: to.StringPtr(test.grants)}
+
+		if err := RevokeBucketAccess(context.Background(), test.bucketID, sftpGrantName, newKeyRotationCloud(t, tags, Key1Name, Key2Name)); err != nil {
+			t.Errorf("\nTestCase: %s\nExpected Error: nil\nActual Error: %v", test.testName, err)
+		}
+		if !reflect.DeepEqual(regenerator.regenerated, test.expectedRegenerated) {
+			t.Errorf("\nTestCase: %s\nExpected Regenerated Keys: %v\nActual Regenerated Keys: %v", test.testName, test.expectedRegenerated, regenerator.regenerated)
+		}
+		if grants := to.String(tags[AccountKeyGrantsTag]); grants != test.expectedGrants {
+			t.Errorf("\nTestCase: %s\nExpected Grants: %s\nActual Grants: %s", test.testName, test.expectedGrants, grants)
+		}
+	}
+
+	if err := RevokeBucketAccess(context.Background(), encodeBucketID(t, "https://deletedaccount.blob.core.windows.net/"), sftpGrantName, newSFTPCloud(t)); err != nil {
+		t.Errorf("expected nothing to revoke on a deleted storage account, got %v", err)
+	}
+}
@@ -0,0 +1,335 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"project/azure-cosi-driver/pkg/metrics"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/Azure/go-autorest/autorest/to"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+const (
+	// DefaultAccountKeyCacheTTL is how long storage account keys are cached for by default
+	DefaultAccountKeyCacheTTL = 10 * time.Minute
+	// accountKeyFetchTimeout bounds a ListKeys call shared by concurrent lookups
+	accountKeyFetchTimeout = time.Minute
+
+	// Key1Name and Key2Name are the names of the two keys of a storage account
+	Key1Name = "key1"
+	Key2Name = "key2"
+)
+
+// accountKeyCache caches storage account keys, and the SigningKeyTag of the accounts SAS tokens are signed for,
+// so that grants and deletions do not each make rate-limited ARM calls. Concurrent lookups of a key that is not
+// cached share a single call.
+type accountKeyCache struct {
+	lock sync.Mutex
+	// ttl is how long keys are cached for, zero disables caching
+	ttl  time.Duration
+	keys map[string]cachedAccountKeys
+	// generation is bumped whenever cached keys are dropped, so that fetches started before do not cache the keys
+	// they listed, which may be the dropped ones
+	generation uint64
+	// fetches coalesces concurrent ListKeys calls for the same storage account
+	fetches singleflight.Group
+	now     func() time.Time
+}
+
+type cachedAccountKeys struct {
+	keys []accountKey
+	// signingKey is the name of the key recorded by the SigningKeyTag of the account, "" if it has none.
+	// It is nil if the tag was not looked up with the keys.
+	signingKey *string
+	// fetched is when the keys started being listed, see dropFetchedBefore
+	fetched time.Time
+	expires time.Time
+}
+
+// accountKey is a key of a storage account, in the order ListKeys returns them
+type accountKey struct {
+	name  string
+	value string
+	// created is when the key was generated, zero if Azure did not report it
+	created time.Time
+}
+
+// accountKeys caches the keys of the storage accounts of this driver instance. Caching is disabled until SetAccountKeyCacheTTL is called.
+var accountKeys = newAccountKeyCache(0)
+
+func newAccountKeyCache(ttl time.Duration) *accountKeyCache {
+	return &accountKeyCache{
+		ttl:  ttl,
+		keys: make(map[string]cachedAccountKeys),
+		now:  time.Now,
+	}
+}
+
+// SetAccountKeyCacheTTL sets how long storage account keys are cached for, zero disables caching.
+// It must be called before any bucket is provisioned.
+func SetAccountKeyCacheTTL(ttl time.Duration) {
+	accountKeys = newAccountKeyCache(ttl)
+}
+
+func accountKeyCacheKey(subsID, resourceGroup, account string) string {
+	return strings.ToLower(subsID + "/" + resourceGroup + "/" + account)
+}
+
+// get returns the keys of the storage account, from the cache if they have not expired, otherwise from ARM
+func (c *accountKeyCache) get(ctx context.Context, cloud *azure.Cloud, subsID, resourceGroup, account string) ([]accountKey, error) {
+	cached, err := c.lookup(ctx, cloud, subsID, resourceGroup, account, false)
+	return cached.keys, err
+}
+
+// lookup returns the keys of the storage account, and its SigningKeyTag if withSigningKey is set, from the cache if
+// they have not expired, otherwise from ARM. The tag is looked up again whenever the keys are, so that a rotation is
+// picked up once the cached keys expire. The ARM calls are made with a context detached from the one of the lookup,
+// so that a cancelled lookup does not fail the lookups sharing the calls.
+func (c *accountKeyCache) lookup(ctx context.Context, cloud *azure.Cloud, subsID, resourceGroup, account string, withSigningKey bool) (cachedAccountKeys, error) {
+	cacheKey := accountKeyCacheKey(subsID, resourceGroup, account)
+	c.lock.Lock()
+	cached, ok := c.keys[cacheKey]
+	if ok && c.now().After(cached.expires) {
+		delete(c.keys, cacheKey)
+		ok = false
+	}
+	ok = ok && (!withSigningKey || cached.signingKey != nil)
+	c.lock.Unlock()
+	metrics.RecordAccountKeyLookup(ok)
+	if ok {
+		return cached, nil
+	}
+
+	fetchKey := cacheKey
+	if withSigningKey {
+		fetchKey += "/" + SigningKeyTag
+	}
+	fetch := c.fetches.DoChan(fetchKey, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(detachedContext{ctx}, accountKeyFetchTimeout)
+		defer cancel()
+		c.lock.Lock()
+		generation := c.generation
+		c.lock.Unlock()
+		fetched := cachedAccountKeys{fetched: c.now()}
+		if withSigningKey {
+			signingKey, err := getSigningKeyName(ctx, cloud, subsID, resourceGroup, account)
+			if err != nil {
+				return nil, err
+			}
+			fetched.signingKey = &signingKey
+		}
+		keys, err := listStorageAccountKeys(ctx, cloud, subsID, resourceGroup, account)
+		if err != nil {
+			return nil, err
+		}
+		fetched.keys = keys
+		if c.ttl > 0 {
+			fetched.expires = c.now().Add(c.ttl)
+			c.lock.Lock()
+			if c.generation == generation {
+				c.keys[cacheKey] = fetched
+			}
+			c.lock.Unlock()
+		}
+		return fetched, nil
+	})
+	select {
+	case result := <-fetch:
+		if result.Err != nil {
+			return cachedAccountKeys{}, result.Err
+		}
+		return result.Val.(cachedAccountKeys), nil
+	case <-ctx.Done():
+		return cachedAccountKeys{}, ctx.Err()
+	}
+}
+
+// listStorageAccountKeys lists the keys of the storage account from ARM, skipping empty ones
+func listStorageAccountKeys(ctx context.Context, cloud *azure.Cloud, subsID, resourceGroup, account string) ([]accountKey, error) {
+	if cloud.StorageAccountClient == nil {
+		return nil, fmt.Errorf("StorageAccountClient is nil")
+	}
+	reqCtx, req, err := startARMRequest(ctx, getStorageAccountKeyOperation, subsID)
+	if err != nil {
+		return nil, err
+	}
+	result, rerr := cloud.StorageAccountClient.ListKeys(reqCtx, subsID, resourceGroup, account)
+	req.endARM(rerr)
+	if rerr != nil {
+		return nil, rerr.Error()
+	}
+
+	var keys []accountKey
+	if result.Keys != nil {
+		for _, k := range *result.Keys {
+			if k.Value == nil || *k.Value == "" {
+				continue
+			}
+			// Like azure.Cloud.GetStorageAccesskey, only keep what follows the last space of the value
+			value := *k.Value
+			if i := strings.LastIndex(value, " "); i >= 0 {
+				value = value[i+1:]
+			}
+			key := accountKey{name: strings.ToLower(to.String(k.KeyName)), value: value}
+			if k.CreationTime != nil {
+				key.created = k.CreationTime.Time
+			}
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no valid keys for storage account %s", account)
+	}
+	return keys, nil
+}
+
+// invalidate drops the cached keys and SigningKeyTag of the storage account, e.g. because they were rotated.
+// Lookups made after it list the keys again rather than share the fetches in flight.
+func (c *accountKeyCache) invalidate(subsID, resourceGroup, account string) {
+	cacheKey := accountKeyCacheKey(subsID, resourceGroup, account)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.keys, cacheKey)
+	c.generation++
+	c.fetches.Forget(cacheKey)
+	c.fetches.Forget(cacheKey + "/" + SigningKeyTag)
+}
+
+// observe drops the cached keys of the storage account if the account reports keys generated at other times
+// than the cached ones, i.e. its keys were regenerated since they were cached, e.g. from the Azure portal
+func (c *accountKeyCache) observe(subsID, resourceGroup string, account storage.Account) {
+	if account.Name == nil || account.AccountProperties == nil || account.KeyCreationTime == nil {
+		return
+	}
+	created := map[string]*date.Time{Key1Name: account.KeyCreationTime.Key1, Key2Name: account.KeyCreationTime.Key2}
+
+	cacheKey := accountKeyCacheKey(subsID, resourceGroup, *account.Name)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cached, ok := c.keys[cacheKey]
+	if !ok {
+		return
+	}
+	for _, key := range cached.keys {
+		if at := created[key.name]; at != nil && !key.created.IsZero() && !at.Time.Equal(key.created) {
+			klog.Infof("Keys of storage account %s were regenerated, dropping them from the key cache", *account.Name)
+			delete(c.keys, cacheKey)
+			c.generation++
+			return
+		}
+	}
+}
+
+// dropFetchedBefore drops the cached keys of the storage account named account that started being listed before at,
+// e.g. because they were regenerated then by another process. The account is identified by name only, as storage
+// account names are unique across subscriptions.
+func (c *accountKeyCache) dropFetchedBefore(account string, at time.Time) {
+	suffix := "/" + strings.ToLower(account)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// Keys being listed may have been listed before at
+	c.generation++
+	for cacheKey, cached := range c.keys {
+		if strings.HasSuffix(cacheKey, suffix) && cached.fetched.Before(at) {
+			klog.Infof("Keys of storage account %s were regenerated at %s, dropping them from the key cache", account, at.Format(time.RFC3339))
+			delete(c.keys, cacheKey)
+		}
+	}
+}
+
+// getStorageAccountKey returns the first key of the storage account, cached for the account key cache TTL
+func getStorageAccountKey(ctx context.Context, cloud *azure.Cloud, subsID, resourceGroup, account string) (string, error) {
+	keys, err := accountKeys.get(ctx, cloud, subsID, resourceGroup, account)
+	if err != nil {
+		return "", err
+	}
+	return keys[0].value, nil
+}
+
+// getNamedStorageAccountKey returns the key of the storage account named keyName, key1 or key2,
+// cached for the account key cache TTL
+func getNamedStorageAccountKey(ctx context.Context, cloud *azure.Cloud, subsID, resourceGroup, account, keyName string) (string, error) {
+	keys, err := accountKeys.get(ctx, cloud, subsID, resourceGroup, account)
+	if err != nil {
+		return "", err
+	}
+	for _, key := range keys {
+		if key.name == strings.ToLower(keyName) {
+			return key.value, nil
+		}
+	}
+	return "", status.Error(codes.FailedPrecondition, fmt.Sprintf("Storage account %s has no key %s", account, keyName))
+}
+
+// getSigningAccountKey returns the key of the storage account named keyName. When keyName is empty the key recorded
+// by the SigningKeyTag of the account is returned, and the first key of the account when it has no tag.
+// The tag is cached with the keys, so a rotation is picked up once the cached keys expire.
+func getSigningAccountKey(ctx context.Context, cloud *azure.Cloud, subsID, resourceGroup, account, keyName string) (accountKey, error) {
+	cached, err := accountKeys.lookup(ctx, cloud, subsID, resourceGroup, account, keyName == "")
+	if err != nil {
+		return accountKey{}, err
+	}
+	if keyName == "" {
+		keyName = *cached.signingKey
+	}
+	if keyName == "" {
+		return cached.keys[0], nil
+	}
+	for _, key := range cached.keys {
+		if key.name == strings.ToLower(keyName) {
+			return key, nil
+		}
+	}
+	return accountKey{}, status.Error(codes.FailedPrecondition, fmt.Sprintf("Storage account %s has no key %s", account, keyName))
+}
+
+// InvalidateStorageAccountKey drops the cached keys and SigningKeyTag of the storage account.
+// It must be called when the keys of an account are rotated.
+func InvalidateStorageAccountKey(subsID, resourceGroup, account string) {
+	accountKeys.invalidate(subsID, resourceGroup, account)
+}
+
+// withStorageAccountKey calls f with the key of the storage account. If the key is rejected by the storage
+// account, e.g. because it was rotated since it was cached, f is called once more with a key fetched from ARM.
+func withStorageAccountKey(ctx context.Context, cloud *azure.Cloud, subsID, resourceGroup, account string, f func(key string) error) error {
+	key, err := getStorageAccountKey(ctx, cloud, subsID, resourceGroup, account)
+	if err != nil {
+		return err
+	}
+	err = f(key)
+	if !bloberror.HasCode(err, bloberror.AuthenticationFailed) {
+		return err
+	}
+
+	klog.Infof("Key of storage account %s was rejected, fetching it again", account)
+	InvalidateStorageAccountKey(subsID, resourceGroup, account)
+	key, err = getStorageAccountKey(ctx, cloud, subsID, resourceGroup, account)
+	if err != nil {
+		return err
+	}
+	return f(key)
+}
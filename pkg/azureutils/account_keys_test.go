@@ -0,0 +1,483 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/golang/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/storageaccountclient/mockstorageaccountclient"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
+)
+
+// keyServer serves the current key of every storage account through ListKeys and counts the calls
+type keyServer struct {
+	calls int32
+	key   atomic.Value
+	fail  atomic.Value
+	// created is when key1 was generated
+	created atomic.Value
+	// gate, when set, holds ListKeys calls until it is closed
+	gate chan struct{}
+}
+
+func newKeyServer(t *testing.T) (*keyServer, *azure.Cloud) {
+	s := &keyServer{}
+	s.key.Store("a2V5")
+	s.fail.Store(false)
+	s.created.Store(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	ctrl := gomock.NewController(t)
+	cloud := azure.GetTestCloud(ctrl)
+	cl := mockstorageaccountclient.NewMockInterface(ctrl)
+	cl.EXPECT().
+		ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(context.Context, string, string, string) (storage.AccountListKeysResult, *retry.Error) {
+			atomic.AddInt32(&s.calls, 1)
+			if s.gate != nil {
+				<-s.gate
+			}
+			if s.fail.Load().(bool) {
+				return storage.AccountListKeysResult{}, retry.GetError(&http.Response{StatusCode: http.StatusForbidden}, fmt.Errorf("forbidden"))
+			}
+			return storage.AccountListKeysResult{Keys: &[]storage.AccountKey{
+				{KeyName: to.StringPtr(Key1Name), Value: to.StringPtr(s.key.Load().(string)), CreationTime: &date.Time{Time: s.created.Load().(time.Time)}},
+				{KeyName: to.StringPtr("Key2"), Value: to.StringPtr("c2Vjb25kYXJ5")},
+			}}, nil
+		}).
+		AnyTimes()
+	cloud.StorageAccountClient = cl
+	return s, cloud
+}
+
+func TestAccountKeyCache(t *testing.T) {
+	server, cloud := newKeyServer(t)
+	cache := newAccountKeyCache(time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	tests := []struct {
+		testName      string
+		setup         func()
+		account       string
+		expectedKey   string
+		expectedCalls int32
+		expectErr     bool
+	}{
+		{
+			testName:      "Miss",
+			account:       "account1",
+			expectedKey:   "a2V5",
+			expectedCalls: 1,
+		},
+		{
+			testName:      "Hit",
+			setup:         func() { server.key.Store("cm90YXRlZA==") },
+			account:       "account1",
+			expectedKey:   "a2V5",
+			expectedCalls: 1,
+		},
+		{
+			testName:      "Other storage account",
+			account:       "account2",
+			expectedKey:   "cm90YXRlZA==",
+			expectedCalls: 2,
+		},
+		{
+			testName:      "Invalidated",
+			setup:         func() { cache.invalidate("subscription", "rg", "account1") },
+			account:       "account1",
+			expectedKey:   "cm90YXRlZA==",
+			expectedCalls: 3,
+		},
+		{
+			testName:      "Expired",
+			setup:         func() { now = now.Add(2 * time.Minute); server.fail.Store(true) },
+			account:       "account1",
+			expectedCalls: 4,
+			expectErr:     true,
+		},
+		{
+			testName:      "Errors are not cached",
+			setup:         func() { server.fail.Store(false) },
+			account:       "account1",
+			expectedKey:   "cm90YXRlZA==",
+			expectedCalls: 5,
+		},
+	}
+	for _, test := range tests {
+		if test.setup != nil {
+			test.setup()
+		}
+		keys, err := cache.get(context.Background(), cloud, "subscription", "rg", test.account)
+		key := ""
+		if len(keys) > 0 {
+			key = keys[0].value
+		}
+		if (err != nil) != test.expectErr {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectErr, err)
+		}
+		if key != test.expectedKey {
+			t.Errorf("\nTestCase: %s\nExpected Key: %s\nActual Key: %s", test.testName, test.expectedKey, key)
+		}
+		if calls := atomic.LoadInt32(&server.calls); calls != test.expectedCalls {
+			t.Errorf("\nTestCase: %s\nExpected ListKeys Calls: %d\nActual ListKeys Calls: %d", test.testName, test.expectedCalls, calls)
+		}
+	}
+}
+
+func TestAccountKeyCacheSharesConcurrentMisses(t *testing.T) {
+	server, cloud := newKeyServer(t)
+	server.gate = make(chan struct{})
+	// Caching is disabled, concurrent lookups still share a single ListKeys call
+	cache := newAccountKeyCache(0)
+
+	var wg sync.WaitGroup
+	keys := make(chan string, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			accountKeys, err := cache.get(context.Background(), cloud, "subscription", "rg", "account")
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			keys <- accountKeys[0].value
+		}()
+	}
+	// Give every lookup the time to join the call in flight
+	time.Sleep(100 * time.Millisecond)
+	close(server.gate)
+	wg.Wait()
+	close(keys)
+
+	for key := range keys {
+		if key != "a2V5" {
+			t.Errorf("expected every lookup to get the key, got %q", key)
+		}
+	}
+	if calls := atomic.LoadInt32(&server.calls); calls != 1 {
+		t.Errorf("expected concurrent lookups to share 1 ListKeys call, got %d", calls)
+	}
+	if len(cache.keys) != 0 {
+		t.Errorf("expected no key to be cached when caching is disabled, got %v", cache.keys)
+	}
+}
+
+func TestAccountKeyCacheSharedMissOutlivesCancelledLookup(t *testing.T) {
+	server, cloud := newKeyServer(t)
+	server.gate = make(chan struct{})
+	cache := newAccountKeyCache(time.Minute)
+
+	// The lookup starting the ListKeys call is cancelled while another lookup waits for the same call
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	go func() {
+		_, err := cache.get(ctx, cloud, "subscription", "rg", "account")
+		cancelled <- err
+	}()
+	for atomic.LoadInt32(&server.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	waiting := make(chan error)
+	go func() {
+		_, err := cache.get(context.Background(), cloud, "subscription", "rg", "account")
+		waiting <- err
+	}()
+	cancel()
+	if err := <-cancelled; err != context.Canceled {
+		t.Errorf("expected the cancelled lookup to return its context error, got %v", err)
+	}
+
+	close(server.gate)
+	if err := <-waiting; err != nil {
+		t.Errorf("expected the waiting lookup to get the keys, got %v", err)
+	}
+	if calls := atomic.LoadInt32(&server.calls); calls != 1 {
+		t.Errorf("expected the lookups to share 1 ListKeys call, got %d", calls)
+	}
+}
+
+func TestAccountKeyCacheInvalidateDuringFetch(t *testing.T) {
+	server, cloud := newKeyServer(t)
+	cache := newAccountKeyCache(time.Minute)
+	lookup := func() chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := cache.get(context.Background(), cloud, "subscription", "rg", "account")
+			done <- err
+		}()
+		return done
+	}
+	waitForCalls := func(calls int32) {
+		for atomic.LoadInt32(&server.calls) < calls {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Keys invalidated while they are being listed are not cached once listed
+	server.gate = make(chan struct{})
+	fetched := lookup()
+	waitForCalls(1)
+	cache.invalidate("subscription", "rg", "account")
+	close(server.gate)
+	if err := <-fetched; err != nil {
+		t.Errorf("expected the lookup to get the keys, got %v", err)
+	}
+	if len(cache.keys) != 0 {
+		t.Errorf("expected the keys listed before the invalidation not to be cached, got %v", cache.keys)
+	}
+
+	// Lookups made after the invalidation list the keys again rather than share the fetch in flight
+	server.gate = make(chan struct{})
+	fetched = lookup()
+	waitForCalls(2)
+	cache.invalidate("subscription", "rg", "account")
+	refetched := lookup()
+	waitForCalls(3)
+	close(server.gate)
+	if err := <-fetched; err != nil {
+		t.Errorf("expected the lookup to get the keys, got %v", err)
+	}
+	if err := <-refetched; err != nil {
+		t.Errorf("expected the lookup to get the keys, got %v", err)
+	}
+}
+
+func TestAccountKeyCacheObserve(t *testing.T) {
+	server, cloud := newKeyServer(t)
+	cache := newAccountKeyCache(time.Minute)
+	created := server.created.Load().(time.Time)
+	account := func(key1Created time.Time) storage.Account {
+		return storage.Account{
+			Name:              to.StringPtr("account"),
+			AccountProperties: &storage.AccountProperties{KeyCreationTime: &storage.KeyCreationTime{Key1: &date.Time{Time: key1Created}}},
+		}
+	}
+
+	tests := []struct {
+		testName      string
+		account       storage.Account
+		expectedCalls int32
+	}{
+		{
+			testName:      "Keys were not regenerated",
+			account:       account(created),
+			expectedCalls: 1,
+		},
+		{
+			testName:      "Account without key creation times",
+			account:       storage.Account{Name: to.StringPtr("account"), AccountProperties: &storage.AccountProperties{}},
+			expectedCalls: 1,
+		},
+		{
+			testName:      "Keys were regenerated",
+			account:       account(created.Add(time.Hour)),
+			expectedCalls: 2,
+		},
+	}
+	if _, err := cache.get(context.Background(), cloud, "subscription", "rg", "account"); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		cache.observe("subscription", "rg", test.account)
+		if _, err := cache.get(context.Background(), cloud, "subscription", "rg", "account"); err != nil {
+			t.Fatal(err)
+		}
+		if calls := atomic.LoadInt32(&server.calls); calls != test.expectedCalls {
+			t.Errorf("\nTestCase: %s\nExpected ListKeys Calls: %d\nActual ListKeys Calls: %d", test.testName, test.expectedCalls, calls)
+		}
+	}
+}
+
+func TestGetNamedStorageAccountKey(t *testing.T) {
+	_, cloud := newKeyServer(t)
+	tests := []struct {
+		testName     string
+		keyName      string
+		expectedKey  string
+		expectedCode codes.Code
+	}{
+		{
+			testName:    "First key",
+			keyName:     Key1Name,
+			expectedKey: "a2V5",
+		},
+		{
+			testName:    "Key names are case insensitive",
+			keyName:     "KEY2",
+			expectedKey: "c2Vjb25kYXJ5",
+		},
+		{
+			testName:     "Unknown key",
+			keyName:      "key3",
+			expectedCode: codes.FailedPrecondition,
+		},
+	}
+	for _, test := range tests {
+		key, err := getNamedStorageAccountKey(context.Background(), cloud, "subscription", "rg", "account", test.keyName)
+		if status.Code(err) != test.expectedCode {
+			t.Errorf("\nTestCase: %s\nExpected Code: %v\nActual Error: %v", test.testName, test.expectedCode, err)
+		}
+		if key != test.expectedKey {
+			t.Errorf("\nTestCase: %s\nExpected Key: %s\nActual Key: %s", test.testName, test.expectedKey, key)
+		}
+	}
+}
+
+func TestWithStorageAccountKey(t *testing.T) {
+	rejected := &azcore.ResponseError{StatusCode: http.StatusForbidden, ErrorCode: string(bloberror.AuthenticationFailed)}
+	tests := []struct {
+		testName      string
+		results       []error
+		expectedKeys  []string
+		expectedCalls int32
+		expectedErr   error
+	}{
+		{
+			testName:      "Cached key works",
+			results:       []error{nil},
+			expectedKeys:  []string{"a2V5"},
+			expectedCalls: 1,
+		},
+		{
+			testName:      "Rotated key is fetched again",
+			results:       []error{rejected, nil},
+			expectedKeys:  []string{"a2V5", "cm90YXRlZA=="},
+			expectedCalls: 2,
+		},
+		{
+			testName:      "Fetched key is rejected too",
+			results:       []error{rejected, rejected},
+			expectedKeys:  []string{"a2V5", "cm90YXRlZA=="},
+			expectedCalls: 2,
+			expectedErr:   rejected,
+		},
+		{
+			testName:      "Other errors are not retried",
+			results:       []error{fmt.Errorf("container not found")},
+			expectedKeys:  []string{"a2V5"},
+			expectedCalls: 1,
+			expectedErr:   fmt.Errorf("container not found"),
+		},
+	}
+	defer SetAccountKeyCacheTTL(0)
+	for _, test := range tests {
+		SetAccountKeyCacheTTL(time.Minute)
+		server, cloud := newKeyServer(t)
+		var keys []string
+		err := withStorageAccountKey(context.Background(), cloud, "subscription", "rg", "account", func(key string) error {
+			keys = append(keys, key)
+			// The key is rotated once the cached one has been used
+			server.key.Store("cm90YXRlZA==")
+			return test.results[len(keys)-1]
+		})
+		if fmt.Sprint(err) != fmt.Sprint(test.expectedErr) {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectedErr, err)
+		}
+		if fmt.Sprint(keys) != fmt.Sprint(test.expectedKeys) {
+			t.Errorf("\nTestCase: %s\nExpected Keys: %v\nActual Keys: %v", test.testName, test.expectedKeys, keys)
+		}
+		if calls := atomic.LoadInt32(&server.calls); calls != test.expectedCalls {
+			t.Errorf("\nTestCase: %s\nExpected ListKeys Calls: %d\nActual ListKeys Calls: %d", test.testName, test.expectedCalls, calls)
+		}
+	}
+}
+
+func TestAccountKeyCacheSigningKey(t *testing.T) {
+	server, cloud := newKeyServer(t)
+	var propertiesCalls int32
+	cloud.StorageAccountClient.(*mockstorageaccountclient.MockInterface).EXPECT().
+		GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), "account").
+		DoAndReturn(func(context.Context, string, string, string) (storage.Account, *retry.Error) {
+			atomic.AddInt32(&propertiesCalls, 1)
+			return storage.Account{Name: to.StringPtr("account"), Tags: map[string]*string{SigningKeyTag: to.StringPtr("Key2")}}, nil
+		}).
+		AnyTimes()
+	cache := newAccountKeyCache(time.Minute)
+
+	tests := []struct {
+		testName string
+		before   func()
+		// withSigningKey looks the SigningKeyTag up with the keys
+		withSigningKey          bool
+		expectedListKeysCalls   int32
+		expectedPropertiesCalls int32
+	}{
+		{
+			testName:                "Keys without the tag",
+			before:                  func() {},
+			expectedListKeysCalls:   1,
+			expectedPropertiesCalls: 0,
+		},
+		{
+			testName:                "Tag not cached yet",
+			before:                  func() {},
+			withSigningKey:          true,
+			expectedListKeysCalls:   2,
+			expectedPropertiesCalls: 1,
+		},
+		{
+			testName:                "Tag cached with the keys",
+			before:                  func() {},
+			withSigningKey:          true,
+			expectedListKeysCalls:   2,
+			expectedPropertiesCalls: 1,
+		},
+		{
+			testName:                "Keys fetched after the regeneration are kept",
+			before:                  func() { cache.dropFetchedBefore("account", time.Now().Add(-time.Hour)) },
+			withSigningKey:          true,
+			expectedListKeysCalls:   2,
+			expectedPropertiesCalls: 1,
+		},
+		{
+			testName:                "Keys fetched before the regeneration are dropped",
+			before:                  func() { cache.dropFetchedBefore("ACCOUNT", time.Now().Add(time.Second)) },
+			withSigningKey:          true,
+			expectedListKeysCalls:   3,
+			expectedPropertiesCalls: 2,
+		},
+	}
+	for _, test := range tests {
+		test.before()
+		cached, err := cache.lookup(context.Background(), cloud, "subscription", "rg", "account", test.withSigningKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.withSigningKey && (cached.signingKey == nil || *cached.signingKey != Key2Name) {
+			t.Errorf("\nTestCase: %s\nExpected Signing Key: %s\nActual Signing Key: %v", test.testName, Key2Name, cached.signingKey)
+		}
+		if calls := atomic.LoadInt32(&server.calls); calls != test.expectedListKeysCalls {
+			t.Errorf("\nTestCase: %s\nExpected ListKeys Calls: %d\nActual ListKeys Calls: %d", test.testName, test.expectedListKeysCalls, calls)
+		}
+		if calls := atomic.LoadInt32(&propertiesCalls); calls != test.expectedPropertiesCalls {
+			t.Errorf("\nTestCase: %s\nExpected GetProperties Calls: %d\nActual GetProperties Calls: %d", test.testName, test.expectedPropertiesCalls, calls)
+		}
+	}
+}
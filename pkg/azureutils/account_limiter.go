@@ -0,0 +1,90 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// accountRequests bounds the requests working on the same storage account at once. It is unbounded until
+// SetMaxConcurrentRequestsPerAccount is called.
+var accountRequests = newAccountLimiter(0)
+
+// SetMaxConcurrentRequestsPerAccount bounds the number of requests working on the same storage account at once,
+// so that a burst of requests does not get the subscription throttled by ARM. Zero leaves them unbounded.
+func SetMaxConcurrentRequestsPerAccount(limit int) {
+	accountRequests = newAccountLimiter(limit)
+}
+
+type accountLimiter struct {
+	lock  sync.Mutex
+	limit int
+	// slots holds a semaphore for every storage account with requests in flight
+	slots map[string]chan struct{}
+	// users counts the requests holding or waiting for a slot of every storage account
+	users map[string]int
+}
+
+func newAccountLimiter(limit int) *accountLimiter {
+	return &accountLimiter{
+		limit: limit,
+		slots: make(map[string]chan struct{}),
+		users: make(map[string]int),
+	}
+}
+
+// acquire waits for a slot of account until ctx is done, and returns the function releasing it.
+// Requests are not limited when the limiter is unbounded or the account is not known, e.g. because Azure picks its name.
+func (l *accountLimiter) acquire(ctx context.Context, account string) (func(), error) {
+	if l.limit <= 0 || account == "" {
+		return func() {}, nil
+	}
+
+	l.lock.Lock()
+	slots, ok := l.slots[account]
+	if !ok {
+		slots = make(chan struct{}, l.limit)
+		l.slots[account] = slots
+	}
+	l.users[account]++
+	l.lock.Unlock()
+
+	done := func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		l.users[account]--
+		if l.users[account] == 0 {
+			delete(l.users, account)
+			delete(l.slots, account)
+		}
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return func() {
+			<-slots
+			done()
+		}, nil
+	case <-ctx.Done():
+		done()
+		klog.Infof("Rejecting request for storage account %s, %d requests are already working on it", account, l.limit)
+		return nil, status.Error(codes.ResourceExhausted, fmt.Sprintf("Too many concurrent requests for storage account %s", account))
+	}
+}
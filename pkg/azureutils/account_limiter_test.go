@@ -0,0 +1,148 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/golang/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+func TestAccountLimiter(t *testing.T) {
+	limiter := newAccountLimiter(2)
+
+	// Hold both slots of account1
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		release, err := limiter.acquire(context.Background(), "account1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		releases = append(releases, release)
+	}
+
+	tests := []struct {
+		testName     string
+		account      string
+		expectedCode codes.Code
+	}{
+		{
+			testName:     "Storage account at its limit",
+			account:      "account1",
+			expectedCode: codes.ResourceExhausted,
+		},
+		{
+			testName:     "Other storage account",
+			account:      "account2",
+			expectedCode: codes.OK,
+		},
+		{
+			testName:     "Storage account not known",
+			account:      "",
+			expectedCode: codes.OK,
+		},
+	}
+	for _, test := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		release, err := limiter.acquire(ctx, test.account)
+		cancel()
+		if status.Code(err) != test.expectedCode {
+			t.Errorf("\nTestCase: %s\nExpected Code: %v\nActual Error: %v", test.testName, test.expectedCode, err)
+		}
+		if err == nil {
+			release()
+		}
+	}
+
+	// A waiting request gets the slot of the first request to finish
+	waiting := make(chan error)
+	go func() {
+		release, err := limiter.acquire(context.Background(), "account1")
+		if err == nil {
+			release()
+		}
+		waiting <- err
+	}()
+	for _, release := range releases {
+		release()
+	}
+	if err := <-waiting; err != nil {
+		t.Errorf("expected the waiting request to succeed, got %v", err)
+	}
+
+	if len(limiter.slots) != 0 || len(limiter.users) != 0 {
+		t.Errorf("expected the limiter to forget idle storage accounts, got slots %v and users %v", limiter.slots, limiter.users)
+	}
+}
+
+func TestAccountLimiterUnbounded(t *testing.T) {
+	limiter := newAccountLimiter(0)
+	for i := 0; i < 3; i++ {
+		if _, err := limiter.acquire(context.Background(), "account"); err != nil {
+			t.Fatalf("expected an unbounded limiter to never block, got %v", err)
+		}
+	}
+}
+
+func TestGeneratedStorageAccountNamesAreLimited(t *testing.T) {
+	defer func(limiter *accountLimiter) { accountRequests = limiter }(accountRequests)
+	SetMaxConcurrentRequestsPerAccount(1)
+
+	ctrl := gomock.NewController(t)
+	cloud := azure.GetTestCloud(ctrl)
+
+	tests := []struct {
+		testName string
+		create   func(ctx context.Context, bucketName string, parameters *BucketClassParameters) error
+	}{
+		{
+			testName: "Storage account bucket",
+			create: func(ctx context.Context, bucketName string, parameters *BucketClassParameters) error {
+				_, err := createStorageAccountBucket(ctx, bucketName, parameters, cloud)
+				return err
+			},
+		},
+		{
+			testName: "Container bucket in a new storage account",
+			create: func(ctx context.Context, bucketName string, parameters *BucketClassParameters) error {
+				parameters.createStorageAccount = to.BoolPtr(true)
+				_, err := createContainerBucket(ctx, bucketName, parameters, nil, cloud)
+				return err
+			},
+		},
+	}
+	for _, test := range tests {
+		// Hold the only slot of the storage account the driver names after the bucket
+		generated := &BucketClassParameters{resourceGroup: cloud.ResourceGroup}
+		setStorageAccountName("bucket", generated, cloud)
+		release, err := accountRequests.acquire(context.Background(), generated.storageAccountName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		err = test.create(ctx, "bucket", &BucketClassParameters{resourceGroup: cloud.ResourceGroup})
+		cancel()
+		release()
+		if status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("\nTestCase: %s\nExpected Code: %v\nActual Error: %v", test.testName, codes.ResourceExhausted, err)
+		}
+	}
+}
@@ -14,6 +14,7 @@
 package azureutils
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -92,18 +93,7 @@ func GetAzureCloudProvider(
 
 	if az.TenantID == "" || az.SubscriptionID == "" || az.ResourceGroup == "" {
 		klog.Infof("could not read cloud config from secret")
-		credFile, ok := os.LookupEnv(DefaultAzureCredentialFileEnv)
-		if ok && strings.TrimSpace(credFile) != "" {
-			klog.Infof("%s env var set as %v", DefaultAzureCredentialFileEnv, credFile)
-		} else {
-			if runtime.GOOS == "windows" {
-				credFile = DefaultCredFilePathWindows
-			} else {
-				credFile = DefaultCredFilePathLinux
-			}
-
-			klog.Infof("use default %s env var: %v", DefaultAzureCredentialFileEnv, credFile)
-		}
+		credFile := GetAzureCredentialFile()
 
 		f, err := os.Open(credFile)
 		if err != nil {
@@ -124,3 +114,42 @@ func GetAzureCloudProvider(
 	}
 	return az, nil
 }
+
+// GetAzureCredentialFile returns the path of the credential file the cloud config is read from when the secret holds none
+func GetAzureCredentialFile() string {
+	credFile, ok := os.LookupEnv(DefaultAzureCredentialFileEnv)
+	if ok && strings.TrimSpace(credFile) != "" {
+		klog.V(2).Infof("%s env var set as %v", DefaultAzureCredentialFileEnv, credFile)
+		return credFile
+	}
+
+	if runtime.GOOS == "windows" {
+		credFile = DefaultCredFilePathWindows
+	} else {
+		credFile = DefaultCredFilePathLinux
+	}
+	klog.V(2).Infof("use default %s env var: %v", DefaultAzureCredentialFileEnv, credFile)
+	return credFile
+}
+
+// CheckAzureConnectivity checks that the cloud config holds the subscription and resource group
+// and that the storage accounts of the resource group can be listed with the configured credentials
+func CheckAzureConnectivity(ctx context.Context, cloud *azure.Cloud) error {
+	if cloud == nil {
+		return fmt.Errorf("cloud config is not loaded")
+	}
+	if cloud.SubscriptionID == "" || cloud.ResourceGroup == "" {
+		return fmt.Errorf("cloud config is missing the subscription ID or resource group")
+	}
+	if cloud.StorageAccountClient == nil {
+		return fmt.Errorf("StorageAccountClient is nil")
+	}
+
+	reqCtx, req := startAzureRequest(ctx, listStorageAccountsOperation)
+	_, rerr := cloud.StorageAccountClient.ListByResourceGroup(reqCtx, cloud.SubscriptionID, cloud.ResourceGroup)
+	req.endARM(rerr)
+	if rerr != nil {
+		return fmt.Errorf("could not list storage accounts in resource group %s: %v", cloud.ResourceGroup, rerr.Error())
+	}
+	return nil
+}
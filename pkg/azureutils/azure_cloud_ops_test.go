@@ -1,9 +1,18 @@
 package azureutils
 
 import (
+	"context"
+	"fmt"
+	"net/http"
 	"os"
 	"reflect"
 	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
+	"github.com/golang/mock/gomock"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/storageaccountclient/mockstorageaccountclient"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
 )
 
 func createTestFile(path string) error {
@@ -54,3 +63,70 @@ func TestGetAzureCloudProvider(t *testing.T) {
 		}*/
 	}
 }
+
+func TestCheckAzureConnectivity(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tests := []struct {
+		testName    string
+		cloud       func() *azure.Cloud
+		expectedErr error
+	}{
+		{
+			testName:    "Cloud not loaded",
+			cloud:       func() *azure.Cloud { return nil },
+			expectedErr: fmt.Errorf("cloud config is not loaded"),
+		},
+		{
+			testName: "Missing resource group",
+			cloud: func() *azure.Cloud {
+				cloud := azure.GetTestCloud(ctrl)
+				cloud.ResourceGroup = ""
+				return cloud
+			},
+			expectedErr: fmt.Errorf("cloud config is missing the subscription ID or resource group"),
+		},
+		{
+			testName: "Storage Account Client is nil",
+			cloud: func() *azure.Cloud {
+				cloud := azure.GetTestCloud(ctrl)
+				cloud.StorageAccountClient = nil
+				return cloud
+			},
+			expectedErr: fmt.Errorf("StorageAccountClient is nil"),
+		},
+		{
+			testName: "List fails",
+			cloud: func() *azure.Cloud {
+				cloud := azure.GetTestCloud(ctrl)
+				cl := mockstorageaccountclient.NewMockInterface(ctrl)
+				cl.EXPECT().
+					ListByResourceGroup(gomock.Any(), cloud.SubscriptionID, cloud.ResourceGroup).
+					Return(nil, &retry.Error{HTTPStatusCode: http.StatusUnauthorized, RawError: fmt.Errorf("unauthorized")})
+				cloud.StorageAccountClient = cl
+				return cloud
+			},
+			expectedErr: fmt.Errorf("could not list storage accounts in resource group rg: Retriable: false, RetryAfter: 0s, HTTPStatusCode: 401, RawError: unauthorized"),
+		},
+		{
+			testName: "Connected",
+			cloud: func() *azure.Cloud {
+				cloud := azure.GetTestCloud(ctrl)
+				cl := mockstorageaccountclient.NewMockInterface(ctrl)
+				cl.EXPECT().
+					ListByResourceGroup(gomock.Any(), cloud.SubscriptionID, cloud.ResourceGroup).
+					Return([]storage.Account{}, nil)
+				cloud.StorageAccountClient = cl
+				return cloud
+			},
+			expectedErr: nil,
+		},
+	}
+	for _, test := range tests {
+		err := CheckAzureConnectivity(context.Background(), test.cloud())
+		if fmt.Sprint(err) != fmt.Sprint(test.expectedErr) {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectedErr, err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"project/azure-cosi-driver/pkg/metrics"
+	"project/azure-cosi-driver/pkg/tracing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"go.opentelemetry.io/otel/trace"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
+)
+
+// Operation names Azure requests are recorded under
+const (
+	ensureStorageAccountOperation        = "ensure_storage_account"
+	deleteStorageAccountOperation        = "delete_storage_account"
+	getStorageAccountKeyOperation        = "get_storage_account_key"
+	getStorageAccountPropertiesOperation = "get_storage_account_properties"
+	listStorageAccountsOperation         = "list_storage_accounts"
+	checkStorageAccountNameOperation     = "check_storage_account_name"
+	updateStorageAccountOperation        = "update_storage_account"
+	regenerateStorageAccountKeyOperation = "regenerate_storage_account_key"
+	createLocalUserOperation             = "create_local_user"
+	regenerateLocalUserPasswordOperation = "regenerate_local_user_password"
+	deleteLocalUserOperation             = "delete_local_user"
+	createContainerOperation             = "create_container"
+	deleteContainerOperation             = "delete_container"
+	getContainerPropertiesOperation      = "get_container_properties"
+	listContainersOperation              = "list_containers"
+)
+
+// throttledStatus is how a throttled ARM response shows up in the errors returned by azure.Cloud
+var throttledStatus = fmt.Sprintf("HTTPStatusCode: %d", http.StatusTooManyRequests)
+
+// azureRequest tracks a single request to Azure in the metrics and as a span
+type azureRequest struct {
+	operation string
+	span      trace.Span
+	// subscription is the subscription whose ARM rate limit the outcome of the request adapts, empty for data plane requests
+	subscription string
+}
+
+// startAzureRequest starts tracking a request to Azure. The returned context should be passed to the request
+// so that Azure SDK HTTP calls are traced as children of the operation.
+func startAzureRequest(ctx context.Context, operation string) (context.Context, *azureRequest) {
+	ctx, span := tracing.StartSpan(ctx, "azure."+operation)
+	return ctx, &azureRequest{operation: operation, span: span}
+}
+
+// startARMRequest starts tracking an ARM request of the subscription, once the client-side rate limit
+// of the subscription lets it through. codes.ResourceExhausted is returned if it cannot before ctx is done.
+func startARMRequest(ctx context.Context, operation, subscription string) (context.Context, *azureRequest, error) {
+	if err := armRequests.wait(ctx, subscription); err != nil {
+		return ctx, nil, err
+	}
+	ctx, req := startAzureRequest(ctx, operation)
+	req.subscription = subscription
+	return ctx, req, nil
+}
+
+// end records the outcome of a request which returned err
+func (r *azureRequest) end(err error) {
+	metrics.RecordAzureRequest(r.operation, err != nil, isThrottled(err))
+	tracing.EndSpan(r.span, err)
+	if r.subscription != "" {
+		armRequests.observe(r.subscription, err)
+	}
+}
+
+// endARM records the outcome of a request made through a cloud-provider-azure client, which reports errors as *retry.Error
+func (r *azureRequest) endARM(rerr *retry.Error) {
+	metrics.RecordAzureRequest(r.operation, rerr != nil, rerr.IsThrottled())
+	tracing.EndSpan(r.span, rerr.Error())
+	if r.subscription != "" {
+		armRequests.observe(r.subscription, rerr.Error())
+	}
+}
+
+// blobTransportKey is the context key of the HTTP transport blob clients are created with
+type blobTransportKey struct{}
+
+// withBlobTransport returns a context in which blob clients send their requests with transport
+// instead of the default HTTP transport, so that tests can serve and fail blob requests
+func withBlobTransport(ctx context.Context, transport policy.Transporter) context.Context {
+	return context.WithValue(ctx, blobTransportKey{}, transport)
+}
+
+// blobClientOptions returns the options the blob service and container clients of ctx are created with
+func blobClientOptions(ctx context.Context) azcore.ClientOptions {
+	transport, _ := ctx.Value(blobTransportKey{}).(policy.Transporter)
+	return azcore.ClientOptions{
+		PerRetryPolicies: []policy.Policy{tracing.NewAzurePolicy()},
+		Transport:        transport,
+	}
+}
+
+func isThrottled(err error) bool {
+	if err == nil {
+		return false
+	}
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.StatusCode == http.StatusTooManyRequests
+	}
+	return strings.Contains(err.Error(), throttledStatus)
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
+)
+
+func TestIsThrottled(t *testing.T) {
+	tests := []struct {
+		testName string
+		err      error
+		expected bool
+	}{
+		{
+			testName: "No error",
+			err:      nil,
+			expected: false,
+		},
+		{
+			testName: "Blob response throttled",
+			err:      fmt.Errorf("wrapped: %w", &azcore.ResponseError{StatusCode: http.StatusTooManyRequests}),
+			expected: true,
+		},
+		{
+			testName: "Blob response not found",
+			err:      &azcore.ResponseError{StatusCode: http.StatusNotFound},
+			expected: false,
+		},
+		{
+			testName: "ARM error throttled",
+			err:      retry.GetError(&http.Response{StatusCode: http.StatusTooManyRequests}, fmt.Errorf("too many requests")).Error(),
+			expected: true,
+		},
+		{
+			testName: "ARM error not found",
+			err:      retry.GetError(&http.Response{StatusCode: http.StatusNotFound}, fmt.Errorf("not found")).Error(),
+			expected: false,
+		},
+	}
+	for _, test := range tests {
+		if actual := isThrottled(test.err); actual != test.expected {
+			t.Errorf("\nTestCase: %s\nExpected: %v\nActual: %v", test.testName, test.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"project/azure-cosi-driver/pkg/constant"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// DriverConfig holds the cluster-wide defaults and policy of the driver, read from the --config file, e.g.
+//
+//	defaults:
+//	  bucketClass:
+//	    region: eastus
+//	    skuname: Standard_LRS
+//	    storageaccountnametemplate: cosi${cluster.name}
+//	  tags:
+//	    cost-center: storage
+//	policy:
+//	  allowedRegions: [eastus, westus]
+//	  allowedKinds: [StorageV2]
+//	  maxSASLifetime: 24h
+//	  forbiddenSASPermissions: [deleteversion]
+//	  requireHTTPS: true
+//	  allowAccountKeyCredentials: true
+type DriverConfig struct {
+	Defaults DriverDefaults `json:"defaults,omitempty"`
+	Policy   DriverPolicy   `json:"policy,omitempty"`
+}
+
+// DriverDefaults are merged under the parameters of every BucketClass and BucketAccessClass.
+// Parameters set by a class take precedence.
+type DriverDefaults struct {
+	// BucketClass holds default BucketClass parameters, e.g. region, skuname or storageaccountnametemplate
+	BucketClass map[string]string `json:"bucketClass,omitempty"`
+	// BucketAccessClass holds default BucketAccessClass parameters, e.g. validationperiod
+	BucketAccessClass map[string]string `json:"bucketAccessClass,omitempty"`
+	// Tags are added to the storage accounts the driver creates. Tags of the same name set by a BucketClass take precedence.
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// DriverPolicy restricts what BucketClasses and BucketAccessClasses may request.
+// Requests violating it are rejected with codes.PermissionDenied. Empty lists allow any value.
+type DriverPolicy struct {
+	AllowedRegions []string `json:"allowedRegions,omitempty"`
+	// AllowedSKUs restricts the SKU of storage accounts, set by the skuname or storageaccounttype parameter
+	AllowedSKUs  []string `json:"allowedSKUs,omitempty"`
+	AllowedKinds []string `json:"allowedKinds,omitempty"`
+	// MaxSASLifetime caps the validationperiod of SAS tokens. Zero allows any lifetime.
+	// SFTP local users do not expire and are forbidden when it is set.
+	MaxSASLifetime metav1.Duration `json:"maxSASLifetime,omitempty"`
+	// ForbiddenSASPermissions lists the permissions no SAS token nor SFTP local user may grant, see sasPermissions for their names
+	ForbiddenSASPermissions []string `json:"forbiddenSASPermissions,omitempty"`
+	// ForbidAccountSAS rejects SAS tokens scoped to a whole storage account rather than a container
+	ForbidAccountSAS bool `json:"forbidAccountSAS,omitempty"`
+	// RequireHTTPS rejects SAS tokens that can be used over HTTP
+	RequireHTTPS bool `json:"requireHTTPS,omitempty"`
+	// AllowAccountKeyCredentials allows BucketAccessClasses with credentialmode accountkey, which are rejected otherwise.
+	// Account keys give full access to the whole account and never expire, so they are only ever granted on storage
+	// account buckets, and stay rejected when ForbidAccountSAS is set.
+	AllowAccountKeyCredentials bool `json:"allowAccountKeyCredentials,omitempty"`
+}
+
+// sasPermission is a permission a SAS token can grant, and the BucketAccessClass parameter granting it
+type sasPermission struct {
+	parameter string
+	granted   func(*BucketAccessClassParameters) bool
+}
+
+// sasPermissions maps the names used in forbiddenSASPermissions to the permissions.
+// enablepermanentdelete grants the permission to delete blob versions, which removes data for good,
+// so it is forbidden by either deleteversion or permanentdelete.
+var sasPermissions = map[string]sasPermission{
+	"read":            {constant.EnableReadField, func(p *BucketAccessClassParameters) bool { return p.enableRead }},
+	"list":            {constant.EnableListField, func(p *BucketAccessClassParameters) bool { return p.enableList }},
+	"write":           {constant.EnableWriteField, func(p *BucketAccessClassParameters) bool { return p.enableWrite }},
+	"add":             {constant.EnableAddField, func(p *BucketAccessClassParameters) bool { return p.enableAdd }},
+	"delete":          {constant.EnableDeleteField, func(p *BucketAccessClassParameters) bool { return p.enableDelete }},
+	"deleteversion":   {constant.EnablePermanentDeleteField, func(p *BucketAccessClassParameters) bool { return p.enablePermanentDelete }},
+	"permanentdelete": {constant.EnablePermanentDeleteField, func(p *BucketAccessClassParameters) bool { return p.enablePermanentDelete }},
+	"tags":            {constant.EnableTagsField, func(p *BucketAccessClassParameters) bool { return p.enableTags }},
+	"filter":          {constant.EnableFilterField, func(p *BucketAccessClassParameters) bool { return p.enableFilter }},
+}
+
+// driverConfig is the configuration of this driver instance
+var driverConfig = &DriverConfig{}
+
+// SetDriverConfig sets the configuration of this driver instance, nil resets it.
+// It must be called before any bucket is provisioned.
+func SetDriverConfig(config *DriverConfig) {
+	if config == nil {
+		config = &DriverConfig{}
+	}
+	driverConfig = config
+}
+
+// LoadDriverConfig reads and validates the driver configuration file
+func LoadDriverConfig(path string) (*DriverConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading driver config: %v", err)
+	}
+	config := &DriverConfig{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("error parsing driver config %s: %v", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid driver config %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// Validate checks the default parameters against the parameter schemas and the policy, and canonicalizes their names
+func (c *DriverConfig) Validate() error {
+	bucketClassDefaults, err := bucketClassSchema.canonicalize(c.Defaults.BucketClass)
+	if err != nil {
+		return fmt.Errorf("defaults.bucketClass: %s", status.Convert(err).Message())
+	}
+	c.Defaults.BucketClass = bucketClassDefaults
+	if err := checkNameTemplate(bucketClassDefaults[constant.StorageAccountNameTemplateField]); err != nil {
+		return fmt.Errorf("defaults.bucketClass: %s", status.Convert(err).Message())
+	}
+	bucketAccessClassDefaults, err := bucketAccessClassSchema.canonicalize(c.Defaults.BucketAccessClass)
+	if err != nil {
+		return fmt.Errorf("defaults.bucketAccessClass: %s", status.Convert(err).Message())
+	}
+	c.Defaults.BucketAccessClass = bucketAccessClassDefaults
+
+	if c.Policy.MaxSASLifetime.Duration < 0 {
+		return fmt.Errorf("policy.maxSASLifetime must not be negative")
+	}
+	for _, permission := range c.Policy.ForbiddenSASPermissions {
+		if _, ok := sasPermissions[strings.ToLower(permission)]; !ok {
+			return fmt.Errorf("policy.forbiddenSASPermissions: unknown permission %q, known permissions are: %s", permission, strings.Join(getSASPermissionNames(), ", "))
+		}
+	}
+	kindSpec := bucketClassSchema[KindField]
+	for _, kind := range c.Policy.AllowedKinds {
+		if err := kindSpec.validate(KindField, kind); err != nil {
+			return fmt.Errorf("policy.allowedKinds: %s", status.Convert(err).Message())
+		}
+	}
+
+	policyChecks := []struct {
+		field   string
+		allowed []string
+	}{
+		{constant.RegionField, c.Policy.AllowedRegions},
+		{constant.SKUNameField, c.Policy.AllowedSKUs},
+		{StorageAccountTypeField, c.Policy.AllowedSKUs},
+		{KindField, c.Policy.AllowedKinds},
+	}
+	for _, check := range policyChecks {
+		if v, ok := bucketClassDefaults[check.field]; ok && !isAllowed(check.allowed, v) {
+			return fmt.Errorf("defaults.bucketClass.%s %s is not allowed by the policy", check.field, v)
+		}
+	}
+	if len(bucketAccessClassDefaults) > 0 {
+		params, err := newBucketAccessClassParameters(c.bucketAccessClassParameters(bucketAccessClassDefaults))
+		if err != nil {
+			return fmt.Errorf("defaults.bucketAccessClass: %s", status.Convert(err).Message())
+		}
+		check := c.checkSASPolicy
+		switch params.credentialMode {
+		case constant.SFTPCredentialMode:
+			check = c.checkSFTPPolicy
+		case constant.AccountKeyCredentialMode:
+			check = c.checkAccountKeyPolicy
+		}
+		if err := check(params); err != nil {
+			return fmt.Errorf("defaults.bucketAccessClass: %s", status.Convert(err).Message())
+		}
+	}
+	return nil
+}
+
+// bucketClassParameters returns the BucketClass parameters with the default parameters merged under them
+func (c *DriverConfig) bucketClassParameters(parameters map[string]string) map[string]string {
+	return bucketClassSchema.withDefaults(parameters, c.Defaults.BucketClass)
+}
+
+// bucketAccessClassParameters returns the BucketAccessClass parameters with the default parameters merged under them.
+// Without a validationperiod, SAS tokens get the maximum lifetime of the policy if it is shorter than the schema default,
+// and without a signedprotocol they are restricted to HTTPS if the policy requires it.
+func (c *DriverConfig) bucketAccessClassParameters(parameters map[string]string) map[string]string {
+	merged := bucketAccessClassSchema.withDefaults(parameters, c.Defaults.BucketAccessClass)
+	if c.Policy.RequireHTTPS {
+		merged = bucketAccessClassSchema.withDefaults(merged, map[string]string{constant.SignedProtocolField: string(sas.ProtocolHTTPS)})
+	}
+	maxLifetime := c.Policy.MaxSASLifetime.Duration
+	if maxLifetime <= 0 {
+		return merged
+	}
+	defaultPeriod, _ := strconv.ParseInt(bucketAccessClassSchema[constant.ValidationPeriodField].Default, 10, 64)
+	if maxLifetime.Milliseconds() >= defaultPeriod {
+		return merged
+	}
+	return bucketAccessClassSchema.withDefaults(merged, map[string]string{
+		constant.ValidationPeriodField: strconv.FormatInt(maxLifetime.Milliseconds(), 10),
+	})
+}
+
+// withDefaultTags returns the storage account tags with the default tags merged under them
+func (c *DriverConfig) withDefaultTags(tags map[string]string, templateValues TemplateValues) (map[string]string, error) {
+	if len(c.Defaults.Tags) == 0 {
+		return tags, nil
+	}
+	merged, err := expandTemplateMap(c.Defaults.Tags, templateValues)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range tags {
+		merged[k] = v
+	}
+	return merged, nil
+}
+
+// checkBucketClassPolicy rejects a BucketClass whose region, SKU or kind is not allowed.
+// The region falls back to defaultRegion, the region of the cloud config, when the BucketClass does not set one.
+func (c *DriverConfig) checkBucketClassPolicy(params *BucketClassParameters, defaultRegion string) error {
+	region := params.region
+	if region == "" {
+		region = defaultRegion
+	}
+	if !isAllowed(c.Policy.AllowedRegions, region) {
+		return policyViolation("Region", region, c.Policy.AllowedRegions)
+	}
+
+	sku := params.storageAccountType
+	if sku == "" {
+		sku = params.SKUName.String()
+	}
+	if !isAllowed(c.Policy.AllowedSKUs, sku) {
+		return policyViolation("SKU", sku, c.Policy.AllowedSKUs)
+	}
+
+	if kind := params.kind.String(); !isAllowed(c.Policy.AllowedKinds, kind) {
+		return policyViolation("Account kind", kind, c.Policy.AllowedKinds)
+	}
+	return nil
+}
+
+// checkSASPolicy rejects a SAS token whose lifetime, permissions, scope or protocol the policy does not allow
+func (c *DriverConfig) checkSASPolicy(params *BucketAccessClassParameters) error {
+	if maxLifetime := c.Policy.MaxSASLifetime.Duration; maxLifetime > 0 && params.validationPeriod > uint64(maxLifetime.Milliseconds()) {
+		lifetime := time.Duration(params.validationPeriod) * time.Millisecond
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("SAS lifetime %v (%s %d) exceeds the maximum of %v allowed by the driver policy", lifetime, constant.ValidationPeriodField, params.validationPeriod, maxLifetime))
+	}
+
+	for _, name := range c.Policy.ForbiddenSASPermissions {
+		permission := sasPermissions[strings.ToLower(name)]
+		if permission.granted != nil && permission.granted(params) {
+			return status.Error(codes.PermissionDenied, fmt.Sprintf("SAS permission %s is forbidden by the driver policy, set %s to %s", name, permission.parameter, FalseValue))
+		}
+	}
+
+	if c.Policy.ForbidAccountSAS && params.bucketUnitType == constant.StorageAccount {
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("SAS tokens scoped to a whole storage account are forbidden by the driver policy, set %s to %s", constant.BucketUnitTypeField, constant.Container))
+	}
+
+	if c.Policy.RequireHTTPS && params.signedProtocol != sas.ProtocolHTTPS {
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("SAS tokens must be restricted to HTTPS by the driver policy, set %s to %s", constant.SignedProtocolField, sas.ProtocolHTTPS))
+	}
+	return nil
+}
+
+// checkSFTPPolicy rejects SFTP local users granting a permission the policy forbids SAS tokens to grant.
+// Local users do not expire, so they are rejected altogether when the policy caps the lifetime of SAS tokens.
+func (c *DriverConfig) checkSFTPPolicy(params *BucketAccessClassParameters) error {
+	if maxLifetime := c.Policy.MaxSASLifetime.Duration; maxLifetime > 0 {
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("%s %s is forbidden by the driver policy, SFTP local users do not expire but credentials may only be valid for %v", constant.CredentialModeField, constant.SFTPCredentialMode, maxLifetime))
+	}
+
+	for _, name := range c.Policy.ForbiddenSASPermissions {
+		for _, p := range sftpPermissions {
+			if p.name != strings.ToLower(name) {
+				continue
+			}
+			if permission := sasPermissions[p.name]; permission.granted(params) {
+				return status.Error(codes.PermissionDenied, fmt.Sprintf("SFTP permission %s is forbidden by the driver policy, set %s to %s", name, permission.parameter, FalseValue))
+			}
+		}
+	}
+	return nil
+}
+
+// checkAccountKeyPolicy rejects account key credentials unless the policy allows them, and on anything but storage account buckets
+func (c *DriverConfig) checkAccountKeyPolicy(params *BucketAccessClassParameters) error {
+	if !c.Policy.AllowAccountKeyCredentials {
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("%s %s is not allowed by the driver policy", constant.CredentialModeField, constant.AccountKeyCredentialMode))
+	}
+	if c.Policy.ForbidAccountSAS {
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("%s %s is forbidden by the driver policy, which forbids access to whole storage accounts", constant.CredentialModeField, constant.AccountKeyCredentialMode))
+	}
+	if params.bucketUnitType != constant.StorageAccount {
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("%s %s is only allowed by the driver policy with %s %s", constant.CredentialModeField, constant.AccountKeyCredentialMode, constant.BucketUnitTypeField, constant.StorageAccount))
+	}
+	return nil
+}
+
+func getSASPermissionNames() []string {
+	names := make([]string, 0, len(sasPermissions))
+	for name := range sasPermissions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isAllowed returns whether value is in allowed, ignoring case and spaces so that e.g. "East US" matches eastus.
+// An empty list allows any value.
+func isAllowed(allowed []string, value string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	normalize := func(s string) string { return strings.ToLower(strings.ReplaceAll(s, " ", "")) }
+	for _, a := range allowed {
+		if normalize(a) == normalize(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func policyViolation(what, value string, allowed []string) error {
+	if value == "" {
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("%s must be set, the driver policy only allows: %s", what, strings.Join(allowed, ", ")))
+	}
+	return status.Error(codes.PermissionDenied, fmt.Sprintf("%s %s is not allowed by the driver policy, allowed values are: %s", what, value, strings.Join(allowed, ", ")))
+}
@@ -0,0 +1,461 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"project/azure-cosi-driver/pkg/constant"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLoadDriverConfig(t *testing.T) {
+	tests := []struct {
+		testName       string
+		config         string
+		expectedConfig *DriverConfig
+		expectErr      bool
+	}{
+		{
+			testName: "Valid config",
+			config: `
+defaults:
+  bucketClass:
+    Location: eastus
+    skuName: Standard_LRS
+  bucketAccessClass:
+    validationPeriod: "3600000"
+  tags:
+    cost-center: storage
+policy:
+  allowedRegions: [eastus, westus]
+  allowedKinds: [StorageV2]
+  maxSASLifetime: 24h
+`,
+			expectedConfig: &DriverConfig{
+				Defaults: DriverDefaults{
+					BucketClass:       map[string]string{constant.RegionField: "eastus", constant.SKUNameField: "Standard_LRS"},
+					BucketAccessClass: map[string]string{constant.ValidationPeriodField: "3600000"},
+					Tags:              map[string]string{"cost-center": "storage"},
+				},
+				Policy: DriverPolicy{
+					AllowedRegions: []string{"eastus", "westus"},
+					AllowedKinds:   []string{"StorageV2"},
+					MaxSASLifetime: metav1.Duration{Duration: 24 * time.Hour},
+				},
+			},
+		},
+		{
+			testName:  "Unknown field",
+			config:    "policy:\n  allowedZones: [1]\n",
+			expectErr: true,
+		},
+		{
+			testName:  "Unknown default parameter",
+			config:    "defaults:\n  bucketClass:\n    regoin: eastus\n",
+			expectErr: true,
+		},
+		{
+			testName:  "Invalid default parameter",
+			config:    "defaults:\n  bucketClass:\n    kind: Premium\n",
+			expectErr: true,
+		},
+		{
+			testName:  "Default violates policy",
+			config:    "defaults:\n  bucketClass:\n    region: northeurope\npolicy:\n  allowedRegions: [eastus]\n",
+			expectErr: true,
+		},
+		{
+			testName:  "Default SAS lifetime violates policy",
+			config:    "defaults:\n  bucketAccessClass:\n    validationperiod: \"604800000\"\npolicy:\n  maxSASLifetime: 1h\n",
+			expectErr: true,
+		},
+		{
+			testName:  "Invalid allowed kind",
+			config:    "policy:\n  allowedKinds: [Premium]\n",
+			expectErr: true,
+		},
+		{
+			testName:  "Default SAS permission violates policy",
+			config:    "defaults:\n  bucketAccessClass:\n    enabledelete: \"true\"\npolicy:\n  forbiddenSASPermissions: [delete]\n",
+			expectErr: true,
+		},
+		{
+			testName: "Default SAS defaults follow policy",
+			config:   "defaults:\n  bucketAccessClass:\n    enablewrite: \"true\"\npolicy:\n  maxSASLifetime: 1h\n  requireHTTPS: true\n",
+			expectedConfig: &DriverConfig{
+				Defaults: DriverDefaults{BucketClass: map[string]string{}, BucketAccessClass: map[string]string{constant.EnableWriteField: TrueValue}},
+				Policy:   DriverPolicy{MaxSASLifetime: metav1.Duration{Duration: time.Hour}, RequireHTTPS: true},
+			},
+		},
+		{
+			testName:  "Default SFTP permission violates policy",
+			config:    "defaults:\n  bucketAccessClass:\n    credentialmode: sftp\n    enablewrite: \"true\"\npolicy:\n  forbiddenSASPermissions: [write]\n",
+			expectErr: true,
+		},
+		{
+			testName:  "Unknown SAS permission",
+			config:    "policy:\n  forbiddenSASPermissions: [purge]\n",
+			expectErr: true,
+		},
+		{
+			testName:  "Negative SAS lifetime",
+			config:    "policy:\n  maxSASLifetime: -1h\n",
+			expectErr: true,
+		},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(test.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		config, err := LoadDriverConfig(path)
+		if (err != nil) != test.expectErr {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectErr, err)
+		}
+		if err == nil && !reflect.DeepEqual(config, test.expectedConfig) {
+			t.Errorf("\nTestCase: %s\nExpected Config: %+v\nActual Config: %+v", test.testName, test.expectedConfig, config)
+		}
+	}
+
+	if _, err := LoadDriverConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Errorf("expected an error loading a missing config file")
+	}
+}
+
+func TestDriverConfigDefaults(t *testing.T) {
+	SetDriverConfig(&DriverConfig{
+		Defaults: DriverDefaults{
+			BucketClass:       map[string]string{constant.RegionField: "eastus", constant.StorageAccountNameTemplateField: "cosi${bucket.name}"},
+			BucketAccessClass: map[string]string{constant.EnableWriteField: TrueValue},
+			Tags:              map[string]string{"cost-center": "storage", "bucket": "${bucket.name}"},
+		},
+	})
+	defer SetDriverConfig(nil)
+	values := TemplateValues{BucketNamePlaceholder: constant.ValidContainer}
+
+	tests := []struct {
+		testName       string
+		parameters     map[string]string
+		expectedParams BucketClassParameters
+	}{
+		{
+			testName:   "Defaults",
+			parameters: map[string]string{},
+			expectedParams: BucketClassParameters{
+				region:                     "eastus",
+				storageAccountNameTemplate: "cosi" + constant.ValidContainer,
+				tags:                       map[string]string{"cost-center": "storage", "bucket": constant.ValidContainer},
+			},
+		},
+		{
+			testName:   "Parameters override defaults",
+			parameters: map[string]string{"Location": "westus", TagsField: "cost-center=analytics"},
+			expectedParams: BucketClassParameters{
+				region:                     "westus",
+				storageAccountNameTemplate: "cosi" + constant.ValidContainer,
+				tags:                       map[string]string{"cost-center": "analytics", "bucket": constant.ValidContainer},
+			},
+		},
+	}
+	for _, test := range tests {
+		params, err := parseBucketClassParameters(test.parameters, values)
+		if err != nil {
+			t.Errorf("\nTestCase: %s\nUnexpected Error: %v", test.testName, err)
+			continue
+		}
+		if !reflect.DeepEqual(*params, test.expectedParams) {
+			t.Errorf("\nTestCase: %s\nExpected Params: %+v\nActual Params: %+v", test.testName, test.expectedParams, params)
+		}
+	}
+
+	params, err := parseBucketAccessClassParameters(map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !params.enableWrite {
+		t.Errorf("expected the default BucketAccessClass parameters to be applied")
+	}
+}
+
+func TestDriverConfigPolicy(t *testing.T) {
+	SetDriverConfig(&DriverConfig{
+		Policy: DriverPolicy{
+			AllowedRegions: []string{"eastus"},
+			AllowedSKUs:    []string{"Standard_LRS", "Standard_ZRS"},
+			AllowedKinds:   []string{"StorageV2"},
+		},
+	})
+	defer SetDriverConfig(nil)
+
+	bucketClassTests := []struct {
+		testName      string
+		parameters    map[string]string
+		defaultRegion string
+		expectedErr   error
+	}{
+		{
+			testName:   "Allowed",
+			parameters: map[string]string{constant.RegionField: "East US", StorageAccountTypeField: "Standard_ZRS"},
+		},
+		{
+			testName:      "Region of the cloud config",
+			parameters:    map[string]string{},
+			defaultRegion: "westus",
+			expectedErr:   status.Error(codes.PermissionDenied, "Region westus is not allowed by the driver policy, allowed values are: eastus"),
+		},
+		{
+			testName:    "No region",
+			parameters:  map[string]string{},
+			expectedErr: status.Error(codes.PermissionDenied, "Region must be set, the driver policy only allows: eastus"),
+		},
+		{
+			testName:    "SKU",
+			parameters:  map[string]string{constant.RegionField: "eastus", constant.SKUNameField: "Standard_GRS"},
+			expectedErr: status.Error(codes.PermissionDenied, "SKU Standard_GRS is not allowed by the driver policy, allowed values are: Standard_LRS, Standard_ZRS"),
+		},
+		{
+			testName:    "Kind",
+			parameters:  map[string]string{constant.RegionField: "eastus", KindField: "BlobStorage"},
+			expectedErr: status.Error(codes.PermissionDenied, "Account kind BlobStorage is not allowed by the driver policy, allowed values are: StorageV2"),
+		},
+	}
+	for _, test := range bucketClassTests {
+		params, err := parseBucketClassParameters(test.parameters, TemplateValues{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = driverConfig.checkBucketClassPolicy(params, test.defaultRegion)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectedErr, err)
+		}
+	}
+
+	_, err := CreateBucket(context.Background(), constant.ValidContainer, map[string]string{constant.RegionField: "westus"}, TemplateValues{}, nil, nil)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected CreateBucket to fail with PermissionDenied, got %v", err)
+	}
+}
+
+func TestSASPolicy(t *testing.T) {
+	tests := []struct {
+		testName           string
+		policy             DriverPolicy
+		parameters         map[string]string
+		expectedPeriod     uint64
+		expectedCode       codes.Code
+		expectedErrMessage string
+	}{
+		{
+			testName:       "No policy",
+			parameters:     map[string]string{constant.EnablePermanentDeleteField: TrueValue},
+			expectedPeriod: 604800000,
+			expectedCode:   codes.OK,
+		},
+		{
+			testName:       "Lifetime capped to the policy",
+			policy:         DriverPolicy{MaxSASLifetime: metav1.Duration{Duration: time.Hour}},
+			parameters:     map[string]string{},
+			expectedPeriod: 3600000,
+			expectedCode:   codes.OK,
+		},
+		{
+			testName:       "Shorter lifetime",
+			policy:         DriverPolicy{MaxSASLifetime: metav1.Duration{Duration: time.Hour}},
+			parameters:     map[string]string{constant.ValidationPeriodField: "60000"},
+			expectedPeriod: 60000,
+			expectedCode:   codes.OK,
+		},
+		{
+			testName:           "Longer lifetime",
+			policy:             DriverPolicy{MaxSASLifetime: metav1.Duration{Duration: time.Hour}},
+			parameters:         map[string]string{constant.ValidationPeriodField: "31536000000"},
+			expectedCode:       codes.PermissionDenied,
+			expectedErrMessage: "SAS lifetime 8760h0m0s (validationperiod 31536000000) exceeds the maximum of 1h0m0s allowed by the driver policy",
+		},
+		{
+			testName:           "Forbidden permission",
+			policy:             DriverPolicy{ForbiddenSASPermissions: []string{"deleteversion"}},
+			parameters:         map[string]string{constant.EnablePermanentDeleteField: TrueValue},
+			expectedCode:       codes.PermissionDenied,
+			expectedErrMessage: "SAS permission deleteversion is forbidden by the driver policy, set enablepermanentdelete to false",
+		},
+		{
+			testName:       "Forbidden permission not granted",
+			policy:         DriverPolicy{ForbiddenSASPermissions: []string{"PermanentDelete", "delete"}},
+			parameters:     map[string]string{constant.EnableWriteField: TrueValue},
+			expectedPeriod: 604800000,
+			expectedCode:   codes.OK,
+		},
+		{
+			testName:           "Account SAS",
+			policy:             DriverPolicy{ForbidAccountSAS: true},
+			parameters:         map[string]string{constant.BucketUnitTypeField: constant.StorageAccount.String()},
+			expectedCode:       codes.PermissionDenied,
+			expectedErrMessage: "SAS tokens scoped to a whole storage account are forbidden by the driver policy, set bucketunittype to container",
+		},
+		{
+			testName:       "HTTPS by default",
+			policy:         DriverPolicy{RequireHTTPS: true},
+			parameters:     map[string]string{},
+			expectedPeriod: 604800000,
+			expectedCode:   codes.OK,
+		},
+		{
+			testName:           "HTTP",
+			policy:             DriverPolicy{RequireHTTPS: true},
+			parameters:         map[string]string{constant.SignedProtocolField: "https,http"},
+			expectedCode:       codes.PermissionDenied,
+			expectedErrMessage: "SAS tokens must be restricted to HTTPS by the driver policy, set signedprotocol to https",
+		},
+	}
+	defer SetDriverConfig(nil)
+	for _, test := range tests {
+		SetDriverConfig(&DriverConfig{Policy: test.policy})
+		params, err := parseBucketAccessClassParameters(test.parameters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = driverConfig.checkSASPolicy(params)
+		if status.Code(err) != test.expectedCode || (err != nil && status.Convert(err).Message() != test.expectedErrMessage) {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v %s\nActual Error: %v", test.testName, test.expectedCode, test.expectedErrMessage, err)
+		}
+		if err == nil && params.validationPeriod != test.expectedPeriod {
+			t.Errorf("\nTestCase: %s\nExpected Validation Period: %d\nActual Validation Period: %d", test.testName, test.expectedPeriod, params.validationPeriod)
+		}
+
+		// The policy is evaluated before the storage account key is fetched
+		if test.expectedCode != codes.OK {
+			if _, _, err := CreateBucketSASURL(context.Background(), "bucket", test.parameters, nil); status.Code(err) != test.expectedCode {
+				t.Errorf("\nTestCase: %s\nExpected CreateBucketSASURL Code: %v\nActual Error: %v", test.testName, test.expectedCode, err)
+			}
+		}
+	}
+}
+
+func TestSFTPPolicy(t *testing.T) {
+	sftp := map[string]string{constant.CredentialModeField: constant.SFTPCredentialMode, constant.EnableWriteField: TrueValue}
+	tests := []struct {
+		testName           string
+		policy             DriverPolicy
+		expectedCode       codes.Code
+		expectedErrMessage string
+	}{
+		{
+			testName:     "No policy",
+			expectedCode: codes.OK,
+		},
+		{
+			testName:     "Forbidden SAS permission without SFTP equivalent",
+			policy:       DriverPolicy{ForbiddenSASPermissions: []string{"tags", "permanentdelete"}},
+			expectedCode: codes.OK,
+		},
+		{
+			testName:           "Forbidden permission",
+			policy:             DriverPolicy{ForbiddenSASPermissions: []string{"Write"}},
+			expectedCode:       codes.PermissionDenied,
+			expectedErrMessage: "SFTP permission Write is forbidden by the driver policy, set enablewrite to false",
+		},
+		{
+			testName:           "Capped lifetime",
+			policy:             DriverPolicy{MaxSASLifetime: metav1.Duration{Duration: time.Hour}},
+			expectedCode:       codes.PermissionDenied,
+			expectedErrMessage: "credentialmode sftp is forbidden by the driver policy, SFTP local users do not expire but credentials may only be valid for 1h0m0s",
+		},
+	}
+	defer SetDriverConfig(nil)
+	for _, test := range tests {
+		SetDriverConfig(&DriverConfig{Policy: test.policy})
+		params, err := parseBucketAccessClassParameters(sftp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = driverConfig.checkSFTPPolicy(params)
+		if status.Code(err) != test.expectedCode || (err != nil && status.Convert(err).Message() != test.expectedErrMessage) {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v %s\nActual Error: %v", test.testName, test.expectedCode, test.expectedErrMessage, err)
+		}
+
+		// The policy is evaluated before the local user is created
+		if test.expectedCode != codes.OK {
+			if _, err := GrantBucketAccess(context.Background(), "bucket", "ba", sftp, nil); status.Code(err) != test.expectedCode {
+				t.Errorf("\nTestCase: %s\nExpected GrantBucketAccess Code: %v\nActual Error: %v", test.testName, test.expectedCode, err)
+			}
+		}
+	}
+}
+
+func TestAccountKeyPolicy(t *testing.T) {
+	accountKey := map[string]string{constant.CredentialModeField: constant.AccountKeyCredentialMode, constant.BucketUnitTypeField: constant.StorageAccount.String()}
+	tests := []struct {
+		testName           string
+		policy             DriverPolicy
+		parameters         map[string]string
+		expectedCode       codes.Code
+		expectedErrMessage string
+	}{
+		{
+			testName:     "Storage account bucket",
+			policy:       DriverPolicy{AllowAccountKeyCredentials: true},
+			parameters:   accountKey,
+			expectedCode: codes.OK,
+		},
+		{
+			testName:           "Container bucket",
+			policy:             DriverPolicy{AllowAccountKeyCredentials: true},
+			parameters:         map[string]string{constant.CredentialModeField: constant.AccountKeyCredentialMode},
+			expectedCode:       codes.PermissionDenied,
+			expectedErrMessage: "credentialmode accountkey is only allowed by the driver policy with bucketunittype storageaccount",
+		},
+		{
+			testName:           "Account keys not allowed",
+			parameters:         accountKey,
+			expectedCode:       codes.PermissionDenied,
+			expectedErrMessage: "credentialmode accountkey is not allowed by the driver policy",
+		},
+		{
+			testName:           "Account keys allowed with account SAS forbidden",
+			policy:             DriverPolicy{AllowAccountKeyCredentials: true, ForbidAccountSAS: true},
+			parameters:         accountKey,
+			expectedCode:       codes.PermissionDenied,
+			expectedErrMessage: "credentialmode accountkey is forbidden by the driver policy, which forbids access to whole storage accounts",
+		},
+	}
+	defer SetDriverConfig(nil)
+	for _, test := range tests {
+		SetDriverConfig(&DriverConfig{Policy: test.policy})
+		params, err := parseBucketAccessClassParameters(test.parameters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = driverConfig.checkAccountKeyPolicy(params)
+		if status.Code(err) != test.expectedCode || (err != nil && status.Convert(err).Message() != test.expectedErrMessage) {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v %s\nActual Error: %v", test.testName, test.expectedCode, test.expectedErrMessage, err)
+		}
+
+		// The policy is evaluated before the storage account key is fetched
+		if test.expectedCode != codes.OK {
+			if _, err := GrantBucketAccess(context.Background(), "bucket", "ba", test.parameters, nil); status.Code(err) != test.expectedCode {
+				t.Errorf("\nTestCase: %s\nExpected GrantBucketAccess Code: %v\nActual Error: %v", test.testName, test.expectedCode, err)
+			}
+		}
+	}
+}
@@ -17,12 +17,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"project/azure-cosi-driver/pkg/metrics"
+	"project/azure-cosi-driver/pkg/redact"
 	"project/azure-cosi-driver/pkg/types"
 	"regexp"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+	"github.com/Azure/go-autorest/autorest/to"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog"
@@ -37,35 +41,104 @@ var (
 	storageAccountRE = regexp.MustCompile(`https://(.+).blob.core.windows.net/([^/]*)/?(.*)`)
 )
 
+// createContainerBucket ensures the storage account and creates the container of the bucket.
+// Progress is recorded in the journal so that a creation failing or interrupted after the storage
+// account was created is rolled back, or resumed when the same bucket is requested again.
 func createContainerBucket(
 	ctx context.Context,
 	bucketName string,
 	parameters *BucketClassParameters,
+	journal Journal,
 	cloud *azure.Cloud) (string, error) {
-	accOptions := getAccountOptions(parameters)
-	_, key, err := cloud.EnsureStorageAccount(ctx, accOptions, "")
+	containerName, err := getContainerName(bucketName)
 	if err != nil {
-		return "", status.Error(codes.Internal, fmt.Sprintf("Could not ensure storage account %s exists: %v", accOptions.Name, err))
+		return "", err
+	}
+	if journal == nil {
+		journal = noopJournal{}
+	}
+	if parameters.resourceGroup == "" {
+		parameters.resourceGroup = cloud.ResourceGroup
 	}
-	containerParams := make(map[string]string) //NOTE: Container parameters still need to be filled/implemented
 
-	container, err := createAzureContainer(ctx, parameters.storageAccountName, key, bucketName, containerParams)
+	if parameters.storageAccountPoolPrefix != "" {
+		accountName, done, err := storageAccountPools.place(ctx, parameters.storageAccountPoolPrefix, containerName, func(placed map[string]string) (string, error) {
+			return selectPoolAccount(ctx, containerName, parameters, placed, cloud)
+		})
+		if err != nil {
+			return "", err
+		}
+		defer done()
+		parameters.storageAccountName = accountName
+		parameters.createStorageAccount = to.BoolPtr(true)
+	} else if to.Bool(parameters.createStorageAccount) {
+		setStorageAccountName(bucketName, parameters, cloud)
+	}
+	release, err := accountRequests.acquire(ctx, parameters.storageAccountName)
 	if err != nil {
 		return "", err
 	}
+	defer release()
 
-	id := types.BucketID{
-		ResourceGroup: parameters.resourceGroup,
-		URL:           container,
+	subsID := parameters.subscriptionID
+	if subsID == "" {
+		subsID = cloud.SubscriptionID
+	}
+	entry, err := beginJournalEntry(ctx, journal, &JournalEntry{
+		Bucket:         bucketName,
+		SubscriptionID: subsID,
+		ResourceGroup:  parameters.resourceGroup,
+		StorageAccount: parameters.storageAccountName,
+		Container:      containerName,
+	}, to.Bool(parameters.createStorageAccount), cloud)
+	if err != nil {
+		return "", err
+	}
+
+	accOptions := getAccountOptions(parameters)
+	_, key, err := ensureStorageAccount(ctx, bucketName, accOptions, cloud)
+	if isOperationInProgress(err) {
+		// The journal entry stays at this step, the next identical call resumes waiting for the account
+		return "", err
+	}
+	if err != nil {
+		return "", rollbackOnError(ctx, journal, entry, cloud, azureError(err, "Could not ensure storage account %s exists", accOptions.Name))
+	}
+
+	entry.Step = journalStepCreateContainer
+	if err := putJournalEntry(ctx, journal, entry); err != nil {
+		return "", rollbackOnError(ctx, journal, entry, cloud, status.Error(codes.Internal, fmt.Sprintf("Could not record progress of bucket %s: %v", bucketName, err)))
+	}
+
+	containerParams := make(map[string]string)
+	for k, v := range parameters.containerMetadata {
+		containerParams[k] = v
 	}
-	if parameters.subscriptionID != "" {
-		id.SubID = parameters.subscriptionID
-	} else {
-		id.SubID = cloud.SubscriptionID
+	containerParams[BucketNameMetadataKey] = bucketName
+	if driverName != "" {
+		containerParams[DriverNameMetadataKey] = driverName
+	}
+
+	container, created, err := createAzureContainer(ctx, parameters.storageAccountName, key, containerName, containerParams)
+	if err != nil {
+		return "", rollbackOnError(ctx, journal, entry, cloud, err)
+	}
+	entry.ContainerCreated = entry.ContainerCreated || created
+
+	id := types.BucketID{
+		ResourceGroup:      parameters.resourceGroup,
+		URL:                container,
+		StorageAccountPool: parameters.storageAccountPoolPrefix,
+		SubID:              subsID,
 	}
 	base64ID, err := id.Encode()
 	if err != nil {
-		return "", status.Error(codes.InvalidArgument, fmt.Sprintf("could not encode ID: %v", err))
+		return "", rollbackOnError(ctx, journal, entry, cloud, status.Error(codes.InvalidArgument, fmt.Sprintf("could not encode ID: %v", err)))
+	}
+
+	// The bucket is complete once its entry is gone. Until then a retry resumes it and a restart rolls it back.
+	if err := journal.Delete(ctx, bucketName); err != nil {
+		return "", status.Error(codes.Internal, fmt.Sprintf("Could not record completion of bucket %s: %v", bucketName, err))
 	}
 
 	return base64ID, nil
@@ -77,20 +150,19 @@ func DeleteContainerBucket(
 	cloud *azure.Cloud) error {
 	// Get storage account name from bucket url
 	storageAccountName := getStorageAccountNameFromContainerURL(bucketID.URL)
-	// Get access keys for the storage account
-	accessKey, err := cloud.GetStorageAccesskey(ctx, bucketID.SubID, storageAccountName, bucketID.ResourceGroup)
-	if err != nil {
-		return err
-	}
-
 	containerName := getContainerNameFromContainerURL(bucketID.URL)
-	err = deleteAzureContainer(ctx, storageAccountName, accessKey, containerName)
-	if err != nil {
-		return fmt.Errorf("Error deleting container %s in storage account %s : %v", containerName, storageAccountName, err)
+	var deleteErr error
+	err := withStorageAccountKey(ctx, cloud, bucketID.SubID, bucketID.ResourceGroup, storageAccountName, func(accessKey string) error {
+		if err := checkContainerDriverOwner(ctx, storageAccountName, accessKey, containerName); err != nil {
+			return err
+		}
+		deleteErr = deleteAzureContainer(ctx, storageAccountName, accessKey, containerName)
+		return deleteErr
+	})
+	if err != nil && err == deleteErr {
+		return azureError(err, "Could not delete container %s in storage account %s", containerName, storageAccountName)
 	}
-
-	// Now, we check and delete the storage account if its empty
-	return nil
+	return err
 }
 
 func getStorageAccountNameFromContainerURL(containerURL string) string {
@@ -116,17 +188,20 @@ func deleteAzureContainer(
 	storageAccount,
 	accessKey,
 	containerName string) error {
-	containerClient, err := createContainerClient(storageAccount, accessKey, containerName)
+	containerClient, err := createContainerClient(ctx, storageAccount, accessKey, containerName)
 
 	if err != nil {
 		return err
 	}
 
-	_, err = containerClient.Delete(ctx, nil)
+	reqCtx, req := startAzureRequest(ctx, deleteContainerOperation)
+	_, err = containerClient.Delete(reqCtx, nil)
+	req.end(err)
 	return err
 }
 
 func createContainerClient(
+	ctx context.Context,
 	storageAccount string,
 	accessKey string,
 	containerName string) (*container.Client, error) {
@@ -138,7 +213,7 @@ func createContainerClient(
 
 	containerURL := fmt.Sprintf("https://%s.blob.core.windows.net/%s", storageAccount, containerName)
 
-	containerClient, err := container.NewClientWithSharedKeyCredential(containerURL, credential, nil)
+	containerClient, err := container.NewClientWithSharedKeyCredential(containerURL, credential, &container.ClientOptions{ClientOptions: blobClientOptions(ctx)})
 
 	return containerClient, err
 }
@@ -146,7 +221,7 @@ func createContainerClient(
 func parsecontainerurl(containerURL string) (string, string, string, error) {
 	matches := storageAccountRE.FindStringSubmatch(containerURL)
 	if len(matches) < 2 {
-		errStr := fmt.Sprintf("Invalid URL has been passed: %s", containerURL)
+		errStr := fmt.Sprintf("Invalid URL has been passed: %s", redact.String(containerURL))
 		klog.Errorf("Error in parsecontainerurl :: %s", errStr)
 		return "", "", "", errors.New(errStr)
 	}
@@ -165,34 +240,100 @@ func parsecontainerurl(containerURL string) (string, string, string, error) {
 	return storageAccount, containerName, blobName, nil
 }
 
+// createAzureContainer creates the container and returns its URL and whether it was created.
+// An existing container is adopted if it belongs to the same bucket.
 func createAzureContainer(
 	ctx context.Context,
 	storageAccount string,
 	accessKey string,
 	containerName string,
-	parameters map[string]string) (string, error) {
+	parameters map[string]string) (string, bool, error) {
 	if len(storageAccount) == 0 || len(accessKey) == 0 {
-		return "", fmt.Errorf("Invalid storage account or access key")
+		return "", false, fmt.Errorf("Invalid storage account or access key")
 	}
 
-	containerClient, err := createContainerClient(storageAccount, accessKey, containerName)
+	containerClient, err := createContainerClient(ctx, storageAccount, accessKey, containerName)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 
 	// Lets create a container with the containerClient
-	_, err = containerClient.Create(ctx, &container.CreateOptions{
+	reqCtx, req := startAzureRequest(ctx, createContainerOperation)
+	_, err = containerClient.Create(reqCtx, &container.CreateOptions{
 		Metadata: parameters,
 		Access:   nil,
 	})
+	req.end(err)
 	if err != nil {
-		if err.Error() == "ResourceExistsError" {
-			return containerClient.URL(), nil
+		if bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+			if err := checkContainerOwner(ctx, containerClient, parameters); err != nil {
+				return "", false, err
+			}
+			return containerClient.URL(), false, nil
 		}
-		return "", fmt.Errorf("Error creating container from containterURL : %s, Error : %v", containerClient.URL(), err)
+		return "", false, azureError(err, "Could not create container %s", containerClient.URL())
 	}
 
-	return containerClient.URL(), nil
+	return containerClient.URL(), true, nil
+}
+
+// checkContainerOwner rejects an existing container whose metadata does not record the bucket requested.
+// Containers without the metadata were made by hand or by someone else, and are never adopted as the bucket would delete them.
+func checkContainerOwner(
+	ctx context.Context,
+	containerClient *container.Client,
+	metadata map[string]string) error {
+	bucketName, ok := metadata[BucketNameMetadataKey]
+	if !ok {
+		return nil
+	}
+
+	reqCtx, req := startAzureRequest(ctx, getContainerPropertiesOperation)
+	props, err := containerClient.GetProperties(reqCtx, nil)
+	req.end(err)
+	if err != nil {
+		return azureError(err, "Could not get properties of container %s", containerClient.URL())
+	}
+
+	owner, _ := getMetadataValue(props.Metadata, DriverNameMetadataKey)
+	if err := checkDriverOwner("Container "+containerClient.URL(), owner); err != nil {
+		return err
+	}
+	owner, ok = getMetadataValue(props.Metadata, BucketNameMetadataKey)
+	if !ok {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("Container %s already exists and was not created by this driver", containerClient.URL()))
+	}
+	if owner != bucketName {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("Container %s already belongs to bucket %s", containerClient.URL(), owner))
+	}
+	return nil
+}
+
+// checkContainerDriverOwner rejects a container recorded as created by another driver instance
+func checkContainerDriverOwner(
+	ctx context.Context,
+	storageAccount,
+	accessKey,
+	containerName string) error {
+	if driverName == "" {
+		return nil
+	}
+	containerClient, err := createContainerClient(ctx, storageAccount, accessKey, containerName)
+	if err != nil {
+		return err
+	}
+
+	reqCtx, req := startAzureRequest(ctx, getContainerPropertiesOperation)
+	props, err := containerClient.GetProperties(reqCtx, nil)
+	req.end(err)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.ContainerNotFound) {
+			return nil
+		}
+		return azureError(err, "Could not get properties of container %s", containerClient.URL())
+	}
+	owner, _ := getMetadataValue(props.Metadata, DriverNameMetadataKey)
+	return checkDriverOwner("Container "+containerClient.URL(), owner)
 }
 
 func createContainerSASURL(ctx context.Context, bucketID string, parameters *BucketAccessClassParameters, accountKey string) (string, string, error) {
@@ -226,6 +367,7 @@ func createContainerSASURL(ctx context.Context, bucketID string, parameters *Buc
 	if err != nil {
 		return "", "", err
 	}
+	metrics.RecordSASGrant(expiry)
 
 	queryParams := sasQueryParams.Encode()
 	sasURL := fmt.Sprintf("%s?%s", bucketID, queryParams)
@@ -26,9 +26,15 @@ func TestCreateContainerBucket(t *testing.T) {
 		params      *BucketClassParameters
 		expectedErr error
 	}{
+		{
+			testName:    "Invalid bucket name",
+			url:         "--",
+			params:      &BucketClassParameters{storageAccountName: constant.InvalidAccount},
+			expectedErr: status.Error(codes.InvalidArgument, "Could not derive a container name from bucket name \"--\""),
+		},
 		{
 			testName: "Could not ensure account exists",
-			url:      "",
+			url:      constant.ValidContainer,
 			params:   &BucketClassParameters{storageAccountName: constant.InvalidAccount},
 			expectedErr: status.Error(codes.Internal, fmt.Sprintf("Could not ensure storage account %s exists: %v", constant.InvalidAccount,
 				fmt.Errorf("could not get storage key for storage account %s: %w", constant.InvalidAccount,
@@ -43,7 +49,7 @@ func TestCreateContainerBucket(t *testing.T) {
 	cloud.StorageAccountClient = NewMockSAClient(context.Background(), ctrl, "", "", "", &keyList)
 
 	for _, test := range tests {
-		_, err := createContainerBucket(context.Background(), test.url, test.params, cloud)
+		_, err := createContainerBucket(context.Background(), test.url, test.params, nil, cloud)
 		if !reflect.DeepEqual(err, test.expectedErr) {
 			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectedErr, err)
 		}
@@ -75,7 +81,7 @@ func TestDeleteContainerBucket(t *testing.T) {
 				URL:           constant.ValidContainerURL,
 			},
 			clientNil:   false,
-			expectedErr: fmt.Errorf("Error deleting container %s in storage account %s : %v", constant.ValidContainer, constant.ValidAccount, fmt.Errorf("Invalid credentials with error : decode account key: illegal base64 data at input byte 0")),
+			expectedErr: status.Error(codes.Internal, fmt.Sprintf("Could not delete container %s in storage account %s: %v", constant.ValidContainer, constant.ValidAccount, fmt.Errorf("Invalid credentials with error : decode account key: illegal base64 data at input byte 0"))),
 		},
 	}
 
@@ -198,7 +204,7 @@ func TestCreateContainerClient(t *testing.T) {
 		},
 	}
 	for _, test := range tests {
-		client, err := createContainerClient(test.account, test.key, test.container)
+		client, err := createContainerClient(context.Background(), test.account, test.key, test.container)
 		if err != nil {
 			if !reflect.DeepEqual(err, test.expectedErr) {
 				t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectedErr, err)
@@ -277,7 +283,7 @@ func TestCreateAzureContainer(t *testing.T) {
 	}
 	params := make(map[string]string)
 	for _, test := range tests {
-		url, err := createAzureContainer(context.Background(), test.account, test.key, test.container, params)
+		url, _, err := createAzureContainer(context.Background(), test.account, test.key, test.container, params)
 		if !reflect.DeepEqual(err, test.expectedErr) {
 			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectedErr, err)
 		}
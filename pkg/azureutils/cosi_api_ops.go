@@ -3,11 +3,12 @@ package azureutils
 import (
 	"context"
 	"fmt"
-	"net"
 	"strconv"
 	"strings"
 
 	"project/azure-cosi-driver/pkg/constant"
+	"project/azure-cosi-driver/pkg/redact"
+	"project/azure-cosi-driver/pkg/tracing"
 	"project/azure-cosi-driver/pkg/types"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
@@ -22,8 +23,10 @@ type BucketClassParameters struct {
 	bucketUnitType                 constant.BucketUnitType
 	createBucket                   bool
 	createStorageAccount           *bool
+	createStorageAccountSet        bool
 	subscriptionID                 string
 	storageAccountName             string
+	storageAccountNameTemplate     string
 	region                         string
 	accessTier                     constant.AccessTier
 	SKUName                        constant.SKU
@@ -35,6 +38,9 @@ type BucketClassParameters struct {
 	blobDeleteRetentionDays        int
 	enableContainerDeleteRetention bool
 	containerDeleteRetentionDays   int
+	storageAccountPoolPrefix       string
+	maxContainersPerAccount        int
+	containerMetadata              map[string]string
 	//account options
 	storageAccountType        string
 	kind                      constant.Kind
@@ -73,21 +79,51 @@ type BucketAccessClassParameters struct {
 	allowServiceSignedResourceType   bool
 	allowContainerSignedResourceType bool
 	allowObjectSignedResourceType    bool
+	// signingKey is the storage account key the SAS is signed with, key1 or key2.
+	// When empty the key recorded by the SigningKeyTag of the storage account is used.
+	signingKey string
+	// credentialMode is the kind of credentials granted, a SAS when empty, an SFTP local user or the storage account key
+	credentialMode string
+	// sftpAuthentication is how SFTP local users authenticate, with a password when empty or an SSH key
+	sftpAuthentication string
+	// sftpSSHPublicKey is the public key SFTP local users authenticating with an SSH key are authorized with
+	sftpSSHPublicKey string
+	// regenerateKeyOnRevoke regenerates the storage account key granted with credentialmode accountkey when the grant
+	// is revoked, or once the last other grant of that key is, which also revokes every other credential of that key
+	regenerateKeyOnRevoke bool
 }
 
 func CreateBucket(ctx context.Context,
 	bucketName string,
 	parameters map[string]string,
-	cloud *azure.Cloud) (string, error) {
-	bucketClassParams, err := parseBucketClassParameters(parameters)
+	templateValues TemplateValues,
+	journal Journal,
+	cloud *azure.Cloud) (bucketID string, err error) {
+	ctx, span := tracing.StartSpan(ctx, "azureutils.CreateBucket", tracing.BucketNameKey.String(bucketName))
+	defer func() {
+		if err == nil {
+			span.SetAttributes(tracing.BucketIDKey.String(bucketID))
+		}
+		tracing.EndSpan(span, err)
+	}()
+	defer func() { err = toStatus(err) }()
+
+	bucketClassParams, err := parseBucketClassParameters(parameters, templateValues)
 	if err != nil {
-		return "", status.Error(codes.Unknown, fmt.Sprintf("Error parsing parameters : %v", err))
+		return "", err
+	}
+	defaultRegion := ""
+	if cloud != nil {
+		defaultRegion = cloud.Location
+	}
+	if err := driverConfig.checkBucketClassPolicy(bucketClassParams, defaultRegion); err != nil {
+		return "", err
 	}
 
 	switch bucketClassParams.bucketUnitType {
 	case constant.Container:
 		klog.Info("Creating a container")
-		return createContainerBucket(ctx, bucketName, bucketClassParams, cloud)
+		return createContainerBucket(ctx, bucketName, bucketClassParams, journal, cloud)
 	case constant.StorageAccount:
 		klog.Info("Creating a storage account")
 		return createStorageAccountBucket(ctx, bucketName, bucketClassParams, cloud)
@@ -97,7 +133,11 @@ func CreateBucket(ctx context.Context,
 
 func DeleteBucket(ctx context.Context,
 	bucketID string,
-	cloud *azure.Cloud) error {
+	cloud *azure.Cloud) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "azureutils.DeleteBucket", tracing.BucketIDKey.String(bucketID))
+	defer func() { tracing.EndSpan(span, err) }()
+	defer func() { err = toStatus(err) }()
+
 	//decode bucketID
 	klog.Info("Decoding bucketID from base64 string to BucketID struct")
 	id, err := types.DecodeToBucketID(bucketID)
@@ -109,7 +149,7 @@ func DeleteBucket(ctx context.Context,
 	klog.Info("Parsing Bucket URL")
 	account, container, blob, err := parsecontainerurl(id.URL)
 	if err != nil {
-		klog.Errorf("Error: %v parsing url: %s", err, id.URL)
+		klog.Errorf("Error: %s parsing url: %s", redact.Error(err), redact.String(id.URL))
 		return err
 	}
 	klog.Infof("Values from URL. Account: %s, Container: %s, Blob: %s", account, container, blob)
@@ -119,6 +159,11 @@ func DeleteBucket(ctx context.Context,
 	if blob != "" {
 		return status.Error(codes.InvalidArgument, "Individual Blobs unsupported. Please use Blob Containers or Storage Accounts instead.")
 	}
+	release, err := accountRequests.acquire(ctx, account)
+	if err != nil {
+		return err
+	}
+	defer release()
 
 	if container == "" { //container not present, deleting storage account
 		klog.Info("Deleting bucket of type storage account")
@@ -130,12 +175,121 @@ func DeleteBucket(ctx context.Context,
 	return err
 }
 
+// GetBucketUnitType returns whether the bucket is a container or a storage account
+func GetBucketUnitType(bucketID string) (constant.BucketUnitType, error) {
+	id, err := types.DecodeToBucketID(bucketID)
+	if err != nil {
+		return 0, err
+	}
+
+	_, container, _, err := parsecontainerurl(id.URL)
+	if err != nil {
+		return 0, err
+	}
+	if container == "" {
+		return constant.StorageAccount, nil
+	}
+	return constant.Container, nil
+}
+
+// GetStorageAccountName returns the name of the storage account holding the bucket, or "" if bucketID is invalid
+func GetStorageAccountName(bucketID string) string {
+	id, err := types.DecodeToBucketID(bucketID)
+	if err != nil {
+		return ""
+	}
+	return getStorageAccountNameFromContainerURL(id.URL)
+}
+
+// GrantBucketAccess grants the account name access to the bucket and returns the secrets of its credentials:
+// a SAS URL, an SFTP local user for BucketAccessClasses with credentialmode sftp, or the storage account key
+// for BucketAccessClasses with credentialmode accountkey
+func GrantBucketAccess(ctx context.Context, bucketID, accountName string, parameters map[string]string, cloud *azure.Cloud) (secrets map[string]string, err error) {
+	ctx, span := tracing.StartSpan(ctx, "azureutils.GrantBucketAccess", tracing.BucketIDKey.String(bucketID))
+	defer func() { tracing.EndSpan(span, err) }()
+	defer func() { err = toStatus(err) }()
+
+	bucketAccessClassParams, err := parseBucketAccessClassParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+	release, err := accountRequests.acquire(ctx, GetStorageAccountName(bucketID))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	switch bucketAccessClassParams.credentialMode {
+	case constant.SFTPCredentialMode:
+		if err := driverConfig.checkSFTPPolicy(bucketAccessClassParams); err != nil {
+			klog.Infof("Denying SFTP local user for bucket %s: %v", bucketID, err)
+			return nil, err
+		}
+		klog.Info("Creating an SFTP local user")
+		return createSFTPLocalUser(ctx, bucketID, accountName, bucketAccessClassParams, cloud)
+	case constant.AccountKeyCredentialMode:
+		if err := driverConfig.checkAccountKeyPolicy(bucketAccessClassParams); err != nil {
+			klog.Infof("Denying account key for bucket %s: %v", bucketID, err)
+			return nil, err
+		}
+		klog.Info("Granting the storage account key")
+		return grantAccountKey(ctx, bucketID, accountName, bucketAccessClassParams, cloud)
+	}
+
+	sasURL, _, err := createBucketSASURL(ctx, bucketID, parameters, cloud)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{constant.AccessToken: sasURL}, nil
+}
+
+// RevokeBucketAccess revokes the access of the account name to the bucket. SFTP local users of grants recorded on the
+// storage account are deleted, and the storage account key of account key grants is regenerated if the grant asked for it.
+// SAS URLs cannot be revoked and stay valid until they expire.
+func RevokeBucketAccess(ctx context.Context, bucketID, accountName string, cloud *azure.Cloud) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "azureutils.RevokeBucketAccess", tracing.BucketIDKey.String(bucketID))
+	defer func() { tracing.EndSpan(span, err) }()
+	defer func() { err = toStatus(err) }()
+
+	// Nothing was granted on buckets this driver did not create. SFTP local users are only granted on containers,
+	// account keys only on storage account buckets.
+	id, err := types.DecodeToBucketID(bucketID)
+	if err != nil {
+		klog.Infof("Nothing to revoke on bucket %s, it is not a bucket of this driver: %v", bucketID, err)
+		return nil
+	}
+	release, err := accountRequests.acquire(ctx, getStorageAccountNameFromContainerURL(id.URL))
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if getContainerNameFromContainerURL(id.URL) == "" {
+		return revokeAccountKey(ctx, id, accountName, cloud)
+	}
+	return deleteSFTPLocalUser(ctx, id, accountName, cloud)
+}
+
 // creates bucketSASURL and returns (SASURL, accountID, err)
-func CreateBucketSASURL(ctx context.Context, bucketID string, parameters map[string]string, cloud *azure.Cloud) (string, string, error) {
+func CreateBucketSASURL(ctx context.Context, bucketID string, parameters map[string]string, cloud *azure.Cloud) (sasURL string, accountID string, err error) {
+	ctx, span := tracing.StartSpan(ctx, "azureutils.CreateBucketSASURL", tracing.BucketIDKey.String(bucketID))
+	defer func() { tracing.EndSpan(span, err) }()
+	defer func() { err = toStatus(err) }()
+
+	return createBucketSASURL(ctx, bucketID, parameters, cloud)
+}
+
+// createBucketSASURL creates a bucket SAS URL signed with the storage account key of the signingkey parameter,
+// or the key recorded by the SigningKeyTag of the storage account, and the first key of the account when neither is set.
+func createBucketSASURL(ctx context.Context, bucketID string, parameters map[string]string, cloud *azure.Cloud) (string, string, error) {
 	bucketAccessClassParams, err := parseBucketAccessClassParameters(parameters)
 	if err != nil {
 		return "", "", err
 	}
+	if err := driverConfig.checkSASPolicy(bucketAccessClassParams); err != nil {
+		klog.Infof("Denying SAS for bucket %s: %v", bucketID, err)
+		return "", "", err
+	}
 
 	id, err := types.DecodeToBucketID(bucketID)
 	if err != nil {
@@ -147,10 +301,11 @@ func CreateBucketSASURL(ctx context.Context, bucketID string, parameters map[str
 	subsID := id.SubID
 	resourceGroup := id.ResourceGroup
 
-	key, err := cloud.GetStorageAccesskey(ctx, subsID, storageAccountName, resourceGroup)
+	signingKey, err := getSigningAccountKey(ctx, cloud, subsID, resourceGroup, storageAccountName, bucketAccessClassParams.signingKey)
 	if err != nil {
 		return "", "", err
 	}
+	key := signingKey.value
 
 	switch bucketAccessClassParams.bucketUnitType {
 	case constant.Container:
@@ -163,189 +318,139 @@ func CreateBucketSASURL(ctx context.Context, bucketID string, parameters map[str
 	return "", "", status.Error(codes.InvalidArgument, "invalid bucket type")
 }
 
-func parseBucketClassParameters(parameters map[string]string) (*BucketClassParameters, error) {
+// parseBucketClassParameters parses the BucketClass parameters, with the defaults of the driver config merged under them.
+// Placeholders in tags, container metadata and the storage account name template are expanded with templateValues.
+func parseBucketClassParameters(parameters map[string]string, templateValues TemplateValues) (*BucketClassParameters, error) {
+	parameters, err := bucketClassSchema.normalize(driverConfig.bucketClassParameters(parameters))
+	if err != nil {
+		return nil, err
+	}
+
 	BCParams := &BucketClassParameters{}
 	for k, v := range parameters {
 		switch strings.ToLower(k) {
 		case constant.BucketUnitTypeField:
-			//determine unit type and set to container as default if blank
-			switch strings.ToLower(v) {
-			case constant.Container.String(), "":
-				BCParams.bucketUnitType = constant.Container
-			case constant.StorageAccount.String():
-				BCParams.bucketUnitType = constant.StorageAccount
-			default:
-				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid BucketUnitType %s", v))
-			}
+			BCParams.bucketUnitType = parseEnum(bucketUnitTypes, v)
 		case constant.CreateBucketField:
-			if strings.EqualFold(v, TrueValue) {
-				BCParams.createBucket = true
-			} else {
-				BCParams.createBucket = false
-			}
+			BCParams.createBucket = strings.EqualFold(v, TrueValue)
 		case constant.CreateStorageAccountField:
-			if strings.EqualFold(v, TrueValue) {
-				BCParams.createStorageAccount = to.BoolPtr(true)
-			} else if strings.EqualFold(v, FalseValue) {
-				BCParams.createStorageAccount = to.BoolPtr(false)
-			}
+			BCParams.createStorageAccount = to.BoolPtr(strings.EqualFold(v, TrueValue))
+			BCParams.createStorageAccountSet = true
 		case constant.SubscriptionIDField:
 			BCParams.subscriptionID = v
 		case constant.StorageAccountNameField:
+			if !isValidStorageAccountName(v) {
+				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid storage account name %s, must be 3-24 lowercase letters and numbers", v))
+			}
 			BCParams.storageAccountName = v
+		case constant.StorageAccountNameTemplateField:
+			template, err := expandNameTemplate(v, templateValues)
+			if err != nil {
+				return nil, err
+			}
+			BCParams.storageAccountNameTemplate = template
 		case constant.RegionField:
 			BCParams.region = v
 		case constant.AccessTierField:
-			switch strings.ToLower(v) {
-			case constant.Hot.String():
-				BCParams.accessTier = constant.Hot
-			case constant.Cool.String():
-				BCParams.accessTier = constant.Cool
-			case constant.Archive.String():
-				BCParams.accessTier = constant.Archive
-			default:
-				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Access Tier %s is unsupported", v))
-			}
+			BCParams.accessTier = parseEnum(accessTiers, v)
 		case constant.SKUNameField:
-			switch strings.ToLower(v) {
-			case strings.ToLower(constant.StandardLRS.String()):
-				BCParams.SKUName = constant.StandardLRS
-			case strings.ToLower(constant.StandardGRS.String()):
-				BCParams.SKUName = constant.StandardGRS
-			case strings.ToLower(constant.StandardRAGRS.String()):
-				BCParams.SKUName = constant.StandardRAGRS
-			case strings.ToLower(constant.PremiumLRS.String()):
-				BCParams.SKUName = constant.PremiumLRS
-			default:
-				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Access Tier %s is unsupported", v))
-			}
+			BCParams.SKUName = parseEnum(skuNames, v)
 		case constant.ResourceGroupField:
 			BCParams.resourceGroup = v
 		case constant.AllowBlobAccessField:
-			if strings.EqualFold(v, TrueValue) {
-				BCParams.allowBlobAccess = true
-			} else {
-				BCParams.allowBlobAccess = false
-			}
+			BCParams.allowBlobAccess = strings.EqualFold(v, TrueValue)
 		case constant.AllowSharedAccessKeyField:
-			if strings.EqualFold(v, TrueValue) {
-				BCParams.allowSharedAccessKey = true
-			} else {
-				BCParams.allowSharedAccessKey = false
-			}
+			BCParams.allowSharedAccessKey = strings.EqualFold(v, TrueValue)
 		case constant.EnableBlobVersioningField:
-			if strings.EqualFold(v, TrueValue) {
-				BCParams.enableBlobVersioning = true
-			} else {
-				BCParams.enableBlobVersioning = false
-			}
+			BCParams.enableBlobVersioning = strings.EqualFold(v, TrueValue)
 		case constant.EnableBlobDeleteRetentionField:
-			if strings.EqualFold(v, TrueValue) {
-				BCParams.enableBlobDeleteRetention = true
-			} else {
-				BCParams.enableBlobDeleteRetention = false
-			}
+			BCParams.enableBlobDeleteRetention = strings.EqualFold(v, TrueValue)
 		case constant.BlobDeleteRetentionDaysField:
-			days, err := strconv.Atoi(v)
-			if err != nil {
-				return nil, status.Error(codes.InvalidArgument, err.Error())
-			}
-			BCParams.blobDeleteRetentionDays = days
+			// integers are validated by the schema
+			BCParams.blobDeleteRetentionDays, _ = strconv.Atoi(v)
 		case constant.EnableContainerDeleteRetentionField:
-			if strings.EqualFold(v, TrueValue) {
-				BCParams.enableContainerDeleteRetention = true
-			} else {
-				BCParams.enableContainerDeleteRetention = false
-			}
+			BCParams.enableContainerDeleteRetention = strings.EqualFold(v, TrueValue)
 		case constant.ContainerDeleteRetentionDaysField:
-			days, err := strconv.Atoi(v)
+			BCParams.containerDeleteRetentionDays, _ = strconv.Atoi(v)
+		case constant.StorageAccountPoolPrefixField:
+			BCParams.storageAccountPoolPrefix = v
+		case constant.MaxContainersPerAccountField:
+			maxContainers, _ := strconv.Atoi(v)
+			if maxContainers <= 0 {
+				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%s must be greater than 0", constant.MaxContainersPerAccountField))
+			}
+			BCParams.maxContainersPerAccount = maxContainers
+		case constant.ContainerMetadataField:
+			metadata, err := ConvertTagsToMap(v)
 			if err != nil {
 				return nil, status.Error(codes.InvalidArgument, err.Error())
 			}
-			BCParams.containerDeleteRetentionDays = days
+			BCParams.containerMetadata, err = expandTemplateMap(metadata, templateValues)
+			if err != nil {
+				return nil, err
+			}
 		case StorageAccountTypeField: //Account Options Variables
 			BCParams.storageAccountType = v
 		case KindField:
-			switch strings.ToLower(v) {
-			case strings.ToLower(constant.StorageV2.String()):
-				BCParams.kind = constant.StorageV2
-			case strings.ToLower(constant.Storage.String()):
-				BCParams.kind = constant.Storage
-			case strings.ToLower(constant.BlobStorage.String()):
-				BCParams.kind = constant.BlobStorage
-			case strings.ToLower(constant.BlockBlobStorage.String()):
-				BCParams.kind = constant.BlockBlobStorage
-			case strings.ToLower(constant.FileStorage.String()):
-				BCParams.kind = constant.FileStorage
-			default:
-				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Account Kind %s is unsupported", v))
-			}
+			BCParams.kind = parseEnum(kinds, v)
 		case TagsField:
 			tags, err := ConvertTagsToMap(v)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			BCParams.tags, err = expandTemplateMap(tags, templateValues)
 			if err != nil {
 				return nil, err
 			}
-			BCParams.tags = tags
 		case VNResourceIdsField:
 			BCParams.virtualNetworkResourceIDs = strings.Split(v, TagsDelimiter)
 		case HTTPSTrafficOnlyField:
-			if strings.EqualFold(v, TrueValue) {
-				BCParams.enableHTTPSTrafficOnly = true
-			}
+			BCParams.enableHTTPSTrafficOnly = strings.EqualFold(v, TrueValue)
 		case CreatePrivateEndpointField:
-			if strings.EqualFold(v, TrueValue) {
-				BCParams.createPrivateEndpoint = true
-			}
+			BCParams.createPrivateEndpoint = strings.EqualFold(v, TrueValue)
 		case HNSEnabledField:
-			if strings.EqualFold(v, TrueValue) {
-				BCParams.isHnsEnabled = true
-			}
+			BCParams.isHnsEnabled = strings.EqualFold(v, TrueValue)
 		case EnableNFSV3Field:
-			if strings.EqualFold(v, TrueValue) {
-				BCParams.enableNfsV3 = true
-			}
+			BCParams.enableNfsV3 = strings.EqualFold(v, TrueValue)
 		case EnableLargeFileSharesField:
-			if strings.EqualFold(v, TrueValue) {
-				BCParams.enableLargeFileShare = true
-			}
+			BCParams.enableLargeFileShare = strings.EqualFold(v, TrueValue)
 		}
 	}
 
+	BCParams.tags, err = driverConfig.withDefaultTags(BCParams.tags, templateValues)
+	if err != nil {
+		return nil, err
+	}
+
 	// If the unit type of bucket is StorageAccount and the create storage account is not set,
 	// We will create a storage account if not present.
 	if BCParams.bucketUnitType == constant.StorageAccount && BCParams.createStorageAccount == nil {
 		BCParams.createStorageAccount = to.BoolPtr(true)
 	}
 
+	if err := validateStorageAccountPoolParameters(BCParams); err != nil {
+		return nil, err
+	}
+
 	return BCParams, nil
 }
 
 func parseBucketAccessClassParameters(parameters map[string]string) (*BucketAccessClassParameters, error) {
-	//defaults
-	// validation period default = one week
-	BACParams := &BucketAccessClassParameters{
-		validationPeriod:                 604800000,
-		signedProtocol:                   sas.ProtocolHTTPSandHTTP,
-		enableRead:                       true,
-		enableList:                       true,
-		allowServiceSignedResourceType:   true,
-		allowContainerSignedResourceType: true,
-		allowObjectSignedResourceType:    true,
+	// defaults are applied by the driver config, then by the schema
+	parameters, err := bucketAccessClassSchema.normalize(driverConfig.bucketAccessClassParameters(parameters))
+	if err != nil {
+		return nil, err
 	}
+	return newBucketAccessClassParameters(parameters)
+}
+
+// newBucketAccessClassParameters parses BucketAccessClass parameters already validated against the schema
+func newBucketAccessClassParameters(parameters map[string]string) (*BucketAccessClassParameters, error) {
+	BACParams := &BucketAccessClassParameters{}
 	for k, v := range parameters {
 		switch strings.ToLower(k) {
 		case constant.BucketUnitTypeField:
-			//determine unit type and set to container as default if blank
-			switch strings.ToLower(v) {
-			case "container":
-				BACParams.bucketUnitType = constant.Container
-			case "":
-				BACParams.bucketUnitType = constant.Container
-			case "storageaccount":
-				BACParams.bucketUnitType = constant.StorageAccount
-			default:
-				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid BucketUnitType %s", v))
-			}
+			BACParams.bucketUnitType = parseEnum(bucketUnitTypes, v)
 		case constant.StorageAccountNameField:
 			BACParams.storageAccountName = v
 		case constant.RegionField:
@@ -353,108 +458,58 @@ func parseBucketAccessClassParameters(parameters map[string]string) (*BucketAcce
 		case constant.SignedVersionField:
 			BACParams.signedversion = v
 		case constant.SignedProtocolField:
-			switch v {
-			case string(sas.ProtocolHTTPS):
-				BACParams.signedProtocol = sas.ProtocolHTTPS
-			case string(sas.ProtocolHTTPSandHTTP):
-				BACParams.signedProtocol = sas.ProtocolHTTPSandHTTP
+			protocol, err := parseSignedProtocol(v)
+			if err != nil {
+				return nil, err
 			}
-			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid SAS Protocol %s", v))
+			BACParams.signedProtocol = protocol
 		case constant.SignedIPField:
-			iplist := strings.Split(v, "-")
-			switch len(iplist) {
-			case 1:
-				start := net.ParseIP(iplist[0])
-				if start == nil {
-					klog.Warning(fmt.Sprintf("IP %s is an invalid ip, no range will be set", iplist[0]))
-				}
-				BACParams.signedIP = sas.IPRange{Start: start}
-			case 2:
-				start := net.ParseIP(iplist[0])
-				end := net.ParseIP(iplist[1])
-				if start == nil {
-					klog.Warning(fmt.Sprintf("IP %s is an invalid ip, no range will be set", iplist[0]))
-				}
-				if end == nil {
-					klog.Warning(fmt.Sprintf("IP %s is an invalid ip, no end to the range will be set", iplist[0]))
-				}
-				BACParams.signedIP = sas.IPRange{Start: start, End: end}
-			}
-			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid IP Range %s, Must be formatted as <ip> or <ip1>-<ip2>", v))
-		case constant.ValidationPeriodField:
-			msec, err := strconv.ParseUint(v, 10, 64)
+			ipRange, err := parseSignedIPRange(v)
 			if err != nil {
-				return nil, status.Error(codes.InvalidArgument, err.Error())
+				return nil, err
 			}
-			BACParams.validationPeriod = msec
+			BACParams.signedIP = ipRange
+		case constant.ValidationPeriodField:
+			// integers are validated by the schema
+			BACParams.validationPeriod, _ = strconv.ParseUint(v, 10, 64)
 		case constant.EnableListField:
-			if strings.EqualFold(v, TrueValue) {
-				BACParams.enableList = true
-			} else if strings.EqualFold(v, FalseValue) {
-				BACParams.enableList = false
-			}
+			BACParams.enableList = strings.EqualFold(v, TrueValue)
 		case constant.EnableReadField:
-			if strings.EqualFold(v, TrueValue) {
-				BACParams.enableRead = true
-			} else if strings.EqualFold(v, FalseValue) {
-				BACParams.enableRead = false
-			}
+			BACParams.enableRead = strings.EqualFold(v, TrueValue)
 		case constant.EnableWriteField:
-			if strings.EqualFold(v, TrueValue) {
-				BACParams.enableWrite = true
-			} else if strings.EqualFold(v, FalseValue) {
-				BACParams.enableWrite = false
-			}
+			BACParams.enableWrite = strings.EqualFold(v, TrueValue)
 		case constant.EnableDeleteField:
-			if strings.EqualFold(v, TrueValue) {
-				BACParams.enableDelete = true
-			} else if strings.EqualFold(v, FalseValue) {
-				BACParams.enableDelete = false
-			}
+			BACParams.enableDelete = strings.EqualFold(v, TrueValue)
 		case constant.EnablePermanentDeleteField:
-			if strings.EqualFold(v, TrueValue) {
-				BACParams.enablePermanentDelete = true
-			} else if strings.EqualFold(v, FalseValue) {
-				BACParams.enablePermanentDelete = false
-			}
+			BACParams.enablePermanentDelete = strings.EqualFold(v, TrueValue)
 		case constant.EnableAddField:
-			if strings.EqualFold(v, TrueValue) {
-				BACParams.enableAdd = true
-			} else if strings.EqualFold(v, FalseValue) {
-				BACParams.enableAdd = false
-			}
+			BACParams.enableAdd = strings.EqualFold(v, TrueValue)
 		case constant.EnableTagsField:
-			if strings.EqualFold(v, TrueValue) {
-				BACParams.enableTags = true
-			} else if strings.EqualFold(v, FalseValue) {
-				BACParams.enableTags = false
-			}
+			BACParams.enableTags = strings.EqualFold(v, TrueValue)
 		case constant.EnableFilterField:
-			if strings.EqualFold(v, TrueValue) {
-				BACParams.enableFilter = true
-			} else if strings.EqualFold(v, FalseValue) {
-				BACParams.enableFilter = false
-			}
+			BACParams.enableFilter = strings.EqualFold(v, TrueValue)
 		case constant.AllowServiceSignedResourceTypeField:
-			if strings.EqualFold(v, TrueValue) {
-				BACParams.allowServiceSignedResourceType = true
-			} else if strings.EqualFold(v, FalseValue) {
-				BACParams.allowServiceSignedResourceType = false
-			}
+			BACParams.allowServiceSignedResourceType = strings.EqualFold(v, TrueValue)
 		case constant.AllowContainerSignedResourceTypeField:
-			if strings.EqualFold(v, TrueValue) {
-				BACParams.allowObjectSignedResourceType = true
-			} else if strings.EqualFold(v, FalseValue) {
-				BACParams.allowObjectSignedResourceType = false
-			}
+			BACParams.allowContainerSignedResourceType = strings.EqualFold(v, TrueValue)
 		case constant.AllowObjectSignedResourceTypeField:
-			if strings.EqualFold(v, TrueValue) {
-				BACParams.allowObjectSignedResourceType = true
-			} else if strings.EqualFold(v, FalseValue) {
-				BACParams.allowObjectSignedResourceType = false
-			}
+			BACParams.allowObjectSignedResourceType = strings.EqualFold(v, TrueValue)
+		case constant.SigningKeyField:
+			BACParams.signingKey = strings.ToLower(v)
+		case constant.CredentialModeField:
+			BACParams.credentialMode = strings.ToLower(v)
+		case constant.SFTPAuthenticationField:
+			BACParams.sftpAuthentication = strings.ToLower(v)
+		case constant.SFTPSSHPublicKeyField:
+			BACParams.sftpSSHPublicKey = strings.TrimSpace(v)
+		case constant.RegenerateKeyOnRevokeField:
+			BACParams.regenerateKeyOnRevoke = strings.EqualFold(v, TrueValue)
 		}
 	}
+
+	if BACParams.credentialMode == constant.SFTPCredentialMode && BACParams.sftpAuthentication == constant.SSHKeySFTPAuthentication && BACParams.sftpSSHPublicKey == "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%s %s requires %s", constant.SFTPAuthenticationField, constant.SSHKeySFTPAuthentication, constant.SFTPSSHPublicKeyField))
+	}
 	return BACParams, nil
 }
 
@@ -469,7 +524,7 @@ func getAccountOptions(params *BucketClassParameters) *azure.AccountOptions {
 		Location:                  params.region,
 		Type:                      params.storageAccountType,
 		Kind:                      params.kind.String(),
-		Tags:                      params.tags,
+		Tags:                      withDriverTag(params.tags),
 		VirtualNetworkResourceIDs: params.virtualNetworkResourceIDs,
 		EnableHTTPSTrafficOnly:    params.enableHTTPSTrafficOnly,
 		CreatePrivateEndpoint:     params.createPrivateEndpoint,
@@ -4,12 +4,14 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"net"
 	"net/http"
 	"project/azure-cosi-driver/pkg/constant"
 	"project/azure-cosi-driver/pkg/types"
 	"reflect"
 	"testing"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
 	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
 	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/golang/mock/gomock"
@@ -28,11 +30,10 @@ func TestCreateBucket(t *testing.T) {
 		params      map[string]string
 	}{
 		{
-			testName: "Parsing Error (invalid bucket unit type)",
-			bucket:   constant.ValidContainerURL,
-			params:   map[string]string{constant.BucketUnitTypeField: "invalid type"},
-			expectedErr: status.Error(codes.Unknown, fmt.Sprintf("Error parsing parameters : %v",
-				status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid BucketUnitType %s", "invalid type")))),
+			testName:    "Parsing Error (invalid bucket unit type)",
+			bucket:      constant.ValidContainerURL,
+			params:      map[string]string{constant.BucketUnitTypeField: "invalid type"},
+			expectedErr: status.Error(codes.InvalidArgument, "Invalid value \"invalid type\" for parameter bucketunittype, allowed values are: container, storageaccount"),
 		},
 		{
 			testName: "Create storage Account Bucket",
@@ -61,7 +62,7 @@ func TestCreateBucket(t *testing.T) {
 	cloud.StorageAccountClient = NewMockSAClient(context.Background(), ctrl, "", "", "", &keyList)
 
 	for _, test := range tests {
-		base64ID, err := CreateBucket(context.Background(), constant.ValidAccount, test.params, cloud)
+		base64ID, err := CreateBucket(context.Background(), constant.ValidAccount, test.params, nil, nil, cloud)
 
 		if !reflect.DeepEqual(err, test.expectedErr) {
 			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectedErr, err)
@@ -109,7 +110,7 @@ func TestDeleteBucket(t *testing.T) {
 				ResourceGroup: constant.ValidResourceGroup,
 				URL:           constant.ValidContainerURL,
 			},
-			expectedErr: fmt.Errorf("Error deleting container %s in storage account %s : %v", constant.ValidContainer, constant.ValidAccount, fmt.Errorf("Delete \"https://validaccount.blob.core.windows.net/validcontainer?restype=container\": dial tcp: lookup validaccount.blob.core.windows.net: no such host")),
+			expectedErr: status.Error(codes.Unavailable, fmt.Sprintf("Could not delete container %s in storage account %s: %v", constant.ValidContainer, constant.ValidAccount, fmt.Errorf("Delete \"https://validaccount.blob.core.windows.net/validcontainer?restype=container\": dial tcp: lookup validaccount.blob.core.windows.net: no such host"))),
 		},
 	}
 	ctrl := gomock.NewController(t)
@@ -131,6 +132,81 @@ func TestDeleteBucket(t *testing.T) {
 	}
 }
 
+func TestGetBucketUnitType(t *testing.T) {
+	tests := []struct {
+		testName         string
+		url              string
+		expectedUnitType constant.BucketUnitType
+		expectErr        bool
+	}{
+		{
+			testName:         "Container",
+			url:              constant.ValidContainerURL,
+			expectedUnitType: constant.Container,
+		},
+		{
+			testName:         "Storage Account",
+			url:              constant.ValidAccountURL,
+			expectedUnitType: constant.StorageAccount,
+		},
+		{
+			testName:  "Invalid URL",
+			url:       "invalid",
+			expectErr: true,
+		},
+	}
+	for _, test := range tests {
+		id := types.BucketID{URL: test.url}
+		bucketID, err := id.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		unitType, err := GetBucketUnitType(bucketID)
+		if (err != nil) != test.expectErr {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectErr, err)
+		}
+		if err == nil && unitType != test.expectedUnitType {
+			t.Errorf("\nTestCase: %s\nExpected Unit Type: %v\nActual Unit Type: %v", test.testName, test.expectedUnitType, unitType)
+		}
+	}
+}
+
+func TestGetStorageAccountName(t *testing.T) {
+	tests := []struct {
+		testName        string
+		url             string
+		expectedAccount string
+	}{
+		{
+			testName:        "Container",
+			url:             constant.ValidContainerURL,
+			expectedAccount: constant.ValidAccount,
+		},
+		{
+			testName:        "Storage Account",
+			url:             constant.ValidAccountURL,
+			expectedAccount: constant.ValidAccount,
+		},
+		{
+			testName: "Invalid URL",
+			url:      "invalid",
+		},
+	}
+	for _, test := range tests {
+		id := types.BucketID{URL: test.url}
+		bucketID, err := id.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if account := GetStorageAccountName(bucketID); account != test.expectedAccount {
+			t.Errorf("\nTestCase: %s\nExpected Account: %q\nActual Account: %q", test.testName, test.expectedAccount, account)
+		}
+	}
+	if account := GetStorageAccountName("not base64"); account != "" {
+		t.Errorf("expected no storage account for an undecodable bucket ID, got %q", account)
+	}
+}
+
 func TestParseBucketClassParameters(t *testing.T) {
 	tests := []struct {
 		testName       string
@@ -174,6 +250,18 @@ func TestParseBucketClassParameters(t *testing.T) {
 			expectedErr:    nil,
 			expectedParams: BucketClassParameters{storageAccountName: constant.ValidAccount},
 		},
+		{
+			testName:       "Invalid Storage Account",
+			parameters:     map[string]string{constant.StorageAccountNameField: "Invalid_Account"},
+			expectedErr:    status.Error(codes.InvalidArgument, "Invalid storage account name Invalid_Account, must be 3-24 lowercase letters and numbers"),
+			expectedParams: BucketClassParameters{},
+		},
+		{
+			testName:       "Storage Account Name Template",
+			parameters:     map[string]string{constant.StorageAccountNameTemplateField: "team"},
+			expectedErr:    nil,
+			expectedParams: BucketClassParameters{storageAccountNameTemplate: "team"},
+		},
 		{
 			testName:       "Valid Region",
 			parameters:     map[string]string{constant.RegionField: constant.ValidRegion},
@@ -225,7 +313,7 @@ func TestParseBucketClassParameters(t *testing.T) {
 		{
 			testName:       "SKU Name Field unsupported",
 			parameters:     map[string]string{constant.SKUNameField: "foobar"},
-			expectedErr:    status.Error(codes.InvalidArgument, fmt.Sprintf("Access Tier %s is unsupported", "foobar")),
+			expectedErr:    status.Error(codes.InvalidArgument, "Invalid value \"foobar\" for parameter skuname, allowed values are: Standard_LRS, Standard_GRS, Standard_RAGRS, Premium_LRS"),
 			expectedParams: BucketClassParameters{},
 		},
 		{
@@ -288,6 +376,24 @@ func TestParseBucketClassParameters(t *testing.T) {
 			expectedErr:    status.Error(codes.InvalidArgument, "strconv.Atoi: parsing \"foobar\": invalid syntax"),
 			expectedParams: BucketClassParameters{},
 		},
+		{
+			testName:       "Storage Account Pool",
+			parameters:     map[string]string{constant.StorageAccountPoolPrefixField: "pool", constant.MaxContainersPerAccountField: "10"},
+			expectedErr:    nil,
+			expectedParams: BucketClassParameters{storageAccountPoolPrefix: "pool", maxContainersPerAccount: 10},
+		},
+		{
+			testName:       "MaxContainersPerAccount Not a number",
+			parameters:     map[string]string{constant.StorageAccountPoolPrefixField: "pool", constant.MaxContainersPerAccountField: "foobar"},
+			expectedErr:    status.Error(codes.InvalidArgument, "strconv.Atoi: parsing \"foobar\": invalid syntax"),
+			expectedParams: BucketClassParameters{},
+		},
+		{
+			testName:       "MaxContainersPerAccount zero",
+			parameters:     map[string]string{constant.StorageAccountPoolPrefixField: "pool", constant.MaxContainersPerAccountField: "0"},
+			expectedErr:    status.Error(codes.InvalidArgument, "maxcontainersperaccount must be greater than 0"),
+			expectedParams: BucketClassParameters{},
+		},
 		{
 			testName:       "storage account type",
 			parameters:     map[string]string{StorageAccountTypeField: "unittest"},
@@ -362,7 +468,7 @@ func TestParseBucketClassParameters(t *testing.T) {
 		},
 	}
 	for _, test := range tests {
-		params, err := parseBucketClassParameters(test.parameters)
+		params, err := parseBucketClassParameters(test.parameters, nil)
 		if !reflect.DeepEqual(err, test.expectedErr) {
 			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectedErr, err)
 		}
@@ -379,8 +485,168 @@ func TestParseBucketClassParameters(t *testing.T) {
 	}
 }
 
+func TestParseBucketClassParametersTemplates(t *testing.T) {
+	values := TemplateValues{BucketNamePlaceholder: constant.ValidContainer, BucketClaimNamespacePlaceholder: "team-a"}
+	tests := []struct {
+		testName       string
+		parameters     map[string]string
+		expectedErr    error
+		expectedParams BucketClassParameters
+	}{
+		{
+			testName:       "Templated tags",
+			parameters:     map[string]string{TagsField: "namespace=${bucketclaim.namespace},bucket=${bucket.name}"},
+			expectedErr:    nil,
+			expectedParams: BucketClassParameters{tags: map[string]string{"namespace": "team-a", "bucket": constant.ValidContainer}},
+		},
+		{
+			testName:       "Templated container metadata",
+			parameters:     map[string]string{constant.ContainerMetadataField: "namespace=${bucketclaim.namespace}"},
+			expectedErr:    nil,
+			expectedParams: BucketClassParameters{containerMetadata: map[string]string{"namespace": "team-a"}},
+		},
+		{
+			testName:       "Templated storage account name",
+			parameters:     map[string]string{constant.StorageAccountNameTemplateField: "${bucketclaim.namespace}"},
+			expectedErr:    nil,
+			expectedParams: BucketClassParameters{storageAccountNameTemplate: "team-a"},
+		},
+		{
+			testName:       "Unknown placeholder",
+			parameters:     map[string]string{TagsField: "owner=${owner}"},
+			expectedErr:    status.Error(codes.InvalidArgument, "Unknown placeholder ${owner} in \"${owner}\", supported placeholders are: ${bucket.name}, ${bucketclaim.namespace}, ${bucketclaim.name}, ${cluster.name}, ${date}"),
+			expectedParams: BucketClassParameters{},
+		},
+		{
+			testName:       "Invalid container metadata",
+			parameters:     map[string]string{constant.ContainerMetadataField: "namespace"},
+			expectedErr:    status.Error(codes.InvalidArgument, "Tags 'namespace' are invalid, the format should like: 'key1=value1,key2=value2'"),
+			expectedParams: BucketClassParameters{},
+		},
+	}
+	for _, test := range tests {
+		params, err := parseBucketClassParameters(test.parameters, values)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectedErr, err)
+		}
+		if err == nil && !reflect.DeepEqual(*params, test.expectedParams) {
+			t.Errorf("\nTestCase: %s\nExpected Params: %+v\nActual Params: %+v", test.testName, test.expectedParams, params)
+		}
+	}
+}
+
 func TestParseBucketAccessClassParameters(t *testing.T) {
+	defaults := BucketAccessClassParameters{
+		validationPeriod:                 604800000,
+		signedProtocol:                   sas.ProtocolHTTPSandHTTP,
+		enableRead:                       true,
+		enableList:                       true,
+		allowServiceSignedResourceType:   true,
+		allowContainerSignedResourceType: true,
+		allowObjectSignedResourceType:    true,
+	}
+	withDefaults := func(modify func(p *BucketAccessClassParameters)) BucketAccessClassParameters {
+		p := defaults
+		modify(&p)
+		return p
+	}
 
+	tests := []struct {
+		testName       string
+		parameters     map[string]string
+		expectedErr    error
+		expectedParams BucketAccessClassParameters
+	}{
+		{
+			testName:       "Defaults",
+			parameters:     map[string]string{},
+			expectedErr:    nil,
+			expectedParams: defaults,
+		},
+		{
+			testName:       "BucketUnitType Account",
+			parameters:     map[string]string{constant.BucketUnitTypeField: constant.StorageAccount.String()},
+			expectedErr:    nil,
+			expectedParams: withDefaults(func(p *BucketAccessClassParameters) { p.bucketUnitType = constant.StorageAccount }),
+		},
+		{
+			testName:       "Validation Period",
+			parameters:     map[string]string{constant.ValidationPeriodField: "1000"},
+			expectedErr:    nil,
+			expectedParams: withDefaults(func(p *BucketAccessClassParameters) { p.validationPeriod = 1000 }),
+		},
+		{
+			testName:       "Validation Period Not a number",
+			parameters:     map[string]string{constant.ValidationPeriodField: "foobar"},
+			expectedErr:    status.Error(codes.InvalidArgument, "strconv.ParseUint: parsing \"foobar\": invalid syntax"),
+			expectedParams: BucketAccessClassParameters{},
+		},
+		{
+			testName:       "Enable Write Mixed Case",
+			parameters:     map[string]string{"EnableWrite": "TRUE"},
+			expectedErr:    nil,
+			expectedParams: withDefaults(func(p *BucketAccessClassParameters) { p.enableWrite = true }),
+		},
+		{
+			testName:       "Disable Read",
+			parameters:     map[string]string{constant.EnableReadField: FalseValue},
+			expectedErr:    nil,
+			expectedParams: withDefaults(func(p *BucketAccessClassParameters) { p.enableRead = false }),
+		},
+		{
+			testName:       "Disable Container Resource Type",
+			parameters:     map[string]string{constant.AllowContainerSignedResourceTypeField: FalseValue},
+			expectedErr:    nil,
+			expectedParams: withDefaults(func(p *BucketAccessClassParameters) { p.allowContainerSignedResourceType = false }),
+		},
+		{
+			testName:       "HTTPS Only",
+			parameters:     map[string]string{constant.SignedProtocolField: "https"},
+			expectedErr:    nil,
+			expectedParams: withDefaults(func(p *BucketAccessClassParameters) { p.signedProtocol = sas.ProtocolHTTPS }),
+		},
+		{
+			testName:       "HTTP Only",
+			parameters:     map[string]string{constant.SignedProtocolField: "http"},
+			expectedErr:    status.Error(codes.InvalidArgument, "Invalid value \"http\" for parameter signedprotocol, allowed values are: https, https,http, http,https"),
+			expectedParams: BucketAccessClassParameters{},
+		},
+		{
+			testName:    "Signed IP CIDR",
+			parameters:  map[string]string{constant.SignedIPField: "10.0.0.0/30"},
+			expectedErr: nil,
+			expectedParams: withDefaults(func(p *BucketAccessClassParameters) {
+				p.signedIP = sas.IPRange{Start: net.IPv4(10, 0, 0, 0).To4(), End: net.IPv4(10, 0, 0, 3).To4()}
+			}),
+		},
+		{
+			testName:       "Signed IP Invalid",
+			parameters:     map[string]string{constant.SignedIPField: "not-an-ip"},
+			expectedErr:    status.Error(codes.InvalidArgument, "Invalid IP Range not-an-ip, Must be formatted as <ip>, <ip1>-<ip2> or <ip>/<prefix length>"),
+			expectedParams: BucketAccessClassParameters{},
+		},
+		{
+			testName:       "Malformed Boolean",
+			parameters:     map[string]string{constant.EnableWriteField: "yes"},
+			expectedErr:    status.Error(codes.InvalidArgument, "Invalid value \"yes\" for parameter enablewrite, must be true or false"),
+			expectedParams: BucketAccessClassParameters{},
+		},
+		{
+			testName:       "Misspelled Key",
+			parameters:     map[string]string{"enablewrtie": TrueValue},
+			expectedErr:    status.Error(codes.InvalidArgument, "Unknown parameter \"enablewrtie\", did you mean \"enablewrite\"?"),
+			expectedParams: BucketAccessClassParameters{},
+		},
+	}
+	for _, test := range tests {
+		params, err := parseBucketAccessClassParameters(test.parameters)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectedErr, err)
+		}
+		if err == nil && !reflect.DeepEqual(*params, test.expectedParams) {
+			t.Errorf("\nTestCase: %s\nExpected Params: %+v\nActual Params: %+v", test.testName, test.expectedParams, params)
+		}
+	}
 }
 
 func TestGetAccountOptions(t *testing.T) {
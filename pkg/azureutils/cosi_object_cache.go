@@ -0,0 +1,145 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer/streaming"
+	"k8s.io/apimachinery/pkg/watch"
+	clientSet "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	restclientwatch "k8s.io/client-go/rest/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// uidIndex indexes the cached COSI objects by UID
+const uidIndex = "uid"
+
+// COSIObjectCache serves references to Bucket and BucketAccess objects from informers,
+// so that recording an event on them does not get or list COSI objects from the API server.
+type COSIObjectCache struct {
+	buckets        cache.SharedIndexInformer
+	bucketAccesses cache.SharedIndexInformer
+}
+
+// NewCOSIObjectCache returns a cache of the Bucket and BucketAccess objects of the cluster. It is empty until Start is called.
+func NewCOSIObjectCache(kubeClient clientSet.Interface) *COSIObjectCache {
+	return &COSIObjectCache{
+		buckets: cache.NewSharedIndexInformer(newCOSIListWatch(kubeClient, "buckets"), &unstructured.Unstructured{}, 0, cache.Indexers{}),
+		bucketAccesses: cache.NewSharedIndexInformer(newCOSIListWatch(kubeClient, "bucketaccesses"), &unstructured.Unstructured{}, 0, cache.Indexers{
+			uidIndex: func(obj interface{}) ([]string, error) {
+				accessor, err := meta.Accessor(obj)
+				if err != nil {
+					return nil, err
+				}
+				return []string{string(accessor.GetUID())}, nil
+			},
+		}),
+	}
+}
+
+// Start fills the cache and keeps it up to date until stop is closed
+func (c *COSIObjectCache) Start(stop <-chan struct{}) {
+	go c.buckets.Run(stop)
+	go c.bucketAccesses.Run(stop)
+}
+
+// WaitForSync waits until the cache is filled or stop is closed, and returns whether it was filled
+func (c *COSIObjectCache) WaitForSync(stop <-chan struct{}) bool {
+	return cache.WaitForCacheSync(stop, c.buckets.HasSynced, c.bucketAccesses.HasSynced)
+}
+
+// BucketReference returns a reference to the Bucket object, which events about the bucket are recorded on
+func (c *COSIObjectCache) BucketReference(bucketName string) (*v1.ObjectReference, error) {
+	obj, exists, err := c.buckets.GetStore().GetByKey(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("no bucket %s found", bucketName)
+	}
+	return objectReference(obj, bucketKind)
+}
+
+// BucketAccessReference returns a reference to the BucketAccess object the account name of a grant was derived from
+func (c *COSIObjectCache) BucketAccessReference(accountName string) (*v1.ObjectReference, error) {
+	uid := strings.TrimPrefix(accountName, bucketAccessAccountPrefix)
+	if uid == accountName || uid == "" {
+		return nil, fmt.Errorf("account name %s does not identify a bucket access", accountName)
+	}
+
+	objs, err := c.bucketAccesses.GetIndexer().ByIndex(uidIndex, uid)
+	if err != nil {
+		return nil, err
+	}
+	if len(objs) == 0 {
+		return nil, fmt.Errorf("no bucket access found for account name %s", accountName)
+	}
+	return objectReference(objs[0], bucketAccessKind)
+}
+
+func objectReference(obj interface{}, kind string) (*v1.ObjectReference, error) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ObjectReference{
+		APIVersion: cosiAPIVersion,
+		Kind:       kind,
+		Namespace:  accessor.GetNamespace(),
+		Name:       accessor.GetName(),
+		UID:        accessor.GetUID(),
+	}, nil
+}
+
+// newCOSIListWatch lists and watches the COSI resource as unstructured objects.
+// The COSI API types are not vendored, so the typed clients and informers cannot be used.
+func newCOSIListWatch(kubeClient clientSet.Interface, resource string) *cache.ListWatch {
+	restClient := kubeClient.CoreV1().RESTClient()
+	path := cosiAPIPath + "/" + resource
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			data, err := restClient.Get().AbsPath(path).VersionedParams(&options, scheme.ParameterCodec).DoRaw(context.TODO())
+			if err != nil {
+				return nil, err
+			}
+			list := &unstructured.UnstructuredList{}
+			if err := list.UnmarshalJSON(data); err != nil {
+				return nil, fmt.Errorf("could not decode %s: %v", resource, err)
+			}
+			return list, nil
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.Watch = true
+			body, err := restClient.Get().AbsPath(path).VersionedParams(&options, scheme.ParameterCodec).Stream(context.TODO())
+			if err != nil {
+				return nil, err
+			}
+			decoder := streaming.NewDecoder(body, unstructured.UnstructuredJSONScheme)
+			return watch.NewStreamWatcher(
+				restclientwatch.NewDecoder(decoder, unstructured.UnstructuredJSONScheme),
+				apierrors.NewClientErrorReporter(500, "GET", "ClientWatchDecoding"),
+			), nil
+		},
+	}
+}
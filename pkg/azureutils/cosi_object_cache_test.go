@@ -0,0 +1,121 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	clientSet "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestCOSIObjectCache(t *testing.T) {
+	var lists int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") == "true" {
+			// no changes until the watch is stopped
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		switch r.URL.Path {
+		case cosiAPIPath + "/buckets":
+			atomic.AddInt32(&lists, 1)
+			fmt.Fprint(w, `{"kind":"BucketList","apiVersion":"objectstorage.k8s.io/v1alpha1","metadata":{"resourceVersion":"1"},"items":[{"kind":"Bucket","apiVersion":"objectstorage.k8s.io/v1alpha1","metadata":{"name":"claimed","uid":"bucket-uid"}}]}`)
+		case cosiAPIPath + "/bucketaccesses":
+			atomic.AddInt32(&lists, 1)
+			fmt.Fprint(w, `{"kind":"BucketAccessList","apiVersion":"objectstorage.k8s.io/v1alpha1","metadata":{"resourceVersion":"1"},"items":[`+
+				`{"kind":"BucketAccess","apiVersion":"objectstorage.k8s.io/v1alpha1","metadata":{"name":"other","namespace":"team-b","uid":"other-uid"}},`+
+				`{"kind":"BucketAccess","apiVersion":"objectstorage.k8s.io/v1alpha1","metadata":{"name":"access","namespace":"team-a","uid":"access-uid"}}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	kubeClient, err := clientSet.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := NewCOSIObjectCache(kubeClient)
+	stop := make(chan struct{})
+	defer close(stop)
+	objects.Start(stop)
+	if !objects.WaitForSync(stop) {
+		t.Fatal("cache did not sync")
+	}
+
+	tests := []struct {
+		testName    string
+		get         func() (*v1.ObjectReference, error)
+		expectedRef *v1.ObjectReference
+		expectErr   bool
+	}{
+		{
+			testName: "Bucket",
+			get: func() (*v1.ObjectReference, error) {
+				return objects.BucketReference("claimed")
+			},
+			expectedRef: &v1.ObjectReference{APIVersion: cosiAPIVersion, Kind: bucketKind, Name: "claimed", UID: "bucket-uid"},
+		},
+		{
+			testName: "Bucket not found",
+			get: func() (*v1.ObjectReference, error) {
+				return objects.BucketReference("missing")
+			},
+			expectErr: true,
+		},
+		{
+			testName: "Bucket access",
+			get: func() (*v1.ObjectReference, error) {
+				return objects.BucketAccessReference("ba-access-uid")
+			},
+			expectedRef: &v1.ObjectReference{APIVersion: cosiAPIVersion, Kind: bucketAccessKind, Namespace: "team-a", Name: "access", UID: "access-uid"},
+		},
+		{
+			testName: "Bucket access not found",
+			get: func() (*v1.ObjectReference, error) {
+				return objects.BucketAccessReference("ba-missing-uid")
+			},
+			expectErr: true,
+		},
+		{
+			testName: "Account name without bucket access prefix",
+			get: func() (*v1.ObjectReference, error) {
+				return objects.BucketAccessReference("access-uid")
+			},
+			expectErr: true,
+		},
+	}
+	for _, test := range tests {
+		ref, err := test.get()
+		if (err != nil) != test.expectErr {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectErr, err)
+		}
+		if err == nil && !reflect.DeepEqual(ref, test.expectedRef) {
+			t.Errorf("\nTestCase: %s\nExpected Reference: %+v\nActual Reference: %+v", test.testName, test.expectedRef, ref)
+		}
+	}
+
+	if n := atomic.LoadInt32(&lists); n != 2 {
+		t.Errorf("expected the lookups to be served from the cache after one list per resource, listed %d times", n)
+	}
+}
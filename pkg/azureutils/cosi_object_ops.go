@@ -0,0 +1,154 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	clientSet "k8s.io/client-go/kubernetes"
+)
+
+const (
+	cosiAPIVersion = "objectstorage.k8s.io/v1alpha1"
+	cosiAPIPath    = "/apis/" + cosiAPIVersion
+
+	bucketKind       = "Bucket"
+	bucketAccessKind = "BucketAccess"
+	// keyAuthenticationType is the authenticationType of BucketAccessClasses granting access with a SAS
+	keyAuthenticationType = "Key"
+	// bucketAccessAccountPrefix prefixes the BucketAccess UID in the account name the COSI sidecar sends
+	bucketAccessAccountPrefix = "ba-"
+)
+
+// objectMeta holds the metadata fields of COSI objects the driver needs
+type objectMeta struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	UID       string `json:"uid"`
+	// CreationTimestamp is when the object was created
+	CreationTimestamp time.Time `json:"creationTimestamp"`
+}
+
+// bucketObject holds the fields of a COSI Bucket object the driver needs.
+// The COSI API types are not vendored, so only these fields are decoded.
+type bucketObject struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		BucketClaim *struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"bucketClaim"`
+	} `json:"spec"`
+	Status struct {
+		BucketID string `json:"bucketID"`
+	} `json:"status"`
+}
+
+// bucketAccessObject holds the fields of a COSI BucketAccess object the driver needs
+type bucketAccessObject struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		BucketClaimName       string `json:"bucketClaimName"`
+		BucketAccessClassName string `json:"bucketAccessClassName"`
+		CredentialsSecretName string `json:"credentialsSecretName"`
+	} `json:"spec"`
+	Status struct {
+		AccessGranted bool `json:"accessGranted"`
+	} `json:"status"`
+}
+
+// bucketAccessList holds the fields of a list of COSI BucketAccess objects the driver needs
+type bucketAccessList struct {
+	Items []bucketAccessObject `json:"items"`
+}
+
+// bucketClaimObject holds the fields of a COSI BucketClaim object the driver needs
+type bucketClaimObject struct {
+	Metadata objectMeta `json:"metadata"`
+	Status   struct {
+		BucketName string `json:"bucketName"`
+	} `json:"status"`
+}
+
+// bucketAccessClassObject holds the fields of a COSI BucketAccessClass object the driver needs
+type bucketAccessClassObject struct {
+	Metadata           objectMeta        `json:"metadata"`
+	DriverName         string            `json:"driverName"`
+	AuthenticationType string            `json:"authenticationType"`
+	Parameters         map[string]string `json:"parameters"`
+}
+
+// getCOSIObject decodes the COSI object at the path below the COSI API into object, describing it as what in errors
+func getCOSIObject(ctx context.Context, kubeClient clientSet.Interface, object interface{}, what string, path ...string) error {
+	if kubeClient == nil {
+		return fmt.Errorf("kube client is nil")
+	}
+
+	data, err := kubeClient.CoreV1().RESTClient().Get().AbsPath(append([]string{cosiAPIPath}, path...)...).DoRaw(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get %s: %w", what, err)
+	}
+	if err := json.Unmarshal(data, object); err != nil {
+		return fmt.Errorf("could not decode %s: %v", what, err)
+	}
+	return nil
+}
+
+func getBucket(ctx context.Context, kubeClient clientSet.Interface, bucketName string) (*bucketObject, error) {
+	bucket := &bucketObject{}
+	if err := getCOSIObject(ctx, kubeClient, bucket, "bucket "+bucketName, "buckets", bucketName); err != nil {
+		return nil, err
+	}
+	return bucket, nil
+}
+
+func getBucketClaimObject(ctx context.Context, kubeClient clientSet.Interface, namespace, name string) (*bucketClaimObject, error) {
+	claim := &bucketClaimObject{}
+	if err := getCOSIObject(ctx, kubeClient, claim, "bucket claim "+namespace+"/"+name, "namespaces", namespace, "bucketclaims", name); err != nil {
+		return nil, err
+	}
+	return claim, nil
+}
+
+func getBucketAccessClass(ctx context.Context, kubeClient clientSet.Interface, name string) (*bucketAccessClassObject, error) {
+	class := &bucketAccessClassObject{}
+	if err := getCOSIObject(ctx, kubeClient, class, "bucket access class "+name, "bucketaccessclasses", name); err != nil {
+		return nil, err
+	}
+	return class, nil
+}
+
+func listBucketAccesses(ctx context.Context, kubeClient clientSet.Interface) ([]bucketAccessObject, error) {
+	list := &bucketAccessList{}
+	if err := getCOSIObject(ctx, kubeClient, list, "bucket accesses", "bucketaccesses"); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// GetBucketClaim returns the namespace and name of the BucketClaim the Bucket was created for
+func GetBucketClaim(ctx context.Context, kubeClient clientSet.Interface, bucketName string) (string, string, error) {
+	bucket, err := getBucket(ctx, kubeClient, bucketName)
+	if err != nil {
+		return "", "", err
+	}
+	if bucket.Spec.BucketClaim == nil {
+		return "", "", fmt.Errorf("bucket %s has no bucket claim", bucketName)
+	}
+
+	return bucket.Spec.BucketClaim.Namespace, bucket.Spec.BucketClaim.Name, nil
+}
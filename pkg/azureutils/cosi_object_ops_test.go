@@ -0,0 +1,82 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	clientSet "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestGetBucketClaim(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case cosiAPIPath + "/buckets/claimed":
+			fmt.Fprint(w, `{"spec":{"bucketClaim":{"name":"claim","namespace":"team-a"}}}`)
+		case cosiAPIPath + "/buckets/unclaimed":
+			fmt.Fprint(w, `{"spec":{}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	kubeClient, err := clientSet.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		testName          string
+		bucketName        string
+		expectedNamespace string
+		expectedName      string
+		expectErr         bool
+	}{
+		{
+			testName:          "Bucket with claim",
+			bucketName:        "claimed",
+			expectedNamespace: "team-a",
+			expectedName:      "claim",
+		},
+		{
+			testName:   "Bucket without claim",
+			bucketName: "unclaimed",
+			expectErr:  true,
+		},
+		{
+			testName:   "Bucket not found",
+			bucketName: "missing",
+			expectErr:  true,
+		},
+	}
+	for _, test := range tests {
+		namespace, name, err := GetBucketClaim(context.Background(), kubeClient, test.bucketName)
+		if (err != nil) != test.expectErr {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectErr, err)
+		}
+		if err == nil && (namespace != test.expectedNamespace || name != test.expectedName) {
+			t.Errorf("\nTestCase: %s\nExpected Claim: %s/%s\nActual Claim: %s/%s", test.testName, test.expectedNamespace, test.expectedName, namespace, name)
+		}
+	}
+
+	if _, _, err := GetBucketClaim(context.Background(), nil, "claimed"); err == nil {
+		t.Errorf("expected an error for a nil kube client")
+	}
+}
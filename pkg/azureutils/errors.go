@@ -0,0 +1,218 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/go-autorest/autorest"
+	autorestazure "github.com/Azure/go-autorest/autorest/azure"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// requestIDHeader is the header Azure returns the ID it assigned to a request in
+const requestIDHeader = "x-ms-request-id"
+
+var (
+	// armErrorRE matches the status of errors from cloud-provider-azure, which are reported as text, e.g.
+	// "Retriable: true, RetryAfter: 30s, HTTPStatusCode: 429, RawError: ..."
+	armErrorRE = regexp.MustCompile(`Retriable: (true|false), RetryAfter: (\d+)s, HTTPStatusCode: (-?\d+)`)
+	// armErrorStructRE matches the status of cloud-provider-azure errors formatted as a struct, which is how
+	// EnsureStorageAccount reports a failed creation, e.g. "error: &{false 403 0001-01-01 00:00:00 +0000 UTC ...}"
+	armErrorStructRE = regexp.MustCompile(`&\{(true|false) (-?\d+) \d{4}-\d{2}-\d{2} `)
+	// armErrorCodeRE matches the error code in the body of an ARM error response
+	armErrorCodeRE = regexp.MustCompile(`"code"\s*:\s*"([^"]+)"`)
+
+	// alreadyExistsErrorCodes are the Azure error codes of conflicts with a resource that already exists.
+	// Other conflicts, such as a container being deleted, are reported as codes.FailedPrecondition.
+	alreadyExistsErrorCodes = map[string]bool{
+		"ContainerAlreadyExists":     true,
+		"ResourceAlreadyExists":      true,
+		"StorageAccountAlreadyTaken": true,
+	}
+)
+
+// azureErrorInfo is what an error returned by Azure tells about the failed request
+type azureErrorInfo struct {
+	// statusCode is the HTTP status code of the response, zero or negative if no response was received
+	statusCode int
+	// errorCode is the Azure error code of the response, e.g. ContainerAlreadyExists
+	errorCode string
+	// requestID is the ID Azure assigned to the request, which Azure support asks for
+	requestID string
+	// retriable is whether cloud-provider-azure considers the request worth retrying
+	retriable  bool
+	retryAfter time.Duration
+}
+
+// parseAzureError returns what err tells about the failed Azure request, and false if err is not an Azure error.
+// It understands blob service errors, and ARM errors reported as text by cloud-provider-azure.
+func parseAzureError(err error) (azureErrorInfo, bool) {
+	if err == nil {
+		return azureErrorInfo{}, false
+	}
+
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) {
+		info := azureErrorInfo{statusCode: respErr.StatusCode, errorCode: respErr.ErrorCode}
+		if respErr.RawResponse != nil {
+			info.requestID = respErr.RawResponse.Header.Get(requestIDHeader)
+			info.retryAfter = parseRetryAfter(respErr.RawResponse.Header.Get("Retry-After"))
+		}
+		return info, true
+	}
+
+	var info azureErrorInfo
+	if match := armErrorRE.FindStringSubmatch(err.Error()); match != nil {
+		seconds, _ := strconv.Atoi(match[2])
+		info.statusCode, _ = strconv.Atoi(match[3])
+		info.retriable = match[1] == "true"
+		info.retryAfter = time.Duration(seconds) * time.Second
+	} else if match := armErrorStructRE.FindStringSubmatch(err.Error()); match != nil {
+		info.statusCode, _ = strconv.Atoi(match[2])
+		info.retriable = match[1] == "true"
+	} else {
+		return azureErrorInfo{}, false
+	}
+	// The autorest error a request failed with is kept if the request got no response it could decode
+	var reqErr *autorestazure.RequestError
+	if errors.As(err, &reqErr) {
+		info.requestID = reqErr.RequestID
+		if reqErr.ServiceError != nil {
+			info.errorCode = reqErr.ServiceError.Code
+		}
+	}
+	var detailedErr autorest.DetailedError
+	if info.requestID == "" && errors.As(err, &detailedErr) && detailedErr.Response != nil {
+		info.requestID = detailedErr.Response.Header.Get(requestIDHeader)
+	}
+	if info.errorCode == "" {
+		if match := armErrorCodeRE.FindStringSubmatch(err.Error()); match != nil {
+			info.errorCode = match[1]
+		}
+	}
+	return info, true
+}
+
+// class returns whether the request was throttled, failed in a way a later retry may not, or failed for good
+func (info azureErrorInfo) class() azureErrorClass {
+	switch {
+	// Storage reports throttling of the blob service as 503 ServerBusy
+	case info.statusCode == http.StatusTooManyRequests || info.errorCode == "ServerBusy":
+		return throttledError
+	case info.statusCode == http.StatusRequestTimeout || info.statusCode >= http.StatusInternalServerError:
+		return transientError
+	case info.statusCode <= 0 && info.retriable:
+		// No response was received
+		return transientError
+	}
+	return permanentError
+}
+
+// code returns the status code the failed request is reported with
+func (info azureErrorInfo) code() codes.Code {
+	switch info.class() {
+	case throttledError:
+		return codes.ResourceExhausted
+	case transientError:
+		return codes.Unavailable
+	}
+	switch info.statusCode {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		if alreadyExistsErrorCodes[info.errorCode] {
+			return codes.AlreadyExists
+		}
+		return codes.FailedPrecondition
+	case http.StatusPreconditionFailed:
+		return codes.FailedPrecondition
+	}
+	return codes.Internal
+}
+
+// isNetworkError returns whether err is a failure to reach Azure at all, such as a DNS lookup or a dropped connection
+func isNetworkError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// azureError returns err, an error of an Azure request, as a status with the code matching the Azure error,
+// the message prefixed with format, and the Azure request ID and retry delay attached as details.
+// Errors already carrying a status code keep it, other errors that do not come from Azure are codes.Internal.
+func azureError(err error, format string, args ...interface{}) error {
+	prefix := fmt.Sprintf(format, args...)
+	if st, ok := status.FromError(err); ok && st.Code() != codes.Unknown {
+		p := st.Proto()
+		p.Message = prefix + ": " + p.Message
+		return status.ErrorProto(p)
+	}
+	return newAzureStatus(err, prefix+": "+status.Convert(err).Message(), codes.Internal)
+}
+
+// toStatus converts an Azure error returned without a status code to the matching status.
+// It is applied to the errors of the COSI calls, so that an Azure error no call site mapped still gets a
+// consistent code. Other errors are returned unchanged.
+func toStatus(err error) error {
+	if err == nil || status.Code(err) != codes.Unknown {
+		return err
+	}
+	if _, ok := parseAzureError(err); !ok && !isNetworkError(err) {
+		return err
+	}
+	return newAzureStatus(err, err.Error(), codes.Unknown)
+}
+
+// newAzureStatus returns a status with message and the code matching err, or fallback if err is not an Azure error
+func newAzureStatus(err error, message string, fallback codes.Code) error {
+	info, ok := parseAzureError(err)
+	code := fallback
+	switch {
+	case ok:
+		code = info.code()
+	case isNetworkError(err):
+		code = codes.Unavailable
+	}
+
+	st := status.New(code, message)
+	if info.requestID != "" {
+		if withDetails, detailsErr := st.WithDetails(&errdetails.RequestInfo{RequestId: info.requestID}); detailsErr == nil {
+			st = withDetails
+		}
+	}
+	retryAfter := info.retryAfter
+	if code == codes.ResourceExhausted && retryAfter <= 0 {
+		retryAfter = defaultRetryAfter
+	}
+	if (code == codes.ResourceExhausted || code == codes.Unavailable) && retryAfter > 0 {
+		if withDetails, detailsErr := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)}); detailsErr == nil {
+			st = withDetails
+		}
+	}
+	return st.Err()
+}
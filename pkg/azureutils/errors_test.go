@@ -0,0 +1,243 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/go-autorest/autorest"
+	autorestazure "github.com/Azure/go-autorest/autorest/azure"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
+)
+
+// armError returns the text error cloud-provider-azure reports a failed ARM request with
+func armError(retriable bool, retryAfterSeconds, statusCode int) error {
+	return fmt.Errorf("Retriable: %v, RetryAfter: %ds, HTTPStatusCode: %d, RawError: %w", retriable, retryAfterSeconds, statusCode, fmt.Errorf("failed"))
+}
+
+// blobError returns the error the blob service client reports a failed request with
+func blobError(statusCode int, errorCode string, header http.Header) *azcore.ResponseError {
+	return &azcore.ResponseError{
+		StatusCode: statusCode,
+		ErrorCode:  errorCode,
+		RawResponse: &http.Response{
+			StatusCode: statusCode,
+			Header:     header,
+			Body:       http.NoBody,
+			Request:    httptest.NewRequest(http.MethodPut, "https://account.blob.core.windows.net/container", nil),
+		},
+	}
+}
+
+// armBodyError returns the error cloud-provider-azure reports an ARM error response with body with
+func armBodyError(statusCode int, body string) error {
+	return retry.GetError(&http.Response{StatusCode: statusCode, Body: io.NopCloser(strings.NewReader(body))}, nil).Error()
+}
+
+func TestAzureError(t *testing.T) {
+	tests := []struct {
+		testName           string
+		err                error
+		expectedCode       codes.Code
+		expectedMessage    string
+		expectedRequestID  string
+		expectedRetryAfter time.Duration
+	}{
+		{
+			testName:          "Blob not found",
+			err:               blobError(http.StatusNotFound, "ContainerNotFound", http.Header{"X-Ms-Request-Id": []string{"blob-request"}}),
+			expectedCode:      codes.NotFound,
+			expectedRequestID: "blob-request",
+		},
+		{
+			testName:     "Blob already exists",
+			err:          blobError(http.StatusConflict, "ContainerAlreadyExists", nil),
+			expectedCode: codes.AlreadyExists,
+		},
+		{
+			testName:     "Blob being deleted",
+			err:          blobError(http.StatusConflict, "ContainerBeingDeleted", nil),
+			expectedCode: codes.FailedPrecondition,
+		},
+		{
+			testName:     "Blob authorization failure",
+			err:          blobError(http.StatusForbidden, "AuthorizationFailure", nil),
+			expectedCode: codes.PermissionDenied,
+		},
+		{
+			testName:     "Blob condition not met",
+			err:          blobError(http.StatusPreconditionFailed, "ConditionNotMet", nil),
+			expectedCode: codes.FailedPrecondition,
+		},
+		{
+			testName:           "Blob service busy",
+			err:                blobError(http.StatusServiceUnavailable, "ServerBusy", http.Header{"Retry-After": []string{"5"}}),
+			expectedCode:       codes.ResourceExhausted,
+			expectedRetryAfter: 5 * time.Second,
+		},
+		{
+			testName:     "ARM name taken",
+			err:          armBodyError(http.StatusConflict, `{"error":{"code":"StorageAccountAlreadyTaken","message":"The storage account named account is already taken."}}`),
+			expectedCode: codes.AlreadyExists,
+		},
+		{
+			testName:     "ARM invalid request",
+			err:          armBodyError(http.StatusBadRequest, `{"error":{"code":"AccountNameInvalid","message":"account is not a valid storage account name."}}`),
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			testName: "ARM forbidden",
+			err: retry.GetError(&http.Response{StatusCode: http.StatusForbidden}, &autorestazure.RequestError{
+				DetailedError: autorest.DetailedError{StatusCode: http.StatusForbidden},
+				ServiceError:  &autorestazure.ServiceError{Code: "AuthorizationFailed"},
+				RequestID:     "arm-request",
+			}).Error(),
+			expectedCode:      codes.PermissionDenied,
+			expectedRequestID: "arm-request",
+		},
+		{
+			testName:     "ARM storage account creation forbidden",
+			err:          fmt.Errorf("failed to create storage account account, error: %v", retry.GetError(&http.Response{StatusCode: http.StatusForbidden}, fmt.Errorf("forbidden"))),
+			expectedCode: codes.PermissionDenied,
+		},
+		{
+			testName:           "ARM throttled",
+			err:                armError(true, 30, http.StatusTooManyRequests),
+			expectedCode:       codes.ResourceExhausted,
+			expectedRetryAfter: 30 * time.Second,
+		},
+		{
+			testName:     "ARM unavailable",
+			err:          armError(true, 0, http.StatusServiceUnavailable),
+			expectedCode: codes.Unavailable,
+		},
+		{
+			testName:     "Azure unreachable",
+			err:          &net.DNSError{Err: "no such host", Name: "account.blob.core.windows.net"},
+			expectedCode: codes.Unavailable,
+		},
+		{
+			testName:     "Not an Azure error",
+			err:          fmt.Errorf("invalid credentials"),
+			expectedCode: codes.Internal,
+		},
+		{
+			testName:        "Status is kept",
+			err:             status.Error(codes.ResourceExhausted, "Too many ARM requests"),
+			expectedCode:    codes.ResourceExhausted,
+			expectedMessage: "Could not do it: Too many ARM requests",
+		},
+	}
+	for _, test := range tests {
+		st := status.Convert(azureError(test.err, "Could not %s", "do it"))
+		if st.Code() != test.expectedCode {
+			t.Errorf("\nTestCase: %s\nExpected Code: %v\nActual Code: %v", test.testName, test.expectedCode, st.Code())
+		}
+		if test.expectedMessage != "" && st.Message() != test.expectedMessage {
+			t.Errorf("\nTestCase: %s\nExpected Message: %s\nActual Message: %s", test.testName, test.expectedMessage, st.Message())
+		}
+		if !strings.HasPrefix(st.Message(), "Could not do it: ") {
+			t.Errorf("\nTestCase: %s\nExpected Message Prefix: %s\nActual Message: %s", test.testName, "Could not do it: ", st.Message())
+		}
+		var requestID string
+		var retryAfter time.Duration
+		for _, detail := range st.Details() {
+			switch detail := detail.(type) {
+			case *errdetails.RequestInfo:
+				requestID = detail.RequestId
+			case *errdetails.RetryInfo:
+				retryAfter = detail.RetryDelay.AsDuration()
+			}
+		}
+		if requestID != test.expectedRequestID {
+			t.Errorf("\nTestCase: %s\nExpected Request ID: %s\nActual Request ID: %s", test.testName, test.expectedRequestID, requestID)
+		}
+		if retryAfter != test.expectedRetryAfter {
+			t.Errorf("\nTestCase: %s\nExpected Retry After: %v\nActual Retry After: %v", test.testName, test.expectedRetryAfter, retryAfter)
+		}
+	}
+}
+
+func TestToStatus(t *testing.T) {
+	tests := []struct {
+		testName           string
+		err                error
+		expectedCode       codes.Code
+		expectedRetryAfter time.Duration
+	}{
+		{
+			testName:     "No error",
+			err:          nil,
+			expectedCode: codes.OK,
+		},
+		{
+			testName:           "Throttled with Retry-After",
+			err:                armError(true, 30, http.StatusTooManyRequests),
+			expectedCode:       codes.ResourceExhausted,
+			expectedRetryAfter: 30 * time.Second,
+		},
+		{
+			testName:           "Throttled without Retry-After",
+			err:                blobError(http.StatusServiceUnavailable, "ServerBusy", nil),
+			expectedCode:       codes.ResourceExhausted,
+			expectedRetryAfter: defaultRetryAfter,
+		},
+		{
+			testName:     "Transient",
+			err:          fmt.Errorf("could not create container: %w", blobError(http.StatusInternalServerError, "", nil)),
+			expectedCode: codes.Unavailable,
+		},
+		{
+			testName:     "Not found",
+			err:          retry.GetError(&http.Response{StatusCode: http.StatusNotFound}, fmt.Errorf("not found")).Error(),
+			expectedCode: codes.NotFound,
+		},
+		{
+			testName:     "Not an Azure error",
+			err:          fmt.Errorf("invalid URL"),
+			expectedCode: codes.Unknown,
+		},
+		{
+			testName:     "Status is kept",
+			err:          status.Error(codes.InvalidArgument, armError(true, 30, http.StatusTooManyRequests).Error()),
+			expectedCode: codes.InvalidArgument,
+		},
+	}
+	for _, test := range tests {
+		st := status.Convert(toStatus(test.err))
+		if st.Code() != test.expectedCode {
+			t.Errorf("\nTestCase: %s\nExpected Code: %v\nActual Code: %v", test.testName, test.expectedCode, st.Code())
+		}
+		var retryAfter time.Duration
+		for _, detail := range st.Details() {
+			if info, ok := detail.(*errdetails.RetryInfo); ok {
+				retryAfter = info.RetryDelay.AsDuration()
+			}
+		}
+		if retryAfter != test.expectedRetryAfter {
+			t.Errorf("\nTestCase: %s\nExpected Retry After: %v\nActual Retry After: %v", test.testName, test.expectedRetryAfter, retryAfter)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientSet "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+const (
+	// DefaultJournalConfigMapName is the ConfigMap the journal of in progress bucket creations is kept in
+	DefaultJournalConfigMapName = "azure-cosi-driver-journal"
+
+	journalStepEnsureStorageAccount = "EnsureStorageAccount"
+	journalStepCreateContainer      = "CreateContainer"
+
+	// journalLeaseDuration is how long the entry of another driver process is considered in progress after it
+	// was last written. It exceeds the longest bucket creation, so that only the entries of processes that are
+	// gone, e.g. the replica a rolling update replaced, are rolled back.
+	journalLeaseDuration = 30 * time.Minute
+)
+
+var (
+	// journalOwner identifies the driver process in the entries it writes. Pods keep their hostname across
+	// container restarts, so a restarted driver rolls back the entries of the process it replaces right away.
+	journalOwner = func() string {
+		hostname, err := os.Hostname()
+		if err != nil {
+			klog.Warningf("Could not get hostname to identify journal entries: %v", err)
+		}
+		return hostname
+	}()
+
+	// journalNow returns the time entries are written at
+	journalNow = time.Now
+)
+
+// JournalEntry records a container bucket creation in progress, so that a creation interrupted
+// between ensuring the storage account and creating the container can be resumed or rolled back.
+type JournalEntry struct {
+	Bucket         string `json:"bucket"`
+	SubscriptionID string `json:"subscriptionID"`
+	ResourceGroup  string `json:"resourceGroup"`
+	StorageAccount string `json:"storageAccount"`
+	Container      string `json:"container"`
+	// Step is the last step the creation started
+	Step string `json:"step"`
+	// AccountCreated is set when the storage account did not exist before the creation started
+	AccountCreated bool `json:"accountCreated"`
+	// ContainerCreated is set when the container was created, rather than adopted, by the creation
+	ContainerCreated bool `json:"containerCreated"`
+	// Driver is the driver instance running the creation. Instances sharing a journal only recover their own entries.
+	Driver string `json:"driver,omitempty"`
+	// Owner is the driver process running the creation, see journalOwner
+	Owner string `json:"owner,omitempty"`
+	// UpdatedAt is when the owner last wrote the entry. The entries of other owners are only rolled back
+	// once they are older than journalLeaseDuration.
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Journal persists the entries of bucket creations in progress, keyed by bucket name
+type Journal interface {
+	// Get returns the entry of the bucket, or nil if there is none
+	Get(ctx context.Context, bucketName string) (*JournalEntry, error)
+	Put(ctx context.Context, entry *JournalEntry) error
+	Delete(ctx context.Context, bucketName string) error
+	List(ctx context.Context) ([]*JournalEntry, error)
+}
+
+// noopJournal keeps no entries. Interrupted creations are still rolled back in process, but not after a restart.
+type noopJournal struct{}
+
+func (noopJournal) Get(context.Context, string) (*JournalEntry, error) { return nil, nil }
+func (noopJournal) Put(context.Context, *JournalEntry) error           { return nil }
+func (noopJournal) Delete(context.Context, string) error               { return nil }
+func (noopJournal) List(context.Context) ([]*JournalEntry, error)      { return nil, nil }
+
+// configMapJournal keeps one entry per bucket in the data of a ConfigMap, keyed by the bucket's container name
+type configMapJournal struct {
+	kubeClient clientSet.Interface
+	namespace  string
+	name       string
+}
+
+// NewConfigMapJournal returns a Journal kept in the named ConfigMap, which is created on first use
+func NewConfigMapJournal(kubeClient clientSet.Interface, namespace, name string) Journal {
+	return &configMapJournal{kubeClient: kubeClient, namespace: namespace, name: name}
+}
+
+func journalKey(bucketName string) (string, error) {
+	// Container names are valid ConfigMap keys and unique per bucket name
+	return getContainerName(bucketName)
+}
+
+// get returns the journal ConfigMap and whether it exists. A missing ConfigMap is returned empty.
+func (j *configMapJournal) get(ctx context.Context) (*v1.ConfigMap, bool, error) {
+	configMap, err := j.kubeClient.CoreV1().ConfigMaps(j.namespace).Get(ctx, j.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: j.namespace, Name: j.name}}, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("could not get journal %s/%s: %v", j.namespace, j.name, err)
+	}
+	return configMap, true, nil
+}
+
+// update applies mutate to the ConfigMap data, retrying on conflicts with concurrent updates.
+// Nothing is written when mutate reports that the data did not change.
+func (j *configMapJournal) update(ctx context.Context, mutate func(data map[string]string) bool) error {
+	return j.updateConfigMap(ctx, func(configMap *v1.ConfigMap) bool {
+		if configMap.Data == nil {
+			configMap.Data = make(map[string]string)
+		}
+		return mutate(configMap.Data)
+	})
+}
+
+// updateConfigMap applies mutate to the ConfigMap, creating it if it does not exist, as update does
+func (j *configMapJournal) updateConfigMap(ctx context.Context, mutate func(configMap *v1.ConfigMap) bool) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, exists, err := j.get(ctx)
+		if err != nil {
+			return err
+		}
+		if !mutate(configMap) {
+			return nil
+		}
+
+		if !exists {
+			_, err = j.kubeClient.CoreV1().ConfigMaps(j.namespace).Create(ctx, configMap, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// Created concurrently, retry as a conflict so the update is applied to it
+				return apierrors.NewConflict(v1.Resource("configmaps"), j.name, err)
+			}
+		} else {
+			_, err = j.kubeClient.CoreV1().ConfigMaps(j.namespace).Update(ctx, configMap, metav1.UpdateOptions{})
+		}
+		return err
+	})
+}
+
+func (j *configMapJournal) Get(ctx context.Context, bucketName string) (*JournalEntry, error) {
+	key, err := journalKey(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	configMap, _, err := j.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := configMap.Data[key]
+	if !ok {
+		return nil, nil
+	}
+
+	entry := &JournalEntry{}
+	if err := json.Unmarshal([]byte(value), entry); err != nil {
+		return nil, fmt.Errorf("could not decode journal entry of bucket %s: %v", bucketName, err)
+	}
+	return entry, nil
+}
+
+func (j *configMapJournal) Put(ctx context.Context, entry *JournalEntry) error {
+	key, err := journalKey(entry.Bucket)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return j.update(ctx, func(data map[string]string) bool {
+		data[key] = string(value)
+		return true
+	})
+}
+
+func (j *configMapJournal) Delete(ctx context.Context, bucketName string) error {
+	key, err := journalKey(bucketName)
+	if err != nil {
+		return err
+	}
+	return j.update(ctx, func(data map[string]string) bool {
+		if _, ok := data[key]; !ok {
+			return false
+		}
+		delete(data, key)
+		return true
+	})
+}
+
+func (j *configMapJournal) List(ctx context.Context) ([]*JournalEntry, error) {
+	configMap, _, err := j.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*JournalEntry, 0, len(configMap.Data))
+	for _, key := range sortedKeys(configMap.Data) {
+		entry := &JournalEntry{}
+		if err := json.Unmarshal([]byte(configMap.Data[key]), entry); err != nil {
+			return nil, fmt.Errorf("could not decode journal entry %s: %v", key, err)
+		}
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(a, b int) bool { return entries[a].Bucket < entries[b].Bucket })
+	return entries, nil
+}
+
+// beginJournalEntry records the start of a bucket creation and returns the entry it proceeds with.
+// A previous entry for the same storage account and container is resumed, any other previous entry
+// of the bucket is rolled back first.
+func beginJournalEntry(
+	ctx context.Context,
+	journal Journal,
+	entry *JournalEntry,
+	createAccount bool,
+	cloud *azure.Cloud) (*JournalEntry, error) {
+	previous, err := journal.Get(ctx, entry.Bucket)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Could not read journal of bucket %s: %v", entry.Bucket, err))
+	}
+	if previous != nil {
+		if previous.SubscriptionID == entry.SubscriptionID &&
+			previous.ResourceGroup == entry.ResourceGroup &&
+			previous.StorageAccount == entry.StorageAccount &&
+			previous.Container == entry.Container {
+			klog.Infof("Resuming creation of bucket %s from step %s", entry.Bucket, previous.Step)
+			return previous, nil
+		}
+		klog.Infof("Rolling back previous creation of bucket %s in storage account %s", entry.Bucket, previous.StorageAccount)
+		if err := rollbackContainerBucket(ctx, journal, previous, cloud); err != nil {
+			return nil, err
+		}
+	}
+
+	exists, err := storageAccountExists(ctx, entry.SubscriptionID, entry.ResourceGroup, entry.StorageAccount, cloud)
+	if err != nil {
+		return nil, err
+	}
+	entry.AccountCreated = createAccount && !exists
+	entry.Driver = driverName
+	entry.Step = journalStepEnsureStorageAccount
+	if err := putJournalEntry(ctx, journal, entry); err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Could not record start of bucket %s: %v", entry.Bucket, err))
+	}
+	return entry, nil
+}
+
+// putJournalEntry writes entry as owned by this driver process
+func putJournalEntry(ctx context.Context, journal Journal, entry *JournalEntry) error {
+	entry.Owner = journalOwner
+	entry.UpdatedAt = journalNow().UTC()
+	return journal.Put(ctx, entry)
+}
+
+// rollbackOnError rolls back the creation recorded by entry and returns err, the error the creation failed with.
+// If the rollback fails the entry is kept, so the creation is resumed on retry or rolled back on restart.
+// A creation interrupted by the cancellation of ctx, e.g. when the driver shuts down, keeps its entry without
+// attempting the rollback, as the Azure calls of the rollback would fail with the same cancelled context.
+func rollbackOnError(ctx context.Context, journal Journal, entry *JournalEntry, cloud *azure.Cloud, err error) error {
+	if ctx.Err() != nil {
+		klog.Infof("Creation of bucket %s was interrupted at step %s, keeping its journal entry", entry.Bucket, entry.Step)
+		return err
+	}
+	if rollbackErr := rollbackContainerBucket(ctx, journal, entry, cloud); rollbackErr != nil {
+		klog.Errorf("Could not roll back creation of bucket %s: %v", entry.Bucket, rollbackErr)
+	}
+	return err
+}
+
+// rollbackContainerBucket undoes what the creation recorded by entry did and removes the entry.
+// The container is only deleted if the creation created it, and the storage account only if the
+// creation created it and no other container has been placed in it since.
+func rollbackContainerBucket(ctx context.Context, journal Journal, entry *JournalEntry, cloud *azure.Cloud) error {
+	exists, err := storageAccountExists(ctx, entry.SubscriptionID, entry.ResourceGroup, entry.StorageAccount, cloud)
+	if err != nil {
+		return err
+	}
+
+	if exists && (entry.ContainerCreated || entry.AccountCreated) {
+		key, err := getStorageAccountKey(ctx, cloud, entry.SubscriptionID, entry.ResourceGroup, entry.StorageAccount)
+		if err != nil {
+			return azureError(err, "Could not get access key of storage account %s", entry.StorageAccount)
+		}
+
+		// A container in an account the creation made can only be the bucket's own, even if the creation
+		// was interrupted before recording that it created it
+		if entry.ContainerCreated || entry.Step == journalStepCreateContainer {
+			err := deleteAzureContainer(ctx, entry.StorageAccount, key, entry.Container)
+			if err != nil && !bloberror.HasCode(err, bloberror.ContainerNotFound) {
+				return azureError(err, "Could not delete container %s in storage account %s", entry.Container, entry.StorageAccount)
+			}
+		}
+
+		if entry.AccountCreated {
+			count, found, err := countContainers(ctx, entry.StorageAccount, key, entry.Container)
+			if err != nil {
+				return azureError(err, "Could not list containers of storage account %s", entry.StorageAccount)
+			}
+			if found {
+				count--
+			}
+			if count > 0 {
+				klog.Warningf("Keeping storage account %s created for bucket %s, it holds %d other containers", entry.StorageAccount, entry.Bucket, count)
+			} else {
+				reqCtx, req, err := startARMRequest(ctx, deleteStorageAccountOperation, entry.SubscriptionID)
+				if err != nil {
+					return err
+				}
+				rerr := cloud.StorageAccountClient.Delete(reqCtx, entry.SubscriptionID, entry.ResourceGroup, entry.StorageAccount)
+				req.endARM(rerr)
+				if rerr != nil && !rerr.IsNotFound() {
+					return azureError(rerr.Error(), "Could not delete storage account %s", entry.StorageAccount)
+				}
+			}
+		}
+	}
+
+	if err := journal.Delete(ctx, entry.Bucket); err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("Could not remove journal entry of bucket %s: %v", entry.Bucket, err))
+	}
+	klog.Infof("Rolled back creation of bucket %s", entry.Bucket)
+	return nil
+}
+
+// storageAccountExists returns whether the storage account exists.
+// An account created by another driver instance is rejected, so that it is neither used nor rolled back.
+func storageAccountExists(ctx context.Context, subsID, resourceGroup, accountName string, cloud *azure.Cloud) (bool, error) {
+	if cloud.StorageAccountClient == nil {
+		return false, fmt.Errorf("StorageAccountClient is nil")
+	}
+
+	reqCtx, req, err := startARMRequest(ctx, getStorageAccountPropertiesOperation, subsID)
+	if err != nil {
+		return false, err
+	}
+	account, rerr := cloud.StorageAccountClient.GetProperties(reqCtx, subsID, resourceGroup, accountName)
+	req.endARM(rerr)
+	if rerr != nil {
+		if rerr.IsNotFound() {
+			return false, nil
+		}
+		return false, azureError(rerr.Error(), "Could not get storage account %s", accountName)
+	}
+	accountKeys.observe(subsID, resourceGroup, account)
+	if err := checkDriverOwner("Storage account "+accountName, getAccountDriverOwner(account.Tags)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RecoverJournal rolls back the bucket creations left in the journal, e.g. by a restart of the driver.
+// Only the entries of this process and the expired entries of other processes are rolled back, so that
+// the creations another replica is still running during a rolling update are left alone.
+// Buckets still requested are created again when the COSI sidecar retries them.
+func RecoverJournal(ctx context.Context, journal Journal, cloud *azure.Cloud) error {
+	entries, err := journal.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, entry := range entries {
+		if entry.Driver != "" && entry.Driver != driverName {
+			klog.V(2).Infof("Skipping creation of bucket %s by driver %s", entry.Bucket, entry.Driver)
+			continue
+		}
+		if entry.Owner != "" && entry.Owner != journalOwner && journalNow().Sub(entry.UpdatedAt) < journalLeaseDuration {
+			klog.Infof("Skipping creation of bucket %s, it may still be in progress in %s", entry.Bucket, entry.Owner)
+			continue
+		}
+		klog.Infof("Rolling back interrupted creation of bucket %s", entry.Bucket)
+		if err := rollbackContainerBucket(ctx, journal, entry, cloud); err != nil {
+			klog.Errorf("Could not roll back creation of bucket %s: %v", entry.Bucket, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("could not roll back %d of %d interrupted bucket creations", failed, len(entries))
+	}
+	return nil
+}
@@ -0,0 +1,665 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/golang/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/storageaccountclient/mockstorageaccountclient"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
+)
+
+const (
+	journalTestAccount = "journalaccount"
+	journalTestBucket  = "journalbucket"
+)
+
+// fakeStorage holds the storage accounts and containers of a fake Azure subscription.
+// Each step of a bucket creation can be made to fail through the fail fields.
+type fakeStorage struct {
+	lock sync.Mutex
+	// accounts maps storage account names to the names of their containers
+	accounts map[string]map[string]bool
+	// tags maps storage account names to the tags they were created with
+	tags map[string]map[string]*string
+	// metadata maps account/container to the metadata headers the container was created with
+	metadata map[string]http.Header
+
+	failCreateAccount   bool
+	failDeleteAccount   bool
+	failCreateContainer bool
+	failDeleteContainer bool
+	// onCreateContainer, when set, is called on every container creation
+	onCreateContainer func()
+	// createAccountGate, when set, holds storage account creations until it is closed
+	createAccountGate chan struct{}
+}
+
+func newFakeStorage(accounts map[string][]string) *fakeStorage {
+	f := &fakeStorage{
+		accounts: make(map[string]map[string]bool),
+		tags:     make(map[string]map[string]*string),
+		metadata: make(map[string]http.Header),
+	}
+	for account, containers := range accounts {
+		f.accounts[account] = make(map[string]bool)
+		for _, container := range containers {
+			f.accounts[account][container] = true
+		}
+	}
+	return f
+}
+
+// state returns the sorted container names of every account
+func (f *fakeStorage) state() map[string][]string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	state := make(map[string][]string)
+	for account, containers := range f.accounts {
+		names := make([]string, 0, len(containers))
+		for name := range containers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		state[account] = names
+	}
+	return state
+}
+
+func (f *fakeStorage) storageAccountClient(ctrl *gomock.Controller) *mockstorageaccountclient.MockInterface {
+	notFound := retry.GetError(&http.Response{StatusCode: http.StatusNotFound}, fmt.Errorf("storage account not found"))
+	failed := retry.GetError(&http.Response{StatusCode: http.StatusForbidden}, fmt.Errorf("injected failure"))
+
+	cl := mockstorageaccountclient.NewMockInterface(ctrl)
+	cl.EXPECT().
+		GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, _, _, name string) (storage.Account, *retry.Error) {
+			f.lock.Lock()
+			defer f.lock.Unlock()
+			if _, ok := f.accounts[name]; !ok {
+				return storage.Account{}, notFound
+			}
+			return storage.Account{Name: to.StringPtr(name), Tags: f.tags[name]}, nil
+		}).
+		AnyTimes()
+	cl.EXPECT().
+		ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, _, _, name string) (storage.AccountListKeysResult, *retry.Error) {
+			f.lock.Lock()
+			defer f.lock.Unlock()
+			if _, ok := f.accounts[name]; !ok {
+				return storage.AccountListKeysResult{}, notFound
+			}
+			return storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: to.StringPtr("a2V5")}}}, nil
+		}).
+		AnyTimes()
+	cl.EXPECT().
+		Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, _, _, name string, params storage.AccountCreateParameters) *retry.Error {
+			if f.createAccountGate != nil {
+				<-f.createAccountGate
+			}
+			f.lock.Lock()
+			defer f.lock.Unlock()
+			if f.failCreateAccount {
+				return failed
+			}
+			f.accounts[name] = make(map[string]bool)
+			f.tags[name] = params.Tags
+			return nil
+		}).
+		AnyTimes()
+	cl.EXPECT().
+		Delete(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, _, _, name string) *retry.Error {
+			f.lock.Lock()
+			defer f.lock.Unlock()
+			if f.failDeleteAccount {
+				return failed
+			}
+			if _, ok := f.accounts[name]; !ok {
+				return notFound
+			}
+			delete(f.accounts, name)
+			return nil
+		}).
+		AnyTimes()
+	return cl
+}
+
+// Do serves the blob requests of a bucket creation from the fake storage accounts
+func (f *fakeStorage) Do(req *http.Request) (*http.Response, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	account := strings.TrimSuffix(req.URL.Host, ".blob.core.windows.net")
+	containers, ok := f.accounts[account]
+	if !ok {
+		return nil, fmt.Errorf("no such host %s", req.URL.Host)
+	}
+	container := strings.Trim(req.URL.Path, "/")
+	query := req.URL.Query()
+
+	switch {
+	case req.Method == http.MethodGet && query.Get("comp") == "list":
+		names := make([]string, 0, len(containers))
+		for name := range containers {
+			names = append(names, fmt.Sprintf("<Container><Name>%s</Name><Properties></Properties></Container>", name))
+		}
+		sort.Strings(names)
+		return blobResponse(req, http.StatusOK, "", fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?><EnumerationResults><Containers>%s</Containers><NextMarker/></EnumerationResults>`, strings.Join(names, ""))), nil
+	case req.Method == http.MethodPut && query.Get("restype") == "container":
+		if f.onCreateContainer != nil {
+			f.onCreateContainer()
+		}
+		if f.failCreateContainer {
+			return blobResponse(req, http.StatusForbidden, "AuthorizationFailure", ""), nil
+		}
+		if containers[container] {
+			return blobResponse(req, http.StatusConflict, "ContainerAlreadyExists", ""), nil
+		}
+		containers[container] = true
+		f.metadata[account+"/"+container] = http.Header{}
+		for k, v := range req.Header {
+			f.metadata[account+"/"+container].Set(k, v[0])
+		}
+		return blobResponse(req, http.StatusCreated, "", ""), nil
+	case req.Method == http.MethodGet && query.Get("restype") == "container":
+		if !containers[container] {
+			return blobResponse(req, http.StatusNotFound, "ContainerNotFound", ""), nil
+		}
+		resp := blobResponse(req, http.StatusOK, "", "")
+		metadata, ok := f.metadata[account+"/"+container]
+		if !ok {
+			resp.Header.Set("x-ms-meta-"+BucketNameMetadataKey, journalTestBucket)
+		}
+		for k, v := range metadata {
+			if strings.HasPrefix(strings.ToLower(k), "x-ms-meta-") {
+				resp.Header.Set(k, v[0])
+			}
+		}
+		return resp, nil
+	case req.Method == http.MethodDelete && query.Get("restype") == "container":
+		if f.failDeleteContainer {
+			return blobResponse(req, http.StatusForbidden, "AuthorizationFailure", ""), nil
+		}
+		if !containers[container] {
+			return blobResponse(req, http.StatusNotFound, "ContainerNotFound", ""), nil
+		}
+		delete(containers, container)
+		delete(f.metadata, account+"/"+container)
+		return blobResponse(req, http.StatusAccepted, "", ""), nil
+	}
+	return nil, fmt.Errorf("unexpected request %s %s", req.Method, req.URL)
+}
+
+func blobResponse(req *http.Request, statusCode int, errorCode, body string) *http.Response {
+	resp := &http.Response{
+		StatusCode: statusCode,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}
+	if errorCode != "" {
+		resp.Header.Set("x-ms-error-code", errorCode)
+	}
+	return resp
+}
+
+// memoryJournal keeps entries in memory. The Nth call to Put or Delete can be made to fail.
+type memoryJournal struct {
+	entries      map[string]JournalEntry
+	puts         int
+	deletes      int
+	failPutAt    int
+	failDeleteAt int
+}
+
+func newMemoryJournal(entries ...JournalEntry) *memoryJournal {
+	j := &memoryJournal{entries: make(map[string]JournalEntry)}
+	for _, entry := range entries {
+		j.entries[entry.Bucket] = entry
+	}
+	return j
+}
+
+func (j *memoryJournal) Get(_ context.Context, bucketName string) (*JournalEntry, error) {
+	entry, ok := j.entries[bucketName]
+	if !ok {
+		return nil, nil
+	}
+	return &entry, nil
+}
+
+func (j *memoryJournal) Put(_ context.Context, entry *JournalEntry) error {
+	j.puts++
+	if j.puts == j.failPutAt {
+		return fmt.Errorf("injected journal failure")
+	}
+	j.entries[entry.Bucket] = *entry
+	return nil
+}
+
+func (j *memoryJournal) Delete(_ context.Context, bucketName string) error {
+	j.deletes++
+	if j.deletes == j.failDeleteAt {
+		return fmt.Errorf("injected journal failure")
+	}
+	delete(j.entries, bucketName)
+	return nil
+}
+
+func (j *memoryJournal) List(context.Context) ([]*JournalEntry, error) {
+	entries := make([]*JournalEntry, 0, len(j.entries))
+	for _, entry := range j.entries {
+		entry := entry
+		entries = append(entries, &entry)
+	}
+	return entries, nil
+}
+
+// journalTestTime is the time journal entries are written at in tests
+var journalTestTime = time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+
+func setJournalClock(t *testing.T, now time.Time) {
+	journalNow = func() time.Time { return now }
+	t.Cleanup(func() { journalNow = time.Now })
+}
+
+// setupFakeStorage returns a cloud whose storage accounts are served by storage, and a context whose blob requests are
+func setupFakeStorage(t *testing.T, storage *fakeStorage) (context.Context, *azure.Cloud) {
+	ctrl := gomock.NewController(t)
+	cloud := azure.GetTestCloud(ctrl)
+	cloud.StorageAccountClient = storage.storageAccountClient(ctrl)
+	return withBlobTransport(context.Background(), storage), cloud
+}
+
+func TestCreateContainerBucketJournal(t *testing.T) {
+	setJournalClock(t, journalTestTime)
+	containerName, _ := getContainerName(journalTestBucket)
+	tests := []struct {
+		testName         string
+		accounts         map[string][]string
+		journal          *memoryJournal
+		inject           func(f *fakeStorage)
+		interrupt        bool
+		expectedCode     codes.Code
+		expectedAccounts map[string][]string
+		expectedEntry    *JournalEntry
+	}{
+		{
+			testName:         "Completed creation leaves no entry",
+			journal:          newMemoryJournal(),
+			expectedCode:     codes.OK,
+			expectedAccounts: map[string][]string{journalTestAccount: {containerName}},
+		},
+		{
+			testName:         "Journal unavailable before any step",
+			journal:          &memoryJournal{entries: map[string]JournalEntry{}, failPutAt: 1},
+			expectedCode:     codes.Internal,
+			expectedAccounts: map[string][]string{},
+		},
+		{
+			testName:         "Storage account creation fails",
+			journal:          newMemoryJournal(),
+			inject:           func(f *fakeStorage) { f.failCreateAccount = true },
+			expectedCode:     codes.PermissionDenied,
+			expectedAccounts: map[string][]string{},
+		},
+		{
+			testName:         "Progress cannot be recorded after storage account creation",
+			journal:          &memoryJournal{entries: map[string]JournalEntry{}, failPutAt: 2},
+			expectedCode:     codes.Internal,
+			expectedAccounts: map[string][]string{},
+		},
+		{
+			testName:         "Container creation fails in created storage account",
+			journal:          newMemoryJournal(),
+			inject:           func(f *fakeStorage) { f.failCreateContainer = true },
+			expectedCode:     codes.PermissionDenied,
+			expectedAccounts: map[string][]string{},
+		},
+		{
+			testName:         "Container creation fails in existing storage account",
+			accounts:         map[string][]string{journalTestAccount: {"other"}},
+			journal:          newMemoryJournal(),
+			inject:           func(f *fakeStorage) { f.failCreateContainer = true },
+			expectedCode:     codes.PermissionDenied,
+			expectedAccounts: map[string][]string{journalTestAccount: {"other"}},
+		},
+		{
+			testName: "Existing container not created by the driver",
+			accounts: map[string][]string{journalTestAccount: {containerName}},
+			journal:  newMemoryJournal(),
+			inject: func(f *fakeStorage) {
+				f.metadata[journalTestAccount+"/"+containerName] = http.Header{}
+			},
+			expectedCode:     codes.InvalidArgument,
+			expectedAccounts: map[string][]string{journalTestAccount: {containerName}},
+		},
+		{
+			testName: "Rollback fails keeps entry",
+			journal:  newMemoryJournal(),
+			inject: func(f *fakeStorage) {
+				f.failCreateContainer = true
+				f.failDeleteAccount = true
+			},
+			expectedCode:     codes.PermissionDenied,
+			expectedAccounts: map[string][]string{journalTestAccount: {}},
+			expectedEntry: &JournalEntry{
+				Bucket:         journalTestBucket,
+				SubscriptionID: "subscription",
+				ResourceGroup:  "rg",
+				StorageAccount: journalTestAccount,
+				Container:      containerName,
+				Step:           journalStepCreateContainer,
+				AccountCreated: true,
+				Owner:          journalOwner,
+				UpdatedAt:      journalTestTime,
+			},
+		},
+		{
+			testName:         "Interrupted creation keeps entry without rollback",
+			journal:          newMemoryJournal(),
+			inject:           func(f *fakeStorage) { f.failCreateContainer = true },
+			interrupt:        true,
+			expectedCode:     codes.PermissionDenied,
+			expectedAccounts: map[string][]string{journalTestAccount: {}},
+			expectedEntry: &JournalEntry{
+				Bucket:         journalTestBucket,
+				SubscriptionID: "subscription",
+				ResourceGroup:  "rg",
+				StorageAccount: journalTestAccount,
+				Container:      containerName,
+				Step:           journalStepCreateContainer,
+				AccountCreated: true,
+				Owner:          journalOwner,
+				UpdatedAt:      journalTestTime,
+			},
+		},
+		{
+			testName:         "Completion cannot be recorded keeps entry",
+			journal:          &memoryJournal{entries: map[string]JournalEntry{}, failDeleteAt: 1},
+			expectedCode:     codes.Internal,
+			expectedAccounts: map[string][]string{journalTestAccount: {containerName}},
+			expectedEntry: &JournalEntry{
+				Bucket:         journalTestBucket,
+				SubscriptionID: "subscription",
+				ResourceGroup:  "rg",
+				StorageAccount: journalTestAccount,
+				Container:      containerName,
+				Step:           journalStepCreateContainer,
+				AccountCreated: true,
+				Owner:          journalOwner,
+				UpdatedAt:      journalTestTime,
+			},
+		},
+	}
+	for _, test := range tests {
+		storage := newFakeStorage(test.accounts)
+		ctx, cloud := setupFakeStorage(t, storage)
+		if test.inject != nil {
+			test.inject(storage)
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		if test.interrupt {
+			storage.onCreateContainer = cancel
+		}
+
+		params := &BucketClassParameters{storageAccountName: journalTestAccount, createStorageAccount: to.BoolPtr(true)}
+		_, err := createContainerBucket(ctx, journalTestBucket, params, test.journal, cloud)
+		cancel()
+		if status.Code(err) != test.expectedCode {
+			t.Errorf("\nTestCase: %s\nExpected Code: %v\nActual Error: %v", test.testName, test.expectedCode, err)
+		}
+		if accounts := storage.state(); !reflect.DeepEqual(accounts, test.expectedAccounts) {
+			t.Errorf("\nTestCase: %s\nExpected Accounts: %v\nActual Accounts: %v", test.testName, test.expectedAccounts, accounts)
+		}
+		entry, _ := test.journal.Get(ctx, journalTestBucket)
+		if !reflect.DeepEqual(entry, test.expectedEntry) {
+			t.Errorf("\nTestCase: %s\nExpected Entry: %+v\nActual Entry: %+v", test.testName, test.expectedEntry, entry)
+		}
+	}
+}
+
+func TestCreateContainerBucketResumes(t *testing.T) {
+	containerName, _ := getContainerName(journalTestBucket)
+	storage := newFakeStorage(map[string][]string{journalTestAccount: {containerName}})
+	ctx, cloud := setupFakeStorage(t, storage)
+
+	// Left behind by a creation which created the account and container but could not record its completion
+	journal := newMemoryJournal(JournalEntry{
+		Bucket:         journalTestBucket,
+		SubscriptionID: "subscription",
+		ResourceGroup:  "rg",
+		StorageAccount: journalTestAccount,
+		Container:      containerName,
+		Step:           journalStepCreateContainer,
+		AccountCreated: true,
+	})
+
+	params := &BucketClassParameters{storageAccountName: journalTestAccount, createStorageAccount: to.BoolPtr(true)}
+	if _, err := createContainerBucket(ctx, journalTestBucket, params, journal, cloud); err != nil {
+		t.Fatalf("unexpected error resuming creation: %v", err)
+	}
+	if len(journal.entries) != 0 {
+		t.Errorf("expected the resumed creation to complete its entry, found %v", journal.entries)
+	}
+	expectedAccounts := map[string][]string{journalTestAccount: {containerName}}
+	if accounts := storage.state(); !reflect.DeepEqual(accounts, expectedAccounts) {
+		t.Errorf("\nExpected Accounts: %v\nActual Accounts: %v", expectedAccounts, accounts)
+	}
+
+	// A retry with a different storage account rolls back the previous creation first
+	journal = newMemoryJournal(JournalEntry{
+		Bucket:         journalTestBucket,
+		SubscriptionID: "subscription",
+		ResourceGroup:  "rg",
+		StorageAccount: "previousaccount",
+		Step:           journalStepEnsureStorageAccount,
+		AccountCreated: true,
+	})
+	storage = newFakeStorage(map[string][]string{"previousaccount": {}})
+	ctx, cloud = setupFakeStorage(t, storage)
+	if _, err := createContainerBucket(ctx, journalTestBucket, params, journal, cloud); err != nil {
+		t.Fatalf("unexpected error after rolling back previous creation: %v", err)
+	}
+	expectedAccounts = map[string][]string{journalTestAccount: {containerName}}
+	if accounts := storage.state(); !reflect.DeepEqual(accounts, expectedAccounts) {
+		t.Errorf("\nExpected Accounts: %v\nActual Accounts: %v", expectedAccounts, accounts)
+	}
+}
+
+func TestRecoverJournal(t *testing.T) {
+	setJournalClock(t, journalTestTime)
+	containerName, _ := getContainerName(journalTestBucket)
+	entry := func(step string, accountCreated, containerCreated bool) JournalEntry {
+		return JournalEntry{
+			Bucket:           journalTestBucket,
+			SubscriptionID:   "subscription",
+			ResourceGroup:    "rg",
+			StorageAccount:   journalTestAccount,
+			Container:        containerName,
+			Step:             step,
+			AccountCreated:   accountCreated,
+			ContainerCreated: containerCreated,
+		}
+	}
+	ownedEntry := func(owner string, age time.Duration) JournalEntry {
+		e := entry(journalStepCreateContainer, true, true)
+		e.Owner = owner
+		e.UpdatedAt = journalTestTime.Add(-age)
+		return e
+	}
+	tests := []struct {
+		testName         string
+		accounts         map[string][]string
+		entry            JournalEntry
+		inject           func(f *fakeStorage)
+		expectedErr      bool
+		expectedKept     bool
+		expectedAccounts map[string][]string
+	}{
+		{
+			testName:         "Interrupted after creating storage account",
+			accounts:         map[string][]string{journalTestAccount: {}},
+			entry:            entry(journalStepEnsureStorageAccount, true, false),
+			expectedAccounts: map[string][]string{},
+		},
+		{
+			testName:         "Interrupted after creating container in created storage account",
+			accounts:         map[string][]string{journalTestAccount: {containerName}},
+			entry:            entry(journalStepCreateContainer, true, false),
+			expectedAccounts: map[string][]string{},
+		},
+		{
+			testName:         "Interrupted after creating container in existing storage account",
+			accounts:         map[string][]string{journalTestAccount: {containerName, "other"}},
+			entry:            entry(journalStepCreateContainer, false, true),
+			expectedAccounts: map[string][]string{journalTestAccount: {"other"}},
+		},
+		{
+			testName:         "Interrupted after adopting container in existing storage account",
+			accounts:         map[string][]string{journalTestAccount: {containerName}},
+			entry:            entry(journalStepCreateContainer, false, false),
+			expectedAccounts: map[string][]string{journalTestAccount: {containerName}},
+		},
+		{
+			testName:         "Created storage account used by another bucket",
+			accounts:         map[string][]string{journalTestAccount: {containerName, "other"}},
+			entry:            entry(journalStepCreateContainer, true, true),
+			expectedAccounts: map[string][]string{journalTestAccount: {"other"}},
+		},
+		{
+			testName:         "Storage account already gone",
+			accounts:         map[string][]string{},
+			entry:            entry(journalStepCreateContainer, true, true),
+			expectedAccounts: map[string][]string{},
+		},
+		{
+			testName:         "Entry of this process",
+			accounts:         map[string][]string{journalTestAccount: {containerName}},
+			entry:            ownedEntry(journalOwner, time.Minute),
+			expectedAccounts: map[string][]string{},
+		},
+		{
+			testName:         "Entry of another process still in progress",
+			accounts:         map[string][]string{journalTestAccount: {containerName}},
+			entry:            ownedEntry("other-replica", time.Minute),
+			expectedKept:     true,
+			expectedAccounts: map[string][]string{journalTestAccount: {containerName}},
+		},
+		{
+			testName:         "Expired entry of another process",
+			accounts:         map[string][]string{journalTestAccount: {containerName}},
+			entry:            ownedEntry("other-replica", journalLeaseDuration),
+			expectedAccounts: map[string][]string{},
+		},
+		{
+			testName:         "Container cannot be deleted",
+			accounts:         map[string][]string{journalTestAccount: {containerName}},
+			entry:            entry(journalStepCreateContainer, true, true),
+			inject:           func(f *fakeStorage) { f.failDeleteContainer = true },
+			expectedErr:      true,
+			expectedKept:     true,
+			expectedAccounts: map[string][]string{journalTestAccount: {containerName}},
+		},
+	}
+	for _, test := range tests {
+		storage := newFakeStorage(test.accounts)
+		ctx, cloud := setupFakeStorage(t, storage)
+		if test.inject != nil {
+			test.inject(storage)
+		}
+
+		journal := newMemoryJournal(test.entry)
+		err := RecoverJournal(ctx, journal, cloud)
+		if (err != nil) != test.expectedErr {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectedErr, err)
+		}
+		if accounts := storage.state(); !reflect.DeepEqual(accounts, test.expectedAccounts) {
+			t.Errorf("\nTestCase: %s\nExpected Accounts: %v\nActual Accounts: %v", test.testName, test.expectedAccounts, accounts)
+		}
+		if remaining := len(journal.entries); (remaining != 0) != test.expectedKept {
+			t.Errorf("\nTestCase: %s\nExpected Entry Kept: %v\nActual Entries: %v", test.testName, test.expectedKept, journal.entries)
+		}
+	}
+}
+
+func TestConfigMapJournal(t *testing.T) {
+	ctx := context.Background()
+	kubeClient := fake.NewSimpleClientset()
+	journal := NewConfigMapJournal(kubeClient, "kube-system", DefaultJournalConfigMapName)
+
+	entries, err := journal.List(ctx)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("expected an empty journal, got %v, %v", entries, err)
+	}
+	// Deleting from a journal which does not exist yet does not create it
+	if err := journal.Delete(ctx, "missing"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kubeClient.CoreV1().ConfigMaps("kube-system").Get(ctx, DefaultJournalConfigMapName, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the journal ConfigMap not to be created, got %v", err)
+	}
+
+	first := &JournalEntry{Bucket: "Bucket A", StorageAccount: "account", Step: journalStepEnsureStorageAccount, AccountCreated: true}
+	second := &JournalEntry{Bucket: "bucket-b", StorageAccount: "account", Step: journalStepCreateContainer}
+	for _, entry := range []*JournalEntry{first, second} {
+		if err := journal.Put(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first.Step = journalStepCreateContainer
+	if err := journal.Put(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := journal.Get(ctx, "Bucket A")
+	if err != nil || !reflect.DeepEqual(entry, first) {
+		t.Errorf("\nExpected Entry: %+v\nActual Entry: %+v, %v", first, entry, err)
+	}
+	entries, err = journal.List(ctx)
+	if err != nil || !reflect.DeepEqual(entries, []*JournalEntry{first, second}) {
+		t.Errorf("\nExpected Entries: %+v\nActual Entries: %+v, %v", []*JournalEntry{first, second}, entries, err)
+	}
+
+	if err := journal.Delete(ctx, "Bucket A"); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := journal.Get(ctx, "Bucket A"); err != nil || entry != nil {
+		t.Errorf("expected deleted entry to be gone, got %+v, %v", entry, err)
+	}
+	if entry, err := journal.Get(ctx, "bucket-b"); err != nil || !reflect.DeepEqual(entry, second) {
+		t.Errorf("\nExpected Entry: %+v\nActual Entry: %+v, %v", second, entry, err)
+	}
+}
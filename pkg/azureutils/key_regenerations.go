@@ -0,0 +1,77 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	clientSet "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// KeysRegeneratedAnnotationPrefix prefixes the annotations of the journal ConfigMap recording when the keys of a
+// storage account, named after the prefix, were last regenerated. The journal ConfigMap is shared by the driver
+// processes, so key regenerations run from the command line reach the key caches of the running drivers through it.
+const KeysRegeneratedAnnotationPrefix = "keys-regenerated.cosi.azure.com/"
+
+// RecordKeyRegeneration records in the journal ConfigMap that the keys of the storage account were just regenerated,
+// so that drivers watching it with WatchKeyRegenerations drop the keys they cached before
+func RecordKeyRegeneration(ctx context.Context, kubeClient clientSet.Interface, namespace, name, account string) error {
+	journal := &configMapJournal{kubeClient: kubeClient, namespace: namespace, name: name}
+	regenerated := time.Now().UTC().Format(time.RFC3339Nano)
+	return journal.updateConfigMap(ctx, func(configMap *v1.ConfigMap) bool {
+		if configMap.Annotations == nil {
+			configMap.Annotations = make(map[string]string)
+		}
+		configMap.Annotations[KeysRegeneratedAnnotationPrefix+strings.ToLower(account)] = regenerated
+		return true
+	})
+}
+
+// WatchKeyRegenerations drops the cached keys of the storage accounts whose regeneration is recorded in the journal
+// ConfigMap, see RecordKeyRegeneration, until stop is closed
+func WatchKeyRegenerations(kubeClient clientSet.Interface, namespace, name string, stop <-chan struct{}) {
+	listWatch := cache.NewListWatchFromClient(kubeClient.CoreV1().RESTClient(), "configmaps", namespace, fields.OneTermEqualSelector("metadata.name", name))
+	informer := cache.NewSharedIndexInformer(listWatch, &v1.ConfigMap{}, 0, cache.Indexers{})
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { dropRegeneratedKeys(obj) },
+		UpdateFunc: func(_, obj interface{}) { dropRegeneratedKeys(obj) },
+	})
+	go informer.Run(stop)
+}
+
+// dropRegeneratedKeys drops the cached keys fetched before the regenerations recorded in the annotations of the ConfigMap
+func dropRegeneratedKeys(obj interface{}) {
+	configMap, ok := obj.(*v1.ConfigMap)
+	if !ok {
+		return
+	}
+	for key, value := range configMap.Annotations {
+		account := strings.TrimPrefix(key, KeysRegeneratedAnnotationPrefix)
+		if account == key {
+			continue
+		}
+		regenerated, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			klog.Warningf("Ignoring annotation %s of ConfigMap %s/%s: %v", key, configMap.Namespace, configMap.Name, err)
+			continue
+		}
+		accountKeys.dropFetchedBefore(account, regenerated)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRecordKeyRegeneration(t *testing.T) {
+	defer func(cache *accountKeyCache) { accountKeys = cache }(accountKeys)
+	server, cloud := newKeyServer(t)
+	accountKeys = newAccountKeyCache(time.Hour)
+
+	// The regeneration is recorded in the journal ConfigMap, which is created if needed, without touching the journal entries
+	kubeClient := fake.NewSimpleClientset()
+	journal := NewConfigMapJournal(kubeClient, "kube-system", DefaultJournalConfigMapName)
+	if err := journal.Put(context.Background(), &JournalEntry{Bucket: journalTestBucket}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getStorageAccountKey(context.Background(), cloud, "subscription", "rg", "account"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordKeyRegeneration(context.Background(), kubeClient, "kube-system", DefaultJournalConfigMapName, "Account"); err != nil {
+		t.Fatal(err)
+	}
+	configMap, err := kubeClient.CoreV1().ConfigMaps("kube-system").Get(context.Background(), DefaultJournalConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := configMap.Annotations[KeysRegeneratedAnnotationPrefix+"account"]; !ok {
+		t.Errorf("expected the regeneration to be recorded in the annotations of the journal, got %v", configMap.Annotations)
+	}
+	if entries, err := journal.List(context.Background()); err != nil || len(entries) != 1 {
+		t.Errorf("expected the journal entry to be kept, got %v, %v", entries, err)
+	}
+
+	// Keys cached before the regeneration are dropped, keys cached after it are kept
+	tests := []struct {
+		testName      string
+		configMap     interface{}
+		expectedCalls int32
+	}{
+		{
+			testName:      "Regeneration recorded after the keys were cached",
+			configMap:     configMap,
+			expectedCalls: 2,
+		},
+		{
+			testName:      "Same regeneration seen again",
+			configMap:     configMap,
+			expectedCalls: 2,
+		},
+		{
+			testName: "Invalid annotation",
+			configMap: &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+				KeysRegeneratedAnnotationPrefix + "account": "yesterday",
+			}}},
+			expectedCalls: 2,
+		},
+		{
+			testName:      "Not a ConfigMap",
+			configMap:     "account",
+			expectedCalls: 2,
+		},
+	}
+	for _, test := range tests {
+		dropRegeneratedKeys(test.configMap)
+		if _, err := getStorageAccountKey(context.Background(), cloud, "subscription", "rg", "account"); err != nil {
+			t.Fatal(err)
+		}
+		if calls := atomic.LoadInt32(&server.calls); calls != test.expectedCalls {
+			t.Errorf("\nTestCase: %s\nExpected ListKeys Calls: %d\nActual ListKeys Calls: %d", test.testName, test.expectedCalls, calls)
+		}
+	}
+}
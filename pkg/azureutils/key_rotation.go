@@ -0,0 +1,426 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"project/azure-cosi-driver/pkg/constant"
+	"project/azure-cosi-driver/pkg/types"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
+	"github.com/Azure/go-autorest/autorest"
+	autorestazure "github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	clientSet "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+	"sigs.k8s.io/cloud-provider-azure/pkg/auth"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
+)
+
+const (
+	// SigningKeyTag is the storage account tag recording the key SAS tokens of the account are signed with, key1 or key2.
+	// Accounts without it are signed with their first key.
+	SigningKeyTag = "cosi-signing-key"
+	// KeysRegeneratedTag is the storage account tag recording when a key of the account was last regenerated by the driver
+	KeysRegeneratedTag = "cosi-keys-regenerated"
+	// SigningKeySwitchedTag is the storage account tag recording, while a key rotation is in progress, the time from
+	// which grants are signed with the key of the SigningKeyTag. Grants made before may hold credentials of the other key,
+	// which is regenerated once they were all granted again.
+	SigningKeySwitchedTag = "cosi-signing-key-switched"
+
+	// reasonStorageAccountKeyRotation is the reason of the events recorded on the BucketAccesses holding credentials
+	// of a key being rotated
+	reasonStorageAccountKeyRotation = "StorageAccountKeyRotation"
+)
+
+// storageAccountKeyRegenerator regenerates the keys of storage accounts.
+// azure.Cloud has no client for it, so it is made with the credentials of the cloud config.
+type storageAccountKeyRegenerator interface {
+	regenerateKey(ctx context.Context, resourceGroup, account, keyName string) error
+}
+
+// newKeyRegenerator returns the regenerator of the storage account keys of the subscription, replaced in tests
+var newKeyRegenerator = func(cloud *azure.Cloud, subsID string) (storageAccountKeyRegenerator, error) {
+	authorizer, err := getARMAuthorizer(cloud)
+	if err != nil {
+		return nil, err
+	}
+	client := storage.NewAccountsClientWithBaseURI(cloud.Environment.ResourceManagerEndpoint, subsID)
+	client.Authorizer = authorizer
+	return &armKeyRegenerator{client: client, subsID: subsID}, nil
+}
+
+// getARMAuthorizer returns an authorizer of ARM requests with the credentials of the cloud config,
+// for the storage management clients azure.Cloud does not have
+func getARMAuthorizer(cloud *azure.Cloud) (autorest.Authorizer, error) {
+	token, err := auth.GetServicePrincipalToken(&cloud.AzureAuthConfig, &cloud.Environment, cloud.Environment.ServiceManagementEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("could not get a token for ARM: %v", err)
+	}
+	return autorest.NewBearerAuthorizer(token), nil
+}
+
+type armKeyRegenerator struct {
+	client storage.AccountsClient
+	subsID string
+}
+
+func (r *armKeyRegenerator) regenerateKey(ctx context.Context, resourceGroup, account, keyName string) error {
+	reqCtx, req, err := startARMRequest(ctx, regenerateStorageAccountKeyOperation, r.subsID)
+	if err != nil {
+		return err
+	}
+	result, err := r.client.RegenerateKey(reqCtx, resourceGroup, account, storage.AccountRegenerateKeyParameters{KeyName: to.StringPtr(keyName)})
+	// Report the error as cloud-provider-azure clients do, so it is classified like theirs
+	rerr := retry.GetError(result.Response.Response, err)
+	req.endARM(rerr)
+	return rerr.Error()
+}
+
+// StorageAccountRef identifies a storage account
+type StorageAccountRef struct {
+	SubscriptionID string
+	ResourceGroup  string
+	Name           string
+}
+
+// ParseStorageAccount parses a storage account ARM resource ID, or a storage account name which
+// is looked up in the subscription and resource group of the cloud config
+func ParseStorageAccount(account string, cloud *azure.Cloud) (StorageAccountRef, error) {
+	if !strings.HasPrefix(account, "/") {
+		if !isValidStorageAccountName(account) {
+			return StorageAccountRef{}, fmt.Errorf("invalid storage account name %q", account)
+		}
+		return StorageAccountRef{SubscriptionID: cloud.SubscriptionID, ResourceGroup: cloud.ResourceGroup, Name: account}, nil
+	}
+
+	resource, err := autorestazure.ParseResourceID(account)
+	if err != nil {
+		return StorageAccountRef{}, err
+	}
+	if !strings.EqualFold(resource.Provider, "Microsoft.Storage") || !strings.EqualFold(resource.ResourceType, "storageAccounts") {
+		return StorageAccountRef{}, fmt.Errorf("%s is not a storage account", account)
+	}
+	return StorageAccountRef{SubscriptionID: resource.SubscriptionID, ResourceGroup: resource.ResourceGroup, Name: resource.ResourceName}, nil
+}
+
+// KeyRotation is the outcome of a storage account key rotation
+type KeyRotation struct {
+	// PreviousKey is the key grants were signed with before the rotation, which was regenerated
+	PreviousKey string
+	// SigningKey is the key grants are signed with after the rotation
+	SigningKey string
+	// PendingGrants is the number of grants that hold a SAS signed with, or hold, PreviousKey, on which an event asking
+	// for them to be granted again was recorded. PreviousKey is only regenerated once there are none.
+	PendingGrants int
+}
+
+// keyRotationWait waits for d, or until ctx is done. It is replaced in tests.
+var keyRotationWait = func(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RotateStorageAccountKey switches the storage account to signing SAS tokens with its other key and regenerates
+// the key it signed them with. The SigningKeyTag of the account is switched first, then the longest of gracePeriod,
+// for grants being signed with the previous key to complete, and keyCacheTTL, for running drivers to look the tag up
+// again, is waited for.
+// The credentials secrets of the grants belong to the COSI sidecar and are not rewritten. Instead the previous key
+// is only regenerated once no grant holds credentials of it: an event is recorded on every BucketAccess granted before
+// the switch asking for it to be granted again, and the rotation fails with codes.FailedPrecondition. Running the
+// rotation again once they were granted again resumes it and regenerates the previous key.
+// A rotation is refused less than keyCacheTTL after keys of the account were last regenerated, as drivers may still
+// hold the regenerated key in their key cache.
+func RotateStorageAccountKey(ctx context.Context, cloud *azure.Cloud, kubeClient clientSet.Interface, recorder record.EventRecorder, account StorageAccountRef, gracePeriod, keyCacheTTL time.Duration) (*KeyRotation, error) {
+	tags, err := getStorageAccountTags(ctx, cloud, account)
+	if err != nil {
+		return nil, err
+	}
+	if regenerated, ok := tags[KeysRegeneratedTag]; ok && regenerated != nil {
+		if at, err := time.Parse(time.RFC3339, *regenerated); err == nil && time.Since(at) < keyCacheTTL {
+			return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("Keys of storage account %s were regenerated at %s, rotate them again after %s",
+				account.Name, *regenerated, at.Add(keyCacheTTL).UTC().Format(time.RFC3339)))
+		}
+	}
+
+	rotation := &KeyRotation{PreviousKey: Key1Name, SigningKey: Key2Name}
+	if current, ok := tags[SigningKeyTag]; ok && current != nil && strings.EqualFold(*current, Key2Name) {
+		rotation.PreviousKey, rotation.SigningKey = Key2Name, Key1Name
+	}
+	regenerator, err := newKeyRegenerator(cloud, account.SubscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	wait := gracePeriod
+	if keyCacheTTL > wait {
+		wait = keyCacheTTL
+	}
+	switched, resumed := getSigningKeySwitched(tags)
+	if resumed {
+		// The tag was switched by a rotation waiting for grants to be granted again, which regenerates the other key
+		rotation.PreviousKey, rotation.SigningKey = rotation.SigningKey, rotation.PreviousKey
+		klog.Infof("Resuming the rotation of %s of storage account %s", rotation.PreviousKey, account.Name)
+		wait = time.Until(switched)
+	} else {
+		switched = time.Now().Add(wait).UTC()
+		klog.Infof("Switching storage account %s to signing with %s", account.Name, rotation.SigningKey)
+		if err := setStorageAccountTags(ctx, cloud, account, tags, map[string]string{
+			SigningKeyTag:         rotation.SigningKey,
+			SigningKeySwitchedTag: switched.Format(time.RFC3339),
+		}); err != nil {
+			return nil, err
+		}
+		InvalidateStorageAccountKey(account.SubscriptionID, account.ResourceGroup, account.Name)
+	}
+
+	if wait > 0 {
+		klog.Infof("Waiting %v for drivers to sign with %s of storage account %s", wait, rotation.SigningKey, account.Name)
+		if err := keyRotationWait(ctx, wait); err != nil {
+			return rotation, err
+		}
+	}
+
+	pending, err := getPendingGrants(ctx, kubeClient, account, tags, rotation.PreviousKey, switched)
+	if err != nil {
+		return rotation, azureError(err, "Could not list the grants of storage account %s, %s was not regenerated", account.Name, rotation.PreviousKey)
+	}
+	if rotation.PendingGrants = len(pending); rotation.PendingGrants > 0 {
+		for _, access := range pending {
+			klog.Warningf("Bucket access %s/%s holds credentials of %s of storage account %s, which is being rotated", access.Namespace, access.Name, rotation.PreviousKey, account.Name)
+			recorder.Eventf(&v1.ObjectReference{APIVersion: cosiAPIVersion, Kind: bucketAccessKind, Namespace: access.Namespace, Name: access.Name, UID: k8stypes.UID(access.UID)},
+				v1.EventTypeWarning, reasonStorageAccountKeyRotation,
+				"%s of storage account %s is being rotated and will be regenerated. Delete and recreate this bucket access to be granted credentials of %s before it is.",
+				rotation.PreviousKey, account.Name, rotation.SigningKey)
+		}
+		return rotation, status.Error(codes.FailedPrecondition, fmt.Sprintf("%d grants of storage account %s hold credentials of %s, rotate again once they were granted again to regenerate it",
+			rotation.PendingGrants, account.Name, rotation.PreviousKey))
+	}
+
+	klog.Infof("Regenerating %s of storage account %s", rotation.PreviousKey, account.Name)
+	delete(tags, SigningKeySwitchedTag)
+	if err := regenerateStorageAccountKeys(ctx, cloud, regenerator, account, tags, rotation.PreviousKey); err != nil {
+		return rotation, err
+	}
+	return rotation, nil
+}
+
+// getSigningKeySwitched returns the time recorded by the SigningKeySwitchedTag of the storage account,
+// and whether a rotation is in progress
+func getSigningKeySwitched(tags map[string]*string) (time.Time, bool) {
+	value, ok := tags[SigningKeySwitchedTag]
+	if !ok || value == nil {
+		return time.Time{}, false
+	}
+	switched, err := time.Parse(time.RFC3339, *value)
+	if err != nil {
+		klog.Warningf("Ignoring tag %s=%s: %v", SigningKeySwitchedTag, *value, err)
+		return time.Time{}, false
+	}
+	return switched, true
+}
+
+// RevokeAccountKeySAS regenerates both keys of the storage account, which revokes every SAS signed with them at once.
+// Drivers holding the keys in their key cache keep signing with the revoked keys until the cache expires, unless the
+// regeneration is recorded with RecordKeyRegeneration.
+func RevokeAccountKeySAS(ctx context.Context, cloud *azure.Cloud, account StorageAccountRef) error {
+	tags, err := getStorageAccountTags(ctx, cloud, account)
+	if err != nil {
+		return err
+	}
+	regenerator, err := newKeyRegenerator(cloud, account.SubscriptionID)
+	if err != nil {
+		return err
+	}
+
+	klog.Infof("Regenerating both keys of storage account %s", account.Name)
+	return regenerateStorageAccountKeys(ctx, cloud, regenerator, account, tags, Key1Name, Key2Name)
+}
+
+// regenerateStorageAccountKeys regenerates the keys of the storage account and records when in its KeysRegeneratedTag
+func regenerateStorageAccountKeys(ctx context.Context, cloud *azure.Cloud, regenerator storageAccountKeyRegenerator, account StorageAccountRef, tags map[string]*string, keyNames ...string) error {
+	defer InvalidateStorageAccountKey(account.SubscriptionID, account.ResourceGroup, account.Name)
+	for _, keyName := range keyNames {
+		if err := regenerator.regenerateKey(ctx, account.ResourceGroup, account.Name, keyName); err != nil {
+			return azureError(err, "Could not regenerate %s of storage account %s", keyName, account.Name)
+		}
+	}
+	return setStorageAccountTags(ctx, cloud, account, tags, map[string]string{KeysRegeneratedTag: time.Now().UTC().Format(time.RFC3339)})
+}
+
+// getSigningKeyName returns the key recorded by the SigningKeyTag of the storage account, or "" if there is none.
+// An account that cannot be found has none, its keys are then reported missing when they are listed.
+func getSigningKeyName(ctx context.Context, cloud *azure.Cloud, subsID, resourceGroup, account string) (string, error) {
+	if cloud == nil || cloud.StorageAccountClient == nil {
+		return "", nil
+	}
+	reqCtx, req, err := startARMRequest(ctx, getStorageAccountPropertiesOperation, subsID)
+	if err != nil {
+		return "", err
+	}
+	result, rerr := cloud.StorageAccountClient.GetProperties(reqCtx, subsID, resourceGroup, account)
+	req.endARM(rerr)
+	if rerr != nil {
+		if rerr.IsNotFound() {
+			return "", nil
+		}
+		return "", azureError(rerr.Error(), "Could not get storage account %s", account)
+	}
+	accountKeys.observe(subsID, resourceGroup, result)
+	if keyName, ok := result.Tags[SigningKeyTag]; ok && keyName != nil {
+		return strings.ToLower(*keyName), nil
+	}
+	return "", nil
+}
+
+// getStorageAccountTags returns the tags of a storage account this driver instance may manage the keys of
+func getStorageAccountTags(ctx context.Context, cloud *azure.Cloud, account StorageAccountRef) (map[string]*string, error) {
+	if cloud.StorageAccountClient == nil {
+		return nil, fmt.Errorf("StorageAccountClient is nil")
+	}
+	reqCtx, req, err := startARMRequest(ctx, getStorageAccountPropertiesOperation, account.SubscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	result, rerr := cloud.StorageAccountClient.GetProperties(reqCtx, account.SubscriptionID, account.ResourceGroup, account.Name)
+	req.endARM(rerr)
+	if rerr != nil {
+		return nil, azureError(rerr.Error(), "Could not get storage account %s", account.Name)
+	}
+	accountKeys.observe(account.SubscriptionID, account.ResourceGroup, result)
+	if err := checkDriverOwner("Storage account "+account.Name, getAccountDriverOwner(result.Tags)); err != nil {
+		return nil, err
+	}
+	if result.Tags == nil {
+		return map[string]*string{}, nil
+	}
+	return result.Tags, nil
+}
+
+// setStorageAccountTags sets tags on the storage account, keeping its other tags, and records them in tags
+func setStorageAccountTags(ctx context.Context, cloud *azure.Cloud, account StorageAccountRef, tags map[string]*string, set map[string]string) error {
+	for k, v := range set {
+		tags[k] = to.StringPtr(v)
+	}
+	reqCtx, req, err := startARMRequest(ctx, updateStorageAccountOperation, account.SubscriptionID)
+	if err != nil {
+		return err
+	}
+	rerr := cloud.StorageAccountClient.Update(reqCtx, account.SubscriptionID, account.ResourceGroup, account.Name, storage.AccountUpdateParameters{Tags: tags})
+	req.endARM(rerr)
+	if rerr != nil {
+		return azureError(rerr.Error(), "Could not update the tags of storage account %s", account.Name)
+	}
+	return nil
+}
+
+// getPendingGrants returns the granted BucketAccesses of this driver instance on the storage account whose
+// credentials may be signed with, or be, the key named keyName. SAS grants are, when their BucketAccess was created
+// before switched, the time from which grants are signed with the other key. Grants of SFTP local users do not depend
+// on the keys and are skipped. Grants of storage account keys are when the tags of the account record they hold keyName.
+func getPendingGrants(ctx context.Context, kubeClient clientSet.Interface, account StorageAccountRef, tags map[string]*string, keyName string, switched time.Time) ([]objectMeta, error) {
+	accesses, err := listBucketAccesses(ctx, kubeClient)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []objectMeta
+	for _, access := range accesses {
+		name := access.Metadata.Namespace + "/" + access.Metadata.Name
+		if !access.Status.AccessGranted {
+			continue
+		}
+		class, err := getBucketAccessClass(ctx, kubeClient, access.Spec.BucketAccessClassName)
+		if err != nil {
+			return nil, err
+		}
+		if (driverName != "" && class.DriverName != driverName) || class.AuthenticationType != keyAuthenticationType {
+			continue
+		}
+		bucketID, err := getGrantBucketID(ctx, kubeClient, access)
+		if apierrors.IsNotFound(err) {
+			klog.Infof("Skipping bucket access %s: %v", name, err)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if !isBucketOfStorageAccount(bucketID, account) {
+			continue
+		}
+		params, err := parseBucketAccessClassParameters(class.Parameters)
+		if err != nil {
+			return nil, azureError(err, "Could not parse the parameters of bucket access %s", name)
+		}
+		switch params.credentialMode {
+		case constant.SFTPCredentialMode:
+			continue
+		case constant.AccountKeyCredentialMode:
+			grants := parseAccountKeyGrants(tags)
+			i := findAccountKeyGrant(grants, getAccountKeyGrantID(bucketAccessAccountPrefix+access.Metadata.UID))
+			if i < 0 || !strings.EqualFold(grants[i].keyName, keyName) {
+				continue
+			}
+		default:
+			if !access.Metadata.CreationTimestamp.Before(switched) {
+				continue
+			}
+		}
+		pending = append(pending, access.Metadata)
+	}
+	return pending, nil
+}
+
+// getGrantBucketID returns the ID of the bucket the BucketAccess grants access to
+func getGrantBucketID(ctx context.Context, kubeClient clientSet.Interface, access bucketAccessObject) (string, error) {
+	claim, err := getBucketClaimObject(ctx, kubeClient, access.Metadata.Namespace, access.Spec.BucketClaimName)
+	if err != nil {
+		return "", err
+	}
+	if claim.Status.BucketName == "" {
+		return "", fmt.Errorf("bucket claim %s/%s has no bucket", access.Metadata.Namespace, access.Spec.BucketClaimName)
+	}
+	bucket, err := getBucket(ctx, kubeClient, claim.Status.BucketName)
+	if err != nil {
+		return "", err
+	}
+	return bucket.Status.BucketID, nil
+}
+
+// isBucketOfStorageAccount returns whether the bucket ID is a container of, or is, the storage account
+func isBucketOfStorageAccount(bucketID string, account StorageAccountRef) bool {
+	id, err := types.DecodeToBucketID(bucketID)
+	if err != nil {
+		return false
+	}
+	if !strings.EqualFold(getStorageAccountNameFromContainerURL(id.URL), account.Name) {
+		return false
+	}
+	return (id.SubID == "" || strings.EqualFold(id.SubID, account.SubscriptionID)) &&
+		(id.ResourceGroup == "" || strings.EqualFold(id.ResourceGroup, account.ResourceGroup))
+}
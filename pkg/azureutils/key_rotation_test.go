@@ -0,0 +1,443 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"project/azure-cosi-driver/pkg/constant"
+	"project/azure-cosi-driver/pkg/types"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/golang/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientSet "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/storageaccountclient/mockstorageaccountclient"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
+)
+
+const oldContainerSAS = constant.ValidContainerURL + "?sv=2020-02-10&sig=old"
+
+// fakeRegenerator records the keys it regenerates
+type fakeRegenerator struct {
+	regenerated []string
+}
+
+func (r *fakeRegenerator) regenerateKey(_ context.Context, _, _, keyName string) error {
+	r.regenerated = append(r.regenerated, keyName)
+	return nil
+}
+
+// newKeyRotationCloud returns a cloud whose storage account has tags, lists only the keys named keyNames,
+// and records tag updates in tags
+func newKeyRotationCloud(t *testing.T, tags map[string]*string, keyNames ...string) *azure.Cloud {
+	ctrl := gomock.NewController(t)
+	cloud := azure.GetTestCloud(ctrl)
+	cl := mockstorageaccountclient.NewMockInterface(ctrl)
+	var keys []storage.AccountKey
+	for _, keyName := range keyNames {
+		keys = append(keys, storage.AccountKey{KeyName: to.StringPtr(keyName), Value: to.StringPtr("a2V5")})
+	}
+	cl.EXPECT().
+		ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(storage.AccountListKeysResult{Keys: &keys}, nil).
+		AnyTimes()
+	cl.EXPECT().
+		GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), constant.ValidAccount).
+		DoAndReturn(func(context.Context, string, string, string) (storage.Account, *retry.Error) {
+			return storage.Account{Name: to.StringPtr(constant.ValidAccount), Tags: tags}, nil
+		}).
+		AnyTimes()
+	cl.EXPECT().
+		Update(gomock.Any(), gomock.Any(), gomock.Any(), constant.ValidAccount, gomock.Any()).
+		DoAndReturn(func(_ context.Context, _, _, _ string, parameters storage.AccountUpdateParameters) *retry.Error {
+			for k, v := range parameters.Tags {
+				tags[k] = v
+			}
+			return nil
+		}).
+		AnyTimes()
+	cloud.StorageAccountClient = cl
+	return cloud
+}
+
+// newCOSIServer serves the COSI objects and secrets in objects by path, and stores the secrets PUT to it
+func newCOSIServer(t *testing.T, objects map[string]interface{}) clientSet.Interface {
+	var lock sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if r.Method == http.MethodPut {
+			secret := &v1.Secret{}
+			body, _ := io.ReadAll(r.Body)
+			if err := json.Unmarshal(body, secret); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			objects[r.URL.Path] = secret
+		}
+		object, ok := objects[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(object); err != nil {
+			t.Error(err)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	kubeClient, err := clientSet.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kubeClient
+}
+
+// grantObjects returns the COSI objects of a BucketAccess created at created granting access to a container of the
+// valid account, and of one of another driver, with their credentials secrets
+func grantObjects(t *testing.T, parameters map[string]string, created time.Time) map[string]interface{} {
+	bucketID, err := (&types.BucketID{SubID: "subscription", ResourceGroup: "rg", URL: constant.ValidContainerURL}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketInfo := fmt.Sprintf(`{"spec":{"bucketName":"bucket","secretAzure":{"accessToken":%q}}}`, oldContainerSAS)
+	secret := func(name string) *v1.Secret {
+		return &v1.Secret{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "team-a"},
+			Data:       map[string][]byte{"BucketInfo": []byte(bucketInfo)},
+		}
+	}
+	access := func(name, class string) map[string]interface{} {
+		return map[string]interface{}{
+			"metadata": map[string]string{"name": name, "namespace": "team-a", "uid": name + "-uid", "creationTimestamp": created.Format(time.RFC3339)},
+			"spec":     map[string]string{"bucketClaimName": "claim", "bucketAccessClassName": class, "credentialsSecretName": name + "-creds"},
+			"status":   map[string]bool{"accessGranted": true},
+		}
+	}
+	return map[string]interface{}{
+		cosiAPIPath + "/bucketaccesses": map[string]interface{}{"items": []interface{}{
+			access("access", "sas"),
+			access("other", "othersas"),
+		}},
+		cosiAPIPath + "/namespaces/team-a/bucketclaims/claim": map[string]interface{}{"status": map[string]string{"bucketName": "bucket"}},
+		cosiAPIPath + "/buckets/bucket":                       map[string]interface{}{"status": map[string]string{"bucketID": bucketID}},
+		cosiAPIPath + "/bucketaccessclasses/sas": map[string]interface{}{
+			"driverName": "test-driver", "authenticationType": keyAuthenticationType, "parameters": parameters,
+		},
+		cosiAPIPath + "/bucketaccessclasses/othersas": map[string]interface{}{
+			"driverName": "other-driver", "authenticationType": keyAuthenticationType, "parameters": parameters,
+		},
+		"/api/v1/namespaces/team-a/secrets/access-creds": secret("access-creds"),
+		"/api/v1/namespaces/team-a/secrets/other-creds":  secret("other-creds"),
+	}
+}
+
+// accessToken returns the accessToken of the BucketInfo in the secret at path
+func accessToken(t *testing.T, objects map[string]interface{}, path string) string {
+	bucketInfo := struct {
+		Spec struct {
+			SecretAzure struct {
+				AccessToken string `json:"accessToken"`
+			} `json:"secretAzure"`
+		} `json:"spec"`
+	}{}
+	if err := json.Unmarshal(objects[path].(*v1.Secret).Data["BucketInfo"], &bucketInfo); err != nil {
+		t.Fatal(err)
+	}
+	return bucketInfo.Spec.SecretAzure.AccessToken
+}
+
+func TestRotateStorageAccountKey(t *testing.T) {
+	SetDriverName("test-driver")
+	defer SetDriverName("")
+	defer func(f func(*azure.Cloud, string) (storageAccountKeyRegenerator, error)) { newKeyRegenerator = f }(newKeyRegenerator)
+	defer func(f func(context.Context, time.Duration) error) { keyRotationWait = f }(keyRotationWait)
+	var waited time.Duration
+	keyRotationWait = func(_ context.Context, d time.Duration) error {
+		waited = d
+		return nil
+	}
+
+	account := StorageAccountRef{SubscriptionID: "subscription", ResourceGroup: "rg", Name: constant.ValidAccount}
+	containerSAS := map[string]string{constant.BucketUnitTypeField: constant.Container.String()}
+	now := time.Now().UTC()
+	tests := []struct {
+		testName string
+		tags     map[string]*string
+		// keys are the keys ListKeys returns, a grant signed with any other key fails
+		keys       []string
+		parameters map[string]string
+		// granted is when the BucketAccess of the grant was created
+		granted             time.Time
+		expectedRotation    *KeyRotation
+		expectedRegenerated []string
+		expectedSigningKey  string
+		expectedSwitched    bool
+		expectedWait        time.Duration
+		expectedCode        codes.Code
+	}{
+		{
+			testName:           "First rotation waits for grants made before the switch",
+			tags:               map[string]*string{},
+			keys:               []string{Key2Name},
+			parameters:         containerSAS,
+			granted:            now.Add(-24 * time.Hour),
+			expectedRotation:   &KeyRotation{PreviousKey: Key1Name, SigningKey: Key2Name, PendingGrants: 1},
+			expectedSigningKey: Key2Name,
+			expectedSwitched:   true,
+			expectedWait:       time.Hour,
+			expectedCode:       codes.FailedPrecondition,
+		},
+		{
+			testName:            "First rotation without grants made before the switch",
+			tags:                map[string]*string{},
+			keys:                []string{Key2Name},
+			parameters:          containerSAS,
+			granted:             now.Add(2 * time.Hour),
+			expectedRotation:    &KeyRotation{PreviousKey: Key1Name, SigningKey: Key2Name},
+			expectedRegenerated: []string{Key1Name},
+			expectedSigningKey:  Key2Name,
+			expectedWait:        time.Hour,
+		},
+		{
+			testName:            "Rotation resumed once grants were granted again",
+			tags:                map[string]*string{SigningKeyTag: to.StringPtr(Key2Name), SigningKeySwitchedTag: to.StringPtr(now.Add(-time.Hour).Format(time.RFC3339))},
+			keys:                []string{Key2Name},
+			parameters:          containerSAS,
+			granted:             now,
+			expectedRotation:    &KeyRotation{PreviousKey: Key1Name, SigningKey: Key2Name},
+			expectedRegenerated: []string{Key1Name},
+			expectedSigningKey:  Key2Name,
+		},
+		{
+			testName:           "Rotation resumed while grants hold the previous key",
+			tags:               map[string]*string{SigningKeyTag: to.StringPtr(Key2Name), SigningKeySwitchedTag: to.StringPtr(now.Add(-time.Hour).Format(time.RFC3339))},
+			keys:               []string{Key2Name},
+			parameters:         containerSAS,
+			granted:            now.Add(-24 * time.Hour),
+			expectedRotation:   &KeyRotation{PreviousKey: Key1Name, SigningKey: Key2Name, PendingGrants: 1},
+			expectedSigningKey: Key2Name,
+			expectedSwitched:   true,
+			expectedCode:       codes.FailedPrecondition,
+		},
+		{
+			testName:            "Rotation back to key1",
+			tags:                map[string]*string{SigningKeyTag: to.StringPtr(Key2Name), KeysRegeneratedTag: to.StringPtr("2021-01-01T00:00:00Z")},
+			keys:                []string{Key1Name},
+			parameters:          containerSAS,
+			granted:             now.Add(2 * time.Hour),
+			expectedRotation:    &KeyRotation{PreviousKey: Key2Name, SigningKey: Key1Name},
+			expectedRegenerated: []string{Key2Name},
+			expectedSigningKey:  Key1Name,
+			expectedWait:        time.Hour,
+		},
+		{
+			testName:           "Keys regenerated recently",
+			tags:               map[string]*string{KeysRegeneratedTag: to.StringPtr(time.Now().UTC().Format(time.RFC3339))},
+			keys:               []string{Key1Name, Key2Name},
+			parameters:         containerSAS,
+			expectedSigningKey: "",
+			expectedCode:       codes.FailedPrecondition,
+		},
+		{
+			testName:           "Grant parameters cannot be parsed",
+			tags:               map[string]*string{},
+			keys:               []string{Key2Name},
+			parameters:         map[string]string{constant.BucketUnitTypeField: "invalid"},
+			expectedSigningKey: Key2Name,
+			expectedSwitched:   true,
+			expectedWait:       time.Hour,
+			expectedCode:       codes.InvalidArgument,
+		},
+	}
+	for _, test := range tests {
+		regenerator := &fakeRegenerator{}
+		newKeyRegenerator = func(*azure.Cloud, string) (storageAccountKeyRegenerator, error) { return regenerator, nil }
+		cloud := newKeyRotationCloud(t, test.tags, test.keys...)
+		objects := grantObjects(t, test.parameters, test.granted)
+		kubeClient := newCOSIServer(t, objects)
+		recorder := record.NewFakeRecorder(10)
+		waited = 0
+
+		rotation, err := RotateStorageAccountKey(context.Background(), cloud, kubeClient, recorder, account, 0, time.Hour)
+		if status.Code(err) != test.expectedCode {
+			t.Errorf("\nTestCase: %s\nExpected Code: %v\nActual Error: %v", test.testName, test.expectedCode, err)
+		}
+		if test.expectedRotation != nil && !reflect.DeepEqual(rotation, test.expectedRotation) {
+			t.Errorf("\nTestCase: %s\nExpected Rotation: %+v\nActual Rotation: %+v", test.testName, test.expectedRotation, rotation)
+		}
+		if !reflect.DeepEqual(regenerator.regenerated, test.expectedRegenerated) {
+			t.Errorf("\nTestCase: %s\nExpected Regenerated Keys: %v\nActual Regenerated Keys: %v", test.testName, test.expectedRegenerated, regenerator.regenerated)
+		}
+		if signingKey := to.String(test.tags[SigningKeyTag]); signingKey != test.expectedSigningKey {
+			t.Errorf("\nTestCase: %s\nExpected Signing Key Tag: %s\nActual Signing Key Tag: %s", test.testName, test.expectedSigningKey, signingKey)
+		}
+		if _, switched := test.tags[SigningKeySwitchedTag]; switched != test.expectedSwitched {
+			t.Errorf("\nTestCase: %s\nExpected Rotation In Progress: %v\nActual Tags: %v", test.testName, test.expectedSwitched, test.tags)
+		}
+		if waited != test.expectedWait {
+			t.Errorf("\nTestCase: %s\nExpected Wait: %v\nActual Wait: %v", test.testName, test.expectedWait, waited)
+		}
+
+		// The credentials secrets belong to the COSI sidecar, grants holding the previous key are asked to be granted again
+		for _, name := range []string{"access-creds", "other-creds"} {
+			if token := accessToken(t, objects, "/api/v1/namespaces/team-a/secrets/"+name); token != oldContainerSAS {
+				t.Errorf("\nTestCase: %s\nExpected Secret %s to be kept\nActual Token: %s", test.testName, name, token)
+			}
+		}
+		close(recorder.Events)
+		var events []string
+		for event := range recorder.Events {
+			events = append(events, event)
+		}
+		expectedEvents := 0
+		if test.expectedRotation != nil {
+			expectedEvents = test.expectedRotation.PendingGrants
+		}
+		if len(events) != expectedEvents || (expectedEvents > 0 && !strings.HasPrefix(events[0], "Warning "+reasonStorageAccountKeyRotation)) {
+			t.Errorf("\nTestCase: %s\nExpected Events: %d %s\nActual Events: %v", test.testName, expectedEvents, reasonStorageAccountKeyRotation, events)
+		}
+	}
+}
+
+func TestRevokeAccountKeySAS(t *testing.T) {
+	defer func(f func(*azure.Cloud, string) (storageAccountKeyRegenerator, error)) { newKeyRegenerator = f }(newKeyRegenerator)
+	regenerator := &fakeRegenerator{}
+	newKeyRegenerator = func(*azure.Cloud, string) (storageAccountKeyRegenerator, error) { return regenerator, nil }
+	tags := map[string]*string{}
+	cloud := newKeyRotationCloud(t, tags, Key1Name, Key2Name)
+
+	err := RevokeAccountKeySAS(context.Background(), cloud, StorageAccountRef{SubscriptionID: "subscription", ResourceGroup: "rg", Name: constant.ValidAccount})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{Key1Name, Key2Name}; !reflect.DeepEqual(regenerator.regenerated, expected) {
+		t.Errorf("expected keys %v to be regenerated, got %v", expected, regenerator.regenerated)
+	}
+	if _, ok := tags[KeysRegeneratedTag]; !ok {
+		t.Errorf("expected the regeneration to be recorded in the %s tag, got %v", KeysRegeneratedTag, tags)
+	}
+}
+
+func TestSigningKeySelection(t *testing.T) {
+	bucketID, err := (&types.BucketID{SubID: "subscription", ResourceGroup: "rg", URL: constant.ValidContainerURL}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		testName     string
+		tags         map[string]*string
+		signingKey   string
+		expectedCode codes.Code
+	}{
+		{
+			testName: "First key without tag nor parameter",
+			tags:     map[string]*string{},
+		},
+		{
+			testName: "Key of the tag",
+			tags:     map[string]*string{SigningKeyTag: to.StringPtr("Key2")},
+		},
+		{
+			testName:     "Missing key of the tag",
+			tags:         map[string]*string{SigningKeyTag: to.StringPtr(Key1Name)},
+			expectedCode: codes.FailedPrecondition,
+		},
+		{
+			testName:   "Parameter overrides the tag",
+			tags:       map[string]*string{SigningKeyTag: to.StringPtr(Key1Name)},
+			signingKey: Key2Name,
+		},
+		{
+			testName:     "Missing key of the parameter",
+			tags:         map[string]*string{},
+			signingKey:   Key1Name,
+			expectedCode: codes.FailedPrecondition,
+		},
+	}
+	for _, test := range tests {
+		// Only key2 can sign
+		cloud := newKeyRotationCloud(t, test.tags, Key2Name)
+		parameters := map[string]string{constant.BucketUnitTypeField: constant.Container.String()}
+		if test.signingKey != "" {
+			parameters[constant.SigningKeyField] = test.signingKey
+		}
+		_, _, err := CreateBucketSASURL(context.Background(), bucketID, parameters, cloud)
+		if status.Code(err) != test.expectedCode {
+			t.Errorf("\nTestCase: %s\nExpected Code: %v\nActual Error: %v", test.testName, test.expectedCode, err)
+		}
+	}
+}
+
+func TestParseStorageAccount(t *testing.T) {
+	cloud := &azure.Cloud{}
+	cloud.SubscriptionID = "subscription"
+	cloud.ResourceGroup = "rg"
+	tests := []struct {
+		testName    string
+		account     string
+		expectedRef StorageAccountRef
+		expectErr   bool
+	}{
+		{
+			testName:    "Name",
+			account:     "account",
+			expectedRef: StorageAccountRef{SubscriptionID: "subscription", ResourceGroup: "rg", Name: "account"},
+		},
+		{
+			testName:    "Resource ID",
+			account:     "/subscriptions/other/resourceGroups/otherrg/providers/Microsoft.Storage/storageAccounts/account",
+			expectedRef: StorageAccountRef{SubscriptionID: "other", ResourceGroup: "otherrg", Name: "account"},
+		},
+		{
+			testName:  "Invalid name",
+			account:   "Account_1",
+			expectErr: true,
+		},
+		{
+			testName:  "Resource ID of another resource",
+			account:   "/subscriptions/other/resourceGroups/otherrg/providers/Microsoft.Compute/virtualMachines/vm",
+			expectErr: true,
+		},
+	}
+	for _, test := range tests {
+		ref, err := ParseStorageAccount(test.account, cloud)
+		if (err != nil) != test.expectErr {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectErr, err)
+		}
+		if err == nil && ref != test.expectedRef {
+			t.Errorf("\nTestCase: %s\nExpected Storage Account: %+v\nActual Storage Account: %+v", test.testName, test.expectedRef, ref)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+const (
+	// accountOperationTimeout bounds a storage account operation running in the background
+	accountOperationTimeout = 30 * time.Minute
+	// accountOperationResultTTL is how long the result of a finished operation waits for the call that collects it
+	accountOperationResultTTL = time.Hour
+)
+
+var (
+	// accountOperationWaitTime is how long a call waits for a storage account operation to finish
+	// before returning codes.Unavailable. It is kept well below the RPC deadline of the COSI sidecar.
+	accountOperationWaitTime = 10 * time.Second
+
+	// accountOperations tracks the storage account creations and deletions running in the background
+	accountOperations = newLongRunningOperations()
+)
+
+// accountOperationResult is the outcome of a storage account operation
+type accountOperationResult struct {
+	accountName string
+	accountKey  string
+}
+
+type longRunningOperation struct {
+	// fingerprint identifies the request which started the operation
+	fingerprint string
+	done        chan struct{}
+	finished    time.Time
+	result      accountOperationResult
+	err         error
+}
+
+// operationInProgressError reports a storage account operation still running in the background. It is reported
+// to the COSI sidecar as codes.Unavailable so that the call is retried, and told apart from Azure errors
+// mapped to codes.Unavailable by isOperationInProgress.
+type operationInProgressError struct {
+	key string
+}
+
+func (e *operationInProgressError) Error() string {
+	return fmt.Sprintf("Operation on %s is in progress, retry later", e.key)
+}
+
+// GRPCStatus implements the interface status.FromError converts errors with
+func (e *operationInProgressError) GRPCStatus() *status.Status {
+	return status.New(codes.Unavailable, e.Error())
+}
+
+// accountOperationKey keys the operations on a storage account, so that a creation and a deletion
+// of the same account never run at the same time
+func accountOperationKey(subsID, resourceGroup, accountName string) string {
+	return fmt.Sprintf("storage account %s/%s/%s", subsID, resourceGroup, accountName)
+}
+
+// longRunningOperations runs ARM operations that can outlive the gRPC call which started them.
+// A call returns codes.Unavailable while its operation is in progress, and the next identical call
+// picks up the same operation instead of starting a duplicate one.
+type longRunningOperations struct {
+	lock       sync.Mutex
+	operations map[string]*longRunningOperation
+	// running counts the operations running in the background
+	running sync.WaitGroup
+	now     func() time.Time
+}
+
+func newLongRunningOperations() *longRunningOperations {
+	return &longRunningOperations{
+		operations: make(map[string]*longRunningOperation),
+		now:        time.Now,
+	}
+}
+
+// run starts operation under key unless an operation with the same fingerprint is already running, and waits for it.
+// The result of a finished operation is returned to the call that observes it and then forgotten.
+func (o *longRunningOperations) run(
+	ctx context.Context,
+	key,
+	fingerprint string,
+	operation func(context.Context) (accountOperationResult, error)) (accountOperationResult, error) {
+	o.lock.Lock()
+	o.prune()
+	op, ok := o.operations[key]
+	if ok && op.fingerprint != fingerprint {
+		select {
+		case <-op.done:
+			ok = false
+		default:
+			o.lock.Unlock()
+			return accountOperationResult{}, status.Error(codes.Aborted, fmt.Sprintf("A different operation on %s is in progress", key))
+		}
+	}
+	if !ok {
+		op = &longRunningOperation{fingerprint: fingerprint, done: make(chan struct{})}
+		o.operations[key] = op
+		o.running.Add(1)
+		go o.start(ctx, op, operation)
+	}
+	o.lock.Unlock()
+
+	timer := time.NewTimer(accountOperationWaitTime)
+	defer timer.Stop()
+	select {
+	case <-op.done:
+	case <-timer.C:
+		klog.Infof("Operation on %s is still in progress", key)
+		return accountOperationResult{}, &operationInProgressError{key: key}
+	case <-ctx.Done():
+		return accountOperationResult{}, &operationInProgressError{key: key}
+	}
+
+	o.lock.Lock()
+	if o.operations[key] == op {
+		delete(o.operations, key)
+	}
+	o.lock.Unlock()
+	return op.result, op.err
+}
+
+// start runs the operation detached from the cancellation of the call that started it
+func (o *longRunningOperations) start(ctx context.Context, op *longRunningOperation, operation func(context.Context) (accountOperationResult, error)) {
+	defer o.running.Done()
+	ctx, cancel := context.WithTimeout(detachedContext{ctx}, accountOperationTimeout)
+	defer cancel()
+
+	result, err := operation(ctx)
+
+	o.lock.Lock()
+	op.result, op.err = result, err
+	op.finished = o.now()
+	o.lock.Unlock()
+	close(op.done)
+}
+
+// wait waits up to timeout for the operations running in the background to finish, and returns whether they did
+func (o *longRunningOperations) wait(timeout time.Duration) bool {
+	finished := make(chan struct{})
+	go func() {
+		o.running.Wait()
+		close(finished)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-finished:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// WaitForAccountOperations waits up to timeout for the storage account creations and deletions running
+// in the background to finish, and returns whether they did. Operations still running are abandoned
+// when the driver exits, and resumed or rolled back from the journal by the next driver.
+func WaitForAccountOperations(timeout time.Duration) bool {
+	return accountOperations.wait(timeout)
+}
+
+// prune forgets results nobody collected, e.g. because the bucket was deleted meanwhile. Must be called with the lock held.
+func (o *longRunningOperations) prune() {
+	for key, op := range o.operations {
+		if !op.finished.IsZero() && o.now().Sub(op.finished) > accountOperationResultTTL {
+			delete(o.operations, key)
+		}
+	}
+}
+
+// detachedContext keeps the values of a context, such as its trace span, but not its deadline or cancellation
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// isOperationInProgress returns whether err reports a storage account operation still running in the background
+func isOperationInProgress(err error) bool {
+	var inProgress *operationInProgressError
+	return errors.As(err, &inProgress)
+}
@@ -0,0 +1,282 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"project/azure-cosi-driver/pkg/types"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLongRunningOperations(t *testing.T) {
+	waitTime := accountOperationWaitTime
+	accountOperationWaitTime = 50 * time.Millisecond
+	defer func() { accountOperationWaitTime = waitTime }()
+
+	operations := newLongRunningOperations()
+	release := make(chan struct{})
+	var started int32
+	blocking := func(ctx context.Context) (accountOperationResult, error) {
+		atomic.AddInt32(&started, 1)
+		<-release
+		if ctx.Err() != nil {
+			return accountOperationResult{}, ctx.Err()
+		}
+		return accountOperationResult{accountName: "account"}, nil
+	}
+	failing := func(context.Context) (accountOperationResult, error) {
+		atomic.AddInt32(&started, 1)
+		return accountOperationResult{}, fmt.Errorf("failed")
+	}
+
+	// The caller's context is cancelled when its RPC returns, which must not cancel the operation
+	ctx, cancel := context.WithCancel(context.Background())
+	tests := []struct {
+		testName        string
+		ctx             context.Context
+		fingerprint     string
+		operation       func(context.Context) (accountOperationResult, error)
+		before          func()
+		expectedResult  accountOperationResult
+		expectedCode    codes.Code
+		expectedStarted int32
+	}{
+		{
+			testName:        "Operation in progress",
+			ctx:             ctx,
+			fingerprint:     "a",
+			operation:       blocking,
+			before:          func() {},
+			expectedCode:    codes.Unavailable,
+			expectedStarted: 1,
+		},
+		{
+			testName:        "Identical call while in progress does not start another operation",
+			ctx:             context.Background(),
+			fingerprint:     "a",
+			operation:       blocking,
+			before:          cancel,
+			expectedCode:    codes.Unavailable,
+			expectedStarted: 1,
+		},
+		{
+			testName:        "Different call while in progress",
+			ctx:             context.Background(),
+			fingerprint:     "b",
+			operation:       blocking,
+			before:          func() {},
+			expectedCode:    codes.Aborted,
+			expectedStarted: 1,
+		},
+		{
+			testName:        "Identical call after operation finished",
+			ctx:             context.Background(),
+			fingerprint:     "a",
+			operation:       blocking,
+			before:          func() { close(release) },
+			expectedResult:  accountOperationResult{accountName: "account"},
+			expectedCode:    codes.OK,
+			expectedStarted: 1,
+		},
+		{
+			testName:        "Collected result starts a new operation",
+			ctx:             context.Background(),
+			fingerprint:     "a",
+			operation:       failing,
+			before:          func() {},
+			expectedCode:    codes.Unknown,
+			expectedStarted: 2,
+		},
+		{
+			testName:        "Failure is not remembered",
+			ctx:             context.Background(),
+			fingerprint:     "a",
+			operation:       blocking,
+			before:          func() {},
+			expectedResult:  accountOperationResult{accountName: "account"},
+			expectedCode:    codes.OK,
+			expectedStarted: 3,
+		},
+	}
+	for _, test := range tests {
+		test.before()
+		result, err := operations.run(test.ctx, "bucket", test.fingerprint, test.operation)
+		if status.Code(err) != test.expectedCode {
+			t.Errorf("\nTestCase: %s\nExpected Code: %v\nActual Error: %v", test.testName, test.expectedCode, err)
+		}
+		if !reflect.DeepEqual(result, test.expectedResult) {
+			t.Errorf("\nTestCase: %s\nExpected Result: %+v\nActual Result: %+v", test.testName, test.expectedResult, result)
+		}
+		if started := atomic.LoadInt32(&started); started != test.expectedStarted {
+			t.Errorf("\nTestCase: %s\nExpected Started: %d\nActual Started: %d", test.testName, test.expectedStarted, started)
+		}
+	}
+}
+
+func TestLongRunningOperationsPrune(t *testing.T) {
+	now := time.Now()
+	operations := newLongRunningOperations()
+	operations.now = func() time.Time { return now }
+	operations.operations["collected"] = &longRunningOperation{done: make(chan struct{}), finished: now.Add(-accountOperationResultTTL - time.Second)}
+	operations.operations["recent"] = &longRunningOperation{done: make(chan struct{}), finished: now.Add(-time.Minute)}
+	operations.operations["running"] = &longRunningOperation{done: make(chan struct{})}
+
+	operations.prune()
+	if _, ok := operations.operations["collected"]; ok {
+		t.Errorf("expected uncollected result past its TTL to be pruned")
+	}
+	if len(operations.operations) != 2 {
+		t.Errorf("expected recent and running operations to be kept, got %v", operations.operations)
+	}
+}
+
+func TestLongRunningOperationsWait(t *testing.T) {
+	waitTime := accountOperationWaitTime
+	accountOperationWaitTime = time.Millisecond
+	defer func() { accountOperationWaitTime = waitTime }()
+
+	operations := newLongRunningOperations()
+	if !operations.wait(time.Millisecond) {
+		t.Errorf("expected wait to return at once without operations running")
+	}
+
+	release := make(chan struct{})
+	_, err := operations.run(context.Background(), "key", "", func(context.Context) (accountOperationResult, error) {
+		<-release
+		return accountOperationResult{}, nil
+	})
+	if !isOperationInProgress(err) {
+		t.Fatalf("expected the operation to be in progress, got %v", err)
+	}
+	if operations.wait(20 * time.Millisecond) {
+		t.Errorf("expected wait to time out while the operation is running")
+	}
+
+	close(release)
+	if !operations.wait(10 * time.Second) {
+		t.Errorf("expected wait to return once the operation finished")
+	}
+}
+
+func TestCreateContainerBucketInProgress(t *testing.T) {
+	waitTime := accountOperationWaitTime
+	accountOperationWaitTime = 50 * time.Millisecond
+	defer func() { accountOperationWaitTime = waitTime }()
+
+	containerName, _ := getContainerName(journalTestBucket)
+	storage := newFakeStorage(nil)
+	ctx, cloud := setupFakeStorage(t, storage)
+	storage.createAccountGate = make(chan struct{})
+
+	journal := newMemoryJournal()
+	params := func() *BucketClassParameters {
+		return &BucketClassParameters{storageAccountName: journalTestAccount, createStorageAccount: to.BoolPtr(true)}
+	}
+	_, err := createContainerBucket(ctx, journalTestBucket, params(), journal, cloud)
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("expected codes.Unavailable while the storage account is created, got %v", err)
+	}
+	if entry := journal.entries[journalTestBucket]; entry.Step != journalStepEnsureStorageAccount || !entry.AccountCreated {
+		t.Errorf("expected the journal entry to be kept at step %s, got %+v", journalStepEnsureStorageAccount, entry)
+	}
+
+	close(storage.createAccountGate)
+	var bucketID string
+	for i := 0; i < 100; i++ {
+		bucketID, err = createContainerBucket(ctx, journalTestBucket, params(), journal, cloud)
+		if !isOperationInProgress(err) {
+			break
+		}
+	}
+	if err != nil || bucketID == "" {
+		t.Fatalf("expected the retry to complete the bucket, got %q, %v", bucketID, err)
+	}
+	if len(journal.entries) != 0 {
+		t.Errorf("expected the completed bucket to leave no journal entry, got %v", journal.entries)
+	}
+	expectedAccounts := map[string][]string{journalTestAccount: {containerName}}
+	if accounts := storage.state(); !reflect.DeepEqual(accounts, expectedAccounts) {
+		t.Errorf("\nExpected Accounts: %v\nActual Accounts: %v", expectedAccounts, accounts)
+	}
+}
+
+func TestIsOperationInProgress(t *testing.T) {
+	tests := []struct {
+		testName string
+		err      error
+		expected bool
+	}{
+		{
+			testName: "Operation in progress",
+			err:      &operationInProgressError{key: "bucket"},
+			expected: true,
+		},
+		{
+			testName: "Wrapped operation in progress",
+			err:      fmt.Errorf("creating bucket: %w", &operationInProgressError{key: "bucket"}),
+			expected: true,
+		},
+		{
+			testName: "Transient Azure error",
+			err:      status.Error(codes.Unavailable, "Could not create storage account: service unavailable"),
+		},
+		{
+			testName: "No error",
+		},
+	}
+	for _, test := range tests {
+		if actual := isOperationInProgress(test.err); actual != test.expected {
+			t.Errorf("\nTestCase: %s\nExpected: %v\nActual: %v", test.testName, test.expected, actual)
+		}
+	}
+	if code := status.Code(&operationInProgressError{key: "bucket"}); code != codes.Unavailable {
+		t.Errorf("expected an operation in progress to be reported as %v, got %v", codes.Unavailable, code)
+	}
+}
+
+func TestAccountCreationAndDeletionDoNotOverlap(t *testing.T) {
+	waitTime := accountOperationWaitTime
+	accountOperationWaitTime = 50 * time.Millisecond
+	defer func() { accountOperationWaitTime = waitTime }()
+
+	storage := newFakeStorage(nil)
+	ctx, cloud := setupFakeStorage(t, storage)
+	storage.createAccountGate = make(chan struct{})
+
+	params := &BucketClassParameters{storageAccountName: journalTestAccount, createStorageAccount: to.BoolPtr(true)}
+	if _, err := createContainerBucket(ctx, journalTestBucket, params, newMemoryJournal(), cloud); !isOperationInProgress(err) {
+		t.Fatalf("expected the storage account creation to be in progress, got %v", err)
+	}
+
+	id := &types.BucketID{SubID: "subscription", ResourceGroup: "rg", URL: "https://" + journalTestAccount + ".blob.core.windows.net/"}
+	if err := DeleteStorageAccount(ctx, id, cloud); status.Code(err) != codes.Aborted {
+		t.Errorf("expected the deletion of an account being created to be aborted, got %v", err)
+	}
+
+	close(storage.createAccountGate)
+	for i := 0; i < 100; i++ {
+		if _, err := createContainerBucket(ctx, journalTestBucket, params, newMemoryJournal(), cloud); !isOperationInProgress(err) {
+			break
+		}
+	}
+}
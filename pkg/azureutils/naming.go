@@ -0,0 +1,278 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
+)
+
+const (
+	minContainerNameLength      = 3
+	maxContainerNameLength      = 63
+	minStorageAccountNameLength = 3
+	containerNameHashLength     = 8
+	accountNameHashLength       = 12
+
+	DefaultStorageAccountNameTemplate = "cosi"
+
+	// BucketNameMetadataKey is the container metadata key recording the bucket a container was created for
+	BucketNameMetadataKey = "cosibucketname"
+	// BucketNameTag is the storage account tag recording the bucket an account was created for
+	BucketNameTag = "cosi-bucket-name"
+	// DriverNameMetadataKey is the container metadata key recording the driver instance a container was created by
+	DriverNameMetadataKey = "cosidrivername"
+	// DriverNameTag is the storage account tag recording the driver instance an account was created by
+	DriverNameTag = "cosi-driver-name"
+)
+
+var (
+	containerNameRE            = regexp.MustCompile(`^[a-z0-9](-?[a-z0-9])*$`)
+	storageAccountNameRE       = regexp.MustCompile(`^[a-z0-9]+$`)
+	invalidContainerNameCharRE = regexp.MustCompile(`[^a-z0-9-]+`)
+	repeatedHyphenRE           = regexp.MustCompile(`-{2,}`)
+	invalidAccountNameCharRE   = regexp.MustCompile(`[^a-z0-9]+`)
+
+	// driverName is the name of this driver instance, recorded on the storage accounts and containers it creates.
+	// Resources recorded as created by another instance are never modified nor deleted.
+	driverName string
+)
+
+// SetDriverName sets the name of this driver instance. It must be called before any bucket is provisioned.
+func SetDriverName(name string) {
+	driverName = name
+}
+
+// withDriverTag returns a copy of the storage account tags with the tag recording this driver instance
+func withDriverTag(tags map[string]string) map[string]string {
+	result := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		result[k] = v
+	}
+	if driverName != "" {
+		result[DriverNameTag] = driverName
+	}
+	return result
+}
+
+// checkDriverOwner rejects a resource recorded as created by another driver instance.
+// Resources without the record, e.g. created before the driver name was recorded or by hand, are shared.
+func checkDriverOwner(resource, owner string) error {
+	if driverName != "" && owner != "" && owner != driverName {
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("%s belongs to driver %s", resource, owner))
+	}
+	return nil
+}
+
+// getAccountDriverOwner returns the driver instance recorded in the storage account tags, or "" if there is none
+func getAccountDriverOwner(tags map[string]*string) string {
+	if owner, ok := tags[DriverNameTag]; ok && owner != nil {
+		return *owner
+	}
+	return ""
+}
+
+func isValidContainerName(name string) bool {
+	return len(name) >= minContainerNameLength &&
+		len(name) <= maxContainerNameLength &&
+		containerNameRE.MatchString(name)
+}
+
+func isValidStorageAccountName(name string) bool {
+	return len(name) >= minStorageAccountNameLength &&
+		len(name) <= maxStorageAccountNameLength &&
+		storageAccountNameRE.MatchString(name)
+}
+
+// nameHash returns the first length hex characters of the sha256 sum of parts
+func nameHash(length int, parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "/")))
+	return hex.EncodeToString(sum[:])[:length]
+}
+
+// getContainerName returns the container name to use for a bucket.
+// Bucket names which are already valid container names are used as is. Any other name is
+// lowercased, stripped of invalid characters and suffixed with a hash of the original name,
+// so that two distinct bucket names never sanitize to the same container.
+func getContainerName(bucketName string) (string, error) {
+	if isValidContainerName(bucketName) {
+		return bucketName, nil
+	}
+
+	name := invalidContainerNameCharRE.ReplaceAllString(strings.ToLower(bucketName), "-")
+	name = repeatedHyphenRE.ReplaceAllString(name, "-")
+	name = strings.Trim(name, "-")
+	if name == "" {
+		return "", status.Error(codes.InvalidArgument, fmt.Sprintf("Could not derive a container name from bucket name %q", bucketName))
+	}
+
+	maxLength := maxContainerNameLength - containerNameHashLength - 1
+	if len(name) > maxLength {
+		name = strings.TrimRight(name[:maxLength], "-")
+	}
+	return fmt.Sprintf("%s-%s", name, nameHash(containerNameHashLength, bucketName)), nil
+}
+
+// generateStorageAccountName builds a storage account name from the template followed by a hash of parts.
+// The template is reduced to lowercase letters and numbers and truncated so the name fits in 24 characters.
+func generateStorageAccountName(template string, parts ...string) string {
+	if template == "" {
+		template = DefaultStorageAccountNameTemplate
+	}
+
+	prefix := invalidAccountNameCharRE.ReplaceAllString(strings.ToLower(template), "")
+	maxLength := maxStorageAccountNameLength - accountNameHashLength
+	if len(prefix) > maxLength {
+		prefix = prefix[:maxLength]
+	}
+	return prefix + nameHash(accountNameHashLength, parts...)
+}
+
+// setStorageAccountName fills in a generated storage account name when the BucketClass does not name one.
+// The name is derived from the subscription, resource group and bucket name so that retries of the
+// same request always resolve to the same account.
+func setStorageAccountName(bucketName string, parameters *BucketClassParameters, cloud *azure.Cloud) {
+	if parameters.storageAccountName != "" || parameters.storageAccountPoolPrefix != "" {
+		return
+	}
+
+	subsID := parameters.subscriptionID
+	if subsID == "" {
+		subsID = cloud.SubscriptionID
+	}
+	parameters.storageAccountName = generateStorageAccountName(parameters.storageAccountNameTemplate, subsID, parameters.resourceGroup, bucketName)
+}
+
+// storageAccountNameChecker checks whether storage account names are available, as they are unique across Azure.
+// azure.Cloud has no client for it, so it is made with the credentials of the cloud config.
+type storageAccountNameChecker interface {
+	// checkNameAvailability returns whether the name is available, and why not if it is not
+	checkNameAvailability(ctx context.Context, name string) (bool, string, error)
+}
+
+// newNameChecker returns the storage account name checker of the subscription, replaced in tests
+var newNameChecker = func(cloud *azure.Cloud, subsID string) (storageAccountNameChecker, error) {
+	authorizer, err := getARMAuthorizer(cloud)
+	if err != nil {
+		return nil, err
+	}
+	client := storage.NewAccountsClientWithBaseURI(cloud.Environment.ResourceManagerEndpoint, subsID)
+	client.Authorizer = authorizer
+	return &armNameChecker{client: client, subsID: subsID}, nil
+}
+
+type armNameChecker struct {
+	client storage.AccountsClient
+	subsID string
+}
+
+func (c *armNameChecker) checkNameAvailability(ctx context.Context, name string) (bool, string, error) {
+	reqCtx, req, err := startARMRequest(ctx, checkStorageAccountNameOperation, c.subsID)
+	if err != nil {
+		return false, "", err
+	}
+	result, err := c.client.CheckNameAvailability(reqCtx, storage.AccountCheckNameAvailabilityParameters{
+		Name: to.StringPtr(name),
+		Type: to.StringPtr("Microsoft.Storage/storageAccounts"),
+	})
+	rerr := retry.GetError(result.Response.Response, err)
+	req.endARM(rerr)
+	if rerr != nil {
+		return false, "", rerr.Error()
+	}
+	return to.Bool(result.NameAvailable), to.String(result.Message), nil
+}
+
+// checkStorageAccountOwner rejects the request with codes.InvalidArgument if the storage account exists and was not
+// created by this driver for the bucket, i.e. it is not tagged with the bucket name. Accounts without the tag were
+// made by hand or by someone else, and are never adopted as the bucket would delete them.
+// Names of accounts which do not exist in the resource group are checked to still be available,
+// so that a name taken elsewhere in Azure fails before the account is created.
+func checkStorageAccountOwner(ctx context.Context, bucketName string, parameters *BucketClassParameters, cloud *azure.Cloud) error {
+	if cloud.StorageAccountClient == nil {
+		return fmt.Errorf("StorageAccountClient is nil")
+	}
+
+	subsID := parameters.subscriptionID
+	if subsID == "" {
+		subsID = cloud.SubscriptionID
+	}
+
+	reqCtx, req, err := startARMRequest(ctx, getStorageAccountPropertiesOperation, subsID)
+	if err != nil {
+		return err
+	}
+	account, rerr := cloud.StorageAccountClient.GetProperties(reqCtx, subsID, parameters.resourceGroup, parameters.storageAccountName)
+	req.endARM(rerr)
+	if rerr != nil {
+		if rerr.IsNotFound() {
+			return checkStorageAccountNameAvailable(ctx, subsID, parameters.storageAccountName, cloud)
+		}
+		return azureError(rerr.Error(), "Could not get storage account %s", parameters.storageAccountName)
+	}
+	accountKeys.observe(subsID, parameters.resourceGroup, account)
+
+	if err := checkDriverOwner("Storage account "+parameters.storageAccountName, getAccountDriverOwner(account.Tags)); err != nil {
+		return err
+	}
+	owner, ok := account.Tags[BucketNameTag]
+	if !ok || owner == nil {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("Storage account %s already exists and was not created by this driver", parameters.storageAccountName))
+	}
+	if *owner != bucketName {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("Storage account %s already belongs to bucket %s", parameters.storageAccountName, *owner))
+	}
+	return nil
+}
+
+// checkStorageAccountNameAvailable rejects a storage account name already taken in Azure with codes.InvalidArgument.
+// The check is best effort, when it fails the creation of the account reports the problem.
+func checkStorageAccountNameAvailable(ctx context.Context, subsID, name string, cloud *azure.Cloud) error {
+	checker, err := newNameChecker(cloud, subsID)
+	if err != nil {
+		klog.Warningf("Could not check the availability of storage account name %s: %v", name, err)
+		return nil
+	}
+	available, message, err := checker.checkNameAvailability(ctx, name)
+	if err != nil {
+		klog.Warningf("Could not check the availability of storage account name %s: %v", name, err)
+		return nil
+	}
+	if !available {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("Storage account name %s is not available: %s", name, message))
+	}
+	return nil
+}
+
+// getMetadataValue looks up a metadata key case insensitively, as the service may return keys in canonical header form
+func getMetadataValue(metadata map[string]string, key string) (string, bool) {
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
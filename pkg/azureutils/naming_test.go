@@ -0,0 +1,430 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"project/azure-cosi-driver/pkg/constant"
+	"project/azure-cosi-driver/pkg/types"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/golang/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/storageaccountclient/mockstorageaccountclient"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+func TestIsValidContainerName(t *testing.T) {
+	tests := []struct {
+		testName string
+		name     string
+		expected bool
+	}{
+		{testName: "Valid name", name: constant.ValidContainer, expected: true},
+		{testName: "Valid name with hyphens", name: "bucket-1-a", expected: true},
+		{testName: "Too short", name: "ab", expected: false},
+		{testName: "Too long", name: strings.Repeat("a", 64), expected: false},
+		{testName: "Uppercase", name: "Bucket", expected: false},
+		{testName: "Leading hyphen", name: "-bucket", expected: false},
+		{testName: "Trailing hyphen", name: "bucket-", expected: false},
+		{testName: "Consecutive hyphens", name: "buc--ket", expected: false},
+		{testName: "Invalid character", name: "buc_ket", expected: false},
+	}
+	for _, test := range tests {
+		if valid := isValidContainerName(test.name); valid != test.expected {
+			t.Errorf("\nTestCase: %s\nExpected: %v\nActual: %v", test.testName, test.expected, valid)
+		}
+	}
+}
+
+func TestGetContainerName(t *testing.T) {
+	tests := []struct {
+		testName     string
+		bucketName   string
+		expectedName string
+		expectedErr  error
+	}{
+		{
+			testName:     "Valid name is unchanged",
+			bucketName:   constant.ValidContainer,
+			expectedName: constant.ValidContainer,
+		},
+		{
+			testName:     "Invalid characters are replaced",
+			bucketName:   "My_Bucket",
+			expectedName: "my-bucket-" + nameHash(containerNameHashLength, "My_Bucket"),
+		},
+		{
+			testName:     "Short name is extended by the hash",
+			bucketName:   "A",
+			expectedName: "a-" + nameHash(containerNameHashLength, "A"),
+		},
+		{
+			testName:     "Long name is truncated",
+			bucketName:   strings.Repeat("B", 70),
+			expectedName: strings.Repeat("b", 54) + "-" + nameHash(containerNameHashLength, strings.Repeat("B", 70)),
+		},
+		{
+			testName:    "No usable characters",
+			bucketName:  "__",
+			expectedErr: status.Error(codes.InvalidArgument, "Could not derive a container name from bucket name \"__\""),
+		},
+	}
+	for _, test := range tests {
+		name, err := getContainerName(test.bucketName)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectedErr, err)
+		}
+		if err == nil {
+			if name != test.expectedName {
+				t.Errorf("\nTestCase: %s\nExpected Name: %v\nActual Name: %v", test.testName, test.expectedName, name)
+			}
+			if !isValidContainerName(name) {
+				t.Errorf("\nTestCase: %s\nGenerated name %s is not a valid container name", test.testName, name)
+			}
+		}
+	}
+
+	sanitized, _ := getContainerName("my_bucket")
+	if other, _ := getContainerName("my-bucket"); sanitized == other {
+		t.Errorf("distinct bucket names must not share container %s", sanitized)
+	}
+}
+
+func TestGenerateStorageAccountName(t *testing.T) {
+	tests := []struct {
+		testName       string
+		template       string
+		parts          []string
+		expectedPrefix string
+	}{
+		{
+			testName:       "Default template",
+			template:       "",
+			parts:          []string{constant.ValidSub, constant.ValidResourceGroup, constant.ValidContainer},
+			expectedPrefix: DefaultStorageAccountNameTemplate,
+		},
+		{
+			testName:       "Template is sanitized",
+			template:       "Team-A_",
+			parts:          []string{constant.ValidContainer},
+			expectedPrefix: "teama",
+		},
+		{
+			testName:       "Template is truncated",
+			template:       "averyveryverylongtemplate",
+			parts:          []string{constant.ValidContainer},
+			expectedPrefix: "averyveryver",
+		},
+	}
+	for _, test := range tests {
+		name := generateStorageAccountName(test.template, test.parts...)
+		expected := test.expectedPrefix + nameHash(accountNameHashLength, test.parts...)
+		if name != expected {
+			t.Errorf("\nTestCase: %s\nExpected Name: %v\nActual Name: %v", test.testName, expected, name)
+		}
+		if !isValidStorageAccountName(name) {
+			t.Errorf("\nTestCase: %s\nGenerated name %s is not a valid storage account name", test.testName, name)
+		}
+		if again := generateStorageAccountName(test.template, test.parts...); again != name {
+			t.Errorf("\nTestCase: %s\nName generation is not deterministic: %s != %s", test.testName, name, again)
+		}
+	}
+}
+
+func TestSetStorageAccountName(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	cloud := azure.GetTestCloud(ctrl)
+
+	tests := []struct {
+		testName     string
+		params       *BucketClassParameters
+		expectedName string
+	}{
+		{
+			testName:     "Explicit name is kept",
+			params:       &BucketClassParameters{storageAccountName: constant.ValidAccount},
+			expectedName: constant.ValidAccount,
+		},
+		{
+			testName:     "Pool accounts are not generated",
+			params:       &BucketClassParameters{storageAccountPoolPrefix: "pool"},
+			expectedName: "",
+		},
+		{
+			testName:     "Generated name",
+			params:       &BucketClassParameters{resourceGroup: constant.ValidResourceGroup},
+			expectedName: generateStorageAccountName("", cloud.SubscriptionID, constant.ValidResourceGroup, constant.ValidContainer),
+		},
+	}
+	for _, test := range tests {
+		setStorageAccountName(constant.ValidContainer, test.params, cloud)
+		if test.params.storageAccountName != test.expectedName {
+			t.Errorf("\nTestCase: %s\nExpected Name: %v\nActual Name: %v", test.testName, test.expectedName, test.params.storageAccountName)
+		}
+	}
+}
+
+// fakeNameChecker reports the names in taken as not available
+type fakeNameChecker struct {
+	taken map[string]bool
+}
+
+func (c *fakeNameChecker) checkNameAvailability(_ context.Context, name string) (bool, string, error) {
+	if c.taken[name] {
+		return false, "The storage account named " + name + " is already taken.", nil
+	}
+	return true, "", nil
+}
+
+func TestCheckStorageAccountOwner(t *testing.T) {
+	defer func(f func(*azure.Cloud, string) (storageAccountNameChecker, error)) { newNameChecker = f }(newNameChecker)
+	newNameChecker = func(*azure.Cloud, string) (storageAccountNameChecker, error) {
+		return &fakeNameChecker{taken: map[string]bool{"takenaccount": true}}, nil
+	}
+
+	tests := []struct {
+		testName    string
+		account     string
+		expectedErr error
+	}{
+		{
+			testName:    "Account does not exist",
+			account:     constant.InvalidAccount,
+			expectedErr: nil,
+		},
+		{
+			testName:    "Account name taken elsewhere",
+			account:     "takenaccount",
+			expectedErr: status.Error(codes.InvalidArgument, "Storage account name takenaccount is not available: The storage account named takenaccount is already taken."),
+		},
+		{
+			testName:    "Account without owner tag",
+			account:     "untaggedaccount",
+			expectedErr: status.Error(codes.InvalidArgument, "Storage account untaggedaccount already exists and was not created by this driver"),
+		},
+		{
+			testName:    "Account owned by the same bucket",
+			account:     "ownedaccount",
+			expectedErr: nil,
+		},
+		{
+			testName:    "Account owned by another bucket",
+			account:     "otheraccount",
+			expectedErr: status.Error(codes.InvalidArgument, "Storage account otheraccount already belongs to bucket otherbucket"),
+		},
+	}
+
+	ctrl := gomock.NewController(t)
+	cloud := azure.GetTestCloud(ctrl)
+	keyList := make([]storage.AccountKey, 0)
+	cl := mockstorageaccountclient.NewMockInterface(ctrl)
+	cl.EXPECT().
+		GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), "untaggedaccount").
+		Return(storage.Account{}, nil).
+		AnyTimes()
+	cl.EXPECT().
+		GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), "ownedaccount").
+		Return(storage.Account{Tags: map[string]*string{BucketNameTag: to.StringPtr(constant.ValidContainer)}}, nil).
+		AnyTimes()
+	cl.EXPECT().
+		GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), "otheraccount").
+		Return(storage.Account{Tags: map[string]*string{BucketNameTag: to.StringPtr("otherbucket")}}, nil).
+		AnyTimes()
+	fallback := NewMockSAClient(context.Background(), ctrl, "", "", "", &keyList)
+	cl.EXPECT().
+		GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(fallback.GetProperties).
+		AnyTimes()
+	cloud.StorageAccountClient = cl
+
+	for _, test := range tests {
+		err := checkStorageAccountOwner(context.Background(), constant.ValidContainer, &BucketClassParameters{storageAccountName: test.account}, cloud)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectedErr, err)
+		}
+	}
+
+	cloud.StorageAccountClient = nil
+	err := checkStorageAccountOwner(context.Background(), constant.ValidContainer, &BucketClassParameters{storageAccountName: constant.ValidAccount}, cloud)
+	if !reflect.DeepEqual(err, fmt.Errorf("StorageAccountClient is nil")) {
+		t.Errorf("\nTestCase: Storage Account Client is nil\nActual Error: %v", err)
+	}
+}
+
+func TestGetMetadataValue(t *testing.T) {
+	metadata := map[string]string{"Cosibucketname": constant.ValidContainer}
+	value, ok := getMetadataValue(metadata, BucketNameMetadataKey)
+	if !ok || value != constant.ValidContainer {
+		t.Errorf("\nExpected Value: %v\nActual Value: %v", constant.ValidContainer, value)
+	}
+	if _, ok := getMetadataValue(metadata, "missing"); ok {
+		t.Errorf("missing key should not be found")
+	}
+}
+
+func TestCheckDriverOwner(t *testing.T) {
+	defer SetDriverName("")
+	tests := []struct {
+		testName     string
+		driverName   string
+		owner        string
+		expectedCode codes.Code
+	}{
+		{testName: "Created by this driver", driverName: "a.cosi.azure.com", owner: "a.cosi.azure.com", expectedCode: codes.OK},
+		{testName: "Created by another driver", driverName: "a.cosi.azure.com", owner: "b.cosi.azure.com", expectedCode: codes.PermissionDenied},
+		{testName: "Created without driver record", driverName: "a.cosi.azure.com", owner: "", expectedCode: codes.OK},
+		{testName: "Driver name not set", driverName: "", owner: "b.cosi.azure.com", expectedCode: codes.OK},
+	}
+	for _, test := range tests {
+		SetDriverName(test.driverName)
+		if err := checkDriverOwner("Container test", test.owner); status.Code(err) != test.expectedCode {
+			t.Errorf("\nTestCase: %s\nExpected Code: %v\nActual Error: %v", test.testName, test.expectedCode, err)
+		}
+	}
+}
+
+func TestDriverInstancesDoNotShareResources(t *testing.T) {
+	defer SetDriverName("")
+	const otherBucket = "otherbucket"
+	containerName, _ := getContainerName(journalTestBucket)
+	storage := newFakeStorage(nil)
+	ctx, cloud := setupFakeStorage(t, storage)
+	params := func() *BucketClassParameters {
+		return &BucketClassParameters{storageAccountName: journalTestAccount, createStorageAccount: to.BoolPtr(true)}
+	}
+
+	SetDriverName("a.cosi.azure.com")
+	bucketID, err := createContainerBucket(ctx, journalTestBucket, params(), newMemoryJournal(), cloud)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := getAccountDriverOwner(storage.tags[journalTestAccount]); owner != "a.cosi.azure.com" {
+		t.Errorf("expected the storage account to be tagged with the driver name, got %q", owner)
+	}
+	if owner := storage.metadata[journalTestAccount+"/"+containerName].Get("x-ms-meta-" + DriverNameMetadataKey); owner != "a.cosi.azure.com" {
+		t.Errorf("expected the container metadata to record the driver name, got %q", owner)
+	}
+
+	SetDriverName("b.cosi.azure.com")
+	id, err := types.DecodeToBucketID(bucketID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := JournalEntry{
+		Bucket:         journalTestBucket,
+		SubscriptionID: "subscription",
+		ResourceGroup:  "rg",
+		StorageAccount: journalTestAccount,
+		Container:      containerName,
+		Step:           journalStepCreateContainer,
+		AccountCreated: true,
+		Driver:         "a.cosi.azure.com",
+	}
+	journal := newMemoryJournal(entry)
+	tests := []struct {
+		testName     string
+		operation    func() error
+		expectedCode codes.Code
+	}{
+		{
+			testName: "Create container in storage account of another driver",
+			operation: func() error {
+				_, err := createContainerBucket(ctx, otherBucket, params(), newMemoryJournal(), cloud)
+				return err
+			},
+			expectedCode: codes.PermissionDenied,
+		},
+		{
+			testName:     "Delete container of another driver",
+			operation:    func() error { return DeleteContainerBucket(ctx, id, cloud) },
+			expectedCode: codes.PermissionDenied,
+		},
+		{
+			testName:     "Delete storage account of another driver",
+			operation:    func() error { return DeleteStorageAccount(ctx, id, cloud) },
+			expectedCode: codes.PermissionDenied,
+		},
+		{
+			testName:     "Recover journal entry of another driver",
+			operation:    func() error { return RecoverJournal(ctx, journal, cloud) },
+			expectedCode: codes.OK,
+		},
+	}
+	for _, test := range tests {
+		if err := test.operation(); status.Code(err) != test.expectedCode {
+			t.Errorf("\nTestCase: %s\nExpected Code: %v\nActual Error: %v", test.testName, test.expectedCode, err)
+		}
+	}
+
+	expectedAccounts := map[string][]string{journalTestAccount: {containerName}}
+	if accounts := storage.state(); !reflect.DeepEqual(accounts, expectedAccounts) {
+		t.Errorf("\nExpected Accounts: %v\nActual Accounts: %v", expectedAccounts, accounts)
+	}
+	if remaining, _ := journal.Get(ctx, journalTestBucket); !reflect.DeepEqual(remaining, &entry) {
+		t.Errorf("\nExpected Entry: %+v\nActual Entry: %+v", entry, remaining)
+	}
+}
+
+func TestStorageAccountBucketRecordsDriverName(t *testing.T) {
+	defer SetDriverName("")
+	storage := newFakeStorage(nil)
+	ctx, cloud := setupFakeStorage(t, storage)
+	params := &BucketClassParameters{storageAccountName: journalTestAccount, createStorageAccount: to.BoolPtr(true), tags: map[string]string{"team": "a"}}
+
+	SetDriverName("a.cosi.azure.com")
+	if _, err := createStorageAccountBucket(ctx, journalTestBucket, params, cloud); err != nil {
+		t.Fatal(err)
+	}
+	tags := storage.tags[journalTestAccount]
+	if owner := getAccountDriverOwner(tags); owner != "a.cosi.azure.com" {
+		t.Errorf("expected the storage account to be tagged with the driver name, got %q", owner)
+	}
+	if bucket := tags[BucketNameTag]; bucket == nil || *bucket != journalTestBucket {
+		t.Errorf("expected the storage account to be tagged with the bucket name, got %v", bucket)
+	}
+	if team := tags["team"]; team == nil || *team != "a" {
+		t.Errorf("expected the storage account to keep the tags of the BucketClass, got %v", team)
+	}
+	if _, ok := params.tags[DriverNameTag]; ok {
+		t.Errorf("expected the BucketClass tags to be left unchanged, got %v", params.tags)
+	}
+}
+
+func TestSelectPoolAccountSkipsOtherDrivers(t *testing.T) {
+	defer SetDriverName("")
+	SetDriverName("b.cosi.azure.com")
+
+	ctrl := gomock.NewController(t)
+	cloud := azure.GetTestCloud(ctrl)
+	cl := mockstorageaccountclient.NewMockInterface(ctrl)
+	cl.EXPECT().
+		ListByResourceGroup(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return([]storage.Account{{Name: to.StringPtr("pool000"), Tags: map[string]*string{DriverNameTag: to.StringPtr("a.cosi.azure.com")}}}, nil).
+		AnyTimes()
+	cloud.StorageAccountClient = cl
+
+	params := &BucketClassParameters{storageAccountPoolPrefix: "pool", maxContainersPerAccount: 1}
+	account, err := selectPoolAccount(context.Background(), constant.ValidContainer, params, nil, cloud)
+	if err != nil || account != "pool001" {
+		t.Errorf("\nExpected Account: pool001\nActual Account: %v\nActual Error: %v", account, err)
+	}
+}
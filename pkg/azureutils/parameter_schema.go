@@ -0,0 +1,312 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"project/azure-cosi-driver/pkg/constant"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+type parameterType int
+
+const (
+	stringParameter parameterType = iota
+	boolParameter
+	intParameter
+	uintParameter
+)
+
+// parameterSpec describes a single BucketClass or BucketAccessClass parameter
+type parameterSpec struct {
+	// Type the value must parse as
+	Type parameterType
+	// Default is applied when the parameter is not set. Empty means no default.
+	Default string
+	// AllowedValues restricts the value, compared case insensitively. Empty allows any value.
+	AllowedValues []string
+	// Aliases are deprecated names still accepted for the parameter
+	Aliases []string
+	// Deprecated is why the parameter is ignored. Deprecated parameters are still accepted, with a warning,
+	// so that classes setting them keep working.
+	Deprecated string
+}
+
+// parameterSchema maps the canonical lowercase name of each parameter to its spec
+type parameterSchema map[string]parameterSpec
+
+var (
+	// The values of enum parameters, shared by the schemas and the parsers. The first value is the default.
+	bucketUnitTypes = []constant.BucketUnitType{constant.Container, constant.StorageAccount}
+	accessTiers     = []constant.AccessTier{constant.Hot, constant.Cool, constant.Archive}
+	skuNames        = []constant.SKU{constant.StandardLRS, constant.StandardGRS, constant.StandardRAGRS, constant.PremiumLRS}
+	kinds           = []constant.Kind{constant.StorageV2, constant.Storage, constant.BlobStorage, constant.BlockBlobStorage, constant.FileStorage}
+
+	bucketUnitTypeValues = enumValues(bucketUnitTypes)
+
+	bucketClassSchema = parameterSchema{
+		constant.BucketUnitTypeField:                 {Type: stringParameter, AllowedValues: append([]string{""}, bucketUnitTypeValues...)},
+		constant.CreateBucketField:                   {Type: boolParameter},
+		constant.CreateStorageAccountField:           {Type: boolParameter},
+		constant.SubscriptionIDField:                 {Type: stringParameter},
+		constant.StorageAccountNameField:             {Type: stringParameter, Aliases: []string{"storageaccount"}},
+		constant.StorageAccountNameTemplateField:     {Type: stringParameter},
+		constant.RegionField:                         {Type: stringParameter, Aliases: []string{LocationField}},
+		constant.AccessTierField:                     {Type: stringParameter, AllowedValues: enumValues(accessTiers)},
+		constant.SKUNameField:                        {Type: stringParameter, AllowedValues: enumValues(skuNames)},
+		constant.ResourceGroupField:                  {Type: stringParameter},
+		constant.AllowBlobAccessField:                {Type: boolParameter},
+		constant.AllowSharedAccessKeyField:           {Type: boolParameter},
+		constant.EnableBlobVersioningField:           {Type: boolParameter},
+		constant.EnableBlobDeleteRetentionField:      {Type: boolParameter},
+		constant.BlobDeleteRetentionDaysField:        {Type: intParameter},
+		constant.EnableContainerDeleteRetentionField: {Type: boolParameter},
+		constant.ContainerDeleteRetentionDaysField:   {Type: intParameter},
+		constant.StorageAccountPoolPrefixField:       {Type: stringParameter},
+		constant.MaxContainersPerAccountField:        {Type: intParameter},
+		constant.ContainerMetadataField:              {Type: stringParameter},
+		StorageAccountTypeField:                      {Type: stringParameter},
+		KindField:                                    {Type: stringParameter, AllowedValues: enumValues(kinds)},
+		TagsField:                                    {Type: stringParameter},
+		VNResourceIdsField:                           {Type: stringParameter},
+		HTTPSTrafficOnlyField:                        {Type: boolParameter},
+		CreatePrivateEndpointField:                   {Type: boolParameter},
+		HNSEnabledField:                              {Type: boolParameter},
+		EnableNFSV3Field:                             {Type: boolParameter},
+		EnableLargeFileSharesField:                   {Type: boolParameter},
+		constant.ContainerNameField:                  {Type: stringParameter, Deprecated: "containers are named after the bucket"},
+	}
+
+	bucketAccessClassSchema = parameterSchema{
+		constant.BucketUnitTypeField:                   {Type: stringParameter, AllowedValues: append([]string{""}, bucketUnitTypeValues...)},
+		constant.StorageAccountNameField:               {Type: stringParameter},
+		constant.RegionField:                           {Type: stringParameter},
+		constant.SignedVersionField:                    {Type: stringParameter},
+		constant.SignedIPField:                         {Type: stringParameter},
+		constant.SignedProtocolField:                   {Type: stringParameter, Default: string(sas.ProtocolHTTPSandHTTP), AllowedValues: []string{string(sas.ProtocolHTTPS), string(sas.ProtocolHTTPSandHTTP), "http,https"}},
+		constant.ValidationPeriodField:                 {Type: uintParameter, Default: "604800000"}, // one week
+		constant.EnableListField:                       {Type: boolParameter, Default: TrueValue},
+		constant.EnableReadField:                       {Type: boolParameter, Default: TrueValue},
+		constant.EnableWriteField:                      {Type: boolParameter},
+		constant.EnableDeleteField:                     {Type: boolParameter},
+		constant.EnablePermanentDeleteField:            {Type: boolParameter},
+		constant.EnableAddField:                        {Type: boolParameter},
+		constant.EnableTagsField:                       {Type: boolParameter},
+		constant.EnableFilterField:                     {Type: boolParameter},
+		constant.EnableSetImmutabilityField:            {Type: boolParameter, Deprecated: "SAS tokens never grant the permission to set immutability policies"},
+		constant.AllowServiceSignedResourceTypeField:   {Type: boolParameter, Default: TrueValue},
+		constant.AllowContainerSignedResourceTypeField: {Type: boolParameter, Default: TrueValue},
+		constant.AllowObjectSignedResourceTypeField:    {Type: boolParameter, Default: TrueValue},
+		constant.SigningKeyField:                       {Type: stringParameter, AllowedValues: []string{"", Key1Name, Key2Name}},
+		constant.CredentialModeField:                   {Type: stringParameter, AllowedValues: []string{"", constant.SASCredentialMode, constant.SFTPCredentialMode, constant.AccountKeyCredentialMode}},
+		constant.SFTPAuthenticationField:               {Type: stringParameter, AllowedValues: []string{"", constant.PasswordSFTPAuthentication, constant.SSHKeySFTPAuthentication}},
+		constant.SFTPSSHPublicKeyField:                 {Type: stringParameter},
+		constant.RegenerateKeyOnRevokeField:            {Type: boolParameter},
+	}
+)
+
+// normalize validates parameters against the schema and returns them keyed by canonical name, with defaults applied.
+// Unknown keys, values of the wrong type and values outside the allowed set are rejected with codes.InvalidArgument.
+func (schema parameterSchema) normalize(parameters map[string]string) (map[string]string, error) {
+	normalized, err := schema.canonicalize(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, spec := range schema {
+		if _, ok := normalized[name]; !ok && spec.Default != "" {
+			normalized[name] = spec.Default
+		}
+	}
+	return normalized, nil
+}
+
+// canonicalName returns the canonical name of a parameter key, resolving case and deprecated aliases
+func (schema parameterSchema) canonicalName(key string) string {
+	key = strings.ToLower(key)
+	for name, spec := range schema {
+		for _, alias := range spec.Aliases {
+			if alias == key {
+				return name
+			}
+		}
+	}
+	return key
+}
+
+// canonicalize validates parameters against the schema and returns them keyed by canonical name, without defaults
+func (schema parameterSchema) canonicalize(parameters map[string]string) (map[string]string, error) {
+	normalized := make(map[string]string, len(schema))
+	for _, k := range sortedKeys(parameters) {
+		v := parameters[k]
+		key := schema.canonicalName(k)
+		if key != strings.ToLower(k) {
+			klog.Warningf("Parameter %s is deprecated, use %s instead", k, key)
+		}
+
+		spec, ok := schema[key]
+		if !ok {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Unknown parameter %q, did you mean %q?", k, schema.nearestKey(key)))
+		}
+		if _, ok := normalized[key]; ok {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Parameter %s is set more than once", key))
+		}
+		if err := spec.validate(key, v); err != nil {
+			return nil, err
+		}
+		if spec.Deprecated != "" {
+			klog.Warningf("Parameter %s is deprecated and ignored, %s", k, spec.Deprecated)
+			continue
+		}
+		normalized[key] = v
+	}
+	return normalized, nil
+}
+
+// withDefaults returns parameters with the defaults whose canonical name is not set in parameters added
+func (schema parameterSchema) withDefaults(parameters, defaults map[string]string) map[string]string {
+	if len(defaults) == 0 {
+		return parameters
+	}
+	set := make(map[string]bool, len(parameters))
+	merged := make(map[string]string, len(parameters)+len(defaults))
+	for k, v := range parameters {
+		set[schema.canonicalName(k)] = true
+		merged[k] = v
+	}
+	for k, v := range defaults {
+		if !set[schema.canonicalName(k)] {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+func (spec parameterSpec) validate(key, value string) error {
+	switch spec.Type {
+	case boolParameter:
+		if !strings.EqualFold(value, TrueValue) && !strings.EqualFold(value, FalseValue) {
+			return status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid value %q for parameter %s, must be %s or %s", value, key, TrueValue, FalseValue))
+		}
+	case intParameter:
+		if _, err := strconv.Atoi(value); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	case uintParameter:
+		if _, err := strconv.ParseUint(value, 10, 64); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	if len(spec.AllowedValues) == 0 {
+		return nil
+	}
+	for _, allowed := range spec.AllowedValues {
+		if strings.EqualFold(value, allowed) {
+			return nil
+		}
+	}
+	return status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid value %q for parameter %s, allowed values are: %s", value, key, strings.Join(nonEmpty(spec.AllowedValues), ", ")))
+}
+
+// enumValues returns the names of the values of an enum parameter
+func enumValues[T fmt.Stringer](values []T) []string {
+	names := make([]string, 0, len(values))
+	for _, v := range values {
+		names = append(names, v.String())
+	}
+	return names
+}
+
+// parseEnum returns the value of an enum parameter named name, compared case insensitively.
+// Names are validated against enumValues by the schema, so an unknown or empty name returns the first value.
+func parseEnum[T fmt.Stringer](values []T, name string) T {
+	for _, v := range values {
+		if strings.EqualFold(v.String(), name) {
+			return v
+		}
+	}
+	return values[0]
+}
+
+// nearestKey returns the parameter name with the smallest edit distance to key
+func (schema parameterSchema) nearestKey(key string) string {
+	nearest := ""
+	nearestDistance := -1
+	for name, spec := range schema {
+		if spec.Deprecated != "" {
+			continue
+		}
+		d := editDistance(key, name)
+		if nearestDistance < 0 || d < nearestDistance || (d == nearestDistance && name < nearest) {
+			nearest, nearestDistance = name, d
+		}
+	}
+	return nearest
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, minInt(curr[j-1]+1, prev[j-1]+cost))
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func nonEmpty(values []string) []string {
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,147 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNormalize(t *testing.T) {
+	schema := parameterSchema{
+		"enabled": {Type: boolParameter, Default: TrueValue},
+		"count":   {Type: intParameter},
+		"period":  {Type: uintParameter},
+		"tier":    {Type: stringParameter, AllowedValues: []string{"hot", "cool"}},
+		"region":  {Type: stringParameter, Aliases: []string{"location"}},
+		"legacy":  {Type: boolParameter, Deprecated: "legacy is always on"},
+	}
+	tests := []struct {
+		testName    string
+		parameters  map[string]string
+		expectedOut map[string]string
+		expectedErr error
+	}{
+		{
+			testName:    "Defaults",
+			parameters:  map[string]string{},
+			expectedOut: map[string]string{"enabled": TrueValue},
+		},
+		{
+			testName:    "Keys are case insensitive",
+			parameters:  map[string]string{"Enabled": "False", "Tier": "HOT"},
+			expectedOut: map[string]string{"enabled": "False", "tier": "HOT"},
+		},
+		{
+			testName:    "Deprecated alias",
+			parameters:  map[string]string{"location": "eastus"},
+			expectedOut: map[string]string{"enabled": TrueValue, "region": "eastus"},
+		},
+		{
+			testName:    "Deprecated parameter is ignored",
+			parameters:  map[string]string{"Legacy": TrueValue},
+			expectedOut: map[string]string{"enabled": TrueValue},
+		},
+		{
+			testName:    "Deprecated parameter is validated",
+			parameters:  map[string]string{"legacy": "yes"},
+			expectedErr: status.Error(codes.InvalidArgument, "Invalid value \"yes\" for parameter legacy, must be true or false"),
+		},
+		{
+			testName:    "Alias and canonical name",
+			parameters:  map[string]string{"location": "eastus", "region": "westus"},
+			expectedErr: status.Error(codes.InvalidArgument, "Parameter region is set more than once"),
+		},
+		{
+			testName:    "Unknown key",
+			parameters:  map[string]string{"tierr": "hot"},
+			expectedErr: status.Error(codes.InvalidArgument, "Unknown parameter \"tierr\", did you mean \"tier\"?"),
+		},
+		{
+			testName:    "Malformed boolean",
+			parameters:  map[string]string{"enabled": "1"},
+			expectedErr: status.Error(codes.InvalidArgument, "Invalid value \"1\" for parameter enabled, must be true or false"),
+		},
+		{
+			testName:    "Malformed integer",
+			parameters:  map[string]string{"count": "one"},
+			expectedErr: status.Error(codes.InvalidArgument, "strconv.Atoi: parsing \"one\": invalid syntax"),
+		},
+		{
+			testName:    "Negative unsigned integer",
+			parameters:  map[string]string{"period": "-1"},
+			expectedErr: status.Error(codes.InvalidArgument, "strconv.ParseUint: parsing \"-1\": invalid syntax"),
+		},
+		{
+			testName:    "Value not allowed",
+			parameters:  map[string]string{"tier": "archive"},
+			expectedErr: status.Error(codes.InvalidArgument, "Invalid value \"archive\" for parameter tier, allowed values are: hot, cool"),
+		},
+	}
+	for _, test := range tests {
+		output, err := schema.normalize(test.parameters)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectedErr, err)
+		}
+		if err == nil && !reflect.DeepEqual(output, test.expectedOut) {
+			t.Errorf("\nTestCase: %s\nExpected Output: %v\nActual Output: %v", test.testName, test.expectedOut, output)
+		}
+	}
+}
+
+func TestNearestKey(t *testing.T) {
+	tests := []struct {
+		testName    string
+		schema      parameterSchema
+		key         string
+		expectedKey string
+	}{
+		{
+			testName:    "Transposed letters",
+			schema:      bucketAccessClassSchema,
+			key:         "enablewrtie",
+			expectedKey: "enablewrite",
+		},
+		{
+			testName:    "Missing letter",
+			schema:      bucketClassSchema,
+			key:         "resourcegrup",
+			expectedKey: "resourcegroup",
+		},
+	}
+	for _, test := range tests {
+		if key := test.schema.nearestKey(test.key); key != test.expectedKey {
+			t.Errorf("\nTestCase: %s\nExpected Key: %v\nActual Key: %v", test.testName, test.expectedKey, key)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{a: "", b: "abc", expected: 3},
+		{a: "abc", b: "abc", expected: 0},
+		{a: "kitten", b: "sitting", expected: 3},
+	}
+	for _, test := range tests {
+		if d := editDistance(test.a, test.b); d != test.expected {
+			t.Errorf("\nTestCase: %s/%s\nExpected Distance: %v\nActual Distance: %v", test.a, test.b, test.expected, d)
+		}
+	}
+}
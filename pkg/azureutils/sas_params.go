@@ -0,0 +1,107 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// parseSignedProtocol parses the signedprotocol parameter. "https" restricts the SAS to HTTPS,
+// "https,http" (in either order) allows both.
+func parseSignedProtocol(value string) (sas.Protocol, error) {
+	switch strings.ToLower(value) {
+	case string(sas.ProtocolHTTPS):
+		return sas.ProtocolHTTPS, nil
+	case string(sas.ProtocolHTTPSandHTTP), "http,https":
+		return sas.ProtocolHTTPSandHTTP, nil
+	}
+	return "", status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid SAS Protocol %s, must be %s or %s", value, sas.ProtocolHTTPS, sas.ProtocolHTTPSandHTTP))
+}
+
+// parseSignedIPRange parses the signedipfield parameter, which may be a single IP (10.0.0.1),
+// an inclusive range (10.0.0.1-10.0.0.255) or a CIDR block (10.0.0.0/24) which is converted to a range.
+// Azure Storage only accepts IPv4 addresses in a SAS.
+func parseSignedIPRange(value string) (sas.IPRange, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		return parseCIDRRange(value)
+	}
+
+	ips := strings.Split(value, "-")
+	if len(ips) > 2 {
+		return sas.IPRange{}, status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid IP Range %s, Must be formatted as <ip>, <ip1>-<ip2> or <ip>/<prefix length>", value))
+	}
+
+	start, err := parseSignedIP(ips[0])
+	if err != nil {
+		return sas.IPRange{}, err
+	}
+	if len(ips) == 1 {
+		return sas.IPRange{Start: start}, nil
+	}
+
+	end, err := parseSignedIP(ips[1])
+	if err != nil {
+		return sas.IPRange{}, err
+	}
+	if bytes.Compare(start, end) > 0 {
+		return sas.IPRange{}, status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid IP Range %s, start address is after end address", value))
+	}
+	return sas.IPRange{Start: start, End: end}, nil
+}
+
+func parseSignedIP(value string) (net.IP, error) {
+	value = strings.TrimSpace(value)
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid IP %q", value))
+	}
+	ipv4 := ip.To4()
+	if ipv4 == nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("IP %s is an IPv6 address, SAS IP ranges only support IPv4", value))
+	}
+	return ipv4, nil
+}
+
+func parseCIDRRange(value string) (sas.IPRange, error) {
+	ip, ipNet, err := net.ParseCIDR(value)
+	if err != nil {
+		return sas.IPRange{}, status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid CIDR %q", value))
+	}
+	if ip.To4() == nil {
+		return sas.IPRange{}, status.Error(codes.InvalidArgument, fmt.Sprintf("CIDR %s is an IPv6 block, SAS IP ranges only support IPv4", value))
+	}
+
+	start := ipNet.IP.To4()
+	mask := ipNet.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	end := make(net.IP, net.IPv4len)
+	for i := range start {
+		end[i] = start[i] | ^mask[i]
+	}
+
+	if start.Equal(end) {
+		return sas.IPRange{Start: start}, nil
+	}
+	return sas.IPRange{Start: start, End: end}, nil
+}
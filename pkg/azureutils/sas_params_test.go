@@ -0,0 +1,151 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseSignedProtocol(t *testing.T) {
+	tests := []struct {
+		testName         string
+		value            string
+		expectedProtocol sas.Protocol
+		expectedErr      error
+	}{
+		{
+			testName:         "HTTPS only",
+			value:            "https",
+			expectedProtocol: sas.ProtocolHTTPS,
+		},
+		{
+			testName:         "HTTPS only upper case",
+			value:            "HTTPS",
+			expectedProtocol: sas.ProtocolHTTPS,
+		},
+		{
+			testName:         "HTTPS and HTTP",
+			value:            "https,http",
+			expectedProtocol: sas.ProtocolHTTPSandHTTP,
+		},
+		{
+			testName:         "HTTP and HTTPS",
+			value:            "http,https",
+			expectedProtocol: sas.ProtocolHTTPSandHTTP,
+		},
+		{
+			testName:    "HTTP only",
+			value:       "http",
+			expectedErr: status.Error(codes.InvalidArgument, "Invalid SAS Protocol http, must be https or https,http"),
+		},
+	}
+	for _, test := range tests {
+		protocol, err := parseSignedProtocol(test.value)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectedErr, err)
+		}
+		if err == nil && protocol != test.expectedProtocol {
+			t.Errorf("\nTestCase: %s\nExpected Protocol: %v\nActual Protocol: %v", test.testName, test.expectedProtocol, protocol)
+		}
+	}
+}
+
+func TestParseSignedIPRange(t *testing.T) {
+	tests := []struct {
+		testName      string
+		value         string
+		expectedRange string
+		expectedErr   error
+	}{
+		{
+			testName:      "Single IP",
+			value:         "10.0.0.1",
+			expectedRange: "10.0.0.1",
+		},
+		{
+			testName:      "IP Range",
+			value:         "10.0.0.1-10.0.0.255",
+			expectedRange: "10.0.0.1-10.0.0.255",
+		},
+		{
+			testName:      "IP Range with spaces",
+			value:         " 10.0.0.1 - 10.0.0.255 ",
+			expectedRange: "10.0.0.1-10.0.0.255",
+		},
+		{
+			testName:      "CIDR",
+			value:         "10.1.0.0/16",
+			expectedRange: "10.1.0.0-10.1.255.255",
+		},
+		{
+			testName:      "CIDR host bits are masked",
+			value:         "192.168.1.77/24",
+			expectedRange: "192.168.1.0-192.168.1.255",
+		},
+		{
+			testName:      "CIDR single host",
+			value:         "192.168.1.77/32",
+			expectedRange: "192.168.1.77",
+		},
+		{
+			testName:    "Invalid IP",
+			value:       "10.0.0.256",
+			expectedErr: status.Error(codes.InvalidArgument, "Invalid IP \"10.0.0.256\""),
+		},
+		{
+			testName:    "Invalid range end",
+			value:       "10.0.0.1-foo",
+			expectedErr: status.Error(codes.InvalidArgument, "Invalid IP \"foo\""),
+		},
+		{
+			testName:    "Too many addresses",
+			value:       "10.0.0.1-10.0.0.2-10.0.0.3",
+			expectedErr: status.Error(codes.InvalidArgument, "Invalid IP Range 10.0.0.1-10.0.0.2-10.0.0.3, Must be formatted as <ip>, <ip1>-<ip2> or <ip>/<prefix length>"),
+		},
+		{
+			testName:    "Reversed range",
+			value:       "10.0.0.255-10.0.0.1",
+			expectedErr: status.Error(codes.InvalidArgument, "Invalid IP Range 10.0.0.255-10.0.0.1, start address is after end address"),
+		},
+		{
+			testName:    "Invalid CIDR",
+			value:       "10.0.0.0/33",
+			expectedErr: status.Error(codes.InvalidArgument, "Invalid CIDR \"10.0.0.0/33\""),
+		},
+		{
+			testName:    "IPv6",
+			value:       "2001:db8::1",
+			expectedErr: status.Error(codes.InvalidArgument, "IP 2001:db8::1 is an IPv6 address, SAS IP ranges only support IPv4"),
+		},
+		{
+			testName:    "IPv6 CIDR",
+			value:       "2001:db8::/32",
+			expectedErr: status.Error(codes.InvalidArgument, "CIDR 2001:db8::/32 is an IPv6 block, SAS IP ranges only support IPv4"),
+		},
+	}
+	for _, test := range tests {
+		ipRange, err := parseSignedIPRange(test.value)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectedErr, err)
+		}
+		if err == nil && ipRange.String() != test.expectedRange {
+			t.Errorf("\nTestCase: %s\nExpected Range: %v\nActual Range: %v", test.testName, test.expectedRange, ipRange.String())
+		}
+	}
+}
@@ -0,0 +1,399 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"project/azure-cosi-driver/pkg/constant"
+	"project/azure-cosi-driver/pkg/types"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
+)
+
+const (
+	// SFTPGrantsTag is the storage account tag recording the SFTP grants of the account, as a comma separated list of
+	// grant IDs. Revocations only look for the local users of the grants it records, as SAS grants on containers have none.
+	SFTPGrantsTag = "cosi-sftp-grants"
+	// sftpGrantIDLength is the length of the hash of the account name identifying a grant in SFTPGrantsTag
+	sftpGrantIDLength = 8
+	// maxSFTPGrantsLength is the longest value Azure allows for a tag
+	maxSFTPGrantsLength = 256
+
+	maxGrantNameLength  = 64
+	grantNameHashLength = 12
+	// sftpService is the service the permission scopes of SFTP local users apply to
+	sftpService = "blob"
+	// sftpGrantTTL is how long the credentials of an SFTP grant are remembered, so that a grant the COSI sidecar
+	// retries, e.g. because the response was lost, returns the same password rather than regenerating it
+	sftpGrantTTL = 10 * time.Minute
+)
+
+// sftpPermissions maps the names of sasPermissions to the local user permissions they grant.
+// The other SAS permissions have no SFTP equivalent.
+var sftpPermissions = []struct {
+	name       string
+	permission string
+}{
+	{"read", "r"},
+	{"write", "w"},
+	{"delete", "d"},
+	{"list", "l"},
+	{"add", "c"},
+}
+
+// localUserClient manages the SFTP local users of storage accounts.
+// azure.Cloud has no client for them, so it is made with the credentials of the cloud config.
+type localUserClient interface {
+	createOrUpdate(ctx context.Context, resourceGroup, account, username string, user storage.LocalUser) error
+	// regeneratePassword returns a new SSH password of the local user
+	regeneratePassword(ctx context.Context, resourceGroup, account, username string) (string, error)
+	// delete deletes the local user, a local user that does not exist is not an error
+	delete(ctx context.Context, resourceGroup, account, username string) error
+}
+
+// newLocalUserClient returns the client of the local users of the storage accounts of the subscription, replaced in tests
+var newLocalUserClient = func(cloud *azure.Cloud, subsID string) (localUserClient, error) {
+	authorizer, err := getARMAuthorizer(cloud)
+	if err != nil {
+		return nil, err
+	}
+	client := storage.NewLocalUsersClientWithBaseURI(cloud.Environment.ResourceManagerEndpoint, subsID)
+	client.Authorizer = authorizer
+	return &armLocalUserClient{client: client, subsID: subsID}, nil
+}
+
+type armLocalUserClient struct {
+	client storage.LocalUsersClient
+	subsID string
+}
+
+func (c *armLocalUserClient) createOrUpdate(ctx context.Context, resourceGroup, account, username string, user storage.LocalUser) error {
+	reqCtx, req, err := startARMRequest(ctx, createLocalUserOperation, c.subsID)
+	if err != nil {
+		return err
+	}
+	result, err := c.client.CreateOrUpdate(reqCtx, resourceGroup, account, username, user)
+	rerr := retry.GetError(result.Response.Response, err)
+	req.endARM(rerr)
+	return rerr.Error()
+}
+
+func (c *armLocalUserClient) regeneratePassword(ctx context.Context, resourceGroup, account, username string) (string, error) {
+	reqCtx, req, err := startARMRequest(ctx, regenerateLocalUserPasswordOperation, c.subsID)
+	if err != nil {
+		return "", err
+	}
+	result, err := c.client.RegeneratePassword(reqCtx, resourceGroup, account, username)
+	rerr := retry.GetError(result.Response.Response, err)
+	req.endARM(rerr)
+	if rerr != nil {
+		return "", rerr.Error()
+	}
+	return to.String(result.SSHPassword), nil
+}
+
+func (c *armLocalUserClient) delete(ctx context.Context, resourceGroup, account, username string) error {
+	reqCtx, req, err := startARMRequest(ctx, deleteLocalUserOperation, c.subsID)
+	if err != nil {
+		return err
+	}
+	result, err := c.client.Delete(reqCtx, resourceGroup, account, username)
+	rerr := retry.GetError(result.Response, err)
+	req.endARM(rerr)
+	if rerr != nil && !rerr.IsNotFound() {
+		return rerr.Error()
+	}
+	return nil
+}
+
+// getGrantName returns the name of the SFTP local user of a grant, derived from the account name of the grant
+// so that it is found again on revocation. Local user names only allow lowercase letters and digits.
+func getGrantName(accountName string) string {
+	name := invalidAccountNameCharRE.ReplaceAllString(strings.ToLower(accountName), "")
+	if len(name) > maxGrantNameLength {
+		name = name[:maxGrantNameLength-grantNameHashLength] + nameHash(grantNameHashLength, accountName)
+	}
+	return name
+}
+
+// getSFTPGrantID returns the ID of the SFTP grant of the account name of a grant
+func getSFTPGrantID(accountName string) string {
+	return nameHash(sftpGrantIDLength, accountName)
+}
+
+// parseSFTPGrants returns the IDs of the SFTP grants recorded in the tags of a storage account
+func parseSFTPGrants(tags map[string]*string) []string {
+	value, ok := tags[SFTPGrantsTag]
+	if !ok || value == nil || *value == "" {
+		return nil
+	}
+	return strings.Split(*value, ",")
+}
+
+// findSFTPGrant returns the index of the grant with the ID in grants, -1 if there is none
+func findSFTPGrant(grants []string, id string) int {
+	for i, grant := range grants {
+		if grant == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// recordSFTPGrant records the SFTP grant with the ID in the tags of the storage account, a retried grant is already recorded
+func recordSFTPGrant(ctx context.Context, cloud *azure.Cloud, account StorageAccountRef, tags map[string]*string, id string) error {
+	grants := parseSFTPGrants(tags)
+	if findSFTPGrant(grants, id) >= 0 {
+		return nil
+	}
+	value := strings.Join(append(grants, id), ",")
+	if len(value) > maxSFTPGrantsLength {
+		return status.Error(codes.ResourceExhausted, fmt.Sprintf("Storage account %s has too many SFTP grants, revoke some of them or grant a SAS", account.Name))
+	}
+	klog.Infof("Recording the SFTP grant %s of storage account %s in tag %s", id, account.Name, SFTPGrantsTag)
+	return setStorageAccountTags(ctx, cloud, account, tags, map[string]string{SFTPGrantsTag: value})
+}
+
+// getSFTPPermissions returns the local user permissions matching the SAS permissions of the parameters
+func getSFTPPermissions(params *BucketAccessClassParameters) string {
+	permissions := ""
+	for _, p := range sftpPermissions {
+		if sasPermissions[p.name].granted(params) {
+			permissions += p.permission
+		}
+	}
+	return permissions
+}
+
+// sftpGrant holds the credentials an SFTP grant returned, see sftpGrantTTL
+type sftpGrant struct {
+	// user is the local user the credentials were returned for, a retry asking for another one is not served them
+	user    storage.LocalUser
+	secrets map[string]string
+	expires time.Time
+}
+
+// sftpGrantCache remembers the credentials of recent SFTP grants by storage account and local user
+type sftpGrantCache struct {
+	lock   sync.Mutex
+	grants map[string]sftpGrant
+	now    func() time.Time
+}
+
+var sftpGrants = &sftpGrantCache{grants: make(map[string]sftpGrant), now: time.Now}
+
+func sftpGrantKey(account StorageAccountRef, username string) string {
+	return strings.ToLower(account.SubscriptionID + "/" + account.ResourceGroup + "/" + account.Name + "/" + username)
+}
+
+// get returns the credentials returned for the same local user, if they were remembered
+func (c *sftpGrantCache) get(account StorageAccountRef, username string, user storage.LocalUser) (map[string]string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := sftpGrantKey(account, username)
+	grant, ok := c.grants[key]
+	if !ok || c.now().After(grant.expires) {
+		delete(c.grants, key)
+		return nil, false
+	}
+	return grant.secrets, reflect.DeepEqual(grant.user, user)
+}
+
+// put remembers the credentials of a grant for sftpGrantTTL, and forgets the expired ones
+func (c *sftpGrantCache) put(account StorageAccountRef, username string, user storage.LocalUser, secrets map[string]string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.now()
+	for key, grant := range c.grants {
+		if now.After(grant.expires) {
+			delete(c.grants, key)
+		}
+	}
+	c.grants[sftpGrantKey(account, username)] = sftpGrant{user: user, secrets: secrets, expires: now.Add(sftpGrantTTL)}
+}
+
+// forget drops the credentials of the local user, which was deleted
+func (c *sftpGrantCache) forget(account StorageAccountRef, username string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.grants, sftpGrantKey(account, username))
+}
+
+// bucketStorageAccount returns the subscription, resource group and name of the storage account of a bucket
+func bucketStorageAccount(id *types.BucketID, cloud *azure.Cloud) StorageAccountRef {
+	account := StorageAccountRef{SubscriptionID: id.SubID, ResourceGroup: id.ResourceGroup, Name: getStorageAccountNameFromContainerURL(id.URL)}
+	if account.SubscriptionID == "" {
+		account.SubscriptionID = cloud.SubscriptionID
+	}
+	if account.ResourceGroup == "" {
+		account.ResourceGroup = cloud.ResourceGroup
+	}
+	return account
+}
+
+// getStorageAccount returns the storage account, with non-nil properties and tags, and false if it does not exist
+func getStorageAccount(ctx context.Context, cloud *azure.Cloud, account StorageAccountRef) (storage.Account, bool, error) {
+	if cloud.StorageAccountClient == nil {
+		return storage.Account{}, false, fmt.Errorf("StorageAccountClient is nil")
+	}
+	reqCtx, req, err := startARMRequest(ctx, getStorageAccountPropertiesOperation, account.SubscriptionID)
+	if err != nil {
+		return storage.Account{}, false, err
+	}
+	result, rerr := cloud.StorageAccountClient.GetProperties(reqCtx, account.SubscriptionID, account.ResourceGroup, account.Name)
+	req.endARM(rerr)
+	if rerr != nil {
+		if rerr.IsNotFound() {
+			return storage.Account{}, false, nil
+		}
+		return storage.Account{}, false, azureError(rerr.Error(), "Could not get storage account %s", account.Name)
+	}
+	accountKeys.observe(account.SubscriptionID, account.ResourceGroup, result)
+	if result.AccountProperties == nil {
+		result.AccountProperties = &storage.AccountProperties{}
+	}
+	if result.Tags == nil {
+		result.Tags = map[string]*string{}
+	}
+	return result, true, nil
+}
+
+// createSFTPLocalUser creates the SFTP local user of a grant on the container of the bucket, with the container as
+// home directory and the permissions of the parameters on it, and returns its credentials. The grant is recorded in
+// the tags of the storage account before the local user is created, so that its revocation deletes it.
+func createSFTPLocalUser(ctx context.Context, bucketID, accountName string, params *BucketAccessClassParameters, cloud *azure.Cloud) (map[string]string, error) {
+	permissions := getSFTPPermissions(params)
+	if permissions == "" {
+		return nil, status.Error(codes.InvalidArgument, "no SFTP permission is granted, enable at least one of read, write, delete, list or add")
+	}
+
+	id, err := types.DecodeToBucketID(bucketID)
+	if err != nil {
+		return nil, err
+	}
+	containerURL, err := url.Parse(id.URL)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid bucket URL %s: %v", id.URL, err))
+	}
+	container := getContainerNameFromContainerURL(id.URL)
+	if container == "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%s %s is only granted on buckets of %s %s", constant.CredentialModeField, constant.SFTPCredentialMode, constant.BucketUnitTypeField, constant.Container))
+	}
+	account := bucketStorageAccount(id, cloud)
+
+	storageAccount, found, err := getStorageAccount(ctx, cloud, account)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("Storage account %s not found", account.Name))
+	}
+	if !to.Bool(storageAccount.IsHnsEnabled) || !to.Bool(storageAccount.IsSftpEnabled) {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("Storage account %s does not allow SFTP, it needs a hierarchical namespace and SFTP enabled", account.Name))
+	}
+
+	client, err := newLocalUserClient(cloud, account.SubscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	username := getGrantName(accountName)
+	sshKey := params.sftpAuthentication == constant.SSHKeySFTPAuthentication
+	user := storage.LocalUser{LocalUserProperties: &storage.LocalUserProperties{
+		PermissionScopes: &[]storage.PermissionScope{{
+			Permissions:  to.StringPtr(permissions),
+			Service:      to.StringPtr(sftpService),
+			ResourceName: to.StringPtr(container),
+		}},
+		HomeDirectory:  to.StringPtr(container),
+		HasSharedKey:   to.BoolPtr(false),
+		HasSSHPassword: to.BoolPtr(!sshKey),
+		HasSSHKey:      to.BoolPtr(sshKey),
+	}}
+	if sshKey {
+		user.SSHAuthorizedKeys = &[]storage.SSHPublicKey{{Description: to.StringPtr(accountName), Key: to.StringPtr(params.sftpSSHPublicKey)}}
+	}
+
+	if err := recordSFTPGrant(ctx, cloud, account, storageAccount.Tags, getSFTPGrantID(accountName)); err != nil {
+		return nil, err
+	}
+	klog.Infof("Creating SFTP local user %s on container %s of storage account %s", username, container, account.Name)
+	if err := client.createOrUpdate(ctx, account.ResourceGroup, account.Name, username, user); err != nil {
+		return nil, azureError(err, "Could not create SFTP local user %s in storage account %s", username, account.Name)
+	}
+
+	secrets := map[string]string{
+		constant.SFTPHost: containerURL.Host,
+		// SFTP clients log in as <account>.<local user>
+		constant.SFTPUsername: account.Name + "." + username,
+	}
+	if sshKey {
+		secrets[constant.SFTPSSHPublicKey] = params.sftpSSHPublicKey
+		return secrets, nil
+	}
+	// A retried grant gets the password of the grant it retries, regenerating it would break the credentials returned then
+	if granted, ok := sftpGrants.get(account, username, user); ok {
+		klog.Infof("SFTP local user %s of storage account %s was just granted, returning the same password", username, account.Name)
+		return granted, nil
+	}
+	password, err := client.regeneratePassword(ctx, account.ResourceGroup, account.Name, username)
+	if err != nil {
+		return nil, azureError(err, "Could not generate the password of SFTP local user %s in storage account %s", username, account.Name)
+	}
+	secrets[constant.SFTPPassword] = password
+	sftpGrants.put(account, username, user, secrets)
+	return secrets, nil
+}
+
+// deleteSFTPLocalUser deletes the SFTP local user of a grant recorded in the tags of the storage account, then the
+// record. Other grants, e.g. SAS grants on containers, have no local user and nothing to revoke. The local user is
+// deleted even if SFTP was disabled on the storage account since it would be active again once SFTP is enabled.
+func deleteSFTPLocalUser(ctx context.Context, id *types.BucketID, accountName string, cloud *azure.Cloud) error {
+	account := bucketStorageAccount(id, cloud)
+	username := getGrantName(accountName)
+	sftpGrants.forget(account, username)
+
+	storageAccount, found, err := getStorageAccount(ctx, cloud, account)
+	if err != nil || !found {
+		return err
+	}
+	grants := parseSFTPGrants(storageAccount.Tags)
+	i := findSFTPGrant(grants, getSFTPGrantID(accountName))
+	if i < 0 {
+		return nil
+	}
+
+	client, err := newLocalUserClient(cloud, account.SubscriptionID)
+	if err != nil {
+		return err
+	}
+	klog.Infof("Deleting SFTP local user %s of storage account %s", username, account.Name)
+	if err := client.delete(ctx, account.ResourceGroup, account.Name, username); err != nil {
+		return azureError(err, "Could not delete SFTP local user %s in storage account %s", username, account.Name)
+	}
+	grants = append(grants[:i], grants[i+1:]...)
+	return setStorageAccountTags(ctx, cloud, account, storageAccount.Tags, map[string]string{SFTPGrantsTag: strings.Join(grants, ",")})
+}
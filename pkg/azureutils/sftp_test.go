@@ -0,0 +1,452 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"project/azure-cosi-driver/pkg/constant"
+	"project/azure-cosi-driver/pkg/types"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/golang/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/storageaccountclient/mockstorageaccountclient"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
+)
+
+const (
+	sftpAccount   = "sftpaccount"
+	sftpGrantName = "ba-0b1c2d3e-4f50-6172-8394-a5b6c7d8e9f0"
+	sftpUserName  = "ba0b1c2d3e4f5061728394a5b6c7d8e9f0"
+)
+
+// fakeLocalUserClient records the local users it creates and deletes, and counts the passwords it generates
+type fakeLocalUserClient struct {
+	created   map[string]storage.LocalUser
+	deleted   []string
+	passwords int
+}
+
+func (c *fakeLocalUserClient) createOrUpdate(_ context.Context, _, account, username string, user storage.LocalUser) error {
+	c.created[account+"/"+username] = user
+	return nil
+}
+
+func (c *fakeLocalUserClient) regeneratePassword(context.Context, string, string, string) (string, error) {
+	c.passwords++
+	return fmt.Sprintf("password%d", c.passwords), nil
+}
+
+func (c *fakeLocalUserClient) delete(_ context.Context, _, account, username string) error {
+	delete(c.created, account+"/"+username)
+	c.deleted = append(c.deleted, account+"/"+username)
+	return nil
+}
+
+// newSFTPCloud returns a cloud with an HNS storage account with SFTP enabled, and the valid account without SFTP
+func newSFTPCloud(t *testing.T) *azure.Cloud {
+	return newSFTPCloudWithTags(t, map[string]map[string]*string{})
+}
+
+// newSFTPCloudWithTags returns the cloud of newSFTPCloud, whose storage accounts have tags by name and record
+// tag updates in them
+func newSFTPCloudWithTags(t *testing.T, tags map[string]map[string]*string) *azure.Cloud {
+	ctrl := gomock.NewController(t)
+	cloud := azure.GetTestCloud(ctrl)
+	cl := mockstorageaccountclient.NewMockInterface(ctrl)
+	var lock sync.Mutex
+	for _, account := range []string{sftpAccount, constant.ValidAccount} {
+		if tags[account] == nil {
+			tags[account] = map[string]*string{}
+		}
+	}
+	cl.EXPECT().
+		GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), sftpAccount).
+		DoAndReturn(func(context.Context, string, string, string) (storage.Account, *retry.Error) {
+			lock.Lock()
+			defer lock.Unlock()
+			return storage.Account{Tags: copyTags(tags[sftpAccount]), AccountProperties: &storage.AccountProperties{IsHnsEnabled: to.BoolPtr(true), IsSftpEnabled: to.BoolPtr(true)}}, nil
+		}).
+		AnyTimes()
+	cl.EXPECT().
+		GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), constant.ValidAccount).
+		DoAndReturn(func(context.Context, string, string, string) (storage.Account, *retry.Error) {
+			lock.Lock()
+			defer lock.Unlock()
+			return storage.Account{Tags: copyTags(tags[constant.ValidAccount]), AccountProperties: &storage.AccountProperties{}}, nil
+		}).
+		AnyTimes()
+	cl.EXPECT().
+		Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, _, _, account string, parameters storage.AccountUpdateParameters) *retry.Error {
+			lock.Lock()
+			defer lock.Unlock()
+			tags[account] = copyTags(parameters.Tags)
+			return nil
+		}).
+		AnyTimes()
+	cl.EXPECT().
+		GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(storage.Account{}, retry.GetError(&http.Response{StatusCode: http.StatusNotFound}, fmt.Errorf("not found"))).
+		AnyTimes()
+	cl.EXPECT().
+		ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{KeyName: to.StringPtr(Key1Name), Value: to.StringPtr("a2V5")}}}, nil).
+		AnyTimes()
+	cloud.StorageAccountClient = cl
+	return cloud
+}
+
+func copyTags(tags map[string]*string) map[string]*string {
+	copied := make(map[string]*string, len(tags))
+	for k, v := range tags {
+		copied[k] = v
+	}
+	return copied
+}
+
+func encodeBucketID(t *testing.T, url string) string {
+	bucketID, err := (&types.BucketID{SubID: "subscription", ResourceGroup: "rg", URL: url}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bucketID
+}
+
+func TestGrantBucketAccess(t *testing.T) {
+	defer func(f func(*azure.Cloud, string) (localUserClient, error)) { newLocalUserClient = f }(newLocalUserClient)
+
+	sftpContainer := encodeBucketID(t, "https://sftpaccount.blob.core.windows.net/container")
+	sftp := map[string]string{constant.CredentialModeField: constant.SFTPCredentialMode}
+	tests := []struct {
+		testName        string
+		bucketID        string
+		parameters      map[string]string
+		expectedSecrets map[string]string
+		expectedUser    *storage.LocalUserProperties
+		expectedCode    codes.Code
+	}{
+		{
+			testName:   "SFTP password",
+			bucketID:   sftpContainer,
+			parameters: sftp,
+			expectedSecrets: map[string]string{
+				constant.SFTPHost:     "sftpaccount.blob.core.windows.net",
+				constant.SFTPUsername: sftpAccount + "." + sftpUserName,
+				constant.SFTPPassword: "password1",
+			},
+			expectedUser: &storage.LocalUserProperties{
+				PermissionScopes: &[]storage.PermissionScope{{Permissions: to.StringPtr("rl"), Service: to.StringPtr("blob"), ResourceName: to.StringPtr("container")}},
+				HomeDirectory:    to.StringPtr("container"),
+				HasSharedKey:     to.BoolPtr(false),
+				HasSSHPassword:   to.BoolPtr(true),
+				HasSSHKey:        to.BoolPtr(false),
+			},
+		},
+		{
+			testName: "SFTP SSH key",
+			bucketID: sftpContainer,
+			parameters: map[string]string{
+				constant.CredentialModeField:     constant.SFTPCredentialMode,
+				constant.SFTPAuthenticationField: constant.SSHKeySFTPAuthentication,
+				constant.SFTPSSHPublicKeyField:   "ssh-ed25519 AAAA",
+				constant.EnableWriteField:        TrueValue,
+				constant.EnableListField:         FalseValue,
+			},
+			expectedSecrets: map[string]string{
+				constant.SFTPHost:         "sftpaccount.blob.core.windows.net",
+				constant.SFTPUsername:     sftpAccount + "." + sftpUserName,
+				constant.SFTPSSHPublicKey: "ssh-ed25519 AAAA",
+			},
+			expectedUser: &storage.LocalUserProperties{
+				PermissionScopes:  &[]storage.PermissionScope{{Permissions: to.StringPtr("rw"), Service: to.StringPtr("blob"), ResourceName: to.StringPtr("container")}},
+				HomeDirectory:     to.StringPtr("container"),
+				HasSharedKey:      to.BoolPtr(false),
+				HasSSHPassword:    to.BoolPtr(false),
+				HasSSHKey:         to.BoolPtr(true),
+				SSHAuthorizedKeys: &[]storage.SSHPublicKey{{Description: to.StringPtr(sftpGrantName), Key: to.StringPtr("ssh-ed25519 AAAA")}},
+			},
+		},
+		{
+			testName:     "SFTP SSH key without public key",
+			bucketID:     sftpContainer,
+			parameters:   map[string]string{constant.CredentialModeField: constant.SFTPCredentialMode, constant.SFTPAuthenticationField: constant.SSHKeySFTPAuthentication},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			testName:     "SFTP without permissions",
+			bucketID:     sftpContainer,
+			parameters:   map[string]string{constant.CredentialModeField: constant.SFTPCredentialMode, constant.EnableReadField: FalseValue, constant.EnableListField: FalseValue},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			testName:     "SFTP on a storage account without SFTP",
+			bucketID:     encodeBucketID(t, constant.ValidContainerURL),
+			parameters:   sftp,
+			expectedCode: codes.FailedPrecondition,
+		},
+		{
+			testName:     "SFTP on a storage account bucket",
+			bucketID:     encodeBucketID(t, "https://sftpaccount.blob.core.windows.net/"),
+			parameters:   sftp,
+			expectedCode: codes.InvalidArgument,
+		},
+	}
+	for _, test := range tests {
+		sftpGrants = &sftpGrantCache{grants: make(map[string]sftpGrant), now: time.Now}
+		localUsers := &fakeLocalUserClient{created: map[string]storage.LocalUser{}}
+		newLocalUserClient = func(*azure.Cloud, string) (localUserClient, error) { return localUsers, nil }
+
+		secrets, err := GrantBucketAccess(context.Background(), test.bucketID, sftpGrantName, test.parameters, newSFTPCloud(t))
+		if status.Code(err) != test.expectedCode {
+			t.Errorf("\nTestCase: %s\nExpected Code: %v\nActual Error: %v", test.testName, test.expectedCode, err)
+		}
+		if !reflect.DeepEqual(secrets, test.expectedSecrets) {
+			t.Errorf("\nTestCase: %s\nExpected Secrets: %v\nActual Secrets: %v", test.testName, test.expectedSecrets, secrets)
+		}
+		user, created := localUsers.created[sftpAccount+"/"+sftpUserName]
+		if created != (test.expectedUser != nil) || (created && !reflect.DeepEqual(user.LocalUserProperties, test.expectedUser)) {
+			t.Errorf("\nTestCase: %s\nExpected Local User: %+v\nActual Local Users: %+v", test.testName, test.expectedUser, localUsers.created)
+		}
+	}
+}
+
+func TestGrantBucketAccessSAS(t *testing.T) {
+	secrets, err := GrantBucketAccess(context.Background(), encodeBucketID(t, constant.ValidContainerURL), sftpGrantName, map[string]string{}, newSFTPCloud(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(secrets) != 1 || !strings.HasPrefix(secrets[constant.AccessToken], constant.ValidContainerURL+"?") {
+		t.Errorf("expected a SAS URL of the container as the only secret, got %v", secrets)
+	}
+}
+
+func TestRevokeBucketAccess(t *testing.T) {
+	defer func(f func(*azure.Cloud, string) (localUserClient, error)) { newLocalUserClient = f }(newLocalUserClient)
+
+	sftpUser := sftpAccount + "/" + sftpUserName
+	grantID := getSFTPGrantID(sftpGrantName)
+	tests := []struct {
+		testName   string
+		bucketID   string
+		localUsers []string
+		// recorded is the storage account whose SFTPGrantsTag records the grant
+		recorded        string
+		expectedDeleted []string
+	}{
+		{
+			testName:        "Container of a storage account with SFTP",
+			bucketID:        encodeBucketID(t, "https://sftpaccount.blob.core.windows.net/container"),
+			localUsers:      []string{sftpUser},
+			recorded:        sftpAccount,
+			expectedDeleted: []string{sftpUser},
+		},
+		{
+			testName:        "Local user of a storage account SFTP was disabled on",
+			bucketID:        encodeBucketID(t, constant.ValidContainerURL),
+			localUsers:      []string{constant.ValidAccount + "/" + sftpUserName},
+			recorded:        constant.ValidAccount,
+			expectedDeleted: []string{constant.ValidAccount + "/" + sftpUserName},
+		},
+		{
+			testName: "SAS grant on a container",
+			bucketID: encodeBucketID(t, constant.ValidContainerURL),
+		},
+		{
+			testName: "Deleted storage account",
+			bucketID: encodeBucketID(t, "https://deletedaccount.blob.core.windows.net/container"),
+		},
+		{
+			testName:   "Storage account bucket",
+			bucketID:   encodeBucketID(t, "https://sftpaccount.blob.core.windows.net/"),
+			localUsers: []string{sftpUser},
+			recorded:   sftpAccount,
+		},
+	}
+	for _, test := range tests {
+		localUsers := &fakeLocalUserClient{created: map[string]storage.LocalUser{}}
+		for _, user := range test.localUsers {
+			localUsers.created[user] = storage.LocalUser{}
+		}
+		clients := 0
+		newLocalUserClient = func(*azure.Cloud, string) (localUserClient, error) {
+			clients++
+			return localUsers, nil
+		}
+		tags := map[string]map[string]*string{}
+		if test.recorded != "" {
+			tags[test.recorded] = map[string]*string{SFTPGrantsTag: to.StringPtr("other," + grantID)}
+		}
+
+		if err := RevokeBucketAccess(context.Background(), test.bucketID, sftpGrantName, newSFTPCloudWithTags(t, tags)); err != nil {
+			t.Errorf("\nTestCase: %s\nExpected Error: nil\nActual Error: %v", test.testName, err)
+		}
+		if !reflect.DeepEqual(localUsers.deleted, test.expectedDeleted) {
+			t.Errorf("\nTestCase: %s\nExpected Deleted Local Users: %v\nActual Deleted Local Users: %v", test.testName, test.expectedDeleted, localUsers.deleted)
+		}
+		// Local users are only managed for recorded grants, whose record is removed with them
+		if test.expectedDeleted == nil && clients != 0 {
+			t.Errorf("\nTestCase: %s\nExpected no local user request\nActual Local User Clients: %d", test.testName, clients)
+		}
+		if test.expectedDeleted != nil && to.String(tags[test.recorded][SFTPGrantsTag]) != "other" {
+			t.Errorf("\nTestCase: %s\nExpected the grant record to be removed\nActual Tags: %v", test.testName, tags[test.recorded])
+		}
+	}
+}
+
+func TestRecordSFTPGrant(t *testing.T) {
+	defer func(f func(*azure.Cloud, string) (localUserClient, error)) { newLocalUserClient = f }(newLocalUserClient)
+	localUsers := &fakeLocalUserClient{created: map[string]storage.LocalUser{}}
+	newLocalUserClient = func(*azure.Cloud, string) (localUserClient, error) { return localUsers, nil }
+	bucketID := encodeBucketID(t, "https://sftpaccount.blob.core.windows.net/container")
+	sftp := map[string]string{constant.CredentialModeField: constant.SFTPCredentialMode}
+	full := strings.TrimSuffix(strings.Repeat("abcdefgh,", maxSFTPGrantsLength/9), ",")
+
+	tests := []struct {
+		testName       string
+		recorded       string
+		expectedGrants string
+		expectedCode   codes.Code
+	}{
+		{
+			testName:       "First grant",
+			expectedGrants: getSFTPGrantID(sftpGrantName),
+		},
+		{
+			testName:       "Retried grant",
+			recorded:       "other," + getSFTPGrantID(sftpGrantName),
+			expectedGrants: "other," + getSFTPGrantID(sftpGrantName),
+		},
+		{
+			testName:       "Too many grants",
+			recorded:       full,
+			expectedGrants: full,
+			expectedCode:   codes.ResourceExhausted,
+		},
+	}
+	for _, test := range tests {
+		sftpGrants = &sftpGrantCache{grants: make(map[string]sftpGrant), now: time.Now}
+		tags := map[string]map[string]*string{sftpAccount: {}}
+		if test.recorded != "" {
+			tags[sftpAccount][SFTPGrantsTag] = to.StringPtr(test.recorded)
+		}
+		_, err := GrantBucketAccess(context.Background(), bucketID, sftpGrantName, sftp, newSFTPCloudWithTags(t, tags))
+		if status.Code(err) != test.expectedCode {
+			t.Errorf("\nTestCase: %s\nExpected Code: %v\nActual Error: %v", test.testName, test.expectedCode, err)
+		}
+		if grants := to.String(tags[sftpAccount][SFTPGrantsTag]); grants != test.expectedGrants {
+			t.Errorf("\nTestCase: %s\nExpected Grants: %s\nActual Grants: %s", test.testName, test.expectedGrants, grants)
+		}
+	}
+}
+
+func TestGrantSFTPPasswordRetry(t *testing.T) {
+	defer func(f func(*azure.Cloud, string) (localUserClient, error)) { newLocalUserClient = f }(newLocalUserClient)
+	defer func(cache *sftpGrantCache) { sftpGrants = cache }(sftpGrants)
+	now := time.Now()
+	sftpGrants = &sftpGrantCache{grants: make(map[string]sftpGrant), now: func() time.Time { return now }}
+	localUsers := &fakeLocalUserClient{created: map[string]storage.LocalUser{}}
+	newLocalUserClient = func(*azure.Cloud, string) (localUserClient, error) { return localUsers, nil }
+	cloud := newSFTPCloud(t)
+	bucketID := encodeBucketID(t, "https://sftpaccount.blob.core.windows.net/container")
+	sftp := map[string]string{constant.CredentialModeField: constant.SFTPCredentialMode}
+
+	tests := []struct {
+		testName         string
+		before           func()
+		parameters       map[string]string
+		expectedPassword string
+	}{
+		{
+			testName:         "First grant",
+			before:           func() {},
+			parameters:       sftp,
+			expectedPassword: "password1",
+		},
+		{
+			testName:         "Retried grant",
+			before:           func() {},
+			parameters:       sftp,
+			expectedPassword: "password1",
+		},
+		{
+			testName:         "Grant with other permissions",
+			before:           func() {},
+			parameters:       map[string]string{constant.CredentialModeField: constant.SFTPCredentialMode, constant.EnableWriteField: TrueValue},
+			expectedPassword: "password2",
+		},
+		{
+			testName:         "Grant after the previous one was forgotten",
+			before:           func() { now = now.Add(sftpGrantTTL + time.Second) },
+			parameters:       map[string]string{constant.CredentialModeField: constant.SFTPCredentialMode, constant.EnableWriteField: TrueValue},
+			expectedPassword: "password3",
+		},
+		{
+			testName: "Grant after a revocation",
+			before: func() {
+				if err := RevokeBucketAccess(context.Background(), bucketID, sftpGrantName, cloud); err != nil {
+					t.Fatal(err)
+				}
+			},
+			parameters:       map[string]string{constant.CredentialModeField: constant.SFTPCredentialMode, constant.EnableWriteField: TrueValue},
+			expectedPassword: "password4",
+		},
+	}
+	for _, test := range tests {
+		test.before()
+		secrets, err := GrantBucketAccess(context.Background(), bucketID, sftpGrantName, test.parameters, cloud)
+		if err != nil {
+			t.Fatalf("\nTestCase: %s\nUnexpected Error: %v", test.testName, err)
+		}
+		if password := secrets[constant.SFTPPassword]; password != test.expectedPassword {
+			t.Errorf("\nTestCase: %s\nExpected Password: %s\nActual Password: %s", test.testName, test.expectedPassword, password)
+		}
+	}
+}
+
+func TestGetLocalUserName(t *testing.T) {
+	long := "ba-" + strings.Repeat("a", 70)
+	tests := []struct {
+		testName     string
+		accountName  string
+		expectedName string
+	}{
+		{
+			testName:     "Bucket access account name",
+			accountName:  sftpGrantName,
+			expectedName: sftpUserName,
+		},
+		{
+			testName:     "Long account name",
+			accountName:  long,
+			expectedName: "ba" + strings.Repeat("a", 50) + nameHash(grantNameHashLength, long),
+		},
+	}
+	for _, test := range tests {
+		if name := getGrantName(test.accountName); name != test.expectedName {
+			t.Errorf("\nTestCase: %s\nExpected Name: %s\nActual Name: %s", test.testName, test.expectedName, name)
+		}
+	}
+}
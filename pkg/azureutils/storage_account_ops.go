@@ -15,37 +15,111 @@ package azureutils
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+	"github.com/Azure/go-autorest/autorest/to"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"project/azure-cosi-driver/pkg/metrics"
 	"project/azure-cosi-driver/pkg/types"
 	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
 )
 
+// DeleteStorageAccount deletes the storage account of the bucket, as a long-running operation keyed by the account.
+// codes.Unavailable is returned while the deletion is in progress.
 func DeleteStorageAccount(
 	ctx context.Context,
 	id *types.BucketID,
 	cloud *azure.Cloud) error {
 	SAClient := cloud.StorageAccountClient
-	err := SAClient.Delete(ctx, id.SubID, id.ResourceGroup, getStorageAccountNameFromContainerURL(id.URL))
+	accountName := getStorageAccountNameFromContainerURL(id.URL)
+	if _, err := storageAccountExists(ctx, id.SubID, id.ResourceGroup, accountName, cloud); err != nil {
+		return err
+	}
+	key := accountOperationKey(id.SubID, id.ResourceGroup, accountName)
+	_, err := accountOperations.run(ctx, key, "", func(ctx context.Context) (accountOperationResult, error) {
+		reqCtx, req, err := startARMRequest(ctx, deleteStorageAccountOperation, id.SubID)
+		if err != nil {
+			return accountOperationResult{}, err
+		}
+		rerr := SAClient.Delete(reqCtx, id.SubID, id.ResourceGroup, accountName)
+		req.endARM(rerr)
+		if rerr != nil {
+			return accountOperationResult{}, azureError(rerr.Error(), "Could not delete storage account %s", accountName)
+		}
+		return accountOperationResult{accountName: accountName}, nil
+	})
+	return err
+}
+
+// ensureStorageAccount ensures the storage account exists, as a long-running operation keyed by the account,
+// or by the bucket name if the account is picked by Azure.
+// codes.Unavailable is returned while the account is being created, and the next call with the same options resumes waiting for it.
+func ensureStorageAccount(ctx context.Context, bucketName string, accOptions *azure.AccountOptions, cloud *azure.Cloud) (string, string, error) {
+	fingerprint, err := json.Marshal(accOptions)
 	if err != nil {
-		return err.Error()
+		return "", "", err
+	}
+
+	subsID, resourceGroup := accOptions.SubscriptionID, accOptions.ResourceGroup
+	if subsID == "" {
+		subsID = cloud.SubscriptionID
+	}
+	if resourceGroup == "" {
+		resourceGroup = cloud.ResourceGroup
+	}
+	key := "bucket " + bucketName
+	if accOptions.Name != "" {
+		key = accountOperationKey(subsID, resourceGroup, accOptions.Name)
 	}
-	return nil
+
+	result, err := accountOperations.run(ctx, key, string(fingerprint), func(ctx context.Context) (accountOperationResult, error) {
+		reqCtx, req, err := startARMRequest(ctx, ensureStorageAccountOperation, subsID)
+		if err != nil {
+			return accountOperationResult{}, err
+		}
+		name, key, err := cloud.EnsureStorageAccount(reqCtx, accOptions, "")
+		req.end(err)
+		return accountOperationResult{accountName: name, accountKey: key}, err
+	})
+	return result.accountName, result.accountKey, err
 }
 
 func createStorageAccountBucket(ctx context.Context,
 	bucketName string,
 	parameters *BucketClassParameters,
 	cloud *azure.Cloud) (string, error) {
-	accName, _, err := cloud.EnsureStorageAccount(ctx, getAccountOptions(parameters), "")
+	// Accounts named by the BucketClass may have been brought by the user and are adopted,
+	// unless the BucketClass explicitly asks the driver to create them
+	checkOwner := parameters.storageAccountName == "" ||
+		(parameters.createStorageAccountSet && to.Bool(parameters.createStorageAccount))
+	setStorageAccountName(bucketName, parameters, cloud)
+	release, err := accountRequests.acquire(ctx, parameters.storageAccountName)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	if checkOwner {
+		if err := checkStorageAccountOwner(ctx, bucketName, parameters, cloud); err != nil {
+			return "", err
+		}
+	}
+
+	accOptions := getAccountOptions(parameters)
+	accOptions.Tags[BucketNameTag] = bucketName
+
+	accName, _, err := ensureStorageAccount(ctx, bucketName, accOptions, cloud)
+	if isOperationInProgress(err) {
+		return "", err
+	}
 	if err != nil {
-		return "", status.Error(codes.Internal, fmt.Sprintf("Could not create storage account: %v", err))
+		return "", azureError(err, "Could not create storage account")
 	}
 
 	accURL := fmt.Sprintf("https://%s.blob.core.windows.net/", accName)
@@ -114,6 +188,7 @@ func createAccountSASURL(ctx context.Context, bucketID string, parameters *Bucke
 	if err != nil {
 		return "", "", err
 	}
+	metrics.RecordSASGrant(expiry)
 	sasURL := fmt.Sprintf("%s/?%s", strings.TrimSuffix(bucketID, "/"), queryParams.Encode())
 	return sasURL, bucketID, nil
 }
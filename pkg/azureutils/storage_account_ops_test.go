@@ -62,6 +62,16 @@ func NewMockSAClient(ctx context.Context, ctrl *gomock.Controller, subsID, rg, a
 		Return(retry.GetError(&http.Response{}, status.Error(codes.NotFound, "could not find storage account"))).
 		AnyTimes()
 
+	cl.EXPECT().
+		GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Eq(constant.ValidAccount)).
+		Return(storage.Account{Name: to.StringPtr(constant.ValidAccount), AccountProperties: &storage.AccountProperties{}}, nil).
+		AnyTimes()
+
+	cl.EXPECT().
+		GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Not(constant.ValidAccount)).
+		Return(storage.Account{}, retry.GetError(&http.Response{StatusCode: http.StatusNotFound}, fmt.Errorf("could not find storage account"))).
+		AnyTimes()
+
 	accountList := []storage.Account{{Name: to.StringPtr(constant.ValidAccount), AccountProperties: &storage.AccountProperties{}}}
 	cl.EXPECT().
 		ListByResourceGroup(gomock.Any(), gomock.Any(), gomock.Any()).
@@ -103,7 +113,7 @@ func TestDeleteStorageAccount(t *testing.T) {
 				ResourceGroup: constant.ValidResourceGroup,
 				URL:           constant.InvalidAccount,
 			},
-			expectedErr: retry.GetError(&http.Response{}, status.Error(codes.NotFound, "could not find storage account")).Error(),
+			expectedErr: status.Error(codes.Internal, "Could not delete storage account : "+retry.GetError(&http.Response{}, status.Error(codes.NotFound, "could not find storage account")).Error().Error()),
 		},
 	}
 
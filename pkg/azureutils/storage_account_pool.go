@@ -0,0 +1,292 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"project/azure-cosi-driver/pkg/constant"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/service"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+const (
+	// Pool accounts are named <prefix><index>, with the index zero padded to this many digits
+	storageAccountPoolIndexDigits = 3
+	maxStorageAccountPoolSize     = 1000
+	maxStorageAccountNameLength   = 24
+	maxStorageAccountPoolPrefix   = maxStorageAccountNameLength - storageAccountPoolIndexDigits
+
+	defaultMaxContainersPerAccount = 100
+)
+
+var (
+	storageAccountPoolPrefixRE = regexp.MustCompile(`^[a-z0-9]+$`)
+
+	// storageAccountPools serializes container placement within each pool of this driver process so that two
+	// concurrent claims cannot both take the last free slot of a pool account. Replicas of the driver do not share it,
+	// so with several replicas working on the same pool an account may end up with more than maxcontainersperaccount
+	// containers.
+	storageAccountPools = &poolPlacements{pools: make(map[string]*poolPlacement)}
+)
+
+// poolPlacements tracks the containers being placed in the storage account pools, by pool prefix
+type poolPlacements struct {
+	lock  sync.Mutex
+	pools map[string]*poolPlacement
+}
+
+type poolPlacement struct {
+	// deciding is a semaphore held while the placement of a container in the pool is decided
+	deciding chan struct{}
+	// placed maps the containers placed in an account of the pool, and not created yet, to the account
+	placed map[string]string
+	// refs counts the requests placing every container of placed
+	refs map[string]int
+}
+
+// place decides the account of the pool the container goes in with pick, given the containers placed but not created
+// yet. Placements in the same pool are decided one at a time, waiting until ctx is done. The placement is taken into
+// account by the next decisions until done is called, once the container is created or its creation failed.
+func (p *poolPlacements) place(
+	ctx context.Context,
+	prefix, containerName string,
+	pick func(placed map[string]string) (string, error)) (account string, done func(), err error) {
+	p.lock.Lock()
+	pool, ok := p.pools[prefix]
+	if !ok {
+		pool = &poolPlacement{deciding: make(chan struct{}, 1), placed: make(map[string]string), refs: make(map[string]int)}
+		p.pools[prefix] = pool
+	}
+	p.lock.Unlock()
+
+	select {
+	case pool.deciding <- struct{}{}:
+	case <-ctx.Done():
+		return "", nil, status.Error(status.FromContextError(ctx.Err()).Code(), fmt.Sprintf("Gave up waiting to place container %s in storage account pool %s: %v", containerName, prefix, ctx.Err()))
+	}
+	defer func() { <-pool.deciding }()
+
+	p.lock.Lock()
+	placed := make(map[string]string, len(pool.placed))
+	for container, account := range pool.placed {
+		placed[container] = account
+	}
+	p.lock.Unlock()
+
+	account, err = pick(placed)
+	if err != nil {
+		return "", nil, err
+	}
+
+	p.lock.Lock()
+	pool.placed[containerName] = account
+	pool.refs[containerName]++
+	p.lock.Unlock()
+	return account, func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		pool.refs[containerName]--
+		if pool.refs[containerName] == 0 {
+			delete(pool.refs, containerName)
+			delete(pool.placed, containerName)
+		}
+	}, nil
+}
+
+func validateStorageAccountPoolParameters(params *BucketClassParameters) error {
+	if params.storageAccountPoolPrefix == "" {
+		if params.maxContainersPerAccount != 0 {
+			return status.Error(codes.InvalidArgument, fmt.Sprintf("%s requires %s to be set", constant.MaxContainersPerAccountField, constant.StorageAccountPoolPrefixField))
+		}
+		return nil
+	}
+
+	if params.bucketUnitType != constant.Container {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("%s is only supported for bucket unit type %s", constant.StorageAccountPoolPrefixField, constant.Container.String()))
+	}
+	if params.storageAccountName != "" {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("%s and %s cannot both be set", constant.StorageAccountPoolPrefixField, constant.StorageAccountNameField))
+	}
+	if len(params.storageAccountPoolPrefix) > maxStorageAccountPoolPrefix || !storageAccountPoolPrefixRE.MatchString(params.storageAccountPoolPrefix) {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid storage account pool prefix %s, must be 1-%d lowercase letters and numbers", params.storageAccountPoolPrefix, maxStorageAccountPoolPrefix))
+	}
+
+	if params.maxContainersPerAccount == 0 {
+		params.maxContainersPerAccount = defaultMaxContainersPerAccount
+	}
+	return nil
+}
+
+// getPoolAccountName returns the name of the storage account at the given index of the pool
+func getPoolAccountName(prefix string, index int) string {
+	return fmt.Sprintf("%s%0*d", prefix, storageAccountPoolIndexDigits, index)
+}
+
+// selectPoolAccount picks the storage account of the pool the container should be placed in.
+// Every existing account of the pool is searched for the container first, so that a retried creation
+// finds the container it already made. Otherwise the first account in index order with room for
+// another container is returned, and if every existing account is full, the name of the first account
+// missing from the pool so that it can be created. placed maps the containers placed in the pool by
+// other requests, and not created yet, to their account.
+func selectPoolAccount(
+	ctx context.Context,
+	containerName string,
+	parameters *BucketClassParameters,
+	placed map[string]string,
+	cloud *azure.Cloud) (string, error) {
+	if cloud.StorageAccountClient == nil {
+		return "", fmt.Errorf("StorageAccountClient is nil")
+	}
+
+	subsID := parameters.subscriptionID
+	if subsID == "" {
+		subsID = cloud.SubscriptionID
+	}
+
+	reqCtx, req, err := startARMRequest(ctx, listStorageAccountsOperation, subsID)
+	if err != nil {
+		return "", err
+	}
+	accounts, rerr := cloud.StorageAccountClient.ListByResourceGroup(reqCtx, subsID, parameters.resourceGroup)
+	req.endARM(rerr)
+	if rerr != nil {
+		return "", azureError(rerr.Error(), "Could not list storage accounts in resource group %s", parameters.resourceGroup)
+	}
+
+	// poolAccounts maps the existing accounts of the pool to whether they may hold the container
+	poolAccounts := make(map[string]bool)
+	for _, account := range accounts {
+		accountKeys.observe(subsID, parameters.resourceGroup, account)
+		if account.Name != nil && strings.HasPrefix(*account.Name, parameters.storageAccountPoolPrefix) {
+			poolAccounts[*account.Name] = checkDriverOwner(*account.Name, getAccountDriverOwner(account.Tags)) == nil
+		}
+	}
+
+	return pickPoolAccount(containerName, parameters, poolAccounts, placed, func(accountName string) (count int, found bool, err error) {
+		err = withStorageAccountKey(ctx, cloud, subsID, parameters.resourceGroup, accountName, func(key string) (err error) {
+			count, found, err = countContainers(ctx, accountName, key, containerName)
+			return err
+		})
+		return count, found, err
+	})
+}
+
+// pickPoolAccount picks the account of the pool for the container among poolAccounts, the existing accounts of the pool
+// mapped to whether they may hold the container. Containers placed but not created yet take a slot of their account.
+// countContainers returns the number of containers of an account and whether the container is one of them.
+func pickPoolAccount(
+	containerName string,
+	parameters *BucketClassParameters,
+	poolAccounts map[string]bool,
+	placed map[string]string,
+	countContainers func(accountName string) (int, bool, error)) (string, error) {
+	prefix := parameters.storageAccountPoolPrefix
+	if accountName, ok := placed[containerName]; ok {
+		klog.Infof("Container %s is already being created in pool storage account %s", containerName, accountName)
+		return accountName, nil
+	}
+	pending := make(map[string]int)
+	for _, accountName := range placed {
+		pending[accountName]++
+	}
+
+	counts := make(map[string]int, len(poolAccounts))
+	for i := 0; i < maxStorageAccountPoolSize; i++ {
+		accountName := getPoolAccountName(prefix, i)
+		usable, exists := poolAccounts[accountName]
+		if !exists {
+			continue
+		}
+		if !usable {
+			klog.Infof("Skipping storage account %s of pool %s, it belongs to another driver", accountName, prefix)
+			continue
+		}
+		count, found, err := countContainers(accountName)
+		if err != nil {
+			return "", azureError(err, "Could not list containers of pool storage account %s", accountName)
+		}
+		if found {
+			klog.Infof("Container %s already exists in pool storage account %s", containerName, accountName)
+			return accountName, nil
+		}
+		counts[accountName] = count
+	}
+
+	for i := 0; i < maxStorageAccountPoolSize; i++ {
+		accountName := getPoolAccountName(prefix, i)
+		count, usable := counts[accountName]
+		count += pending[accountName]
+		if _, exists := poolAccounts[accountName]; !exists {
+			if count >= parameters.maxContainersPerAccount {
+				// The account is being created for other containers which fill it
+				continue
+			}
+			klog.Infof("Storage account pool %s has no free account, using new account %s", prefix, accountName)
+			return accountName, nil
+		}
+		if usable && count < parameters.maxContainersPerAccount {
+			klog.Infof("Placing container %s in pool storage account %s (%d/%d containers)", containerName, accountName, count, parameters.maxContainersPerAccount)
+			return accountName, nil
+		}
+	}
+
+	return "", status.Error(codes.ResourceExhausted, fmt.Sprintf("Storage account pool %s is full", prefix))
+}
+
+// countContainers returns the number of containers in the storage account and whether containerName is one of them
+func countContainers(
+	ctx context.Context,
+	storageAccount,
+	accessKey,
+	containerName string) (int, bool, error) {
+	credential, err := service.NewSharedKeyCredential(storageAccount, accessKey)
+	if err != nil {
+		return 0, false, fmt.Errorf("Invalid credentials with error : %v", err)
+	}
+
+	serviceURL := fmt.Sprintf("https://%s.blob.core.windows.net/", storageAccount)
+	serviceClient, err := service.NewClientWithSharedKeyCredential(serviceURL, credential, &service.ClientOptions{ClientOptions: blobClientOptions(ctx)})
+	if err != nil {
+		return 0, false, err
+	}
+
+	count := 0
+	found := false
+	pager := serviceClient.NewListContainersPager(nil)
+	for pager.More() {
+		reqCtx, req := startAzureRequest(ctx, listContainersOperation)
+		page, err := pager.NextPage(reqCtx)
+		req.end(err)
+		if err != nil {
+			return 0, false, err
+		}
+		for _, item := range page.ContainerItems {
+			if item.Name != nil && *item.Name == containerName {
+				found = true
+			}
+		}
+		count += len(page.ContainerItems)
+	}
+
+	return count, found, nil
+}
@@ -0,0 +1,321 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"project/azure-cosi-driver/pkg/constant"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
+	"github.com/golang/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
+)
+
+func TestValidateStorageAccountPoolParameters(t *testing.T) {
+	tests := []struct {
+		testName       string
+		params         *BucketClassParameters
+		expectedErr    error
+		expectedParams *BucketClassParameters
+	}{
+		{
+			testName:       "Pool not configured",
+			params:         &BucketClassParameters{},
+			expectedErr:    nil,
+			expectedParams: &BucketClassParameters{},
+		},
+		{
+			testName:    "Max containers without prefix",
+			params:      &BucketClassParameters{maxContainersPerAccount: 10},
+			expectedErr: status.Error(codes.InvalidArgument, "maxcontainersperaccount requires storageaccountpoolprefix to be set"),
+		},
+		{
+			testName:    "Storage account unit type",
+			params:      &BucketClassParameters{bucketUnitType: constant.StorageAccount, storageAccountPoolPrefix: "pool"},
+			expectedErr: status.Error(codes.InvalidArgument, "storageaccountpoolprefix is only supported for bucket unit type container"),
+		},
+		{
+			testName:    "Fixed storage account name",
+			params:      &BucketClassParameters{storageAccountName: constant.ValidAccount, storageAccountPoolPrefix: "pool"},
+			expectedErr: status.Error(codes.InvalidArgument, "storageaccountpoolprefix and storageaccountname cannot both be set"),
+		},
+		{
+			testName:    "Prefix with invalid characters",
+			params:      &BucketClassParameters{storageAccountPoolPrefix: "Pool-"},
+			expectedErr: status.Error(codes.InvalidArgument, "Invalid storage account pool prefix Pool-, must be 1-21 lowercase letters and numbers"),
+		},
+		{
+			testName:    "Prefix too long",
+			params:      &BucketClassParameters{storageAccountPoolPrefix: "abcdefghijklmnopqrstuv"},
+			expectedErr: status.Error(codes.InvalidArgument, "Invalid storage account pool prefix abcdefghijklmnopqrstuv, must be 1-21 lowercase letters and numbers"),
+		},
+		{
+			testName:       "Default max containers",
+			params:         &BucketClassParameters{storageAccountPoolPrefix: "pool"},
+			expectedErr:    nil,
+			expectedParams: &BucketClassParameters{storageAccountPoolPrefix: "pool", maxContainersPerAccount: defaultMaxContainersPerAccount},
+		},
+		{
+			testName:       "Explicit max containers",
+			params:         &BucketClassParameters{storageAccountPoolPrefix: "pool", maxContainersPerAccount: 5},
+			expectedErr:    nil,
+			expectedParams: &BucketClassParameters{storageAccountPoolPrefix: "pool", maxContainersPerAccount: 5},
+		},
+	}
+	for _, test := range tests {
+		err := validateStorageAccountPoolParameters(test.params)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectedErr, err)
+		}
+		if err == nil && !reflect.DeepEqual(test.params, test.expectedParams) {
+			t.Errorf("\nTestCase: %s\nExpected Params: %+v\nActual Params: %+v", test.testName, test.expectedParams, test.params)
+		}
+	}
+}
+
+func TestGetPoolAccountName(t *testing.T) {
+	tests := []struct {
+		testName     string
+		prefix       string
+		index        int
+		expectedName string
+	}{
+		{
+			testName:     "First account",
+			prefix:       "pool",
+			index:        0,
+			expectedName: "pool000",
+		},
+		{
+			testName:     "Last account",
+			prefix:       "pool",
+			index:        maxStorageAccountPoolSize - 1,
+			expectedName: "pool999",
+		},
+	}
+	for _, test := range tests {
+		name := getPoolAccountName(test.prefix, test.index)
+		if name != test.expectedName {
+			t.Errorf("\nTestCase: %s\nExpected Name: %v\nActual Name: %v", test.testName, test.expectedName, name)
+		}
+	}
+}
+
+func TestSelectPoolAccount(t *testing.T) {
+	tests := []struct {
+		testName        string
+		clientNil       bool
+		params          *BucketClassParameters
+		expectedAccount string
+		expectedErr     error
+	}{
+		{
+			testName:    "Storage Account Client is nil",
+			clientNil:   true,
+			params:      &BucketClassParameters{storageAccountPoolPrefix: "pool", maxContainersPerAccount: 1},
+			expectedErr: fmt.Errorf("StorageAccountClient is nil"),
+		},
+		{
+			testName:        "Empty pool",
+			params:          &BucketClassParameters{storageAccountPoolPrefix: "pool", maxContainersPerAccount: 1},
+			expectedAccount: "pool000",
+			expectedErr:     nil,
+		},
+	}
+
+	ctrl := gomock.NewController(t)
+	cloud := azure.GetTestCloud(ctrl)
+
+	for _, test := range tests {
+		if test.clientNil {
+			cloud.StorageAccountClient = nil
+		} else {
+			keyList := make([]storage.AccountKey, 0)
+			cloud.StorageAccountClient = NewMockSAClient(context.Background(), ctrl, "", "", "", &keyList)
+		}
+
+		account, err := selectPoolAccount(context.Background(), constant.ValidContainer, test.params, nil, cloud)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectedErr, err)
+		}
+		if err == nil && account != test.expectedAccount {
+			t.Errorf("\nTestCase: %s\nExpected Account: %v\nActual Account: %v", test.testName, test.expectedAccount, account)
+		}
+	}
+}
+
+func TestPickPoolAccount(t *testing.T) {
+	params := &BucketClassParameters{storageAccountPoolPrefix: "pool", maxContainersPerAccount: 2}
+	tests := []struct {
+		testName        string
+		poolAccounts    map[string]bool
+		containers      map[string][]string
+		placed          map[string]string
+		expectedAccount string
+		expectedCounted []string
+		expectedCode    codes.Code
+	}{
+		{
+			testName:        "First account with room",
+			poolAccounts:    map[string]bool{"pool000": true, "pool001": true},
+			containers:      map[string][]string{"pool000": {"a", "b"}, "pool001": {"c"}},
+			expectedAccount: "pool001",
+			expectedCounted: []string{"pool000", "pool001"},
+		},
+		{
+			testName:        "Container in a later account",
+			poolAccounts:    map[string]bool{"pool000": true, "pool001": true},
+			containers:      map[string][]string{"pool000": {"a"}, "pool001": {"c", constant.ValidContainer}},
+			expectedAccount: "pool001",
+			expectedCounted: []string{"pool000", "pool001"},
+		},
+		{
+			testName:        "Account of another driver",
+			poolAccounts:    map[string]bool{"pool000": false, "pool001": true},
+			containers:      map[string][]string{"pool001": {"c", "d"}},
+			expectedAccount: "pool002",
+			expectedCounted: []string{"pool001"},
+		},
+		{
+			testName:        "Gap in the pool",
+			poolAccounts:    map[string]bool{"pool000": true, "pool002": true},
+			containers:      map[string][]string{"pool000": {"a", "b"}, "pool002": {"c"}},
+			expectedAccount: "pool001",
+			expectedCounted: []string{"pool000", "pool002"},
+		},
+		{
+			testName:        "Container being placed by another request",
+			poolAccounts:    map[string]bool{"pool000": true, "pool001": true},
+			placed:          map[string]string{constant.ValidContainer: "pool001"},
+			expectedAccount: "pool001",
+		},
+		{
+			testName:        "Slot taken by a container being placed",
+			poolAccounts:    map[string]bool{"pool000": true},
+			containers:      map[string][]string{"pool000": {"a"}},
+			placed:          map[string]string{"b": "pool000"},
+			expectedAccount: "pool001",
+			expectedCounted: []string{"pool000"},
+		},
+		{
+			testName:        "New account filled by containers being placed",
+			poolAccounts:    map[string]bool{},
+			placed:          map[string]string{"a": "pool000", "b": "pool000"},
+			expectedAccount: "pool001",
+		},
+	}
+	for _, test := range tests {
+		var counted []string
+		account, err := pickPoolAccount(constant.ValidContainer, params, test.poolAccounts, test.placed, func(accountName string) (int, bool, error) {
+			counted = append(counted, accountName)
+			found := false
+			for _, container := range test.containers[accountName] {
+				found = found || container == constant.ValidContainer
+			}
+			return len(test.containers[accountName]), found, nil
+		})
+		if status.Code(err) != test.expectedCode {
+			t.Errorf("\nTestCase: %s\nExpected Code: %v\nActual Error: %v", test.testName, test.expectedCode, err)
+		}
+		if account != test.expectedAccount {
+			t.Errorf("\nTestCase: %s\nExpected Account: %v\nActual Account: %v", test.testName, test.expectedAccount, account)
+		}
+		if !reflect.DeepEqual(counted, test.expectedCounted) {
+			t.Errorf("\nTestCase: %s\nExpected Counted Accounts: %v\nActual Counted Accounts: %v", test.testName, test.expectedCounted, counted)
+		}
+	}
+}
+
+func TestPoolPlacements(t *testing.T) {
+	pools := &poolPlacements{pools: make(map[string]*poolPlacement)}
+	pick := func(account string) func(map[string]string) (string, error) {
+		return func(map[string]string) (string, error) { return account, nil }
+	}
+
+	// Placements are seen by the next decisions of the same pool until they are done
+	_, done, err := pools.place(context.Background(), "pool", "a", pick("pool000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var placed map[string]string
+	if _, _, err := pools.place(context.Background(), "pool", "b", func(p map[string]string) (string, error) {
+		placed = p
+		return "pool000", nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(placed, map[string]string{"a": "pool000"}) {
+		t.Errorf("expected the placement of a to be seen, got %v", placed)
+	}
+	done()
+	if _, _, err := pools.place(context.Background(), "pool", "c", func(p map[string]string) (string, error) {
+		placed = p
+		return "pool000", nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(placed, map[string]string{"b": "pool000"}) {
+		t.Errorf("expected the placement of a to be done, got %v", placed)
+	}
+
+	// Waiting for a decision of the same pool gives up with the context, other pools are not held up
+	deciding := make(chan struct{})
+	decided := make(chan struct{})
+	go func() {
+		_, _, _ = pools.place(context.Background(), "pool", "d", func(map[string]string) (string, error) {
+			close(deciding)
+			<-decided
+			return "pool000", nil
+		})
+	}()
+	<-deciding
+	defer close(decided)
+	if _, _, err := pools.place(context.Background(), "other", "a", pick("other000")); err != nil {
+		t.Errorf("expected another pool to be placed in, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := pools.place(ctx, "pool", "e", pick("pool000")); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("\nExpected Code: %v\nActual Error: %v", codes.DeadlineExceeded, err)
+	}
+}
+
+func TestCreateContainerBucketInPool(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	cloud := azure.GetTestCloud(ctrl)
+	keyList := make([]storage.AccountKey, 0)
+	cloud.StorageAccountClient = NewMockSAClient(context.Background(), ctrl, "", "", "", &keyList)
+
+	params := &BucketClassParameters{storageAccountPoolPrefix: "pool", maxContainersPerAccount: 1}
+	expectedErr := status.Error(codes.Internal, fmt.Sprintf("Could not ensure storage account %s exists: %v", "pool000",
+		fmt.Errorf("failed to create storage account %s, error: %v", "pool000",
+			retry.GetError(&http.Response{}, status.Error(codes.NotFound, "could not find storage account")))))
+
+	_, err := createContainerBucket(context.Background(), constant.ValidContainer, params, nil, cloud)
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("\nExpected Error: %v\nActual Error: %v", expectedErr, err)
+	}
+	if params.resourceGroup != cloud.ResourceGroup {
+		t.Errorf("\nExpected Resource Group: %v\nActual Resource Group: %v", cloud.ResourceGroup, params.resourceGroup)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	BucketNamePlaceholder           = "bucket.name"
+	BucketClaimNamePlaceholder      = "bucketclaim.name"
+	BucketClaimNamespacePlaceholder = "bucketclaim.namespace"
+	ClusterNamePlaceholder          = "cluster.name"
+	DatePlaceholder                 = "date"
+
+	templateDateFormat = "2006-01-02"
+)
+
+var (
+	placeholderRE = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+	supportedPlaceholders = map[string]bool{
+		BucketNamePlaceholder:           true,
+		BucketClaimNamePlaceholder:      true,
+		BucketClaimNamespacePlaceholder: true,
+		ClusterNamePlaceholder:          true,
+		DatePlaceholder:                 true,
+	}
+
+	// timeDependentPlaceholders change value over time. They are not allowed in names, as a creation retried later
+	// would render another name and leave the resource created by the first attempt behind.
+	timeDependentPlaceholders = map[string]bool{
+		DatePlaceholder: true,
+	}
+)
+
+// TemplateValues maps placeholder names to the values they are substituted with
+// in templated BucketClass parameters such as tags, container metadata and account name templates.
+type TemplateValues map[string]string
+
+// NewTemplateValues returns the values known for every bucket. Bucket claim placeholders are
+// added by the caller when the claim could be resolved.
+func NewTemplateValues(bucketName, clusterName string, now time.Time) TemplateValues {
+	values := TemplateValues{
+		BucketNamePlaceholder: bucketName,
+		DatePlaceholder:       now.UTC().Format(templateDateFormat),
+	}
+	if clusterName != "" {
+		values[ClusterNamePlaceholder] = clusterName
+	}
+	return values
+}
+
+// expandTemplate substitutes every ${placeholder} in value.
+// Unknown placeholders, and placeholders with no value for this bucket, are rejected.
+func expandTemplate(value string, values TemplateValues) (string, error) {
+	var expandErr error
+	expanded := placeholderRE.ReplaceAllStringFunc(value, func(match string) string {
+		name := strings.TrimSpace(placeholderRE.FindStringSubmatch(match)[1])
+		if expandErr != nil {
+			return match
+		}
+		if !supportedPlaceholders[name] {
+			expandErr = status.Error(codes.InvalidArgument, fmt.Sprintf("Unknown placeholder %s in %q, supported placeholders are: %s", match, value, strings.Join(getSupportedPlaceholders(), ", ")))
+			return match
+		}
+		v, ok := values[name]
+		if !ok || v == "" {
+			expandErr = status.Error(codes.InvalidArgument, fmt.Sprintf("Placeholder %s in %q has no value for this bucket", match, value))
+			return match
+		}
+		return v
+	})
+	if expandErr != nil {
+		return "", expandErr
+	}
+	return expanded, nil
+}
+
+// expandNameTemplate expands a template naming a resource, such as the storage account name template.
+// Placeholders whose value changes over time are rejected, they are only allowed in tags and container metadata.
+func expandNameTemplate(value string, values TemplateValues) (string, error) {
+	if err := checkNameTemplate(value); err != nil {
+		return "", err
+	}
+	return expandTemplate(value, values)
+}
+
+// checkNameTemplate rejects the placeholders of value whose value changes over time
+func checkNameTemplate(value string) error {
+	for _, match := range placeholderRE.FindAllStringSubmatch(value, -1) {
+		if timeDependentPlaceholders[strings.TrimSpace(match[1])] {
+			return status.Error(codes.InvalidArgument, fmt.Sprintf("Placeholder %s in %q changes over time and is only allowed in tags and container metadata, not in names", match[0], value))
+		}
+	}
+	return nil
+}
+
+// expandTemplateMap expands the values of a key=value map, such as tags or metadata
+func expandTemplateMap(m map[string]string, values TemplateValues) (map[string]string, error) {
+	expanded := make(map[string]string, len(m))
+	for k, v := range m {
+		value, err := expandTemplate(v, values)
+		if err != nil {
+			return nil, err
+		}
+		expanded[k] = value
+	}
+	return expanded, nil
+}
+
+func getSupportedPlaceholders() []string {
+	placeholders := make([]string, 0, len(supportedPlaceholders))
+	for name := range supportedPlaceholders {
+		placeholders = append(placeholders, fmt.Sprintf("${%s}", name))
+	}
+	sort.Strings(placeholders)
+	return placeholders
+}
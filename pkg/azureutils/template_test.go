@@ -0,0 +1,165 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"project/azure-cosi-driver/pkg/constant"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNewTemplateValues(t *testing.T) {
+	now := time.Date(2022, 9, 1, 23, 0, 0, 0, time.FixedZone("UTC-2", -2*60*60))
+	tests := []struct {
+		testName       string
+		clusterName    string
+		expectedValues TemplateValues
+	}{
+		{
+			testName:    "Without cluster name",
+			clusterName: "",
+			expectedValues: TemplateValues{
+				BucketNamePlaceholder: constant.ValidContainer,
+				DatePlaceholder:       "2022-09-02",
+			},
+		},
+		{
+			testName:    "With cluster name",
+			clusterName: "cluster",
+			expectedValues: TemplateValues{
+				BucketNamePlaceholder:  constant.ValidContainer,
+				ClusterNamePlaceholder: "cluster",
+				DatePlaceholder:        "2022-09-02",
+			},
+		},
+	}
+	for _, test := range tests {
+		values := NewTemplateValues(constant.ValidContainer, test.clusterName, now)
+		if !reflect.DeepEqual(values, test.expectedValues) {
+			t.Errorf("\nTestCase: %s\nExpected Values: %v\nActual Values: %v", test.testName, test.expectedValues, values)
+		}
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	values := TemplateValues{
+		BucketNamePlaceholder:           constant.ValidContainer,
+		BucketClaimNamespacePlaceholder: "team-a",
+		DatePlaceholder:                 "2022-09-02",
+	}
+	tests := []struct {
+		testName      string
+		value         string
+		expectedValue string
+		expectedErr   error
+	}{
+		{
+			testName:      "No placeholders",
+			value:         "static",
+			expectedValue: "static",
+		},
+		{
+			testName:      "Multiple placeholders",
+			value:         "${bucketclaim.namespace}-${bucket.name}-${ date }",
+			expectedValue: "team-a-validcontainer-2022-09-02",
+		},
+		{
+			testName:    "Unknown placeholder",
+			value:       "${bucket.namespace}",
+			expectedErr: status.Error(codes.InvalidArgument, "Unknown placeholder ${bucket.namespace} in \"${bucket.namespace}\", supported placeholders are: ${bucket.name}, ${bucketclaim.namespace}, ${bucketclaim.name}, ${cluster.name}, ${date}"),
+		},
+		{
+			testName:    "Placeholder without value",
+			value:       "${cluster.name}",
+			expectedErr: status.Error(codes.InvalidArgument, "Placeholder ${cluster.name} in \"${cluster.name}\" has no value for this bucket"),
+		},
+	}
+	for _, test := range tests {
+		value, err := expandTemplate(test.value, values)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectedErr, err)
+		}
+		if err == nil && value != test.expectedValue {
+			t.Errorf("\nTestCase: %s\nExpected Value: %v\nActual Value: %v", test.testName, test.expectedValue, value)
+		}
+	}
+}
+
+func TestExpandNameTemplate(t *testing.T) {
+	values := TemplateValues{
+		BucketNamePlaceholder: constant.ValidContainer,
+		DatePlaceholder:       "2022-09-02",
+	}
+	tests := []struct {
+		testName      string
+		value         string
+		expectedValue string
+		expectedErr   error
+	}{
+		{
+			testName:      "Bucket name",
+			value:         "cosi${bucket.name}",
+			expectedValue: "cosivalidcontainer",
+		},
+		{
+			testName:    "Date",
+			value:       "cosi${ date }",
+			expectedErr: status.Error(codes.InvalidArgument, "Placeholder ${ date } in \"cosi${ date }\" changes over time and is only allowed in tags and container metadata, not in names"),
+		},
+	}
+	for _, test := range tests {
+		value, err := expandNameTemplate(test.value, values)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectedErr, err)
+		}
+		if err == nil && value != test.expectedValue {
+			t.Errorf("\nTestCase: %s\nExpected Value: %v\nActual Value: %v", test.testName, test.expectedValue, value)
+		}
+	}
+}
+
+func TestExpandTemplateMap(t *testing.T) {
+	values := TemplateValues{BucketNamePlaceholder: constant.ValidContainer}
+	tests := []struct {
+		testName    string
+		input       map[string]string
+		expectedOut map[string]string
+		expectedErr error
+	}{
+		{
+			testName:    "Expanded values",
+			input:       map[string]string{"bucket": "${bucket.name}", "static": "value"},
+			expectedOut: map[string]string{"bucket": constant.ValidContainer, "static": "value"},
+		},
+		{
+			testName:    "Invalid value",
+			input:       map[string]string{"claim": "${bucketclaim.name}"},
+			expectedErr: status.Error(codes.InvalidArgument, "Placeholder ${bucketclaim.name} in \"${bucketclaim.name}\" has no value for this bucket"),
+		},
+	}
+	for _, test := range tests {
+		output, err := expandTemplateMap(test.input, values)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectedErr, err)
+		}
+		if err == nil && !reflect.DeepEqual(output, test.expectedOut) {
+			t.Errorf("\nTestCase: %s\nExpected Output: %v\nActual Output: %v", test.testName, test.expectedOut, output)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"project/azure-cosi-driver/pkg/metrics"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+const (
+	// DefaultARMRequestsPerSecond is the default client-side limit of ARM requests per subscription
+	DefaultARMRequestsPerSecond = 5
+	// DefaultARMBurst is the default number of ARM requests per subscription that may exceed the rate limit at once
+	DefaultARMBurst = 10
+
+	// minARMRateFraction is the fraction of the configured rate the rate of a throttled subscription never drops below
+	minARMRateFraction = 0.05
+	// armRateRecoveryFraction is the fraction of the configured rate given back to a throttled subscription after every successful request
+	armRateRecoveryFraction = 0.05
+	// defaultRetryAfter is how long requests are paused for when Azure throttles without saying for how long
+	defaultRetryAfter = 10 * time.Second
+)
+
+type azureErrorClass int
+
+const (
+	// permanentError is an error retrying does not help with, or no error
+	permanentError azureErrorClass = iota
+	// transientError is an error a later retry may not get, such as a 5xx response or a dropped connection
+	transientError
+	// throttledError is a request Azure refused because too many requests were made
+	throttledError
+)
+
+// classifyAzureError returns whether err is a throttling or transient error, and how long Azure asked to wait before retrying
+func classifyAzureError(err error) (azureErrorClass, time.Duration) {
+	info, ok := parseAzureError(err)
+	if !ok {
+		if isNetworkError(err) {
+			return transientError, 0
+		}
+		return permanentError, 0
+	}
+	class := info.class()
+	if class == permanentError {
+		return permanentError, 0
+	}
+	return class, info.retryAfter
+}
+
+// parseRetryAfter parses a Retry-After header, given in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if d := time.Until(date); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// armLimiter is a client-side token bucket per subscription for ARM requests. When ARM throttles a subscription
+// its rate is halved and its requests are paused for the Retry-After delay, then the rate grows back with every
+// successful request. Requests that cannot be sent before their deadline fail with codes.ResourceExhausted.
+type armLimiter struct {
+	lock sync.Mutex
+	// limit is the configured rate of every subscription, zero disables limiting
+	limit         rate.Limit
+	burst         int
+	subscriptions map[string]*subscriptionLimiter
+	now           func() time.Time
+}
+
+type subscriptionLimiter struct {
+	limiter *rate.Limiter
+	// pausedUntil is when requests of the subscription may be sent again after ARM throttled it
+	pausedUntil time.Time
+}
+
+// armRequests limits the ARM requests of this driver instance. Limiting is disabled until SetARMRateLimit is called.
+var armRequests = newARMLimiter(0, 0)
+
+func newARMLimiter(requestsPerSecond float64, burst int) *armLimiter {
+	return &armLimiter{
+		limit:         rate.Limit(requestsPerSecond),
+		burst:         burst,
+		subscriptions: make(map[string]*subscriptionLimiter),
+		now:           time.Now,
+	}
+}
+
+// SetARMRateLimit sets the rate and burst of ARM requests per subscription, a zero rate disables limiting.
+// It must be called before any bucket is provisioned.
+func SetARMRateLimit(requestsPerSecond float64, burst int) {
+	armRequests = newARMLimiter(requestsPerSecond, burst)
+}
+
+func (l *armLimiter) get(subscription string) *subscriptionLimiter {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	s, ok := l.subscriptions[subscription]
+	if !ok {
+		s = &subscriptionLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.subscriptions[subscription] = s
+	}
+	return s
+}
+
+// wait blocks until a request of the subscription may be sent
+func (l *armLimiter) wait(ctx context.Context, subscription string) error {
+	if l.limit <= 0 {
+		return nil
+	}
+	s := l.get(subscription)
+
+	l.lock.Lock()
+	pause := s.pausedUntil.Sub(l.now())
+	l.lock.Unlock()
+	if pause > 0 {
+		if deadline, ok := ctx.Deadline(); ok && deadline.Before(l.now().Add(pause)) {
+			return l.exhausted(subscription, pause)
+		}
+		timer := time.NewTimer(pause)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return l.exhausted(subscription, pause)
+		}
+	}
+
+	// Wait fails right away when the request could not be sent before the deadline
+	if err := s.limiter.Wait(ctx); err != nil {
+		return l.exhausted(subscription, 0)
+	}
+	return nil
+}
+
+func (l *armLimiter) exhausted(subscription string, retryAfter time.Duration) error {
+	message := fmt.Sprintf("Too many ARM requests for subscription %s, retry later", subscription)
+	if retryAfter > 0 {
+		message = fmt.Sprintf("ARM is throttling subscription %s, retry after %v", subscription, retryAfter.Round(time.Second))
+	}
+	return status.Error(codes.ResourceExhausted, message)
+}
+
+// observe adapts the rate of the subscription to the outcome of one of its requests
+func (l *armLimiter) observe(subscription string, err error) {
+	if l.limit <= 0 {
+		return
+	}
+	s := l.get(subscription)
+	class, retryAfter := classifyAzureError(err)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	current := s.limiter.Limit()
+	next := current
+	switch {
+	case class == throttledError:
+		next = rate.Limit(math.Max(float64(current)/2, float64(l.limit)*minARMRateFraction))
+		if retryAfter <= 0 {
+			retryAfter = defaultRetryAfter
+		}
+		if until := l.now().Add(retryAfter); until.After(s.pausedUntil) {
+			s.pausedUntil = until
+		}
+		klog.Warningf("ARM is throttling subscription %s, lowering its request rate to %.2f/s and pausing its requests for %v", subscription, float64(next), retryAfter)
+	case err == nil && current < l.limit:
+		next = rate.Limit(math.Min(float64(current)+float64(l.limit)*armRateRecoveryFraction, float64(l.limit)))
+	}
+	if next != current {
+		s.limiter.SetLimit(next)
+		metrics.RecordARMRateLimit(subscription, float64(next))
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
+)
+
+func TestClassifyAzureError(t *testing.T) {
+	tests := []struct {
+		testName           string
+		err                error
+		expectedClass      azureErrorClass
+		expectedRetryAfter time.Duration
+	}{
+		{
+			testName:      "No error",
+			err:           nil,
+			expectedClass: permanentError,
+		},
+		{
+			testName:           "Blob response throttled",
+			err:                fmt.Errorf("wrapped: %w", blobError(http.StatusTooManyRequests, "", http.Header{"Retry-After": []string{"30"}})),
+			expectedClass:      throttledError,
+			expectedRetryAfter: 30 * time.Second,
+		},
+		{
+			testName:      "Blob service busy",
+			err:           blobError(http.StatusServiceUnavailable, "ServerBusy", nil),
+			expectedClass: throttledError,
+		},
+		{
+			testName:      "Blob internal error",
+			err:           blobError(http.StatusInternalServerError, "", nil),
+			expectedClass: transientError,
+		},
+		{
+			testName:      "Blob response not found",
+			err:           blobError(http.StatusNotFound, "ContainerNotFound", nil),
+			expectedClass: permanentError,
+		},
+		{
+			testName:           "ARM error throttled",
+			err:                armError(true, 30, http.StatusTooManyRequests),
+			expectedClass:      throttledError,
+			expectedRetryAfter: 30 * time.Second,
+		},
+		{
+			testName:      "ARM error bad gateway",
+			err:           retry.GetError(&http.Response{StatusCode: http.StatusBadGateway}, fmt.Errorf("bad gateway")).Error(),
+			expectedClass: transientError,
+		},
+		{
+			testName:      "ARM error without response",
+			err:           retry.GetError(nil, fmt.Errorf("connection reset")).Error(),
+			expectedClass: transientError,
+		},
+		{
+			testName:      "ARM error not found",
+			err:           retry.GetError(&http.Response{StatusCode: http.StatusNotFound}, fmt.Errorf("not found")).Error(),
+			expectedClass: permanentError,
+		},
+		{
+			testName:      "Other error",
+			err:           fmt.Errorf("invalid parameters"),
+			expectedClass: permanentError,
+		},
+	}
+	for _, test := range tests {
+		class, retryAfter := classifyAzureError(test.err)
+		if class != test.expectedClass {
+			t.Errorf("\nTestCase: %s\nExpected Class: %v\nActual Class: %v", test.testName, test.expectedClass, class)
+		}
+		if retryAfter != test.expectedRetryAfter {
+			t.Errorf("\nTestCase: %s\nExpected Retry After: %v\nActual Retry After: %v", test.testName, test.expectedRetryAfter, retryAfter)
+		}
+	}
+}
+
+func TestARMLimiter(t *testing.T) {
+	throttled := retry.GetError(&http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"60"}}}, fmt.Errorf("too many requests")).Error()
+	limiter := newARMLimiter(10, 10)
+
+	if err := limiter.wait(context.Background(), "subscription"); err != nil {
+		t.Fatalf("expected a request within the rate limit to be sent, got %v", err)
+	}
+
+	limiter.observe("subscription", throttled)
+	if limit := limiter.get("subscription").limiter.Limit(); limit != 5 {
+		t.Errorf("expected a throttled subscription's rate to be halved to 5, got %v", limit)
+	}
+	if limit := limiter.get("other").limiter.Limit(); limit != 10 {
+		t.Errorf("expected other subscriptions to keep the rate of 10, got %v", limit)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := limiter.wait(ctx, "subscription")
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected a request that cannot wait for the pause to fail with %v, got %v", codes.ResourceExhausted, err)
+	}
+	if err := limiter.wait(ctx, "other"); err != nil {
+		t.Errorf("expected requests of other subscriptions not to be paused, got %v", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		limiter.observe("subscription", throttled)
+	}
+	if limit := limiter.get("subscription").limiter.Limit(); limit != rate.Limit(10*minARMRateFraction) {
+		t.Errorf("expected the rate not to drop below %v, got %v", 10*minARMRateFraction, limit)
+	}
+
+	for i := 0; i < 30; i++ {
+		limiter.observe("subscription", nil)
+	}
+	if limit := limiter.get("subscription").limiter.Limit(); limit != 10 {
+		t.Errorf("expected the rate to grow back to 10 after successful requests, got %v", limit)
+	}
+}
@@ -18,6 +18,31 @@ const (
 	AllowServiceSignedResourceTypeField   = "allowservicesignedresourcetypefield"
 	AllowContainerSignedResourceTypeField = "allowcontainersignedresourcetypefield"
 	AllowObjectSignedResourceTypeField    = "allowobjectsignedresourcetypefield"
+	SigningKeyField                       = "signingkey"
+	CredentialModeField                   = "credentialmode"
+	SFTPAuthenticationField               = "sftpauthentication"
+	SFTPSSHPublicKeyField                 = "sftpsshpublickey"
+	RegenerateKeyOnRevokeField            = "regeneratekeyonrevoke"
 	CredentialType                        = "azure"
 	AccessToken                           = "accessToken"
+
+	// CredentialModes, the kind of credentials a BucketAccessClass grants
+	SASCredentialMode        = "sas"
+	SFTPCredentialMode       = "sftp"
+	AccountKeyCredentialMode = "accountkey"
+
+	// SFTPAuthentications, how SFTP local users authenticate
+	PasswordSFTPAuthentication = "password"
+	SSHKeySFTPAuthentication   = "sshkey"
+
+	// Secrets of SFTP credentials
+	SFTPHost         = "host"
+	SFTPUsername     = "username"
+	SFTPPassword     = "password"
+	SFTPSSHPublicKey = "sshPublicKey"
+
+	// Secrets of account key credentials
+	AccountName      = "accountName"
+	AccountKey       = "accountKey"
+	ConnectionString = "connectionString"
 )
@@ -7,6 +7,7 @@ const (
 	CreateStorageAccountField           = "createstorageaccount"
 	SubscriptionIDField                 = "subscriptionid"
 	StorageAccountNameField             = "storageaccountname"
+	StorageAccountNameTemplateField     = "storageaccountnametemplate"
 	ContainerNameField                  = "containername"
 	RegionField                         = "region"
 	AccessTierField                     = "accesstier"
@@ -19,6 +20,9 @@ const (
 	BlobDeleteRetentionDaysField        = "blobdeleteretentiondays"
 	EnableContainerDeleteRetentionField = "enablecontainerdeleteretention"
 	ContainerDeleteRetentionDaysField   = "containerdeleteretentiondays"
+	StorageAccountPoolPrefixField       = "storageaccountpoolprefix"
+	MaxContainersPerAccountField        = "maxcontainersperaccount"
+	ContainerMetadataField              = "containermetadata"
 )
 
 type BucketUnitType int
@@ -15,11 +15,23 @@ package driver
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"os"
 	"sync"
+	"time"
+
+	"project/azure-cosi-driver/pkg/azureutils"
+	"project/azure-cosi-driver/pkg/health"
+	"project/azure-cosi-driver/pkg/metrics"
+	"project/azure-cosi-driver/pkg/redact"
+	"project/azure-cosi-driver/pkg/tracing"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 
 	klog "k8s.io/klog/v2"
 
@@ -31,42 +43,101 @@ type COSIServer struct {
 	endpointProto   string
 	endpointAddress string
 	server          *grpc.Server
+	healthServer    *grpchealth.Server
+	checker         *health.Checker
+	stopHealth      chan struct{}
+	// services are the COSI services the health server reports the status of, besides the overall status
+	services []string
+	// done is closed when the server stops serving, with the error it stopped with in serveErr
+	done     chan struct{}
+	serveErr error
+	// cancelInFlight is closed to cancel the RPCs being handled
+	cancelInFlight chan struct{}
+	cancelOnce     sync.Once
 }
 
 func newCOSIServer(
 	endpointProto string,
 	endpointAddr string,
 	identityServer spec.IdentityServer,
-	provisionerServer spec.ProvisionerServer) *COSIServer {
+	provisionerServer spec.ProvisionerServer,
+	options ServerOptions,
+	creds credentials.TransportCredentials) *COSIServer {
+	s := &COSIServer{
+		endpointProto:   endpointProto,
+		endpointAddress: endpointAddr,
+		checker:         options.Checker,
+		stopHealth:      make(chan struct{}),
+		done:            make(chan struct{}),
+		cancelInFlight:  make(chan struct{}),
+	}
+
+	interceptors := []grpc.UnaryServerInterceptor{
+		s.inFlightUnaryInterceptor,
+		tracing.UnaryServerInterceptor(),
+		logUnaryInterceptor,
+		recoverUnaryInterceptor,
+		timeoutUnaryInterceptor(options.DefaultTimeout, options.MethodTimeouts),
+	}
 	serverOpts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(
-			func(
-				ctx context.Context,
-				req interface{},
-				info *grpc.UnaryServerInfo,
-				handler grpc.UnaryHandler) (interface{}, error) {
-				klog.V(2).InfoS("GRPC call", "method", info.FullMethod, "request", req)
-
-				resp, err := handler(ctx, req)
-				if err != nil {
-					klog.Errorf("GRPC error %v", err)
-				} else {
-					klog.V(2).InfoS("GRPC response", "method", info.FullMethod, "response", resp)
-				}
-
-				return resp, err
-			}),
+		grpc.ChainUnaryInterceptor(interceptors...),
+	}
+	if creds != nil {
+		serverOpts = append(serverOpts, grpc.Creds(creds))
 	}
 
-	server := grpc.NewServer(serverOpts...)
-	spec.RegisterIdentityServer(server, identityServer)
-	spec.RegisterProvisionerServer(server, provisionerServer)
+	s.server = grpc.NewServer(serverOpts...)
+	spec.RegisterIdentityServer(s.server, identityServer)
+	spec.RegisterProvisionerServer(s.server, provisionerServer)
 
-	return &COSIServer{
-		endpointProto:   endpointProto,
-		endpointAddress: endpointAddr,
-		server:          server,
+	s.services = make([]string, 0, 2)
+	for name := range s.server.GetServiceInfo() {
+		s.services = append(s.services, name)
+	}
+	s.healthServer = health.NewServer(s.services...)
+	healthpb.RegisterHealthServer(s.server, s.healthServer)
+
+	return s
+}
+
+// inFlightUnaryInterceptor cancels the context of the RPCs being handled when the server gives up draining them
+func (s *COSIServer) inFlightUnaryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.cancelInFlight:
+			klog.InfoS("Cancelling GRPC call", "method", info.FullMethod)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// logUnaryInterceptor logs every RPC and records its metrics.
+// Requests, responses and errors are redacted before logging as they may carry credentials.
+func logUnaryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	klog.V(2).InfoS("GRPC call", "method", info.FullMethod, "request", redact.Message(req))
+
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	metrics.RecordGRPCRequest(info.FullMethod, status.Code(err), time.Since(start))
+	if err != nil {
+		klog.Errorf("GRPC error %s", redact.Error(err))
+	} else {
+		klog.V(2).InfoS("GRPC response", "method", info.FullMethod, "response", redact.Message(resp))
 	}
+
+	return resp, err
 }
 
 func (s *COSIServer) startServer() error {
@@ -83,14 +154,23 @@ func (s *COSIServer) startServer() error {
 		return err
 	}
 
+	if s.checker != nil {
+		go s.checker.UpdateServer(s.stopHealth, s.healthServer, s.services...)
+	} else {
+		s.healthServer.Resume()
+	}
+
 	s.waitGroup.Add(1)
 
 	go func() {
 		defer s.waitGroup.Done()
 
+		defer close(s.done)
+
 		klog.Infof("Starting GRPC server at %s://%s", s.endpointProto, s.endpointAddress)
 		if err := s.server.Serve(listener); err != nil {
 			klog.Errorf("Error starting GRPC server : %v", err)
+			s.serveErr = err
 		}
 
 		klog.Info("GRPC Server loop finished")
@@ -101,14 +181,72 @@ func (s *COSIServer) startServer() error {
 
 func (s *COSIServer) GracefulStop() {
 	klog.Info("Requesting graceful GRPC server stop")
+	s.stopHealthUpdates()
 	s.server.GracefulStop()
 }
 
+// Drain stops accepting RPCs and waits up to timeout for the in-flight ones, and the storage account operations
+// they left running in the background, to finish. RPCs still running then are cancelled and get cancelGracePeriod
+// to return before the server stops. It returns an error if RPCs had to be cancelled, storage account operations
+// were still running, or the server failed while serving.
+func (s *COSIServer) Drain(timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = DefaultDrainTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	drained := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(drained)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-drained:
+		s.Wait()
+		if !azureutils.WaitForAccountOperations(time.Until(deadline)) {
+			klog.Warningf("Storage account operations still running after %v, abandoning them", timeout)
+			return fmt.Errorf("drain timed out after %v, storage account operations were still running", timeout)
+		}
+		return s.serveErr
+	case <-timer.C:
+	}
+
+	klog.Warningf("GRPC calls still in flight after %v, cancelling them", timeout)
+	s.cancelOnce.Do(func() { close(s.cancelInFlight) })
+	// The graceful stop completes once the cancelled RPCs have returned
+	select {
+	case <-drained:
+	case <-time.After(cancelGracePeriod):
+		klog.Warningf("GRPC calls did not return within %v of their cancellation", cancelGracePeriod)
+	}
+	s.Stop()
+	s.Wait()
+	return fmt.Errorf("drain timed out after %v, in-flight GRPC calls were cancelled", timeout)
+}
+
 func (s *COSIServer) Stop() {
 	klog.Info("Requesting GRPC server stop")
+	s.stopHealthUpdates()
 	s.server.Stop()
 }
 
+// stopHealthUpdates reports every service as not serving from now on
+func (s *COSIServer) stopHealthUpdates() {
+	if s.healthServer != nil {
+		s.healthServer.Shutdown()
+	}
+	if s.stopHealth != nil {
+		select {
+		case <-s.stopHealth:
+		default:
+			close(s.stopHealth)
+		}
+	}
+}
+
 func (s *COSIServer) Wait() {
 	s.waitGroup.Wait()
 	klog.Info("GRPC Server stopped")
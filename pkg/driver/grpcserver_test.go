@@ -1,10 +1,20 @@
 package driver
 
 import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"strings"
 	"sync"
 	"testing"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	spec "sigs.k8s.io/container-object-storage-interface-spec"
 )
 
 func TestWait(t *testing.T) {
@@ -25,3 +35,99 @@ func TestStop(t *testing.T) {
 	s.server = grpc.NewServer()
 	s.Stop()
 }
+
+func TestLogUnaryInterceptorRedactsSecrets(t *testing.T) {
+	const signature = "c2VjcmV0c2lnbmF0dXJl%3D"
+	sasURL := "https://account.blob.core.windows.net/container?sp=rl&sr=c&sig=" + signature
+
+	var buf bytes.Buffer
+	flags := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(flags)
+	for k, v := range map[string]string{"logtostderr": "false", "alsologtostderr": "false", "v": "5"} {
+		if err := flags.Set(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	klog.SetOutput(&buf)
+	defer func() {
+		klog.SetOutput(os.Stderr)
+		_ = flags.Set("logtostderr", "true")
+		_ = flags.Set("v", "0")
+	}()
+
+	tests := []struct {
+		testName string
+		req      interface{}
+		resp     interface{}
+		err      error
+	}{
+		{
+			testName: "Grant response",
+			req:      &spec.DriverGrantBucketAccessRequest{BucketId: "bucket", Parameters: map[string]string{"accountkey": signature}},
+			resp: &spec.DriverGrantBucketAccessResponse{
+				Credentials: map[string]*spec.CredentialDetails{"azure": {Secrets: map[string]string{"accessToken": sasURL}}},
+			},
+		},
+		{
+			testName: "Error",
+			req:      &spec.DriverCreateBucketRequest{Name: "bucket", Parameters: map[string]string{"endpoint": sasURL}},
+			err:      status.Error(codes.Internal, "request to "+sasURL+" failed"),
+		},
+	}
+	for _, test := range tests {
+		buf.Reset()
+		info := &grpc.UnaryServerInfo{FullMethod: "/cosi.v1alpha1.Provisioner/Test"}
+		_, err := logUnaryInterceptor(context.Background(), test.req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return test.resp, test.err
+		})
+		if err != test.err {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.err, err)
+		}
+		klog.Flush()
+
+		output := buf.String()
+		if !strings.Contains(output, "GRPC") {
+			t.Errorf("\nTestCase: %s\nExpected the RPC to be logged, got: %s", test.testName, output)
+		}
+		if strings.Contains(output, signature) {
+			t.Errorf("\nTestCase: %s\nSecret reached the log output: %s", test.testName, output)
+		}
+	}
+}
+
+func TestHealthService(t *testing.T) {
+	identityServer := &spec.UnimplementedIdentityServer{}
+	provisionerServer := &spec.UnimplementedProvisionerServer{}
+	s := newCOSIServer("tcp", "127.0.0.1:0", identityServer, provisionerServer, ServerOptions{}, nil)
+
+	if _, ok := s.server.GetServiceInfo()[healthpb.Health_ServiceDesc.ServiceName]; !ok {
+		t.Errorf("health service is not registered")
+	}
+	if len(s.services) != 2 {
+		t.Errorf("expected the health server to track the 2 COSI services, got %v", s.services)
+	}
+
+	if err := s.startServer(); err != nil {
+		t.Fatal(err)
+	}
+	for _, service := range append([]string{""}, s.services...) {
+		resp, err := s.healthServer.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("\nService: %q\nExpected Status: %v\nActual Status: %v", service, healthpb.HealthCheckResponse_SERVING, resp.Status)
+		}
+	}
+
+	s.GracefulStop()
+	s.Stop()
+	s.Wait()
+	resp, err := s.healthServer.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Expected Status: %v\nActual Status: %v", healthpb.HealthCheckResponse_NOT_SERVING, resp.Status)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	klog "k8s.io/klog/v2"
+)
+
+// recoverUnaryInterceptor turns a panic in a handler into a codes.Internal error instead of crashing the driver
+func recoverUnaryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			klog.ErrorS(nil, "GRPC handler panicked", "method", info.FullMethod, "panic", r, "stack", string(debug.Stack()))
+			resp, err = nil, status.Error(codes.Internal, fmt.Sprintf("Internal error in %s", info.FullMethod))
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// ParseMethodTimeouts parses a comma separated list of method=duration pairs, e.g. "DriverCreateBucket=5m,DriverGrantBucketAccess=30s".
+// Methods are named by the last element of their full gRPC method name.
+func ParseMethodTimeouts(timeouts string) (map[string]time.Duration, error) {
+	result := make(map[string]time.Duration)
+	if timeouts == "" {
+		return result, nil
+	}
+	for _, pair := range strings.Split(timeouts, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("method timeout %q is not of the form method=duration", pair)
+		}
+		timeout, err := time.ParseDuration(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("method timeout %q has an invalid duration: %v", pair, err)
+		}
+		if timeout <= 0 {
+			return nil, fmt.Errorf("method timeout %q must be positive", pair)
+		}
+		result[strings.TrimSpace(kv[0])] = timeout
+	}
+	return result, nil
+}
+
+// methodName returns the last element of a full gRPC method name, e.g. DriverCreateBucket
+func methodName(fullMethod string) string {
+	return fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+}
+
+// timeoutUnaryInterceptor bounds each RPC by the timeout of its method, or defaultTimeout if it has none.
+// A deadline set by the client that is shorter still applies. Zero timeouts leave the RPC unbounded.
+func timeoutUnaryInterceptor(defaultTimeout time.Duration, methodTimeouts map[string]time.Duration) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		timeout, ok := methodTimeouts[methodName(info.FullMethod)]
+		if !ok {
+			timeout = defaultTimeout
+		}
+		if timeout <= 0 {
+			return handler(ctx, req)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		resp, err := handler(ctx, req)
+		// Azure clients report an expired context as plain errors, which would reach the sidecar as codes.Unknown
+		if err != nil && status.Code(err) == codes.Unknown && ctx.Err() == context.DeadlineExceeded {
+			return nil, status.Error(codes.DeadlineExceeded, fmt.Sprintf("%s timed out: %v", info.FullMethod, err))
+		}
+		return resp, err
+	}
+}
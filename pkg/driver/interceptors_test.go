@@ -0,0 +1,184 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"project/azure-cosi-driver/pkg/types"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testMethod = "/cosi.v1alpha1.Provisioner/DriverCreateBucket"
+
+func TestRecoverUnaryInterceptor(t *testing.T) {
+	tests := []struct {
+		testName     string
+		handler      grpc.UnaryHandler
+		expectedResp interface{}
+		expectedCode codes.Code
+	}{
+		{
+			testName: "Panic",
+			handler: func(context.Context, interface{}) (interface{}, error) {
+				var id *types.BucketID
+				return id.URL, nil
+			},
+			expectedCode: codes.Internal,
+		},
+		{
+			testName: "Error",
+			handler: func(context.Context, interface{}) (interface{}, error) {
+				return nil, status.Error(codes.NotFound, "not found")
+			},
+			expectedCode: codes.NotFound,
+		},
+		{
+			testName: "Success",
+			handler: func(context.Context, interface{}) (interface{}, error) {
+				return "response", nil
+			},
+			expectedResp: "response",
+			expectedCode: codes.OK,
+		},
+	}
+	for _, test := range tests {
+		info := &grpc.UnaryServerInfo{FullMethod: testMethod}
+		resp, err := recoverUnaryInterceptor(context.Background(), nil, info, test.handler)
+		if status.Code(err) != test.expectedCode {
+			t.Errorf("\nTestCase: %s\nExpected Code: %v\nActual Error: %v", test.testName, test.expectedCode, err)
+		}
+		if resp != test.expectedResp {
+			t.Errorf("\nTestCase: %s\nExpected Response: %v\nActual Response: %v", test.testName, test.expectedResp, resp)
+		}
+	}
+}
+
+func TestParseMethodTimeouts(t *testing.T) {
+	tests := []struct {
+		testName         string
+		timeouts         string
+		expectedTimeouts map[string]time.Duration
+		expectErr        bool
+	}{
+		{
+			testName:         "Empty",
+			timeouts:         "",
+			expectedTimeouts: map[string]time.Duration{},
+		},
+		{
+			testName:         "Several methods",
+			timeouts:         "DriverCreateBucket=5m, DriverGrantBucketAccess = 30s",
+			expectedTimeouts: map[string]time.Duration{"DriverCreateBucket": 5 * time.Minute, "DriverGrantBucketAccess": 30 * time.Second},
+		},
+		{
+			testName:  "Missing duration",
+			timeouts:  "DriverCreateBucket",
+			expectErr: true,
+		},
+		{
+			testName:  "Missing method",
+			timeouts:  "=5m",
+			expectErr: true,
+		},
+		{
+			testName:  "Invalid duration",
+			timeouts:  "DriverCreateBucket=5",
+			expectErr: true,
+		},
+		{
+			testName:  "Negative duration",
+			timeouts:  "DriverCreateBucket=-5m",
+			expectErr: true,
+		},
+	}
+	for _, test := range tests {
+		timeouts, err := ParseMethodTimeouts(test.timeouts)
+		if (err != nil) != test.expectErr {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectErr, err)
+		}
+		if err == nil && !reflect.DeepEqual(timeouts, test.expectedTimeouts) {
+			t.Errorf("\nTestCase: %s\nExpected Timeouts: %v\nActual Timeouts: %v", test.testName, test.expectedTimeouts, timeouts)
+		}
+	}
+}
+
+func TestTimeoutUnaryInterceptor(t *testing.T) {
+	waitForDeadline := func(ctx context.Context, _ interface{}) (interface{}, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			return nil, nil
+		}
+		<-ctx.Done()
+		return nil, fmt.Errorf("azure request failed: %w", ctx.Err())
+	}
+	tests := []struct {
+		testName        string
+		defaultTimeout  time.Duration
+		methodTimeouts  map[string]time.Duration
+		handler         grpc.UnaryHandler
+		expectedCode    codes.Code
+		expectedTimeout time.Duration
+	}{
+		{
+			testName:        "Method timeout",
+			defaultTimeout:  time.Hour,
+			methodTimeouts:  map[string]time.Duration{"DriverCreateBucket": 10 * time.Millisecond},
+			handler:         waitForDeadline,
+			expectedCode:    codes.DeadlineExceeded,
+			expectedTimeout: 10 * time.Millisecond,
+		},
+		{
+			testName:        "Default timeout",
+			defaultTimeout:  10 * time.Millisecond,
+			methodTimeouts:  map[string]time.Duration{"DriverDeleteBucket": time.Hour},
+			handler:         waitForDeadline,
+			expectedCode:    codes.DeadlineExceeded,
+			expectedTimeout: 10 * time.Millisecond,
+		},
+		{
+			testName:     "Unbounded",
+			handler:      waitForDeadline,
+			expectedCode: codes.OK,
+		},
+		{
+			testName:       "Status of the handler is kept",
+			defaultTimeout: 10 * time.Millisecond,
+			handler: func(ctx context.Context, _ interface{}) (interface{}, error) {
+				<-ctx.Done()
+				return nil, status.Error(codes.Unavailable, "in progress")
+			},
+			expectedCode:    codes.Unavailable,
+			expectedTimeout: 10 * time.Millisecond,
+		},
+	}
+	for _, test := range tests {
+		interceptor := timeoutUnaryInterceptor(test.defaultTimeout, test.methodTimeouts)
+		info := &grpc.UnaryServerInfo{FullMethod: testMethod}
+		start := time.Now()
+		_, err := interceptor(context.Background(), nil, info, test.handler)
+		if status.Code(err) != test.expectedCode {
+			t.Errorf("\nTestCase: %s\nExpected Code: %v\nActual Error: %v", test.testName, test.expectedCode, err)
+		}
+		if elapsed := time.Since(start); elapsed < test.expectedTimeout || elapsed > test.expectedTimeout+time.Second {
+			t.Errorf("\nTestCase: %s\nExpected Timeout: %v\nActual Elapsed: %v", test.testName, test.expectedTimeout, elapsed)
+		}
+	}
+}
@@ -17,73 +17,117 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"regexp"
 	"strings"
 	"syscall"
 	"time"
 
+	"project/azure-cosi-driver/pkg/health"
+
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
 	spec "sigs.k8s.io/container-object-storage-interface-spec"
 )
 
+// ServerOptions configures the COSI gRPC server
+type ServerOptions struct {
+	// Checker reports the readiness of the driver on the gRPC health service. Nil always reports serving.
+	Checker *health.Checker
+	// TLS configures the transport security of tcp:// endpoints
+	TLS TLSOptions
+	// DefaultTimeout bounds the RPCs of methods missing from MethodTimeouts. Zero leaves them unbounded.
+	DefaultTimeout time.Duration
+	// MethodTimeouts bounds the RPCs of each method, keyed by method name, e.g. DriverCreateBucket
+	MethodTimeouts map[string]time.Duration
+	// DrainTimeout is how long in-flight RPCs get to finish on shutdown before they are cancelled. Zero uses DefaultDrainTimeout.
+	DrainTimeout time.Duration
+}
+
 const (
-	DefaultEndpoint = "unix:///var/lib/cosi/cosi.sock"
-	DriverName      = "blob.cosi.azure.com"
-	waitTime        = 5
+	DefaultEndpoint     = "unix:///var/lib/cosi/cosi.sock"
+	DefaultDriverName   = "blob.cosi.azure.com"
+	maxDriverNameLength = 63
+	DefaultDrainTimeout = 30 * time.Second
+	// cancelGracePeriod is how long RPCs cancelled at the end of a drain get to return,
+	// e.g. to leave the journal entries of interrupted bucket creations behind
+	cancelGracePeriod = 5 * time.Second
 )
 
+// driverNameRE matches names beginning and ending with an alphanumeric character, with dashes, dots and alphanumerics between
+var driverNameRE = regexp.MustCompile(`^[a-zA-Z0-9]([-.a-zA-Z0-9]*[a-zA-Z0-9])?$`)
+
+// ValidateDriverName checks the driver name against the COSI naming rules:
+// at most 63 characters, beginning and ending with an alphanumeric character, with dashes, dots and alphanumerics between.
+func ValidateDriverName(name string) error {
+	if name == "" {
+		return fmt.Errorf("driver name must not be empty")
+	}
+	if len(name) > maxDriverNameLength {
+		return fmt.Errorf("driver name %s is longer than %d characters", name, maxDriverNameLength)
+	}
+	if !driverNameRE.MatchString(name) {
+		return fmt.Errorf("driver name %s must begin and end with an alphanumeric character, with only dashes, dots and alphanumerics between", name)
+	}
+	return nil
+}
+
 // Run COSI gRPC Services.
-// Set up signal handlers for SIGINT and SIGTERM.
+// On SIGINT or SIGTERM the server is drained: new RPCs are refused and in-flight RPCs, and the storage account
+// operations they left running in the background, get options.DrainTimeout to finish, after which RPCs are cancelled.
+// An error is returned if the server could not be started, failed while serving, or did not drain in time.
 func RunServerWithSignalHandler(
 	endpoint string,
 	identityServer spec.IdentityServer,
-	provisionerServer spec.ProvisionerServer) error {
-	server, err := StartServers(endpoint, identityServer, provisionerServer)
-	if err != nil {
-		return nil
-	}
-
-	// Registering signal handlers
+	provisionerServer spec.ProvisionerServer,
+	options ServerOptions) error {
+	// Registering signal handlers before serving, so no signal is missed once RPCs are accepted
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
 
-	go func(c chan os.Signal) {
-		sig := <-c
-		signal.Stop(sigChan)
-
-		klog.InfoS("Received signal", "signal", sig)
-
-		// Initially try to gracefully stop the server
-		server.GracefulStop()
-
-		time.Sleep(waitTime * time.Second)
-		// Stopping server
-		server.Stop()
-
-		time.Sleep(waitTime * time.Second)
-		klog.Info("Signal handler timed out, forcing process exit")
-		klog.Flush()
-		os.Exit(1)
-	}(sigChan)
+	return runServer(endpoint, identityServer, provisionerServer, options, sigChan)
+}
 
-	// Wait till all the WaitGroup are released
-	server.Wait()
+// runServer serves until the server fails or a signal is received on sigChan, which drains it
+func runServer(
+	endpoint string,
+	identityServer spec.IdentityServer,
+	provisionerServer spec.ProvisionerServer,
+	options ServerOptions,
+	sigChan <-chan os.Signal) error {
+	server, err := StartServers(endpoint, identityServer, provisionerServer, options)
+	if err != nil {
+		return err
+	}
 
-	return nil
+	select {
+	case sig := <-sigChan:
+		klog.InfoS("Received signal", "signal", sig)
+		return server.Drain(options.DrainTimeout)
+	case <-server.done:
+		server.Wait()
+		return server.serveErr
+	}
 }
 
 // Run the GRPC services
 func StartServers(
 	endpoint string,
 	identityServer spec.IdentityServer,
-	provServer spec.ProvisionerServer) (*COSIServer, error) {
+	provServer spec.ProvisionerServer,
+	options ServerOptions) (*COSIServer, error) {
 	proto, addr, err := parseEndpoint(endpoint)
 	if err != nil {
 		return nil, err
 	}
 
-	grpcServer := newCOSIServer(proto, addr, identityServer, provServer)
+	creds, err := options.TLS.transportCredentials(proto)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	grpcServer := newCOSIServer(proto, addr, identityServer, provServer, options, creds)
 	if err := grpcServer.startServer(); err != nil {
 		klog.Errorf("Error starting GRPC server %v", err)
 		return nil, err
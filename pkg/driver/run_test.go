@@ -0,0 +1,145 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	spec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+// blockingProvisioner serves DriverCreateBucket by waiting until release is closed or its context is cancelled
+type blockingProvisioner struct {
+	spec.UnimplementedProvisionerServer
+	entered chan struct{}
+	release chan struct{}
+	// ctxErr receives the error of the context of the call when it returns
+	ctxErr chan error
+}
+
+func (p *blockingProvisioner) DriverCreateBucket(ctx context.Context, req *spec.DriverCreateBucketRequest) (*spec.DriverCreateBucketResponse, error) {
+	close(p.entered)
+	select {
+	case <-p.release:
+	case <-ctx.Done():
+	}
+	p.ctxErr <- ctx.Err()
+	return &spec.DriverCreateBucketResponse{BucketId: req.Name}, ctx.Err()
+}
+
+func TestRunServerWithSignalHandler(t *testing.T) {
+	tests := []struct {
+		testName         string
+		drainTimeout     time.Duration
+		releaseAfter     time.Duration
+		expectErr        bool
+		expectCancelled  bool
+		expectCallFailed bool
+	}{
+		{
+			testName:     "In-flight call finishes within the drain timeout",
+			drainTimeout: 5 * time.Second,
+			releaseAfter: 50 * time.Millisecond,
+		},
+		{
+			testName:         "In-flight call is cancelled after the drain timeout",
+			drainTimeout:     50 * time.Millisecond,
+			releaseAfter:     time.Minute,
+			expectErr:        true,
+			expectCancelled:  true,
+			expectCallFailed: true,
+		},
+	}
+	for _, test := range tests {
+		endpoint := "unix://" + filepath.Join(t.TempDir(), "cosi.sock")
+		provisioner := &blockingProvisioner{
+			entered: make(chan struct{}),
+			release: make(chan struct{}),
+			ctxErr:  make(chan error, 1),
+		}
+		sigChan := make(chan os.Signal, 1)
+		serverErr := make(chan error, 1)
+		go func() {
+			serverErr <- runServer(endpoint, &spec.UnimplementedIdentityServer{}, provisioner, ServerOptions{DrainTimeout: test.drainTimeout}, sigChan)
+		}()
+
+		conn, err := grpc.Dial(endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		callErr := make(chan error, 1)
+		go func() {
+			_, err := spec.NewProvisionerClient(conn).DriverCreateBucket(context.Background(), &spec.DriverCreateBucketRequest{Name: "bucket"}, grpc.WaitForReady(true))
+			callErr <- err
+		}()
+
+		select {
+		case <-provisioner.entered:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("TestCase: %s\nThe call never reached the server", test.testName)
+		}
+		sigChan <- syscall.SIGTERM
+		release := time.AfterFunc(test.releaseAfter, func() { close(provisioner.release) })
+
+		if err := <-serverErr; (err != nil) != test.expectErr {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectErr, err)
+		}
+		if ctxErr := <-provisioner.ctxErr; (ctxErr != nil) != test.expectCancelled {
+			t.Errorf("\nTestCase: %s\nExpected Cancelled: %v\nActual Context Error: %v", test.testName, test.expectCancelled, ctxErr)
+		}
+		if err := <-callErr; (err != nil) != test.expectCallFailed {
+			t.Errorf("\nTestCase: %s\nExpected Call Failed: %v\nActual Error: %v", test.testName, test.expectCallFailed, err)
+		}
+		release.Stop()
+		conn.Close()
+	}
+}
+
+func TestRunServerWithSignalHandlerStartFailure(t *testing.T) {
+	err := RunServerWithSignalHandler("invalid://endpoint", &spec.UnimplementedIdentityServer{}, &spec.UnimplementedProvisionerServer{}, ServerOptions{})
+	if err == nil {
+		t.Errorf("expected an error for an endpoint the server cannot start on")
+	}
+}
+
+func TestValidateDriverName(t *testing.T) {
+	tests := []struct {
+		testName  string
+		name      string
+		expectErr bool
+	}{
+		{testName: "Default name", name: DefaultDriverName},
+		{testName: "Tenant name", name: "tenant-a.blob.cosi.azure.com"},
+		{testName: "Single character", name: "a"},
+		{testName: "Empty", name: "", expectErr: true},
+		{testName: "Too long", name: strings.Repeat("a", 64), expectErr: true},
+		{testName: "Leading dash", name: "-blob.cosi.azure.com", expectErr: true},
+		{testName: "Trailing dot", name: "blob.cosi.azure.com.", expectErr: true},
+		{testName: "Invalid character", name: "blob_cosi/azure", expectErr: true},
+	}
+	for _, test := range tests {
+		err := ValidateDriverName(test.name)
+		if (err != nil) != test.expectErr {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectErr, err)
+		}
+	}
+}
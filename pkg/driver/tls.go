@@ -0,0 +1,187 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+	"k8s.io/klog/v2"
+)
+
+// certCheckInterval is how often the TLS files are checked for changes. Handshakes in between
+// are served from memory without touching the files.
+const certCheckInterval = 10 * time.Second
+
+// alpnProtocols are the protocols negotiated with ALPN. gRPC clients require h2 to be negotiated.
+var alpnProtocols = []string{"h2"}
+
+// TLSOptions configures TLS on tcp:// endpoints
+type TLSOptions struct {
+	// CertFile and KeyFile hold the PEM encoded server certificate and key
+	CertFile string
+	KeyFile  string
+	// ClientCAFile holds the PEM encoded CA bundle client certificates are verified against.
+	// Client certificates are not requested when empty.
+	ClientCAFile string
+	// Insecure allows serving a tcp:// endpoint without TLS
+	Insecure bool
+}
+
+func (o TLSOptions) enabled() bool {
+	return o.CertFile != "" || o.KeyFile != "" || o.ClientCAFile != ""
+}
+
+// transportCredentials returns the credentials the server for the endpoint protocol should use.
+// nil means the server is insecure, which is only allowed for unix sockets or when Insecure is set.
+func (o TLSOptions) transportCredentials(endpointProto string) (credentials.TransportCredentials, error) {
+	if endpointProto != "tcp" {
+		if o.enabled() {
+			klog.Warningf("TLS is only used for tcp endpoints, serving %s endpoint without TLS", endpointProto)
+		}
+		return nil, nil
+	}
+
+	if !o.enabled() {
+		if !o.Insecure {
+			return nil, fmt.Errorf("refusing to serve a tcp endpoint without TLS, set a server certificate and key or allow insecure connections explicitly")
+		}
+		klog.Warning("Serving tcp endpoint without TLS, any network peer can call the driver")
+		return nil, nil
+	}
+
+	if o.CertFile == "" || o.KeyFile == "" {
+		return nil, fmt.Errorf("both a server certificate and key are required for TLS")
+	}
+	reloader, err := newCertReloader(o)
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(&tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		NextProtos:         alpnProtocols,
+		GetConfigForClient: reloader.getConfigForClient,
+	}), nil
+}
+
+// certReloader serves the server certificate and client CAs from disk,
+// loading them again whenever one of the files is modified, e.g. when a mounted secret is rotated.
+// The files are checked at most every certCheckInterval.
+type certReloader struct {
+	options TLSOptions
+	now     func() time.Time
+
+	lock      sync.Mutex
+	config    *tls.Config
+	modTimes  map[string]time.Time
+	nextCheck time.Time
+}
+
+func newCertReloader(options TLSOptions) (*certReloader, error) {
+	r := &certReloader{options: options, now: time.Now}
+	modTimes, err := r.getModTimes()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTimes); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.options.CertFile, r.options.KeyFile}
+	if r.options.ClientCAFile != "" {
+		files = append(files, r.options.ClientCAFile)
+	}
+	return files
+}
+
+func (r *certReloader) getModTimes() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[file] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// load reads the certificate, key and client CAs and builds the config handshakes are served with
+func (r *certReloader) load(modTimes map[string]time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.options.CertFile, r.options.KeyFile)
+	if err != nil {
+		return fmt.Errorf("could not load server certificate: %v", err)
+	}
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   alpnProtocols,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.NoClientCert,
+	}
+	if r.options.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.options.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("could not read client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA file %s", r.options.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.config = config
+	r.modTimes = modTimes
+	return nil
+}
+
+// getConfigForClient returns the current config, reloading it first if any of the files changed
+// since they were last checked. A failed reload keeps serving the previous certificate.
+func (r *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.now()
+	if now.Before(r.nextCheck) {
+		return r.config, nil
+	}
+	r.nextCheck = now.Add(certCheckInterval)
+
+	modTimes, err := r.getModTimes()
+	if err != nil {
+		klog.Errorf("Could not check TLS files for changes: %v", err)
+		return r.config, nil
+	}
+	for file, modTime := range modTimes {
+		if !modTime.Equal(r.modTimes[file]) {
+			if err := r.load(modTimes); err != nil {
+				klog.Errorf("Could not reload TLS files, serving previous certificate: %v", err)
+			} else {
+				klog.Info("Reloaded TLS certificate")
+			}
+			break
+		}
+	}
+	return r.config, nil
+}
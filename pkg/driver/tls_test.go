@@ -0,0 +1,385 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	spec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCert(t *testing.T, commonName string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func writeFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// handshake runs a TLS handshake between the reloader and a client and returns the server certificate the client saw
+func handshake(reloader *certReloader, clientConfig *tls.Config) (*x509.Certificate, error) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	server := tls.Server(serverConn, &tls.Config{GetConfigForClient: reloader.getConfigForClient})
+	serverErr := make(chan error, 1)
+	go func() {
+		err := server.Handshake()
+		if err == nil {
+			// TLS 1.3 reports a rejected client certificate on the client's first read
+			_, err = server.Write([]byte{0})
+		}
+		serverErr <- err
+		serverConn.Close()
+	}()
+
+	client := tls.Client(clientConn, clientConfig)
+	err := client.Handshake()
+	if err == nil {
+		_, err = client.Read(make([]byte, 1))
+	}
+	if sErr := <-serverErr; err == nil {
+		err = sErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return client.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestTransportCredentials(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	serverCert := newTestCert(t, "server", ca)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeFile(t, certFile, serverCert.certPEM, time.Now())
+	writeFile(t, keyFile, serverCert.keyPEM, time.Now())
+
+	tests := []struct {
+		testName      string
+		proto         string
+		options       TLSOptions
+		expectedCreds bool
+		expectedErr   bool
+	}{
+		{
+			testName: "Unix socket without TLS",
+			proto:    "unix",
+		},
+		{
+			testName: "Unix socket ignores TLS",
+			proto:    "unix",
+			options:  TLSOptions{CertFile: certFile, KeyFile: keyFile},
+		},
+		{
+			testName:    "TCP without TLS is refused",
+			proto:       "tcp",
+			expectedErr: true,
+		},
+		{
+			testName: "TCP without TLS when insecure",
+			proto:    "tcp",
+			options:  TLSOptions{Insecure: true},
+		},
+		{
+			testName:    "TCP with certificate but no key",
+			proto:       "tcp",
+			options:     TLSOptions{CertFile: certFile},
+			expectedErr: true,
+		},
+		{
+			testName:    "TCP with missing certificate file",
+			proto:       "tcp",
+			options:     TLSOptions{CertFile: filepath.Join(dir, "missing.crt"), KeyFile: keyFile},
+			expectedErr: true,
+		},
+		{
+			testName:      "TCP with TLS",
+			proto:         "tcp",
+			options:       TLSOptions{CertFile: certFile, KeyFile: keyFile},
+			expectedCreds: true,
+		},
+	}
+	for _, test := range tests {
+		creds, err := test.options.transportCredentials(test.proto)
+		if (err != nil) != test.expectedErr {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectedErr, err)
+		}
+		if (creds != nil) != test.expectedCreds {
+			t.Errorf("\nTestCase: %s\nExpected Creds: %v\nActual Creds: %v", test.testName, test.expectedCreds, creds)
+		}
+	}
+}
+
+func TestStartServersRefusesInsecureTCP(t *testing.T) {
+	_, err := StartServers("tcp://127.0.0.1:0", nil, nil, ServerOptions{})
+	if err == nil {
+		t.Errorf("expected StartServers to refuse a tcp endpoint without TLS")
+	}
+}
+
+func TestCertReloaderMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	serverCert := newTestCert(t, "server", ca)
+	clientCert := newTestCert(t, "client", ca)
+	otherCA := newTestCert(t, "other-ca", nil)
+	untrustedClientCert := newTestCert(t, "untrusted-client", otherCA)
+
+	options := TLSOptions{
+		CertFile:     filepath.Join(dir, "tls.crt"),
+		KeyFile:      filepath.Join(dir, "tls.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	}
+	modTime := time.Now().Add(-time.Minute)
+	writeFile(t, options.CertFile, serverCert.certPEM, modTime)
+	writeFile(t, options.KeyFile, serverCert.keyPEM, modTime)
+	writeFile(t, options.ClientCAFile, ca.certPEM, modTime)
+
+	reloader, err := newCertReloader(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	tests := []struct {
+		testName    string
+		clientCerts []tls.Certificate
+		expectedErr bool
+	}{
+		{
+			testName:    "Trusted client certificate",
+			clientCerts: []tls.Certificate{clientCert.tlsCertificate(t)},
+		},
+		{
+			testName:    "No client certificate",
+			expectedErr: true,
+		},
+		{
+			testName:    "Untrusted client certificate",
+			clientCerts: []tls.Certificate{untrustedClientCert.tlsCertificate(t)},
+			expectedErr: true,
+		},
+	}
+	for _, test := range tests {
+		_, err := handshake(reloader, &tls.Config{ServerName: "localhost", RootCAs: roots, Certificates: test.clientCerts})
+		if (err != nil) != test.expectedErr {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.expectedErr, err)
+		}
+	}
+}
+
+func TestCertReloaderReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	oldCert := newTestCert(t, "old", ca)
+	newCert := newTestCert(t, "new", ca)
+
+	options := TLSOptions{
+		CertFile: filepath.Join(dir, "tls.crt"),
+		KeyFile:  filepath.Join(dir, "tls.key"),
+	}
+	modTime := time.Now().Add(-time.Minute)
+	writeFile(t, options.CertFile, oldCert.certPEM, modTime)
+	writeFile(t, options.KeyFile, oldCert.keyPEM, modTime)
+
+	reloader, err := newCertReloader(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	reloader.now = func() time.Time { return now }
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientConfig := &tls.Config{ServerName: "localhost", RootCAs: roots}
+
+	tests := []struct {
+		testName     string
+		update       func()
+		advance      time.Duration
+		expectedName string
+	}{
+		{
+			testName:     "Initial certificate",
+			update:       func() {},
+			expectedName: "old",
+		},
+		{
+			testName: "Certificate not matching the key keeps previous certificate",
+			update: func() {
+				writeFile(t, options.CertFile, newCert.certPEM, modTime.Add(time.Second))
+			},
+			advance:      certCheckInterval,
+			expectedName: "old",
+		},
+		{
+			testName: "Rotation is not checked before the check interval",
+			update: func() {
+				writeFile(t, options.KeyFile, newCert.keyPEM, modTime.Add(2*time.Second))
+			},
+			advance:      certCheckInterval - time.Second,
+			expectedName: "old",
+		},
+		{
+			testName:     "Rotated certificate and key",
+			update:       func() {},
+			advance:      time.Second,
+			expectedName: "new",
+		},
+	}
+	for _, test := range tests {
+		test.update()
+		now = now.Add(test.advance)
+		cert, err := handshake(reloader, clientConfig)
+		if err != nil {
+			t.Errorf("\nTestCase: %s\nUnexpected Error: %v", test.testName, err)
+			continue
+		}
+		if cert.Subject.CommonName != test.expectedName {
+			t.Errorf("\nTestCase: %s\nExpected Certificate: %s\nActual Certificate: %s", test.testName, test.expectedName, cert.Subject.CommonName)
+		}
+	}
+}
+
+func TestGRPCClientOverTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	serverCert := newTestCert(t, "server", ca)
+	options := ServerOptions{
+		TLS: TLSOptions{
+			CertFile: filepath.Join(dir, "tls.crt"),
+			KeyFile:  filepath.Join(dir, "tls.key"),
+		},
+	}
+	modTime := time.Now().Add(-time.Minute)
+	writeFile(t, options.TLS.CertFile, serverCert.certPEM, modTime)
+	writeFile(t, options.TLS.KeyFile, serverCert.keyPEM, modTime)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	s, err := StartServers("tcp://"+address, &spec.UnimplementedIdentityServer{}, &spec.UnimplementedProvisionerServer{}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		s.Stop()
+		s.Wait()
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientConfig := &tls.Config{ServerName: "localhost", RootCAs: roots}
+
+	conn, err := tls.Dial("tcp", address, &tls.Config{ServerName: "localhost", RootCAs: roots, NextProtos: []string{"h2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if protocol := conn.ConnectionState().NegotiatedProtocol; protocol != "h2" {
+		t.Errorf("Expected ALPN Protocol: h2\nActual ALPN Protocol: %q", protocol)
+	}
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := grpc.DialContext(ctx, address, grpc.WithTransportCredentials(credentials.NewTLS(clientConfig)), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_, err = spec.NewIdentityClient(client).DriverGetInfo(ctx, &spec.DriverGetInfoRequest{})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("Expected Code: %v\nActual Error: %v", codes.Unimplemented, err)
+	}
+}
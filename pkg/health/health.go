@@ -0,0 +1,148 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// successInterval is how long to wait after a successful probe before probing again
+	successInterval = 30 * time.Second
+	// initialBackoff is how long to wait after a failed probe, doubled on every consecutive failure up to maxBackoff
+	initialBackoff = time.Second
+	maxBackoff     = 5 * time.Minute
+	// probeTimeout bounds a single probe
+	probeTimeout = 10 * time.Second
+	// pollInterval is how often the gRPC health status is refreshed
+	pollInterval = 10 * time.Second
+)
+
+// errNotProbed is reported until the first probe completes
+var errNotProbed = errors.New("readiness has not been probed yet")
+
+// Prober reports whether the driver can serve requests
+type Prober interface {
+	Probe(ctx context.Context) error
+}
+
+// Checker probes a Prober in the background and serves the result of the last probe, so that
+// readiness checks neither wait on Azure nor translate into a request to Azure each.
+// It backs off while probes fail.
+type Checker struct {
+	prober Prober
+
+	lock    sync.Mutex
+	checked bool
+	lastErr error
+	backoff time.Duration
+}
+
+// NewChecker returns a Checker probing prober once Run is called
+func NewChecker(prober Prober) *Checker {
+	return &Checker{
+		prober: prober,
+	}
+}
+
+// Check returns the result of the last probe
+func (c *Checker) Check() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.checked {
+		return errNotProbed
+	}
+	return c.lastErr
+}
+
+// Run probes until stop is closed
+func (c *Checker) Run(stop <-chan struct{}) {
+	for {
+		timer := time.NewTimer(c.probe())
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// probe probes once, records the result and returns how long to wait before probing again.
+// The lock is not held while probing, so that Check never waits on Azure.
+func (c *Checker) probe() time.Duration {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	err := c.prober.Probe(ctx)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.checked = true
+	c.lastErr = err
+	if err == nil {
+		c.backoff = 0
+		return successInterval
+	}
+
+	if c.backoff == 0 {
+		c.backoff = initialBackoff
+	} else if c.backoff *= 2; c.backoff > maxBackoff {
+		c.backoff = maxBackoff
+	}
+	klog.Warningf("Readiness probe failed, retrying in %v: %v", c.backoff, err)
+	return c.backoff
+}
+
+// NewServer returns a grpc.health.v1 server reporting services as not serving until the first successful check
+func NewServer(services ...string) *grpchealth.Server {
+	server := grpchealth.NewServer()
+	for _, service := range append([]string{""}, services...) {
+		server.SetServingStatus(service, healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+	return server
+}
+
+// UpdateServer keeps the serving status of services on server in sync with the checker until stop is closed
+func (c *Checker) UpdateServer(stop <-chan struct{}, server *grpchealth.Server, services ...string) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		c.setServingStatus(server, services)
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Checker) setServingStatus(server *grpchealth.Server, services []string) {
+	status := healthpb.HealthCheckResponse_SERVING
+	if err := c.Check(); err != nil {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	for _, service := range append([]string{""}, services...) {
+		server.SetServingStatus(service, status)
+	}
+}
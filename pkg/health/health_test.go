@@ -0,0 +1,209 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+type fakeProber struct {
+	calls int
+	err   error
+	// block, when set, is waited on by every probe
+	block chan struct{}
+}
+
+func (f *fakeProber) Probe(ctx context.Context) error {
+	if f.block != nil {
+		<-f.block
+	}
+	f.calls++
+	return f.err
+}
+
+func TestCheckerProbe(t *testing.T) {
+	prober := &fakeProber{}
+	checker := NewChecker(prober)
+
+	if err := checker.Check(); err != errNotProbed {
+		t.Errorf("Expected Error before the first probe: %v\nActual Error: %v", errNotProbed, err)
+	}
+
+	tests := []struct {
+		testName     string
+		probeErr     error
+		expectedWait time.Duration
+	}{
+		{
+			testName:     "Success probes again after the success interval",
+			expectedWait: successInterval,
+		},
+		{
+			testName:     "Failure probes again after the initial backoff",
+			probeErr:     fmt.Errorf("failed"),
+			expectedWait: initialBackoff,
+		},
+		{
+			testName:     "Consecutive failure doubles the backoff",
+			probeErr:     fmt.Errorf("failed"),
+			expectedWait: 2 * initialBackoff,
+		},
+		{
+			testName:     "Recovery resets the backoff",
+			expectedWait: successInterval,
+		},
+		{
+			testName:     "Failure after recovery starts from the initial backoff",
+			probeErr:     fmt.Errorf("failed"),
+			expectedWait: initialBackoff,
+		},
+	}
+	for _, test := range tests {
+		prober.err = test.probeErr
+		if wait := checker.probe(); wait != test.expectedWait {
+			t.Errorf("\nTestCase: %s\nExpected Wait: %v\nActual Wait: %v", test.testName, test.expectedWait, wait)
+		}
+		calls := prober.calls
+		if err := checker.Check(); err != test.probeErr {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.probeErr, err)
+		}
+		if prober.calls != calls {
+			t.Errorf("\nTestCase: %s\nCheck probed", test.testName)
+		}
+	}
+}
+
+func TestCheckerMaxBackoff(t *testing.T) {
+	checker := NewChecker(&fakeProber{err: fmt.Errorf("failed")})
+	for i := 0; i < 20; i++ {
+		checker.probe()
+	}
+	if checker.backoff != maxBackoff {
+		t.Errorf("Expected Backoff: %v\nActual Backoff: %v", maxBackoff, checker.backoff)
+	}
+}
+
+func TestCheckDoesNotWaitOnProbe(t *testing.T) {
+	prober := &fakeProber{block: make(chan struct{})}
+	checker := NewChecker(prober)
+	stop := make(chan struct{})
+	defer close(stop)
+	go checker.Run(stop)
+
+	done := make(chan error)
+	go func() { done <- checker.Check() }()
+	select {
+	case err := <-done:
+		if err != errNotProbed {
+			t.Errorf("Expected Error: %v\nActual Error: %v", errNotProbed, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Check waited on the running probe")
+	}
+	close(prober.block)
+}
+
+func TestHandler(t *testing.T) {
+	prober := &fakeProber{}
+	checker := NewChecker(prober)
+	server := httptest.NewServer(Handler(checker))
+	defer server.Close()
+
+	tests := []struct {
+		testName         string
+		path             string
+		probeErr         error
+		expectedStatus   int
+		expectedContains string
+		unexpected       string
+	}{
+		{
+			testName:         "Liveness",
+			path:             LivenessPath,
+			probeErr:         fmt.Errorf("failed"),
+			expectedStatus:   http.StatusOK,
+			expectedContains: "ok",
+		},
+		{
+			testName:         "Not ready",
+			path:             ReadinessPath,
+			probeErr:         fmt.Errorf("GET https://a.blob.core.windows.net/?sig=secret failed"),
+			expectedStatus:   http.StatusServiceUnavailable,
+			expectedContains: "not ready",
+			unexpected:       "secret",
+		},
+		{
+			testName:         "Ready",
+			path:             ReadinessPath,
+			expectedStatus:   http.StatusOK,
+			expectedContains: "ok",
+		},
+	}
+	for _, test := range tests {
+		prober.err = test.probeErr
+		checker.probe()
+
+		resp, err := http.Get(server.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.expectedStatus {
+			t.Errorf("\nTestCase: %s\nExpected Status: %d\nActual Status: %d", test.testName, test.expectedStatus, resp.StatusCode)
+		}
+		if !strings.Contains(string(body), test.expectedContains) {
+			t.Errorf("\nTestCase: %s\nExpected Body to contain: %s\nActual Body: %s", test.testName, test.expectedContains, body)
+		}
+		if test.unexpected != "" && strings.Contains(string(body), test.unexpected) {
+			t.Errorf("\nTestCase: %s\nBody contains %q: %s", test.testName, test.unexpected, body)
+		}
+	}
+}
+
+func TestSetServingStatus(t *testing.T) {
+	prober := &fakeProber{err: fmt.Errorf("failed")}
+	checker := NewChecker(prober)
+	server := NewServer("cosi.v1alpha1.Provisioner")
+
+	for _, test := range []struct {
+		probeErr       error
+		expectedStatus healthpb.HealthCheckResponse_ServingStatus
+	}{
+		{probeErr: fmt.Errorf("failed"), expectedStatus: healthpb.HealthCheckResponse_NOT_SERVING},
+		{probeErr: nil, expectedStatus: healthpb.HealthCheckResponse_SERVING},
+	} {
+		prober.err = test.probeErr
+		checker.probe()
+		checker.setServingStatus(server, []string{"cosi.v1alpha1.Provisioner"})
+		for _, service := range []string{"", "cosi.v1alpha1.Provisioner"} {
+			resp, err := server.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status != test.expectedStatus {
+				t.Errorf("\nService: %q\nExpected Status: %v\nActual Status: %v", service, test.expectedStatus, resp.Status)
+			}
+		}
+	}
+}
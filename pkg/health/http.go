@@ -0,0 +1,65 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"project/azure-cosi-driver/pkg/redact"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// LivenessPath reports whether the process is up
+	LivenessPath = "/healthz"
+	// ReadinessPath reports whether the driver can reach Azure with its configuration
+	ReadinessPath = "/readyz"
+)
+
+// Handler returns the HTTP handler serving the liveness and readiness endpoints
+func Handler(checker *Checker) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(LivenessPath, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+	mux.HandleFunc(ReadinessPath, func(w http.ResponseWriter, r *http.Request) {
+		if err := checker.Check(); err != nil {
+			http.Error(w, fmt.Sprintf("not ready: %s", redact.Error(err)), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})
+	return mux
+}
+
+// StartServer serves the liveness and readiness endpoints on address in the background.
+// An error is returned if the address cannot be listened on.
+func StartServer(address string, checker *Checker) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		klog.Infof("Serving health checks at %s", listener.Addr())
+		if err := http.Serve(listener, Handler(checker)); err != nil {
+			klog.Errorf("Error serving health checks: %v", err)
+		}
+	}()
+
+	return nil
+}
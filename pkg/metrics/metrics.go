@@ -0,0 +1,242 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/codes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	namespace = "azure_cosi"
+
+	// MetricsPath is the path the metrics handler is served on
+	MetricsPath = "/metrics"
+)
+
+var (
+	// registry holds the driver metrics. A dedicated registry keeps the
+	// exported metrics independent of anything else registered globally.
+	registry *prometheus.Registry
+
+	grpcRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "grpc_requests_total",
+			Help:      "Number of gRPC requests handled, by method and status code.",
+		},
+		[]string{"method", "code"},
+	)
+
+	grpcRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "grpc_request_duration_seconds",
+			Help:      "Latency of gRPC requests, by method.",
+			Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+		},
+		[]string{"method"},
+	)
+
+	azureRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "azure_requests_total",
+			Help:      "Number of requests sent to Azure, by operation.",
+		},
+		[]string{"operation"},
+	)
+
+	azureRequestErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "azure_request_errors_total",
+			Help:      "Number of requests to Azure that failed, by operation.",
+		},
+		[]string{"operation"},
+	)
+
+	azureRequestThrottles = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "azure_request_throttles_total",
+			Help:      "Number of requests to Azure that were throttled, by operation.",
+		},
+		[]string{"operation"},
+	)
+
+	// Buckets are counted as created and deleted rather than as a gauge of managed buckets, which would
+	// start from zero on every restart. rate() and increase() of these are meaningful across restarts.
+	bucketsCreated = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "buckets_created_total",
+			Help:      "Number of buckets created by the driver, by bucket unit type.",
+		},
+		[]string{"unit_type"},
+	)
+
+	bucketsDeleted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "buckets_deleted_total",
+			Help:      "Number of buckets deleted by the driver, by bucket unit type.",
+		},
+		[]string{"unit_type"},
+	)
+
+	cloudConfigReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cloud_config_reloads_total",
+			Help:      "Number of reloads of the Azure cloud config and credentials, by result.",
+		},
+		[]string{"result"},
+	)
+
+	accountKeyLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "account_key_cache_lookups_total",
+			Help:      "Number of storage account key lookups, by whether they were served from the cache (hit) or fetched from ARM (miss).",
+		},
+		[]string{"result"},
+	)
+
+	armRateLimit = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "arm_rate_limit",
+			Help:      "Client-side limit of ARM requests per second of subscriptions ARM has throttled, by subscription.",
+		},
+		[]string{"subscription"},
+	)
+
+	sasGrants = newSASGrantCollector()
+)
+
+func init() {
+	register(nil)
+}
+
+// register registers the driver metrics in a new registry, with labels added to every metric
+func register(labels prometheus.Labels) {
+	registry = prometheus.NewRegistry()
+	prometheus.WrapRegistererWith(labels, registry).MustRegister(
+		grpcRequests,
+		grpcRequestDuration,
+		azureRequests,
+		azureRequestErrors,
+		azureRequestThrottles,
+		bucketsCreated,
+		bucketsDeleted,
+		cloudConfigReloads,
+		accountKeyLookups,
+		armRateLimit,
+		sasGrants,
+	)
+}
+
+// SetDriverName labels every metric with the name of the driver instance, so that the metrics of
+// several instances can be told apart. It must be called before the metrics are served.
+func SetDriverName(name string) {
+	register(prometheus.Labels{"driver": name})
+}
+
+// Handler returns the HTTP handler exposing the driver metrics
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// StartServer serves the metrics on address in the background.
+// An error is returned if the address cannot be listened on.
+func StartServer(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, Handler())
+
+	go func() {
+		klog.Infof("Serving metrics at %s%s", listener.Addr(), MetricsPath)
+		if err := http.Serve(listener, mux); err != nil {
+			klog.Errorf("Error serving metrics: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// RecordGRPCRequest records a completed gRPC request
+func RecordGRPCRequest(method string, code codes.Code, duration time.Duration) {
+	grpcRequests.WithLabelValues(method, code.String()).Inc()
+	grpcRequestDuration.WithLabelValues(method).Observe(duration.Seconds())
+}
+
+// RecordAzureRequest records a request sent to Azure and whether it failed or was throttled
+func RecordAzureRequest(operation string, failed, throttled bool) {
+	azureRequests.WithLabelValues(operation).Inc()
+	if failed {
+		azureRequestErrors.WithLabelValues(operation).Inc()
+	}
+	if throttled {
+		azureRequestThrottles.WithLabelValues(operation).Inc()
+	}
+}
+
+// BucketCreated records the creation of a bucket of unitType
+func BucketCreated(unitType string) {
+	bucketsCreated.WithLabelValues(unitType).Inc()
+}
+
+// BucketDeleted records the deletion of a bucket of unitType
+func BucketDeleted(unitType string) {
+	bucketsDeleted.WithLabelValues(unitType).Inc()
+}
+
+// RecordCloudConfigReload records a reload of the Azure cloud config and whether it succeeded
+func RecordCloudConfigReload(succeeded bool) {
+	result := "success"
+	if !succeeded {
+		result = "failure"
+	}
+	cloudConfigReloads.WithLabelValues(result).Inc()
+}
+
+// RecordAccountKeyLookup records a storage account key lookup and whether it was served from the cache
+func RecordAccountKeyLookup(hit bool) {
+	result := "hit"
+	if !hit {
+		result = "miss"
+	}
+	accountKeyLookups.WithLabelValues(result).Inc()
+}
+
+// RecordARMRateLimit records the client-side limit of ARM requests per second of the subscription
+func RecordARMRateLimit(subscription string, requestsPerSecond float64) {
+	armRateLimit.WithLabelValues(subscription).Set(requestsPerSecond)
+}
+
+// RecordSASGrant records a SAS token handed out that stays valid until expiry
+func RecordSASGrant(expiry time.Time) {
+	sasGrants.add(expiry)
+}
@@ -0,0 +1,154 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+func scrape(t *testing.T) string {
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestHandler(t *testing.T) {
+	RecordGRPCRequest("/cosi.v1alpha1.Provisioner/DriverCreateBucket", codes.OK, 200*time.Millisecond)
+	RecordGRPCRequest("/cosi.v1alpha1.Provisioner/DriverCreateBucket", codes.InvalidArgument, time.Millisecond)
+	RecordAzureRequest("create_container", false, false)
+	RecordAzureRequest("ensure_storage_account", true, true)
+	BucketCreated("container")
+	BucketCreated("container")
+	BucketDeleted("container")
+	BucketCreated("storageaccount")
+	RecordSASGrant(time.Now().Add(2 * time.Hour))
+	RecordSASGrant(time.Now().Add(-time.Hour))
+	RecordCloudConfigReload(true)
+	RecordCloudConfigReload(false)
+	RecordAccountKeyLookup(true)
+	RecordAccountKeyLookup(true)
+	RecordAccountKeyLookup(false)
+	RecordARMRateLimit("subscription", 2.5)
+
+	body := scrape(t)
+	tests := []string{
+		`azure_cosi_grpc_requests_total{code="OK",method="/cosi.v1alpha1.Provisioner/DriverCreateBucket"} 1`,
+		`azure_cosi_grpc_requests_total{code="InvalidArgument",method="/cosi.v1alpha1.Provisioner/DriverCreateBucket"} 1`,
+		`azure_cosi_grpc_request_duration_seconds_count{method="/cosi.v1alpha1.Provisioner/DriverCreateBucket"} 2`,
+		`azure_cosi_grpc_request_duration_seconds_bucket{method="/cosi.v1alpha1.Provisioner/DriverCreateBucket",le="0.25"} 2`,
+		`azure_cosi_azure_requests_total{operation="create_container"} 1`,
+		`azure_cosi_azure_requests_total{operation="ensure_storage_account"} 1`,
+		`azure_cosi_azure_request_errors_total{operation="ensure_storage_account"} 1`,
+		`azure_cosi_azure_request_throttles_total{operation="ensure_storage_account"} 1`,
+		`azure_cosi_buckets_created_total{unit_type="container"} 2`,
+		`azure_cosi_buckets_created_total{unit_type="storageaccount"} 1`,
+		`azure_cosi_buckets_deleted_total{unit_type="container"} 1`,
+		`azure_cosi_cloud_config_reloads_total{result="success"} 1`,
+		`azure_cosi_cloud_config_reloads_total{result="failure"} 1`,
+		`azure_cosi_account_key_cache_lookups_total{result="hit"} 2`,
+		`azure_cosi_account_key_cache_lookups_total{result="miss"} 1`,
+		`azure_cosi_arm_rate_limit{subscription="subscription"} 2.5`,
+		`azure_cosi_sas_grants_outstanding{expires_within="1h"} 0`,
+		`azure_cosi_sas_grants_outstanding{expires_within="24h"} 1`,
+	}
+	for _, expected := range tests {
+		if !strings.Contains(body, expected) {
+			t.Errorf("\nExpected metric: %s\nScraped metrics:\n%s", expected, body)
+		}
+	}
+	if strings.Contains(body, `azure_cosi_azure_request_errors_total{operation="create_container"}`) {
+		t.Errorf("unexpected error count for a successful request")
+	}
+}
+
+func TestSetDriverName(t *testing.T) {
+	SetDriverName("tenant-a.blob.cosi.azure.com")
+	defer register(nil)
+
+	RecordGRPCRequest("/cosi.v1alpha1.Provisioner/DriverDeleteBucket", codes.OK, time.Millisecond)
+	RecordSASGrant(time.Now().Add(time.Hour))
+
+	body := scrape(t)
+	tests := []string{
+		`azure_cosi_grpc_requests_total{code="OK",driver="tenant-a.blob.cosi.azure.com",method="/cosi.v1alpha1.Provisioner/DriverDeleteBucket"} 1`,
+		`azure_cosi_sas_grants_outstanding{driver="tenant-a.blob.cosi.azure.com",expires_within="1h"}`,
+	}
+	for _, expected := range tests {
+		if !strings.Contains(body, expected) {
+			t.Errorf("\nExpected Metric: %s\nActual Metrics: %s", expected, body)
+		}
+	}
+}
+
+func TestSASGrantCollector(t *testing.T) {
+	now := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+	collector := newSASGrantCollector()
+	collector.now = func() time.Time { return now }
+
+	for _, expiry := range []time.Duration{-time.Minute, 30 * time.Minute, time.Hour, 12 * time.Hour, 3 * 24 * time.Hour, 365 * 24 * time.Hour} {
+		collector.add(now.Add(expiry))
+	}
+
+	expected := map[string]int{"1h": 2, "24h": 1, "7d": 1, "30d": 0, "+Inf": 1}
+	if counts := collector.count(); !reflect.DeepEqual(counts, expected) {
+		t.Errorf("\nExpected Counts: %v\nActual Counts: %v", expected, counts)
+	}
+	if len(collector.expiries) != 5 {
+		t.Errorf("expected the expired grant to be pruned, %d grants left", len(collector.expiries))
+	}
+
+	now = now.Add(2 * time.Hour)
+	expected = map[string]int{"1h": 0, "24h": 1, "7d": 1, "30d": 0, "+Inf": 1}
+	if counts := collector.count(); !reflect.DeepEqual(counts, expected) {
+		t.Errorf("\nExpected Counts: %v\nActual Counts: %v", expected, counts)
+	}
+}
+
+func TestSASGrantCollectorPrunesOnAdd(t *testing.T) {
+	now := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+	collector := newSASGrantCollector()
+	collector.now = func() time.Time { return now }
+
+	for i := 0; i < 100; i++ {
+		collector.add(now.Add(time.Minute))
+		now = now.Add(2 * time.Minute)
+	}
+	if len(collector.expiries) != 1 {
+		t.Errorf("expected expired grants to be pruned without a scrape, %d grants left", len(collector.expiries))
+	}
+}
+
+func TestStartServer(t *testing.T) {
+	if err := StartServer("invalid-address"); err == nil {
+		t.Errorf("expected an error for an invalid address")
+	}
+}
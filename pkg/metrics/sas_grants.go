@@ -0,0 +1,115 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sasExpiryBuckets are the upper bounds of the remaining lifetime buckets SAS grants are counted in.
+// Grants outliving the last bucket are counted under "+Inf".
+var sasExpiryBuckets = []struct {
+	label string
+	upTo  time.Duration
+}{
+	{"1h", time.Hour},
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+}
+
+const sasExpiryInfLabel = "+Inf"
+
+// sasGrantCollector reports the SAS grants that have not expired yet, by remaining lifetime.
+// Expired grants are dropped when the collector is scraped and when a grant is added, so that the
+// recorded grants stay bounded by the outstanding ones even if nothing scrapes the metrics.
+type sasGrantCollector struct {
+	lock     sync.Mutex
+	expiries []time.Time
+	now      func() time.Time
+	desc     *prometheus.Desc
+}
+
+func newSASGrantCollector() *sasGrantCollector {
+	return &sasGrantCollector{
+		now: time.Now,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "sas_grants_outstanding"),
+			"Number of SAS grants that have not expired yet, by remaining lifetime.",
+			[]string{"expires_within"},
+			nil,
+		),
+	}
+}
+
+func (c *sasGrantCollector) add(expiry time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.prune(c.now())
+	c.expiries = append(c.expiries, expiry)
+}
+
+// prune drops the grants expired at now. The caller must hold the lock.
+func (c *sasGrantCollector) prune(now time.Time) {
+	outstanding := c.expiries[:0]
+	for _, expiry := range c.expiries {
+		if expiry.After(now) {
+			outstanding = append(outstanding, expiry)
+		}
+	}
+	c.expiries = outstanding
+}
+
+// Describe implements prometheus.Collector
+func (c *sasGrantCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector
+func (c *sasGrantCollector) Collect(ch chan<- prometheus.Metric) {
+	for label, count := range c.count() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count), label)
+	}
+}
+
+// count prunes the expired grants and returns the outstanding ones by bucket label
+func (c *sasGrantCollector) count() map[string]int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.now()
+	counts := make(map[string]int, len(sasExpiryBuckets)+1)
+	for _, b := range sasExpiryBuckets {
+		counts[b.label] = 0
+	}
+	counts[sasExpiryInfLabel] = 0
+
+	c.prune(now)
+	for _, expiry := range c.expiries {
+		counts[sasExpiryLabel(expiry.Sub(now))]++
+	}
+	return counts
+}
+
+func sasExpiryLabel(remaining time.Duration) string {
+	for _, b := range sasExpiryBuckets {
+		if remaining <= b.upTo {
+			return b.label
+		}
+	}
+	return sasExpiryInfLabel
+}
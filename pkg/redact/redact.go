@@ -0,0 +1,87 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redact
+
+import (
+	"regexp"
+
+	"google.golang.org/protobuf/proto"
+	spec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+// Mask replaces redacted values
+const Mask = "REDACTED"
+
+var (
+	// secretQueryRE matches SAS signatures and account keys embedded in URLs and connection strings
+	secretQueryRE = regexp.MustCompile(`(?i)\b(sig|accountkey|sharedaccesssignature)=([^&;\s"']+)`)
+
+	// sensitiveKeyRE matches the names of the parameters and credential fields that hold secrets.
+	// Names are matched whole, so that fields such as signingkey or sftpsshpublickey are kept.
+	sensitiveKeyRE = regexp.MustCompile(`(?i)^(accountkey|storageaccountkey|clientsecret|aadclientsecret|aadclientcertpassword|password|token|accesstoken|sastoken|sas|sig|signature|connectionstring)$`)
+)
+
+// String masks the SAS signatures and account keys found in s
+func String(s string) string {
+	return secretQueryRE.ReplaceAllString(s, "${1}="+Mask)
+}
+
+// Error returns the message of err with secrets masked
+func Error(err error) string {
+	if err == nil {
+		return ""
+	}
+	return String(err.Error())
+}
+
+// Parameters returns a copy of parameters with the values of secret-bearing keys masked.
+func Parameters(parameters map[string]string) map[string]string {
+	if parameters == nil {
+		return nil
+	}
+	redacted := make(map[string]string, len(parameters))
+	for k, v := range parameters {
+		if sensitiveKeyRE.MatchString(k) {
+			redacted[k] = Mask
+		} else {
+			redacted[k] = String(v)
+		}
+	}
+	return redacted
+}
+
+// Message returns a copy of a COSI request or response that is safe to log.
+// Credentials are masked entirely, parameters are masked with Parameters and
+// any other message is returned as is.
+func Message(msg interface{}) interface{} {
+	switch m := msg.(type) {
+	case *spec.DriverCreateBucketRequest:
+		redacted := proto.Clone(m).(*spec.DriverCreateBucketRequest)
+		redacted.Parameters = Parameters(m.GetParameters())
+		return redacted
+	case *spec.DriverGrantBucketAccessRequest:
+		redacted := proto.Clone(m).(*spec.DriverGrantBucketAccessRequest)
+		redacted.Parameters = Parameters(m.GetParameters())
+		return redacted
+	case *spec.DriverGrantBucketAccessResponse:
+		redacted := proto.Clone(m).(*spec.DriverGrantBucketAccessResponse)
+		for _, credential := range redacted.GetCredentials() {
+			for k := range credential.GetSecrets() {
+				credential.Secrets[k] = Mask
+			}
+		}
+		return redacted
+	}
+	return msg
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redact
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	spec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+const (
+	testSignature = "c2VjcmV0c2lnbmF0dXJl%3D"
+	testSASURL    = "https://account.blob.core.windows.net/container?se=2022-09-08&sp=rl&sv=2021-08-06&sr=c&sig=" + testSignature
+)
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		testName string
+		value    string
+		expected string
+	}{
+		{
+			testName: "No secrets",
+			value:    "https://account.blob.core.windows.net/container",
+			expected: "https://account.blob.core.windows.net/container",
+		},
+		{
+			testName: "SAS URL",
+			value:    testSASURL,
+			expected: "https://account.blob.core.windows.net/container?se=2022-09-08&sp=rl&sv=2021-08-06&sr=c&sig=REDACTED",
+		},
+		{
+			testName: "Connection string",
+			value:    "DefaultEndpointsProtocol=https;AccountName=account;AccountKey=a2V5;EndpointSuffix=core.windows.net",
+			expected: "DefaultEndpointsProtocol=https;AccountName=account;AccountKey=REDACTED;EndpointSuffix=core.windows.net",
+		},
+		{
+			testName: "Upper case signature in text",
+			value:    "request failed: GET https://a.blob.core.windows.net/?SIG=abc def",
+			expected: "request failed: GET https://a.blob.core.windows.net/?SIG=REDACTED def",
+		},
+	}
+	for _, test := range tests {
+		if actual := String(test.value); actual != test.expected {
+			t.Errorf("\nTestCase: %s\nExpected: %s\nActual: %s", test.testName, test.expected, actual)
+		}
+	}
+}
+
+func TestError(t *testing.T) {
+	if actual := Error(nil); actual != "" {
+		t.Errorf("Expected empty string for nil error, got %q", actual)
+	}
+	if actual := Error(fmt.Errorf("failed %s", testSASURL)); actual != "failed "+String(testSASURL) {
+		t.Errorf("Unexpected redacted error %q", actual)
+	}
+}
+
+func TestParameters(t *testing.T) {
+	tests := []struct {
+		testName   string
+		parameters map[string]string
+		expected   map[string]string
+	}{
+		{
+			testName:   "Nil parameters",
+			parameters: nil,
+			expected:   nil,
+		},
+		{
+			testName: "Mixed parameters",
+			parameters: map[string]string{
+				"bucketunittype":       "container",
+				"allowsharedaccesskey": "true",
+				"accountKey":           "a2V5",
+				"clientSecret":         "secret",
+				"endpoint":             testSASURL,
+			},
+			expected: map[string]string{
+				"bucketunittype":       "container",
+				"allowsharedaccesskey": "true",
+				"accountKey":           Mask,
+				"clientSecret":         Mask,
+				"endpoint":             String(testSASURL),
+			},
+		},
+		{
+			testName: "Names containing secret words",
+			parameters: map[string]string{
+				"signingkey":       "key2",
+				"sftpsshpublickey": "ssh-rsa AAAA",
+				"keyvaultname":     "vault",
+				"tokenaudience":    "api://cosi",
+				"credentialmode":   "sas",
+			},
+			expected: map[string]string{
+				"signingkey":       "key2",
+				"sftpsshpublickey": "ssh-rsa AAAA",
+				"keyvaultname":     "vault",
+				"tokenaudience":    "api://cosi",
+				"credentialmode":   "sas",
+			},
+		},
+	}
+	for _, test := range tests {
+		if actual := Parameters(test.parameters); !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("\nTestCase: %s\nExpected: %v\nActual: %v", test.testName, test.expected, actual)
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	resp := &spec.DriverGrantBucketAccessResponse{
+		AccountId: "account",
+		Credentials: map[string]*spec.CredentialDetails{
+			"azure": {Secrets: map[string]string{"accessToken": testSASURL}},
+		},
+	}
+	redactedResp := Message(resp).(*spec.DriverGrantBucketAccessResponse)
+	if redactedResp.Credentials["azure"].Secrets["accessToken"] != Mask {
+		t.Errorf("credential was not masked: %v", redactedResp)
+	}
+	if redactedResp.AccountId != "account" {
+		t.Errorf("account ID was changed: %v", redactedResp)
+	}
+	if resp.Credentials["azure"].Secrets["accessToken"] != testSASURL {
+		t.Errorf("original response was modified: %v", resp)
+	}
+
+	req := &spec.DriverGrantBucketAccessRequest{
+		BucketId:   "bucket",
+		Parameters: map[string]string{"token": "abc", "enableread": "true"},
+	}
+	redactedReq := Message(req).(*spec.DriverGrantBucketAccessRequest)
+	if !reflect.DeepEqual(redactedReq.Parameters, map[string]string{"token": Mask, "enableread": "true"}) {
+		t.Errorf("unexpected redacted parameters: %v", redactedReq.Parameters)
+	}
+	if req.Parameters["token"] != "abc" {
+		t.Errorf("original request was modified: %v", req)
+	}
+
+	createReq := &spec.DriverCreateBucketRequest{Name: "bucket", Parameters: map[string]string{"password": "abc"}}
+	if Message(createReq).(*spec.DriverCreateBucketRequest).Parameters["password"] != Mask {
+		t.Errorf("create bucket parameters were not masked")
+	}
+
+	deleteReq := &spec.DriverDeleteBucketRequest{BucketId: "bucket"}
+	if Message(deleteReq) != deleteReq {
+		t.Errorf("messages without secrets should be returned as is")
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provisionerserver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"project/azure-cosi-driver/pkg/metrics"
+	"project/azure-cosi-driver/pkg/redact"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	clientSet "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+const (
+	reasonCloudConfigReloaded     = "CloudConfigReloaded"
+	reasonCloudConfigReloadFailed = "CloudConfigReloadFailed"
+
+	// DefaultCloudConfigReloadInterval is how often the credential file is checked for changes and failed reloads are retried
+	DefaultCloudConfigReloadInterval = time.Minute
+	// cloudConfigCheckTimeout bounds checking that Azure can be reached with a reloaded cloud
+	cloudConfigCheckTimeout = 30 * time.Second
+)
+
+// cloudReloader reloads the Azure cloud config when the cloud config secret or the credential file changes.
+// A reloaded cloud is only swapped in once Azure can be reached with it, so that a rotated credential that is
+// not valid yet does not replace one that still works. Failed reloads are retried every interval.
+type cloudReloader struct {
+	// load reads the cloud config
+	load func() (*azure.Cloud, error)
+	// check verifies that Azure can be reached with a loaded cloud
+	check func(ctx context.Context, cloud *azure.Cloud) error
+	// apply swaps in a loaded cloud
+	apply func(cloud *azure.Cloud)
+
+	recorder        record.EventRecorder
+	secretName      string
+	secretNamespace string
+	credFile        string
+	interval        time.Duration
+
+	// lock protects the fields below. It is not held while a cloud is loaded and checked.
+	lock sync.Mutex
+	// secretVersion is the resource version of the secret the current cloud was loaded from
+	secretVersion string
+	// fileVersion identifies the content of the credential file the current cloud was loaded from
+	fileVersion string
+	// pending is set while a change has not been applied, so that the reload is retried
+	pending bool
+	// reason describes the last change, for the logs and events of its reload and retries
+	reason string
+	// generation counts the changes, so that a reload only clears pending if no change came in meanwhile
+	generation int
+	// reloading is set while a reload is in progress, so that reloads do not run concurrently
+	reloading bool
+}
+
+// getFileVersion returns the modification time and size of the file, or "" if it cannot be read
+func getFileVersion(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size())
+}
+
+// start records the current versions of the secret and the credential file, then reloads the cloud
+// whenever they change until stop is closed
+func (r *cloudReloader) start(kubeClient clientSet.Interface, stop <-chan struct{}) {
+	r.fileVersion = getFileVersion(r.credFile)
+	if kubeClient == nil {
+		go r.poll(stop)
+		return
+	}
+
+	secret, err := kubeClient.CoreV1().Secrets(r.secretNamespace).Get(context.Background(), r.secretName, metav1.GetOptions{})
+	if err == nil {
+		r.secretVersion = secret.ResourceVersion
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(kubeClient, 0,
+		informers.WithNamespace(r.secretNamespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", r.secretName).String()
+		}))
+	informer := factory.Core().V1().Secrets().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { r.secretChanged(obj) },
+		UpdateFunc: func(_, obj interface{}) { r.secretChanged(obj) },
+		DeleteFunc: func(interface{}) { r.secretChanged(nil) },
+	})
+	factory.Start(stop)
+	go r.poll(stop)
+}
+
+// secretChanged reloads the cloud if the secret differs from the one the current cloud was loaded from
+func (r *cloudReloader) secretChanged(obj interface{}) {
+	version := ""
+	if secret, ok := obj.(*v1.Secret); ok {
+		if secret.Name != r.secretName {
+			return
+		}
+		version = secret.ResourceVersion
+	}
+
+	r.lock.Lock()
+	changed := version != r.secretVersion
+	if changed {
+		r.secretVersion = version
+		r.changed(fmt.Sprintf("secret %s/%s changed", r.secretNamespace, r.secretName))
+	}
+	r.lock.Unlock()
+	if changed {
+		// Loading and checking the cloud must not hold up the informer
+		go r.reload()
+	}
+}
+
+// changed records a change to reload the cloud for. Must be called with the lock held.
+func (r *cloudReloader) changed(reason string) {
+	r.pending = true
+	r.reason = reason
+	r.generation++
+}
+
+// poll reloads the cloud when the credential file changes, and retries failed reloads
+func (r *cloudReloader) poll(stop <-chan struct{}) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			r.checkFile()
+		}
+	}
+}
+
+func (r *cloudReloader) checkFile() {
+	version := getFileVersion(r.credFile)
+
+	r.lock.Lock()
+	if version != r.fileVersion {
+		r.fileVersion = version
+		r.changed(fmt.Sprintf("credential file %s changed", r.credFile))
+	}
+	r.lock.Unlock()
+	r.reload()
+}
+
+// reload loads the cloud config and swaps it in if Azure can be reached with it, until no change is pending.
+// The current cloud is kept on failure, and the reload retried on the next poll.
+func (r *cloudReloader) reload() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.pending || r.reloading {
+		return
+	}
+	r.reloading = true
+	defer func() { r.reloading = false }()
+
+	for r.pending {
+		generation, reason := r.generation, r.reason
+		r.lock.Unlock()
+		err := r.loadAndApply(reason)
+		r.lock.Lock()
+		if err != nil {
+			return
+		}
+		// A change that came in while loading is reloaded again
+		if r.generation == generation {
+			r.pending = false
+		}
+	}
+}
+
+// loadAndApply loads the cloud config and swaps it in if Azure can be reached with it
+func (r *cloudReloader) loadAndApply(reason string) error {
+	klog.Infof("Reloading cloud config: %s", reason)
+	err := func() error {
+		cloud, err := r.load()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), cloudConfigCheckTimeout)
+		defer cancel()
+		if err := r.check(ctx, cloud); err != nil {
+			return err
+		}
+		r.apply(cloud)
+		return nil
+	}()
+	metrics.RecordCloudConfigReload(err == nil)
+	if err != nil {
+		klog.Errorf("Error reloading cloud config, keeping the current one: %s", redact.Error(err))
+		r.recordEvent(v1.EventTypeWarning, reasonCloudConfigReloadFailed, fmt.Sprintf("Failed to reload cloud config after %s, retrying in %v: %s", reason, r.interval, redact.Error(err)))
+		return err
+	}
+
+	klog.Info("Reloaded cloud config")
+	r.recordEvent(v1.EventTypeNormal, reasonCloudConfigReloaded, fmt.Sprintf("Reloaded cloud config: %s", reason))
+	return nil
+}
+
+// recordEvent records an event on the cloud config secret
+func (r *cloudReloader) recordEvent(eventType, reason, message string) {
+	if r.recorder == nil {
+		return
+	}
+	ref := &v1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Namespace:  r.secretNamespace,
+		Name:       r.secretName,
+	}
+	r.recorder.Event(ref, eventType, reason, message)
+}
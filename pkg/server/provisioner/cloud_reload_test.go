@@ -0,0 +1,257 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provisionerserver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+// newTestReloader returns a reloader loading clouds named after the number of loads, which fail while failLoad or failCheck is set
+func newTestReloader(pr *provisioner, recorder record.EventRecorder) (*cloudReloader, *bool, *bool) {
+	var failLoad, failCheck bool
+	loads := 0
+	reloader := &cloudReloader{
+		load: func() (*azure.Cloud, error) {
+			if failLoad {
+				return nil, fmt.Errorf("invalid cloud config")
+			}
+			loads++
+			cloud := &azure.Cloud{}
+			cloud.ResourceGroup = fmt.Sprintf("rg%d", loads)
+			return cloud, nil
+		},
+		check: func(context.Context, *azure.Cloud) error {
+			if failCheck {
+				return fmt.Errorf("AADSTS7000215: Invalid client secret provided")
+			}
+			return nil
+		},
+		apply:           pr.setCloud,
+		recorder:        recorder,
+		secretName:      "azure-cloud-provider",
+		secretNamespace: "kube-system",
+		interval:        time.Hour,
+	}
+	return reloader, &failLoad, &failCheck
+}
+
+func TestCloudReloaderReload(t *testing.T) {
+	initial := &azure.Cloud{}
+	initial.ResourceGroup = "initial"
+	pr := &provisioner{cloud: initial}
+	recorder := record.NewFakeRecorder(10)
+	reloader, failLoad, failCheck := newTestReloader(pr, recorder)
+
+	tests := []struct {
+		testName              string
+		failLoad              bool
+		failCheck             bool
+		pending               bool
+		expectedResourceGroup string
+		expectedEvent         string
+		expectedPending       bool
+	}{
+		{
+			testName:              "Nothing changed",
+			expectedResourceGroup: "initial",
+		},
+		{
+			testName:              "Cloud config cannot be loaded",
+			failLoad:              true,
+			pending:               true,
+			expectedResourceGroup: "initial",
+			expectedEvent:         v1.EventTypeWarning + " " + reasonCloudConfigReloadFailed,
+			expectedPending:       true,
+		},
+		{
+			testName:              "Rotated credentials are not valid yet",
+			failCheck:             true,
+			expectedResourceGroup: "initial",
+			expectedEvent:         v1.EventTypeWarning + " " + reasonCloudConfigReloadFailed,
+			expectedPending:       true,
+		},
+		{
+			testName:              "Retry succeeds",
+			expectedResourceGroup: "rg2",
+			expectedEvent:         v1.EventTypeNormal + " " + reasonCloudConfigReloaded,
+		},
+	}
+	for _, test := range tests {
+		*failLoad, *failCheck = test.failLoad, test.failCheck
+		if test.pending {
+			reloader.pending = true
+		}
+		reloader.reload()
+
+		if rg := pr.getCloud().ResourceGroup; rg != test.expectedResourceGroup {
+			t.Errorf("\nTestCase: %s\nExpected Resource Group: %s\nActual Resource Group: %s", test.testName, test.expectedResourceGroup, rg)
+		}
+		if reloader.pending != test.expectedPending {
+			t.Errorf("\nTestCase: %s\nExpected Pending: %v\nActual Pending: %v", test.testName, test.expectedPending, reloader.pending)
+		}
+		event := ""
+		select {
+		case event = <-recorder.Events:
+		default:
+		}
+		if !strings.HasPrefix(event, test.expectedEvent) || (test.expectedEvent == "") != (event == "") {
+			t.Errorf("\nTestCase: %s\nExpected Event: %s\nActual Event: %s", test.testName, test.expectedEvent, event)
+		}
+	}
+}
+
+func TestCloudReloaderRetry(t *testing.T) {
+	pr := &provisioner{cloud: &azure.Cloud{}}
+	recorder := record.NewFakeRecorder(10)
+	reloader, _, failCheck := newTestReloader(pr, recorder)
+
+	// A failed reload after a secret change is retried by the next poll, which reports the secret change
+	reloader.lock.Lock()
+	reloader.changed("secret kube-system/azure-cloud-provider changed")
+	reloader.lock.Unlock()
+	*failCheck = true
+	reloader.reload()
+	*failCheck = false
+	reloader.checkFile()
+	<-recorder.Events
+	if event := <-recorder.Events; !strings.Contains(event, "secret kube-system/azure-cloud-provider changed") {
+		t.Errorf("expected the retry to report the secret change, got %q", event)
+	}
+
+	// A change coming in while the cloud is checked is reloaded again
+	check := reloader.check
+	reloader.check = func(ctx context.Context, cloud *azure.Cloud) error {
+		if cloud.ResourceGroup == "rg3" {
+			reloader.secretChanged(&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "azure-cloud-provider", ResourceVersion: "2"}})
+		}
+		return check(ctx, cloud)
+	}
+	reloader.lock.Lock()
+	reloader.changed("secret kube-system/azure-cloud-provider changed")
+	reloader.lock.Unlock()
+	reloader.reload()
+	if rg := pr.getCloud().ResourceGroup; rg != "rg4" {
+		t.Errorf("expected the change during the reload to be reloaded, got %s", rg)
+	}
+	if reloader.pending {
+		t.Errorf("expected no reload to be pending")
+	}
+}
+
+func TestCloudReloaderWatchesSecret(t *testing.T) {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "azure-cloud-provider", Namespace: "kube-system", ResourceVersion: "1"},
+		Data:       map[string][]byte{"cloud-config": []byte("{}")},
+	}
+	kubeClient := fake.NewSimpleClientset(secret)
+	pr := &provisioner{cloud: &azure.Cloud{}}
+	reloader, _, _ := newTestReloader(pr, nil)
+	reloaded := make(chan string, 10)
+	reloader.apply = func(cloud *azure.Cloud) {
+		pr.setCloud(cloud)
+		reloaded <- cloud.ResourceGroup
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	reloader.start(kubeClient, stop)
+
+	// The secret the driver started with is not reloaded
+	select {
+	case rg := <-reloaded:
+		t.Fatalf("unexpected reload to %s before the secret changed", rg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	secret = secret.DeepCopy()
+	secret.ResourceVersion = "2"
+	secret.Data["cloud-config"] = []byte(`{"aadClientSecret":"rotated"}`)
+	if _, err := kubeClient.CoreV1().Secrets("kube-system").Update(context.Background(), secret, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case rg := <-reloaded:
+		if rg != "rg1" {
+			t.Errorf("expected the first reload to be applied, got %s", rg)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the cloud was not reloaded when the secret changed")
+	}
+}
+
+func TestCloudReloaderWatchesCredentialFile(t *testing.T) {
+	credFile := filepath.Join(t.TempDir(), "azure.json")
+	if err := os.WriteFile(credFile, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pr := &provisioner{cloud: &azure.Cloud{}}
+	reloader, _, _ := newTestReloader(pr, nil)
+	reloader.credFile = credFile
+	stop := make(chan struct{})
+	defer close(stop)
+	reloader.start(nil, stop)
+
+	reloader.checkFile()
+	if rg := pr.getCloud().ResourceGroup; rg != "" {
+		t.Errorf("unexpected reload to %s before the credential file changed", rg)
+	}
+
+	if err := os.WriteFile(credFile, []byte(`{"aadClientSecret":"rotated"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reloader.checkFile()
+	if rg := pr.getCloud().ResourceGroup; rg != "rg1" {
+		t.Errorf("expected the cloud to be reloaded when the credential file changed, got %q", rg)
+	}
+}
+
+func TestCallsKeepTheirCloud(t *testing.T) {
+	old := &azure.Cloud{}
+	pr := &provisioner{cloud: old}
+
+	var wg sync.WaitGroup
+	started := make(chan struct{})
+	swapped := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		cloud := pr.getCloud()
+		close(started)
+		<-swapped
+		if cloud != old {
+			t.Errorf("expected the in-flight call to keep the cloud it started with")
+		}
+	}()
+
+	<-started
+	pr.setCloud(&azure.Cloud{})
+	close(swapped)
+	wg.Wait()
+	if pr.getCloud() == old {
+		t.Errorf("expected new calls to use the reloaded cloud")
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provisionerserver
+
+import (
+	"context"
+	"fmt"
+	"project/azure-cosi-driver/pkg/audit"
+	"project/azure-cosi-driver/pkg/redact"
+
+	v1 "k8s.io/api/core/v1"
+	clientSet "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+)
+
+const (
+	eventComponent = "azure-cosi-driver"
+
+	reasonBucketCreated          = "BucketCreated"
+	reasonBucketCreationFailed   = "BucketCreationFailed"
+	reasonBucketDeleted          = "BucketDeleted"
+	reasonBucketDeletionFailed   = "BucketDeletionFailed"
+	reasonAccessGranted          = "AccessGranted"
+	reasonAccessGrantFailed      = "AccessGrantFailed"
+	reasonAccessRevoked          = "AccessRevoked"
+	reasonAccessRevocationFailed = "AccessRevocationFailed"
+)
+
+// newEventRecorder returns a recorder publishing events through the kube client
+func newEventRecorder(kubeClient clientSet.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: eventComponent})
+}
+
+// recordCreateBucket audits a DriverCreateBucket call and records an event on the Bucket
+func (pr *provisioner) recordCreateBucket(ctx context.Context, bucketName, bucketClaim, bucketID string, err error) {
+	record := audit.Record{
+		Action:      audit.ActionCreateBucket,
+		Actor:       audit.Actor(ctx),
+		BucketClaim: bucketClaim,
+		Bucket:      bucketName,
+		BucketID:    bucketID,
+	}
+	if err != nil {
+		pr.auditFailure(record, err)
+		pr.recordBucketEvent(bucketName, v1.EventTypeWarning, reasonBucketCreationFailed, fmt.Sprintf("Failed to create bucket: %s", redact.Error(err)))
+		return
+	}
+	pr.auditSuccess(record)
+	pr.recordBucketEvent(bucketName, v1.EventTypeNormal, reasonBucketCreated, "Created bucket")
+}
+
+// recordDeleteBucket audits a DriverDeleteBucket call and records an event on the Bucket
+func (pr *provisioner) recordDeleteBucket(ctx context.Context, bucketID string, err error) {
+	bucketName := pr.getBucketName(bucketID)
+	record := audit.Record{
+		Action:   audit.ActionDeleteBucket,
+		Actor:    audit.Actor(ctx),
+		Bucket:   bucketName,
+		BucketID: bucketID,
+	}
+	if err != nil {
+		pr.auditFailure(record, err)
+		pr.recordBucketEvent(bucketName, v1.EventTypeWarning, reasonBucketDeletionFailed, fmt.Sprintf("Failed to delete bucket: %s", redact.Error(err)))
+		return
+	}
+	pr.auditSuccess(record)
+	pr.recordBucketEvent(bucketName, v1.EventTypeNormal, reasonBucketDeleted, "Deleted bucket")
+}
+
+// recordGrantBucketAccess audits a DriverGrantBucketAccess call and records an event on the BucketAccess.
+// Only the permissions and expiry of the SAS URL are recorded, never the URL itself.
+func (pr *provisioner) recordGrantBucketAccess(ctx context.Context, bucketID, accountName, sasURL string, err error) {
+	record := audit.Record{
+		Action:       audit.ActionGrantBucketAccess,
+		Actor:        audit.Actor(ctx),
+		Bucket:       pr.getBucketName(bucketID),
+		BucketID:     bucketID,
+		BucketAccess: accountName,
+	}
+	if err != nil {
+		pr.auditFailure(record, err)
+		pr.recordBucketAccessEvent(accountName, v1.EventTypeWarning, reasonAccessGrantFailed, fmt.Sprintf("Failed to grant access: %s", redact.Error(err)))
+		return
+	}
+
+	message := "Granted access"
+	if sasURL != "" {
+		record.Permissions, record.Expiry = audit.SASGrant(sasURL)
+		message = fmt.Sprintf("Granted access with permissions %q", record.Permissions)
+	}
+	pr.auditSuccess(record)
+	if record.Expiry != nil {
+		message = fmt.Sprintf("%s until %s", message, record.Expiry.UTC().Format("2006-01-02T15:04:05Z"))
+	}
+	pr.recordBucketAccessEvent(accountName, v1.EventTypeNormal, reasonAccessGranted, message)
+}
+
+// recordRevokeBucketAccess audits a DriverRevokeBucketAccess call and records an event on the BucketAccess
+func (pr *provisioner) recordRevokeBucketAccess(ctx context.Context, bucketID, accountName string, err error) {
+	record := audit.Record{
+		Action:       audit.ActionRevokeBucketAccess,
+		Actor:        audit.Actor(ctx),
+		Bucket:       pr.getBucketName(bucketID),
+		BucketID:     bucketID,
+		BucketAccess: accountName,
+	}
+	if err != nil {
+		pr.auditFailure(record, err)
+		pr.recordBucketAccessEvent(accountName, v1.EventTypeWarning, reasonAccessRevocationFailed, fmt.Sprintf("Failed to revoke access: %s", redact.Error(err)))
+		return
+	}
+	pr.auditSuccess(record)
+	pr.recordBucketAccessEvent(accountName, v1.EventTypeNormal, reasonAccessRevoked, "Revoked access, SAS URLs already issued stay valid until they expire")
+}
+
+func (pr *provisioner) auditSuccess(record audit.Record) {
+	record.Outcome = audit.OutcomeSuccess
+	pr.auditLog.Log(record)
+}
+
+func (pr *provisioner) auditFailure(record audit.Record, err error) {
+	record.Outcome = audit.OutcomeFailure
+	record.Error = err.Error()
+	pr.auditLog.Log(record)
+}
+
+// recordBucketEvent records an event on the Bucket object. Nothing is recorded if it is not in the object cache.
+func (pr *provisioner) recordBucketEvent(bucketName, eventType, reason, message string) {
+	if pr.recorder == nil || pr.objects == nil || bucketName == "" {
+		return
+	}
+	ref, err := pr.objects.BucketReference(bucketName)
+	if err != nil {
+		klog.V(4).Infof("Not recording event %s: %v", reason, err)
+		return
+	}
+	pr.recorder.Event(ref, eventType, reason, message)
+}
+
+// recordBucketAccessEvent records an event on the BucketAccess object. Nothing is recorded if it is not in the object cache.
+func (pr *provisioner) recordBucketAccessEvent(accountName, eventType, reason, message string) {
+	if pr.recorder == nil || pr.objects == nil || accountName == "" {
+		return
+	}
+	ref, err := pr.objects.BucketAccessReference(accountName)
+	if err != nil {
+		klog.V(4).Infof("Not recording event %s: %v", reason, err)
+		return
+	}
+	pr.recorder.Event(ref, eventType, reason, message)
+}
+
+// getBucketName returns the name of the bucket with bucketID, if it was created by this driver instance
+func (pr *provisioner) getBucketName(bucketID string) string {
+	pr.bucketsLock.RLock()
+	defer pr.bucketsLock.RUnlock()
+	return pr.bucketIDToNameMap[bucketID]
+}
@@ -0,0 +1,148 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provisionerserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"project/azure-cosi-driver/pkg/audit"
+	"project/azure-cosi-driver/pkg/azureutils"
+	"strings"
+	"sync"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	clientSet "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	spec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+func TestEventsAndAuditLog(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") == "true" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		switch r.URL.Path {
+		case "/apis/objectstorage.k8s.io/v1alpha1/buckets":
+			fmt.Fprint(w, `{"kind":"BucketList","apiVersion":"objectstorage.k8s.io/v1alpha1","metadata":{},"items":[{"kind":"Bucket","apiVersion":"objectstorage.k8s.io/v1alpha1","metadata":{"name":"bucket","uid":"bucket-uid"}}]}`)
+		case "/apis/objectstorage.k8s.io/v1alpha1/bucketaccesses":
+			fmt.Fprint(w, `{"kind":"BucketAccessList","apiVersion":"objectstorage.k8s.io/v1alpha1","metadata":{},"items":[{"kind":"BucketAccess","apiVersion":"objectstorage.k8s.io/v1alpha1","metadata":{"name":"access","namespace":"team-a","uid":"access-uid"}}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	kubeClient, err := clientSet.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := azureutils.NewCOSIObjectCache(kubeClient)
+	stop := make(chan struct{})
+	defer close(stop)
+	objects.Start(stop)
+	if !objects.WaitForSync(stop) {
+		t.Fatal("object cache did not sync")
+	}
+	recorder := record.NewFakeRecorder(10)
+	auditBuf := &bytes.Buffer{}
+	pr := &provisioner{
+		nameToBucketMap:   make(map[string]*bucketDetails),
+		bucketsLock:       sync.RWMutex{},
+		bucketIDToNameMap: map[string]string{"bucket-id": "bucket"},
+		kubeClient:        kubeClient,
+		recorder:          recorder,
+		objects:           objects,
+		auditLog:          audit.NewLogger(auditBuf),
+	}
+
+	tests := []struct {
+		testName       string
+		call           func() error
+		expectedEvent  string
+		expectedRecord audit.Record
+	}{
+		{
+			testName: "Failed bucket creation",
+			call: func() error {
+				_, err := pr.DriverCreateBucket(context.Background(), &spec.DriverCreateBucketRequest{Name: "bucket"})
+				return err
+			},
+			expectedEvent:  v1.EventTypeWarning + " " + reasonBucketCreationFailed,
+			expectedRecord: audit.Record{Action: audit.ActionCreateBucket, Outcome: audit.OutcomeFailure, Actor: "unknown", Bucket: "bucket"},
+		},
+		{
+			testName: "Failed grant",
+			call: func() error {
+				_, err := pr.DriverGrantBucketAccess(context.Background(), &spec.DriverGrantBucketAccessRequest{BucketId: "bucket-id", Name: "ba-access-uid"})
+				return err
+			},
+			expectedEvent:  v1.EventTypeWarning + " " + reasonAccessGrantFailed,
+			expectedRecord: audit.Record{Action: audit.ActionGrantBucketAccess, Outcome: audit.OutcomeFailure, Actor: "unknown", Bucket: "bucket", BucketID: "bucket-id", BucketAccess: "ba-access-uid"},
+		},
+		{
+			testName: "Revoke",
+			call: func() error {
+				_, err := pr.DriverRevokeBucketAccess(context.Background(), &spec.DriverRevokeBucketAccessRequest{BucketId: "bucket-id", AccountId: "ba-access-uid"})
+				return err
+			},
+			expectedEvent:  v1.EventTypeNormal + " " + reasonAccessRevoked,
+			expectedRecord: audit.Record{Action: audit.ActionRevokeBucketAccess, Outcome: audit.OutcomeSuccess, Actor: "unknown", Bucket: "bucket", BucketID: "bucket-id", BucketAccess: "ba-access-uid"},
+		},
+		{
+			testName: "Revoke for unknown bucket access",
+			call: func() error {
+				_, err := pr.DriverRevokeBucketAccess(context.Background(), &spec.DriverRevokeBucketAccessRequest{BucketId: "other-id", AccountId: "ba-missing"})
+				return err
+			},
+			expectedRecord: audit.Record{Action: audit.ActionRevokeBucketAccess, Outcome: audit.OutcomeSuccess, Actor: "unknown", BucketID: "other-id", BucketAccess: "ba-missing"},
+		},
+	}
+	for _, test := range tests {
+		auditBuf.Reset()
+		callErr := test.call()
+
+		select {
+		case event := <-recorder.Events:
+			if test.expectedEvent == "" || !strings.HasPrefix(event, test.expectedEvent) {
+				t.Errorf("\nTestCase: %s\nExpected Event: %s\nActual Event: %s", test.testName, test.expectedEvent, event)
+			}
+		default:
+			if test.expectedEvent != "" {
+				t.Errorf("\nTestCase: %s\nExpected Event: %s\nActual Event: none", test.testName, test.expectedEvent)
+			}
+		}
+
+		record := audit.Record{}
+		if err := json.Unmarshal(auditBuf.Bytes(), &record); err != nil {
+			t.Errorf("\nTestCase: %s\nCould not decode audit record %q: %v", test.testName, auditBuf.String(), err)
+			continue
+		}
+		if callErr != nil && record.Error != callErr.Error() {
+			t.Errorf("\nTestCase: %s\nExpected Audit Error: %s\nActual Audit Error: %s", test.testName, callErr.Error(), record.Error)
+		}
+		record.Time, record.Error = test.expectedRecord.Time, ""
+		if record != test.expectedRecord {
+			t.Errorf("\nTestCase: %s\nExpected Record: %+v\nActual Record: %+v", test.testName, test.expectedRecord, record)
+		}
+	}
+}
@@ -16,13 +16,20 @@ package provisionerserver
 import (
 	"context"
 	"fmt"
+	"project/azure-cosi-driver/pkg/audit"
 	"project/azure-cosi-driver/pkg/azureutils"
 	"project/azure-cosi-driver/pkg/constant"
+	"project/azure-cosi-driver/pkg/health"
+	"project/azure-cosi-driver/pkg/metrics"
+	"project/azure-cosi-driver/pkg/tracing"
 	"reflect"
 	"sync"
+	"time"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	clientSet "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog"
 	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
 	spec "sigs.k8s.io/container-object-storage-interface-spec"
@@ -40,14 +47,43 @@ type provisioner struct {
 	nameToBucketMap   map[string]*bucketDetails
 	bucketIDToNameMap map[string]string
 	cloud             *azure.Cloud
+	kubeClient        clientSet.Interface
+	clusterName       string
+	// cloudLock guards cloud, which is swapped when the cloud config is reloaded. Calls use the cloud they started with.
+	cloudLock sync.RWMutex
+	// recorder records events on the COSI objects, nil disables events
+	recorder record.EventRecorder
+	// objects caches the COSI objects events are recorded on, nil disables events
+	objects  *azureutils.COSIObjectCache
+	auditLog *audit.Logger
+	// journal records container bucket creations in progress, so interrupted ones can be rolled back
+	journal azureutils.Journal
+	// stop is closed by Stop to stop the background work of the provisioner
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
-var _ spec.ProvisionerServer = &provisioner{}
+// ProvisionerServer is a COSI provisioner which can report whether it is ready to serve requests
+type ProvisionerServer interface {
+	spec.ProvisionerServer
+	health.Prober
+	// Stop stops the background work of the provisioner
+	Stop()
+	// Stopped returns a channel closed once the provisioner is stopped
+	Stopped() <-chan struct{}
+}
+
+var _ ProvisionerServer = &provisioner{}
 
 func NewProvisionerServer(
 	kubeconfig,
 	cloudConfigSecretName,
-	cloudConfigSecretNamespace string) (spec.ProvisionerServer, error) {
+	cloudConfigSecretNamespace,
+	clusterName string,
+	auditLog *audit.Logger,
+	journalNamespace,
+	journalName string,
+	cloudConfigReloadInterval time.Duration) (ProvisionerServer, error) {
 	kubeClient, err := azureutils.GetKubeClient(kubeconfig)
 	if err != nil {
 		return nil, err
@@ -59,20 +95,90 @@ func NewProvisionerServer(
 		return nil, err
 	}
 
-	return &provisioner{
+	var journal azureutils.Journal
+	if journalName != "" {
+		journal = azureutils.NewConfigMapJournal(kubeClient, journalNamespace, journalName)
+		if err := azureutils.RecoverJournal(context.Background(), journal, azCloud); err != nil {
+			klog.Errorf("Error recovering interrupted bucket creations: %v", err)
+		}
+	}
+
+	pr := &provisioner{
 		nameToBucketMap:   make(map[string]*bucketDetails),
 		bucketsLock:       sync.RWMutex{},
 		bucketIDToNameMap: make(map[string]string),
 		cloud:             azCloud,
-	}, nil
+		kubeClient:        kubeClient,
+		clusterName:       clusterName,
+		recorder:          newEventRecorder(kubeClient),
+		objects:           azureutils.NewCOSIObjectCache(kubeClient),
+		auditLog:          auditLog,
+		journal:           journal,
+		stop:              make(chan struct{}),
+	}
+	pr.objects.Start(pr.stop)
+	if journalName != "" {
+		azureutils.WatchKeyRegenerations(kubeClient, journalNamespace, journalName, pr.stop)
+	}
+
+	if cloudConfigReloadInterval > 0 {
+		reloader := &cloudReloader{
+			load: func() (*azure.Cloud, error) {
+				return azureutils.GetAzureCloudProvider(kubeClient, cloudConfigSecretName, cloudConfigSecretNamespace)
+			},
+			check:           azureutils.CheckAzureConnectivity,
+			apply:           pr.setCloud,
+			recorder:        pr.recorder,
+			secretName:      cloudConfigSecretName,
+			secretNamespace: cloudConfigSecretNamespace,
+			credFile:        azureutils.GetAzureCredentialFile(),
+			interval:        cloudConfigReloadInterval,
+		}
+		reloader.start(kubeClient, pr.stop)
+	}
+	return pr, nil
+}
+
+// Stop stops the background work of the provisioner
+func (pr *provisioner) Stop() {
+	pr.stopOnce.Do(func() {
+		close(pr.stop)
+	})
+}
+
+// Stopped returns a channel closed once the provisioner is stopped
+func (pr *provisioner) Stopped() <-chan struct{} {
+	return pr.stop
+}
+
+// Probe checks that the cloud config was loaded and that Azure can be reached with it
+func (pr *provisioner) Probe(ctx context.Context) error {
+	return azureutils.CheckAzureConnectivity(ctx, pr.getCloud())
+}
+
+// getCloud returns the current Azure cloud
+func (pr *provisioner) getCloud() *azure.Cloud {
+	pr.cloudLock.RLock()
+	defer pr.cloudLock.RUnlock()
+	return pr.cloud
+}
+
+// setCloud replaces the Azure cloud used by the calls starting from now on
+func (pr *provisioner) setCloud(cloud *azure.Cloud) {
+	pr.cloudLock.Lock()
+	defer pr.cloudLock.Unlock()
+	pr.cloud = cloud
 }
 
 func (pr *provisioner) DriverCreateBucket(
 	ctx context.Context,
-	req *spec.DriverCreateBucketRequest) (*spec.DriverCreateBucketResponse, error) {
+	req *spec.DriverCreateBucketRequest) (resp *spec.DriverCreateBucketResponse, err error) {
 
 	bucketName := req.GetName()
 	parameters := req.GetParameters()
+	tracing.SetAttributes(ctx, tracing.BucketNameKey.String(bucketName))
+	var bucketClaim string
+	defer func() { pr.recordCreateBucket(ctx, bucketName, bucketClaim, resp.GetBucketId(), err) }()
 	if parameters == nil {
 		return nil, status.Error(codes.InvalidArgument, "Parameters missing. Cannot initialize Azure bucket.")
 	}
@@ -96,7 +202,11 @@ func (pr *provisioner) DriverCreateBucket(
 		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("Bucket %s exists with different parameters", bucketName))
 	}
 
-	bucketID, err := azureutils.CreateBucket(ctx, bucketName, parameters, pr.cloud)
+	templateValues := pr.getTemplateValues(ctx, bucketName)
+	if namespace, name := templateValues[azureutils.BucketClaimNamespacePlaceholder], templateValues[azureutils.BucketClaimNamePlaceholder]; name != "" {
+		bucketClaim = namespace + "/" + name
+	}
+	bucketID, err := azureutils.CreateBucket(ctx, bucketName, parameters, templateValues, pr.journal, pr.getCloud())
 	if err != nil {
 		return nil, err
 	}
@@ -109,6 +219,7 @@ func (pr *provisioner) DriverCreateBucket(
 	}
 	pr.bucketIDToNameMap[bucketID] = bucketName
 	pr.bucketsLock.RUnlock()
+	recordBucketMetric(bucketID, metrics.BucketCreated)
 
 	klog.Infof("DriverCreateBucket :: Bucket id :: %s", bucketID)
 
@@ -117,12 +228,42 @@ func (pr *provisioner) DriverCreateBucket(
 	}, nil
 }
 
+// getTemplateValues returns the placeholder values for the bucket.
+// Bucket claim placeholders are left unset when the Bucket object cannot be read.
+func (pr *provisioner) getTemplateValues(ctx context.Context, bucketName string) azureutils.TemplateValues {
+	values := azureutils.NewTemplateValues(bucketName, pr.clusterName, time.Now())
+	if pr.kubeClient == nil {
+		return values
+	}
+
+	namespace, name, err := azureutils.GetBucketClaim(ctx, pr.kubeClient, bucketName)
+	if err != nil {
+		klog.Warningf("Could not resolve bucket claim of bucket %s: %v", bucketName, err)
+		return values
+	}
+	values[azureutils.BucketClaimNamespacePlaceholder] = namespace
+	values[azureutils.BucketClaimNamePlaceholder] = name
+	return values
+}
+
+// recordBucketMetric records a bucket created or deleted with the bucket's unit type
+func recordBucketMetric(bucketID string, record func(unitType string)) {
+	unitType, err := azureutils.GetBucketUnitType(bucketID)
+	if err != nil {
+		klog.Warningf("Could not determine unit type of bucket %s: %v", bucketID, err)
+		return
+	}
+	record(unitType.String())
+}
+
 func (pr *provisioner) DriverDeleteBucket(
 	ctx context.Context,
 	req *spec.DriverDeleteBucketRequest) (*spec.DriverDeleteBucketResponse, error) {
 	//determine if the bucket is an account or a blob container
 	bucketID := req.BucketId
-	err := azureutils.DeleteBucket(ctx, bucketID, pr.cloud)
+	tracing.SetAttributes(ctx, tracing.BucketIDKey.String(bucketID))
+	err := azureutils.DeleteBucket(ctx, bucketID, pr.getCloud())
+	pr.recordDeleteBucket(ctx, bucketID, err)
 	if err != nil {
 		return nil, err
 	}
@@ -134,6 +275,7 @@ func (pr *provisioner) DriverDeleteBucket(
 		delete(pr.nameToBucketMap, bucketName)
 		delete(pr.bucketIDToNameMap, bucketID)
 		pr.bucketsLock.RUnlock()
+		recordBucketMetric(bucketID, metrics.BucketDeleted)
 	}
 
 	return &spec.DriverDeleteBucketResponse{}, nil
@@ -141,9 +283,12 @@ func (pr *provisioner) DriverDeleteBucket(
 
 func (pr *provisioner) DriverGrantBucketAccess(
 	ctx context.Context,
-	req *spec.DriverGrantBucketAccessRequest) (*spec.DriverGrantBucketAccessResponse, error) {
+	req *spec.DriverGrantBucketAccessRequest) (resp *spec.DriverGrantBucketAccessResponse, err error) {
 	bucketID := req.GetBucketId()
 	parameters := req.GetParameters()
+	tracing.SetAttributes(ctx, tracing.BucketIDKey.String(bucketID))
+	var token string
+	defer func() { pr.recordGrantBucketAccess(ctx, bucketID, req.GetName(), token, err) }()
 	if parameters == nil {
 		return nil, status.Error(codes.InvalidArgument, "Parameters missing. Cannot initialize Azure bucket.")
 	}
@@ -152,29 +297,32 @@ func (pr *provisioner) DriverGrantBucketAccess(
 		return nil, status.Error(codes.InvalidArgument, "AuthenticationType not provided in GrantBucketAccess request.")
 	}
 
-	var token string
-	var err error
-
 	klog.Infof("DriverGrantBucketAccess :: Bucket id :: %s", bucketID)
 	if req.AuthenticationType == spec.AuthenticationType_IAM {
 		return nil, status.Error(codes.Unimplemented, "AuthenticationType IAM not implemented.")
-	} else if req.AuthenticationType == spec.AuthenticationType_Key {
-		token, _, err = azureutils.CreateBucketSASURL(ctx, bucketID, parameters, pr.cloud)
-		if err != nil {
-			return nil, err
-		}
 	}
 
+	secrets, err := azureutils.GrantBucketAccess(ctx, bucketID, req.GetName(), parameters, pr.getCloud())
+	if err != nil {
+		return nil, err
+	}
+	token = secrets[constant.AccessToken]
+
 	return &spec.DriverGrantBucketAccessResponse{
 		AccountId: req.GetName(),
 		Credentials: map[string]*spec.CredentialDetails{constant.CredentialType: {
-			Secrets: map[string]string{constant.AccessToken: token},
+			Secrets: secrets,
 		}},
 	}, nil
 }
 
 func (pr *provisioner) DriverRevokeBucketAccess(
 	ctx context.Context,
-	req *spec.DriverRevokeBucketAccessRequest) (*spec.DriverRevokeBucketAccessResponse, error) {
+	req *spec.DriverRevokeBucketAccessRequest) (_ *spec.DriverRevokeBucketAccessResponse, err error) {
+	defer func() { pr.recordRevokeBucketAccess(ctx, req.GetBucketId(), req.GetAccountId(), err) }()
+
+	if err := azureutils.RevokeBucketAccess(ctx, req.GetBucketId(), req.GetAccountId(), pr.getCloud()); err != nil {
+		return nil, err
+	}
 	return &spec.DriverRevokeBucketAccessResponse{}, nil
 }
@@ -51,6 +51,16 @@ func NewMockSAClient(ctx context.Context, ctrl *gomock.Controller, subsID, rg, a
 		Return(retry.GetError(&http.Response{}, status.Error(codes.NotFound, "could not find storage account"))).
 		AnyTimes()
 
+	cl.EXPECT().
+		GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Eq(constant.ValidAccount)).
+		Return(storage.Account{Name: to.StringPtr(constant.ValidAccount), AccountProperties: &storage.AccountProperties{}}, nil).
+		AnyTimes()
+
+	cl.EXPECT().
+		GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Not(constant.ValidAccount)).
+		Return(storage.Account{}, retry.GetError(&http.Response{StatusCode: http.StatusNotFound}, fmt.Errorf("could not find storage account"))).
+		AnyTimes()
+
 	accountList := []storage.Account{{Name: to.StringPtr(constant.ValidAccount), AccountProperties: &storage.AccountProperties{}}}
 	cl.EXPECT().
 		ListByResourceGroup(gomock.Any(), gomock.Any(), gomock.Any()).
@@ -157,7 +167,7 @@ func TestDriverDeleteBucket(t *testing.T) {
 				ResourceGroup: constant.ValidResourceGroup,
 				URL:           constant.ValidContainerURL,
 			},
-			expectedErr: fmt.Errorf("Error deleting container %s in storage account %s : %v", constant.ValidContainer, constant.ValidAccount, fmt.Errorf("Delete \"https://validaccount.blob.core.windows.net/validcontainer?restype=container\": dial tcp: lookup validaccount.blob.core.windows.net: no such host")),
+			expectedErr: status.Error(codes.Unavailable, fmt.Sprintf("Could not delete container %s in storage account %s: %v", constant.ValidContainer, constant.ValidAccount, fmt.Errorf("Delete \"https://validaccount.blob.core.windows.net/validcontainer?restype=container\": dial tcp: lookup validaccount.blob.core.windows.net: no such host"))),
 		},
 	}
 
@@ -0,0 +1,53 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"go.opentelemetry.io/otel"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// azurePolicy is an Azure SDK pipeline policy starting a client span for every HTTP request sent
+type azurePolicy struct{}
+
+// NewAzurePolicy returns a policy tracing Azure SDK HTTP requests.
+// Add it to the PerRetryPolicies of the client options so every retry gets its own span.
+func NewAzurePolicy() policy.Policy {
+	return azurePolicy{}
+}
+
+func (azurePolicy) Do(req *policy.Request) (*http.Response, error) {
+	raw := req.Raw()
+	// The query is left out of the URL as it may carry a SAS token
+	url := fmt.Sprintf("%s://%s%s", raw.URL.Scheme, raw.URL.Host, raw.URL.Path)
+	_, span := otel.Tracer(tracerName).Start(raw.Context(), "HTTP "+raw.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPMethodKey.String(raw.Method), semconv.HTTPURLKey.String(url), semconv.NetPeerNameKey.String(raw.URL.Hostname())))
+
+	resp, err := req.Next()
+	if resp != nil {
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+		if err == nil && resp.StatusCode >= http.StatusBadRequest {
+			span.SetStatus(otelcodes.Error, resp.Status)
+		}
+	}
+	EndSpan(span, err)
+	return resp, err
+}
@@ -0,0 +1,242 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanID  = "00f067aa0ba902b7"
+)
+
+func newTestExporter() *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	register(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	return exporter
+}
+
+func getAttribute(span tracetest.SpanStub, key attribute.Key) (attribute.Value, bool) {
+	for _, attr := range span.Attributes {
+		if attr.Key == key {
+			return attr.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestSetup(t *testing.T) {
+	shutdown, err := Setup(context.Background(), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("unexpected error shutting down disabled tracing: %v", err)
+	}
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	exporter := newTestExporter()
+	interceptor := UnaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/cosi.v1alpha1.Provisioner/DriverCreateBucket"}
+
+	tests := []struct {
+		testName       string
+		md             metadata.MD
+		handlerErr     error
+		expectedParent string
+		expectedStatus otelcodes.Code
+		expectedCode   int64
+	}{
+		{
+			testName:       "Propagated trace",
+			md:             metadata.Pairs("traceparent", fmt.Sprintf("00-%s-%s-01", testTraceID, testSpanID)),
+			expectedParent: testSpanID,
+			expectedStatus: otelcodes.Unset,
+			expectedCode:   int64(codes.OK),
+		},
+		{
+			testName:       "Failed RPC",
+			md:             metadata.MD{},
+			handlerErr:     status.Error(codes.InvalidArgument, "invalid"),
+			expectedStatus: otelcodes.Error,
+			expectedCode:   int64(codes.InvalidArgument),
+		},
+	}
+	for _, test := range tests {
+		exporter.Reset()
+		ctx := metadata.NewIncomingContext(context.Background(), test.md)
+		var handlerSpan trace.SpanContext
+		_, err := interceptor(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			handlerSpan = trace.SpanContextFromContext(ctx)
+			return nil, test.handlerErr
+		})
+		if err != test.handlerErr {
+			t.Errorf("\nTestCase: %s\nExpected Error: %v\nActual Error: %v", test.testName, test.handlerErr, err)
+		}
+
+		spans := exporter.GetSpans()
+		if len(spans) != 1 {
+			t.Fatalf("\nTestCase: %s\nExpected 1 span, got %d", test.testName, len(spans))
+		}
+		span := spans[0]
+		if span.Name != info.FullMethod || span.SpanKind != trace.SpanKindServer {
+			t.Errorf("\nTestCase: %s\nUnexpected span %s of kind %v", test.testName, span.Name, span.SpanKind)
+		}
+		if span.SpanContext.SpanID() != handlerSpan.SpanID() {
+			t.Errorf("\nTestCase: %s\nHandler context does not carry the RPC span", test.testName)
+		}
+		parent := ""
+		if span.Parent.IsValid() {
+			parent = span.Parent.SpanID().String()
+			if span.SpanContext.TraceID().String() != testTraceID {
+				t.Errorf("\nTestCase: %s\nExpected Trace ID: %s\nActual Trace ID: %s", test.testName, testTraceID, span.SpanContext.TraceID())
+			}
+		}
+		if parent != test.expectedParent {
+			t.Errorf("\nTestCase: %s\nExpected Parent: %s\nActual Parent: %s", test.testName, test.expectedParent, parent)
+		}
+		if span.Status.Code != test.expectedStatus {
+			t.Errorf("\nTestCase: %s\nExpected Status: %v\nActual Status: %v", test.testName, test.expectedStatus, span.Status.Code)
+		}
+		if code, _ := getAttribute(span, grpcStatusCodeKey); code.AsInt64() != test.expectedCode {
+			t.Errorf("\nTestCase: %s\nExpected Code: %d\nActual Code: %d", test.testName, test.expectedCode, code.AsInt64())
+		}
+		if method, _ := getAttribute(span, "rpc.method"); method.AsString() != "DriverCreateBucket" {
+			t.Errorf("\nTestCase: %s\nUnexpected rpc.method %s", test.testName, method.AsString())
+		}
+	}
+}
+
+func TestStartSpan(t *testing.T) {
+	exporter := newTestExporter()
+
+	ctx, parent := StartSpan(context.Background(), "parent", BucketNameKey.String("bucket"))
+	SetAttributes(ctx, BucketIDKey.String("id"))
+	_, child := StartSpan(ctx, "child")
+	EndSpan(child, fmt.Errorf("failed"))
+	EndSpan(parent, nil)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+	childSpan, parentSpan := spans[0], spans[1]
+	if childSpan.Parent.SpanID() != parentSpan.SpanContext.SpanID() {
+		t.Errorf("child span is not a child of the parent span")
+	}
+	if childSpan.Status.Code != otelcodes.Error || childSpan.Status.Description != "failed" {
+		t.Errorf("Unexpected child status %v", childSpan.Status)
+	}
+	if parentSpan.Status.Code != otelcodes.Unset {
+		t.Errorf("Unexpected parent status %v", parentSpan.Status)
+	}
+	if name, _ := getAttribute(parentSpan, BucketNameKey); name.AsString() != "bucket" {
+		t.Errorf("Unexpected bucket name attribute %q", name.AsString())
+	}
+	if id, _ := getAttribute(parentSpan, BucketIDKey); id.AsString() != "id" {
+		t.Errorf("Unexpected bucket ID attribute %q", id.AsString())
+	}
+}
+
+type fakeTransport struct {
+	statusCode int
+}
+
+func (f fakeTransport) Do(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: f.statusCode, Status: http.StatusText(f.statusCode), Request: req, Body: http.NoBody, Header: http.Header{}}, nil
+}
+
+func TestAzurePolicy(t *testing.T) {
+	exporter := newTestExporter()
+
+	tests := []struct {
+		testName       string
+		statusCode     int
+		expectedStatus otelcodes.Code
+	}{
+		{
+			testName:       "Success",
+			statusCode:     http.StatusCreated,
+			expectedStatus: otelcodes.Unset,
+		},
+		{
+			testName:       "Conflict",
+			statusCode:     http.StatusConflict,
+			expectedStatus: otelcodes.Error,
+		},
+	}
+	for _, test := range tests {
+		exporter.Reset()
+		pipeline := runtime.NewPipeline("test", "v0.0.0", runtime.PipelineOptions{}, &policy.ClientOptions{
+			Transport:        fakeTransport{statusCode: test.statusCode},
+			PerRetryPolicies: []policy.Policy{NewAzurePolicy()},
+			Retry:            policy.RetryOptions{MaxRetries: -1},
+		})
+
+		ctx, parent := StartSpan(context.Background(), "operation")
+		req, err := runtime.NewRequest(ctx, http.MethodPut, "https://account.blob.core.windows.net/container?restype=container&sig=secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pipeline.Do(req); err != nil {
+			t.Fatal(err)
+		}
+		parent.End()
+
+		spans := exporter.GetSpans()
+		if len(spans) != 2 {
+			t.Fatalf("\nTestCase: %s\nExpected 2 spans, got %d", test.testName, len(spans))
+		}
+		span := spans[0]
+		if span.Name != "HTTP PUT" || span.SpanKind != trace.SpanKindClient {
+			t.Errorf("\nTestCase: %s\nUnexpected span %s of kind %v", test.testName, span.Name, span.SpanKind)
+		}
+		if span.Parent.SpanID() != spans[1].SpanContext.SpanID() {
+			t.Errorf("\nTestCase: %s\nHTTP span is not a child of the operation span", test.testName)
+		}
+		if url, _ := getAttribute(span, "http.url"); url.AsString() != "https://account.blob.core.windows.net/container" {
+			t.Errorf("\nTestCase: %s\nUnexpected http.url %s", test.testName, url.AsString())
+		}
+		if code, _ := getAttribute(span, "http.status_code"); code.AsInt64() != int64(test.statusCode) {
+			t.Errorf("\nTestCase: %s\nUnexpected http.status_code %d", test.testName, code.AsInt64())
+		}
+		if span.Status.Code != test.expectedStatus {
+			t.Errorf("\nTestCase: %s\nExpected Status: %v\nActual Status: %v", test.testName, test.expectedStatus, span.Status.Code)
+		}
+	}
+}
+
+func TestSplitMethod(t *testing.T) {
+	service, method := splitMethod("/cosi.v1alpha1.Identity/DriverGetInfo")
+	if service != "cosi.v1alpha1.Identity" || method != "DriverGetInfo" {
+		t.Errorf("Unexpected service %s and method %s", service, method)
+	}
+}
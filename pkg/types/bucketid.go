@@ -11,6 +11,9 @@ type BucketID struct {
 	SubID         string `json:"subscriptionID"`
 	ResourceGroup string `json:"resourceGroup"`
 	URL           string `json:"url"`
+	// StorageAccountPool is the prefix of the storage account pool the container was placed in.
+	// It is empty for buckets created in a fixed storage account.
+	StorageAccountPool string `json:"storageAccountPool,omitempty"`
 }
 
 // Marshals bucketID struct into json bytes, then encodes into base64